@@ -4,20 +4,21 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
 	"syscall"
 
-	"github.com/jackc/pgx/v5"
 	"github.com/joho/godotenv"
 	"github.com/koplec/sokoni/internal/api"
 	"github.com/koplec/sokoni/internal/cmd"
 	"github.com/koplec/sokoni/internal/collector"
 	"github.com/koplec/sokoni/internal/db"
+	"github.com/koplec/sokoni/internal/notify"
 	"github.com/koplec/sokoni/internal/scheduler"
+	"github.com/koplec/sokoni/internal/server"
 	"github.com/koplec/sokoni/internal/service"
+	"github.com/koplec/sokoni/internal/worker"
 )
 
 func main() {
@@ -29,13 +30,34 @@ func main() {
 	if len(os.Args) > 1 {
 		switch os.Args[1] {
 		case "scan":
-			if len(os.Args) > 2 {
+			if len(os.Args) > 2 && os.Args[2] == "cancel" {
+				if len(os.Args) < 4 {
+					showUsage()
+					return
+				}
+				jobID, err := strconv.Atoi(os.Args[3])
+				if err != nil {
+					log.Fatalf("invalid job ID: %v", err)
+				}
+				withDB(0, func(repos db.Repositories) {
+					// Ctrl-C / SIGTERM で止まるのを待つのをやめる（取り消しは続く）
+					ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+					defer stop()
+					if err := cmd.CancelScan(ctx, repos, jobID); err != nil {
+						log.Fatalf("cancel failed: %v", err)
+					}
+				})
+			} else if len(os.Args) > 2 {
 				connectionID, err := strconv.Atoi(os.Args[2])
 				if err != nil {
 					log.Fatalf("invalid connection ID: %v", err)
 				}
-				withDB(func(conn *pgx.Conn) {
-					err := cmd.ScanConnection(connectionID, service.NewConnectionScanner(conn))
+				wait := !(len(os.Args) > 3 && os.Args[3] == "--no-wait")
+				withDB(0, func(repos db.Repositories) {
+					// Ctrl-C / SIGTERM で待つのをやめる（スキャンはワーカーで続く）
+					ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+					defer stop()
+					err := cmd.EnqueueScan(ctx, repos, connectionID, wait)
 					if err != nil {
 						log.Fatalf("scan failed: %v", err)
 					}
@@ -43,10 +65,30 @@ func main() {
 			} else {
 				runScan()
 			}
+		case "watch":
+			if len(os.Args) < 3 {
+				showUsage()
+				return
+			}
+			connectionID, err := strconv.Atoi(os.Args[2])
+			if err != nil {
+				log.Fatalf("invalid connection ID: %v", err)
+			}
+			withDB(0, func(repos db.Repositories) {
+				ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+				defer stop()
+				if err := service.WatchConnection(ctx, repos, connectionID); err != nil {
+					log.Fatalf("watch failed: %v", err)
+				}
+			})
 		case "scheduler":
 			runScheduler()
+		case "worker":
+			runWorker()
 		case "api":
 			runAPI()
+		case "serve":
+			runServe()
 		default:
 			showUsage()
 		}
@@ -55,73 +97,72 @@ func main() {
 	}
 }
 
-func withDB(fn func(*pgx.Conn)) {
-	ctx := context.Background()
-	conn, err := db.Connect(ctx)
+// withDB はDBに接続してfnを呼ぶ。reservedは接続を占有し続ける処理（並行するスキャンとLISTEN）の数。
+func withDB(reserved int, fn func(db.Repositories)) {
+	pool, err := db.Connect(context.Background(), reserved)
 	if err != nil {
 		log.Fatalf("failed to connect to database: %v", err)
 	}
-	defer conn.Close(ctx)
-	fn(conn)
+	defer pool.Close()
+	fn(db.NewRepositories(pool))
 }
 
-func runAPI() {
-	ctx := context.Background()
-	conn, err := db.Connect(ctx)
-	if err != nil {
-		log.Fatalf("failed to connect to database: %v", err)
-	}
-	defer conn.Close(ctx)
-
-	apiHandler := api.NewAPI(conn)
-
-	http.HandleFunc("/search", apiHandler.SearchFiles)
-	http.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/connections" && r.Method == "GET" {
-			apiHandler.GetConnections(w, r)
-		} else if r.URL.Path == "/connections" && r.Method == "POST" {
-			apiHandler.CreateConnection(w, r)
-		} else {
-			apiHandler.GetConnection(w, r)
-		}
-	})
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	})
+// runServices はSIGINT・SIGTERMを受け取るまでservicesを動かし、すべてを止め終えてから戻る。
+// 処理中のHTTPリクエストと、スキャン中のバッチの書き込みは終えてから止まる。
+func runServices(services ...server.Service) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	server.Run(ctx, services...)
+}
 
+func listenAPI(repos db.Repositories) *server.HTTPServer {
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
+	srv, err := server.ListenHTTP(":"+port, api.NewAPI(repos).Routes())
+	if err != nil {
+		log.Fatalf("failed to listen on port %s: %v", port, err)
+	}
 	fmt.Printf("Starting API server on port %s\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	return srv
 }
 
-func runScheduler() {
-	ctx := context.Background()
-	conn, err := db.Connect(ctx)
+func newWorker(repos db.Repositories) *worker.Worker {
+	notifier, err := notify.FromEnv()
 	if err != nil {
-		log.Fatalf("failed to connect to database: %v", err)
+		log.Fatalf("invalid notification settings: %v", err)
 	}
-	defer conn.Close(ctx)
-
-	scanner := scheduler.NewScanner(conn)
-	
-	// Graceful shutdown
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	
-	go func() {
-		<-c
-		log.Println("Shutting down scheduler...")
-		scanner.Stop()
-		os.Exit(0)
-	}()
-
-	fmt.Println("Starting scheduler daemon...")
-	scanner.Start()
+	return worker.New(repos, notifier)
+}
+
+func runAPI() {
+	withDB(0, func(repos db.Repositories) {
+		runServices(listenAPI(repos))
+	})
+}
+
+func runScheduler() {
+	withDB(1, func(repos db.Repositories) {
+		fmt.Println("Starting scheduler daemon...")
+		runServices(scheduler.NewScanner(repos))
+	})
+}
+
+// runWorker はワーカーを動かす。止めるときは処理中のジョブをキャンセルし、書き込み中のバッチを終えてからキューに戻す。
+func runWorker() {
+	withDB(worker.Concurrency()+1, func(repos db.Repositories) {
+		fmt.Println("Starting worker...")
+		runServices(newWorker(repos))
+	})
+}
+
+// runServe はAPIサーバー・スケジューラ・ワーカーを1つのプロセスで動かす。
+func runServe() {
+	withDB(worker.Concurrency()+2, func(repos db.Repositories) {
+		runServices(listenAPI(repos), scheduler.NewScanner(repos), newWorker(repos))
+	})
 }
 
 func runScan() {
@@ -144,13 +185,21 @@ func showUsage() {
 	fmt.Println("Usage: sokoni [command]")
 	fmt.Println("Commands:")
 	fmt.Println("  api              Start REST API server (default)")
-	fmt.Println("  scheduler        Start background file scanner")
+	fmt.Println("  serve            Start API server, scheduler and worker in one process")
+	fmt.Println("  scheduler        Start scheduler (enqueues scans that are due)")
+	fmt.Println("  worker           Start worker (processes queued scans)")
 	fmt.Println("  scan             Run one-time file scan")
-	fmt.Println("  scan <conn_id>   Scan specific connection")
+	fmt.Println("  scan <conn_id>   Queue a scan of a connection and wait for it (--no-wait to return at once)")
+	fmt.Println("  scan cancel <job_id>  Cancel a queued or running scan job")
+	fmt.Println("  watch <conn_id>  Watch connection and index changes as they happen")
 	fmt.Println()
 	fmt.Println("Examples:")
 	fmt.Println("  ./sokoni api       # Start API on port 8080")
-	fmt.Println("  ./sokoni scheduler # Start background scanner")
+	fmt.Println("  ./sokoni serve     # Start everything on port 8080")
+	fmt.Println("  ./sokoni scheduler # Start scheduler")
+	fmt.Println("  ./sokoni worker    # Start worker")
 	fmt.Println("  ./sokoni scan      # Manual scan of /mnt/share")
-	fmt.Println("  ./sokoni scan 1    # Scan connection ID 1")
+	fmt.Println("  ./sokoni scan 1    # Scan connection ID 1 with a worker")
+	fmt.Println("  ./sokoni scan cancel 5 # Cancel scan job ID 5")
+	fmt.Println("  ./sokoni watch 1   # Watch connection ID 1")
 }
@@ -0,0 +1,10 @@
+BEGIN;
+
+DROP INDEX IF EXISTS idx_files_connection_dir;
+ALTER TABLE files DROP COLUMN IF EXISTS dir_path;
+
+DROP TABLE IF EXISTS scan_errors;
+DROP TABLE IF EXISTS scan_checkpoints;
+DROP TABLE IF EXISTS scan_runs;
+
+COMMIT;
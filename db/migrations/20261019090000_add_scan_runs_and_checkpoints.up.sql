@@ -0,0 +1,81 @@
+BEGIN;
+
+-- スキャン実行履歴
+CREATE TABLE scan_runs (
+    id SERIAL PRIMARY KEY,
+    connection_id INT NOT NULL REFERENCES connections(id) ON DELETE CASCADE,
+    status TEXT NOT NULL DEFAULT 'running',
+    files_seen INT NOT NULL DEFAULT 0,
+    files_deleted INT NOT NULL DEFAULT 0,
+    error_count INT NOT NULL DEFAULT 0,
+    error_message TEXT,
+    started_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    resumed_at TIMESTAMP WITH TIME ZONE,
+    finished_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+COMMENT ON TABLE scan_runs IS 'connectionごとのスキャン実行履歴';
+COMMENT ON COLUMN scan_runs.id IS 'スキャン実行ID（主キー）';
+COMMENT ON COLUMN scan_runs.connection_id IS '接続ID（外部キー）';
+COMMENT ON COLUMN scan_runs.status IS '状態（running, completed, partial, failed, interrupted）';
+COMMENT ON COLUMN scan_runs.files_seen IS '見つかったPDFファイル数（再開前の分を含む）';
+COMMENT ON COLUMN scan_runs.files_deleted IS '存在しなくなったため削除したファイル数';
+COMMENT ON COLUMN scan_runs.error_count IS 'スキップしたエントリ数';
+COMMENT ON COLUMN scan_runs.error_message IS '中断・失敗時のエラー';
+COMMENT ON COLUMN scan_runs.started_at IS '開始日時';
+COMMENT ON COLUMN scan_runs.resumed_at IS '最後に再開した日時';
+COMMENT ON COLUMN scan_runs.finished_at IS '終了日時';
+COMMENT ON COLUMN scan_runs.created_at IS '作成日時';
+COMMENT ON COLUMN scan_runs.updated_at IS '更新日時';
+
+CREATE INDEX idx_scan_runs_connection_id ON scan_runs(connection_id, id DESC);
+
+-- 配下の走査とDBへの反映が完了したディレクトリ
+CREATE TABLE scan_checkpoints (
+    scan_run_id INT NOT NULL REFERENCES scan_runs(id) ON DELETE CASCADE,
+    path TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    PRIMARY KEY (scan_run_id, path)
+);
+
+COMMENT ON TABLE scan_checkpoints IS 'スキャン再開用のチェックポイント（配下をすべて反映済みのディレクトリ）';
+COMMENT ON COLUMN scan_checkpoints.scan_run_id IS 'スキャン実行ID（外部キー）';
+COMMENT ON COLUMN scan_checkpoints.path IS 'ディレクトリのパス（files.dir_pathと同じ形式）';
+COMMENT ON COLUMN scan_checkpoints.created_at IS '作成日時';
+
+-- スキャン中に読み取れなかったエントリ
+CREATE TABLE scan_errors (
+    id SERIAL PRIMARY KEY,
+    scan_run_id INT NOT NULL REFERENCES scan_runs(id) ON DELETE CASCADE,
+    path TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+COMMENT ON TABLE scan_errors IS 'スキャン中に読み取れずスキップしたエントリ';
+COMMENT ON COLUMN scan_errors.id IS 'ID（主キー）';
+COMMENT ON COLUMN scan_errors.scan_run_id IS 'スキャン実行ID（外部キー）';
+COMMENT ON COLUMN scan_errors.path IS 'スキップしたファイル・ディレクトリのパス';
+COMMENT ON COLUMN scan_errors.reason IS 'エラー内容';
+COMMENT ON COLUMN scan_errors.created_at IS '作成日時';
+
+CREATE INDEX idx_scan_errors_scan_run_id ON scan_errors(scan_run_id);
+
+-- 削除検出のためにファイルの親ディレクトリを持たせる（Goのfilepath.Dirと同じ形式）
+ALTER TABLE files ADD COLUMN dir_path TEXT;
+
+UPDATE files SET dir_path = CASE
+    WHEN position('/' in path) = 0 THEN '.'
+    WHEN path ~ '^/[^/]*$' THEN '/'
+    ELSE regexp_replace(path, '/[^/]*$', '')
+END;
+
+ALTER TABLE files ALTER COLUMN dir_path SET NOT NULL;
+
+COMMENT ON COLUMN files.dir_path IS '親ディレクトリのパス';
+
+CREATE INDEX idx_files_connection_dir ON files(connection_id, dir_path);
+
+COMMIT;
@@ -0,0 +1,11 @@
+BEGIN;
+
+ALTER TABLE scan_runs
+DROP COLUMN IF EXISTS files_unchanged,
+DROP COLUMN IF EXISTS dirs_unchanged,
+DROP COLUMN IF EXISTS files_written,
+DROP COLUMN IF EXISTS full_scan;
+
+DROP TABLE IF EXISTS dir_states;
+
+COMMIT;
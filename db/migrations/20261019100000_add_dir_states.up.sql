@@ -0,0 +1,40 @@
+BEGIN;
+
+-- 差分スキャン用のディレクトリ状態
+CREATE TABLE dir_states (
+    connection_id INT NOT NULL REFERENCES connections(id) ON DELETE CASCADE,
+    path TEXT NOT NULL,
+    mod_time TIMESTAMP WITH TIME ZONE NOT NULL,
+    entry_count INT NOT NULL,
+    file_count INT NOT NULL,
+    subdirs TEXT[] NOT NULL DEFAULT '{}',
+    listed_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    PRIMARY KEY (connection_id, path)
+);
+
+COMMENT ON TABLE dir_states IS '差分スキャンのために前回の一覧時点のディレクトリ状態を保持するテーブル';
+COMMENT ON COLUMN dir_states.connection_id IS '接続ID（外部キー）';
+COMMENT ON COLUMN dir_states.path IS 'ディレクトリのパス（files.dir_pathと同じ形式）';
+COMMENT ON COLUMN dir_states.mod_time IS 'ディレクトリの最終更新日時';
+COMMENT ON COLUMN dir_states.entry_count IS '直下のエントリ数';
+COMMENT ON COLUMN dir_states.file_count IS '直下のPDFファイル数';
+COMMENT ON COLUMN dir_states.subdirs IS '直下のディレクトリ名';
+COMMENT ON COLUMN dir_states.listed_at IS '一覧を取得した日時';
+COMMENT ON COLUMN dir_states.created_at IS '作成日時';
+COMMENT ON COLUMN dir_states.updated_at IS '更新日時';
+
+-- スキャン実行ごとの差分スキャンの集計
+ALTER TABLE scan_runs
+ADD COLUMN full_scan BOOLEAN NOT NULL DEFAULT true,
+ADD COLUMN files_written INT NOT NULL DEFAULT 0,
+ADD COLUMN dirs_unchanged INT NOT NULL DEFAULT 0,
+ADD COLUMN files_unchanged INT NOT NULL DEFAULT 0;
+
+COMMENT ON COLUMN scan_runs.full_scan IS '差分を使わずにすべてのディレクトリを走査したか';
+COMMENT ON COLUMN scan_runs.files_written IS '新規または変更があり書き込んだファイル数';
+COMMENT ON COLUMN scan_runs.dirs_unchanged IS '変更がなく一覧を取り直さなかったディレクトリ数';
+COMMENT ON COLUMN scan_runs.files_unchanged IS '変更のなかったディレクトリ直下のため確認を省いたファイル数';
+
+COMMIT;
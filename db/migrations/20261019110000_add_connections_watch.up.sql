@@ -0,0 +1,8 @@
+BEGIN;
+
+ALTER TABLE connections
+ADD COLUMN watch BOOLEAN NOT NULL DEFAULT false;
+
+COMMENT ON COLUMN connections.watch IS 'ファイルシステムの変更を監視してスキャン間隔を待たずに反映するか';
+
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+
+ALTER TABLE connections
+DROP COLUMN IF EXISTS host_key,
+DROP COLUMN IF EXISTS private_key;
+
+COMMIT;
@@ -0,0 +1,10 @@
+BEGIN;
+
+ALTER TABLE connections
+ADD COLUMN private_key TEXT,
+ADD COLUMN host_key TEXT;
+
+COMMENT ON COLUMN connections.private_key IS 'SFTP接続用の秘密鍵（PEM/OpenSSH形式）。暗号化されている場合はpasswordをパスフレーズに使う';
+COMMENT ON COLUMN connections.host_key IS 'SFTP接続先のホスト鍵（authorized_keys形式、またはSHA256:で始まるフィンガープリント）';
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE files
+DROP COLUMN IF EXISTS etag;
+
+COMMIT;
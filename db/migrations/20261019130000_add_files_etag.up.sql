@@ -0,0 +1,8 @@
+BEGIN;
+
+ALTER TABLE files
+ADD COLUMN etag TEXT;
+
+COMMENT ON COLUMN files.etag IS 'WebDAV・オブジェクトストレージのETag（変更検出用。取得できない接続ではNULL）';
+
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+
+ALTER TABLE connections
+DROP COLUMN IF EXISTS blackout_windows,
+DROP COLUMN IF EXISTS schedule;
+
+COMMIT;
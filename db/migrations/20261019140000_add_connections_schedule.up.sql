@@ -0,0 +1,10 @@
+BEGIN;
+
+ALTER TABLE connections
+ADD COLUMN schedule TEXT,
+ADD COLUMN blackout_windows TEXT;
+
+COMMENT ON COLUMN connections.schedule IS 'スキャンのスケジュール（cron式または@daily・@every 6h等）。NULLの場合はscan_interval間隔';
+COMMENT ON COLUMN connections.blackout_windows IS 'スキャンしない時間帯（例: 01:00-04:00,sat-sun 00:00-24:00）。アプリケーションのタイムゾーンで評価する';
+
+COMMIT;
@@ -0,0 +1,10 @@
+BEGIN;
+
+ALTER TABLE connections
+DROP COLUMN IF EXISTS suspended_reason,
+DROP COLUMN IF EXISTS suspended_at,
+DROP COLUMN IF EXISTS last_error,
+DROP COLUMN IF EXISTS last_failure_at,
+DROP COLUMN IF EXISTS consecutive_failures;
+
+COMMIT;
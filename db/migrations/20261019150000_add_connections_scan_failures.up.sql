@@ -0,0 +1,16 @@
+BEGIN;
+
+ALTER TABLE connections
+ADD COLUMN consecutive_failures INT NOT NULL DEFAULT 0,
+ADD COLUMN last_failure_at TIMESTAMP WITH TIME ZONE,
+ADD COLUMN last_error TEXT,
+ADD COLUMN suspended_at TIMESTAMP WITH TIME ZONE,
+ADD COLUMN suspended_reason TEXT;
+
+COMMENT ON COLUMN connections.consecutive_failures IS '定期スキャンが続けて失敗した回数（成功するか設定を更新すると0に戻る）';
+COMMENT ON COLUMN connections.last_failure_at IS '最後に定期スキャンが失敗した日時';
+COMMENT ON COLUMN connections.last_error IS '最後に定期スキャンが失敗したときのエラー';
+COMMENT ON COLUMN connections.suspended_at IS '失敗が続いたため定期スキャンを停止した日時（NULLなら停止していない）';
+COMMENT ON COLUMN connections.suspended_reason IS '定期スキャンを停止した理由';
+
+COMMIT;
@@ -0,0 +1,19 @@
+BEGIN;
+
+-- connectionをスキャンしているインスタンスのリース
+CREATE TABLE scan_leases (
+    connection_id INT PRIMARY KEY REFERENCES connections(id) ON DELETE CASCADE,
+    owner TEXT NOT NULL,
+    acquired_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    heartbeat_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+COMMENT ON TABLE scan_leases IS '複数のインスタンスが同じconnectionを同時にスキャンしないためのリース';
+COMMENT ON COLUMN scan_leases.connection_id IS '接続ID（主キー・外部キー）';
+COMMENT ON COLUMN scan_leases.owner IS 'リースを持つスキャンの識別子（ホスト名・PIDなど）';
+COMMENT ON COLUMN scan_leases.acquired_at IS 'リースを取得した日時';
+COMMENT ON COLUMN scan_leases.heartbeat_at IS '最後にリースを延長した日時';
+COMMENT ON COLUMN scan_leases.expires_at IS 'この日時までに延長されなければ、ほかのインスタンスが取得できる';
+
+COMMIT;
@@ -0,0 +1,49 @@
+BEGIN;
+
+-- ワーカー（sokoni worker）が処理するジョブのキュー
+CREATE TABLE jobs (
+    id BIGSERIAL PRIMARY KEY,
+    type TEXT NOT NULL,
+    connection_id INT REFERENCES connections(id) ON DELETE CASCADE,
+    payload JSONB NOT NULL DEFAULT '{}',
+    priority INT NOT NULL DEFAULT 0,
+    status TEXT NOT NULL DEFAULT 'queued',
+    attempts INT NOT NULL DEFAULT 0,
+    max_attempts INT NOT NULL DEFAULT 3,
+    dedupe_key TEXT,
+    run_after TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    locked_by TEXT,
+    locked_until TIMESTAMP WITH TIME ZONE,
+    last_error TEXT,
+    started_at TIMESTAMP WITH TIME ZONE,
+    finished_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+-- 取り出す候補（待機中と、可視性タイムアウトが切れたかもしれない実行中）だけの索引
+CREATE INDEX jobs_ready_idx ON jobs (priority DESC, run_after, id) WHERE status IN ('queued', 'running');
+-- 同じ作業（同じconnectionのスキャンなど）を重ねて積まない
+CREATE UNIQUE INDEX jobs_dedupe_key_idx ON jobs (dedupe_key) WHERE dedupe_key IS NOT NULL AND status IN ('queued', 'running');
+CREATE INDEX jobs_status_idx ON jobs (status, id);
+
+COMMENT ON TABLE jobs IS 'ワーカーが処理するジョブのキュー（スキャンなど）';
+COMMENT ON COLUMN jobs.id IS 'ジョブID（主キー）';
+COMMENT ON COLUMN jobs.type IS 'ジョブの種類（scanなど）';
+COMMENT ON COLUMN jobs.connection_id IS '対象の接続ID（外部キー、接続に関係しないジョブではNULL）';
+COMMENT ON COLUMN jobs.payload IS '種類ごとのパラメータ';
+COMMENT ON COLUMN jobs.priority IS '優先度（大きいものから取り出す）';
+COMMENT ON COLUMN jobs.status IS '状態（queued, running, succeeded, dead）';
+COMMENT ON COLUMN jobs.attempts IS '取り出された回数';
+COMMENT ON COLUMN jobs.max_attempts IS 'この回数失敗したらdeadにする';
+COMMENT ON COLUMN jobs.dedupe_key IS '待機中・実行中のジョブで一意にするキー';
+COMMENT ON COLUMN jobs.run_after IS 'この日時以降に取り出す（再試行の待ち時間）';
+COMMENT ON COLUMN jobs.locked_by IS '実行中のワーカー';
+COMMENT ON COLUMN jobs.locked_until IS '可視性タイムアウト。この日時までに延長されなければほかのワーカーが取り出す';
+COMMENT ON COLUMN jobs.last_error IS '最後に失敗したときのエラー';
+COMMENT ON COLUMN jobs.started_at IS '最後に取り出された日時';
+COMMENT ON COLUMN jobs.finished_at IS '成功またはdeadになった日時';
+COMMENT ON COLUMN jobs.created_at IS '作成日時';
+COMMENT ON COLUMN jobs.updated_at IS '更新日時';
+
+COMMIT;
@@ -0,0 +1,14 @@
+BEGIN;
+
+-- 取り消しのない状態に戻す
+UPDATE jobs SET status = 'dead', last_error = COALESCE(last_error, 'cancelled') WHERE status = 'cancelled';
+UPDATE scan_runs SET status = 'failed', error_message = COALESCE(error_message, 'cancelled') WHERE status = 'cancelled';
+
+ALTER TABLE jobs
+DROP COLUMN IF EXISTS cancel_requested_at;
+
+COMMENT ON COLUMN jobs.status IS '状態（queued, running, succeeded, dead）';
+COMMENT ON COLUMN jobs.finished_at IS '成功またはdeadになった日時';
+COMMENT ON COLUMN scan_runs.status IS '状態（running, completed, partial, failed, interrupted）';
+
+COMMIT;
@@ -0,0 +1,11 @@
+BEGIN;
+
+ALTER TABLE jobs
+ADD COLUMN cancel_requested_at TIMESTAMP WITH TIME ZONE;
+
+COMMENT ON COLUMN jobs.status IS '状態（queued, running, succeeded, dead, cancelled）';
+COMMENT ON COLUMN jobs.cancel_requested_at IS '実行中に取り消しを頼まれた日時。ワーカーは処理を止めてcancelledにする';
+COMMENT ON COLUMN jobs.finished_at IS '成功・dead・取り消しになった日時';
+COMMENT ON COLUMN scan_runs.status IS '状態（running, completed, partial, failed, interrupted, cancelled）';
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE connections
+DROP COLUMN IF EXISTS throttle;
+
+COMMIT;
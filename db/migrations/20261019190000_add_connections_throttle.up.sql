@@ -0,0 +1,8 @@
+BEGIN;
+
+ALTER TABLE connections
+ADD COLUMN throttle TEXT;
+
+COMMENT ON COLUMN connections.throttle IS '接続先への負荷の上限（例: bytes=50MB; mon-fri 09:00-18:00 listings=5,bytes=2MB,requests=1）。時間帯はアプリケーションのタイムゾーンで評価する';
+
+COMMIT;
@@ -0,0 +1,11 @@
+BEGIN;
+
+ALTER TABLE files
+DROP CONSTRAINT IF EXISTS files_connection_id_path_key;
+
+ALTER TABLE files
+ADD CONSTRAINT files_path_key UNIQUE (path);
+
+COMMENT ON COLUMN files.path IS 'ファイルの絶対パス（一意）';
+
+COMMIT;
@@ -0,0 +1,12 @@
+BEGIN;
+
+-- 接続先の中のパスはconnectionごとにしか一意にならない（同じ共有を別の接続で登録した場合など）
+ALTER TABLE files
+DROP CONSTRAINT files_path_key;
+
+ALTER TABLE files
+ADD CONSTRAINT files_connection_id_path_key UNIQUE (connection_id, path);
+
+COMMENT ON COLUMN files.path IS 'ファイルのパス（connectionごとに一意）';
+
+COMMIT;
@@ -0,0 +1,19 @@
+BEGIN;
+
+-- connectionを監視しているインスタンスのリース
+CREATE TABLE watch_leases (
+    connection_id INT PRIMARY KEY REFERENCES connections(id) ON DELETE CASCADE,
+    owner TEXT NOT NULL,
+    acquired_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    heartbeat_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+COMMENT ON TABLE watch_leases IS '複数のインスタンスが同じconnectionを重ねて監視しないためのリース';
+COMMENT ON COLUMN watch_leases.connection_id IS '接続ID（主キー・外部キー）';
+COMMENT ON COLUMN watch_leases.owner IS 'リースを持つ監視の識別子（ホスト名・PIDなど）';
+COMMENT ON COLUMN watch_leases.acquired_at IS 'リースを取得した日時';
+COMMENT ON COLUMN watch_leases.heartbeat_at IS '最後にリースを延長した日時';
+COMMENT ON COLUMN watch_leases.expires_at IS 'この日時までに延長されなければ、ほかのインスタンスが取得できる';
+
+COMMIT;
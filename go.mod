@@ -3,16 +3,27 @@ module github.com/koplec/sokoni
 go 1.23.4
 
 require (
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/hirochachacha/go-smb2 v1.1.0 // collector.smbEncrypted reads unexported fields of v1.1.0; check TestSMBEncryptedFields when upgrading
 	github.com/jackc/pgx/v5 v5.7.4
+	github.com/jlaffaye/ftp v0.2.0
 	github.com/joho/godotenv v1.5.1
-	github.com/hirochachacha/go-smb2 v1.1.0
+	github.com/pkg/sftp v1.13.7
+	github.com/robfig/cron/v3 v3.0.1
+	golang.org/x/crypto v0.36.0
+	golang.org/x/net v0.38.0
 )
 
 require (
-	github.com/geoffgarside/ber v1.1.0 // indirect // indirect
+	github.com/geoffgarside/ber v1.1.0 // indirect
+	github.com/hashicorp/errwrap v1.0.0 // indirect
+	github.com/hashicorp/go-multierror v1.1.1 // indirect
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgservicefile v0.0.0-20240606120523-5a60cdf6a761 // indirect
+	github.com/jackc/puddle/v2 v2.2.2 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/stretchr/testify v1.9.0 // indirect
-	golang.org/x/crypto v0.36.0 // indirect
+	golang.org/x/sync v0.12.0 // indirect
+	golang.org/x/sys v0.31.0 // indirect
 	golang.org/x/text v0.23.0 // indirect
 )
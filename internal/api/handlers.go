@@ -3,21 +3,45 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/koplec/sokoni/internal/collector"
 	"github.com/koplec/sokoni/internal/db"
+	"github.com/koplec/sokoni/internal/service"
 )
 
+// healthCheckTimeout は/healthでDBの応答を待つ時間。
+const healthCheckTimeout = 2 * time.Second
+
+// scanRunsLimit は/connections/{id}/scansで返すスキャン実行の件数。
+const scanRunsLimit = 20
+
+// jobsLimit は/jobsで返すジョブの件数。
+const jobsLimit = 50
+
 type API struct {
-	conn *pgx.Conn
+	repos db.Repositories
 }
 
-func NewAPI(conn *pgx.Conn) *API {
-	return &API{conn: conn}
+// NewAPI はAPIを作る。ハンドラは並行して呼ばれるので、PostgreSQLを使う場合は*pgxpool.Poolから作ったリポジトリを渡すこと。
+func NewAPI(repos db.Repositories) *API {
+	return &API{repos: repos}
+}
+
+// publish はスケジューラーとワーカーに変更を知らせ、次の定期的な確認を待たずに反映させる。
+// 届かなくても定期的な確認で追いつくので、失敗してもリクエストは失敗にしない。
+func (a *API) publish(ctx context.Context, event db.Event) {
+	if err := a.repos.Events.PublishEvent(ctx, event); err != nil {
+		log.Printf("Warning: failed to publish %s event: %v", event.Type, err)
+	}
 }
 
 func (a *API) SearchFiles(w http.ResponseWriter, r *http.Request) {
@@ -32,7 +56,7 @@ func (a *API) SearchFiles(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	files, err := db.SearchFilesByName(context.Background(), a.conn, query)
+	files, err := a.repos.Files.SearchFilesByName(r.Context(), query)
 	if err != nil {
 		log.Printf("Error searching files: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -46,6 +70,62 @@ func (a *API) SearchFiles(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// DownloadFile は検索結果のConnectionIDとPathで指定したファイルの中身を返す。 /files/download?connection_id=...&path=...
+// アーカイブ内のファイル（"bundle.zip!/2024/inv.pdf"）はアーカイブから取り出して返す。
+// 接続先から直接読むので、DBに記録されたファイルだけを対象にする。Content-Typeはファイル名の拡張子から決める。
+func (a *API) DownloadFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	connectionID, err := strconv.Atoi(r.URL.Query().Get("connection_id"))
+	if err != nil {
+		http.Error(w, "Query parameter 'connection_id' is required", http.StatusBadRequest)
+		return
+	}
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "Query parameter 'path' is required", http.StatusBadRequest)
+		return
+	}
+
+	file, err := a.repos.Files.GetFileByPath(r.Context(), connectionID, path)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting file: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	connection, err := a.repos.Connections.GetConnectionByID(r.Context(), connectionID)
+	if err != nil {
+		log.Printf("Error getting connection: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	rc, err := collector.OpenFile(r.Context(), connection, file.Path)
+	if err != nil {
+		log.Printf("Error opening %s: %v", file.Path, err)
+		http.Error(w, "Failed to read file from source", http.StatusBadGateway)
+		return
+	}
+	defer rc.Close()
+
+	contentType := mime.TypeByExtension(filepath.Ext(file.Name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.Name}))
+	if _, err := io.Copy(w, rc); err != nil {
+		log.Printf("Error sending %s: %v", file.Path, err)
+	}
+}
+
 func (a *API) GetConnections(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -55,7 +135,7 @@ func (a *API) GetConnections(w http.ResponseWriter, r *http.Request) {
 	// TODO: 認証実装後にユーザーIDを取得
 	userID := -1 // 仮のユーザーID（開発用）
 
-	connections, err := db.GetConnectionsByUserID(context.Background(), a.conn, userID)
+	connections, err := a.repos.Connections.GetConnectionsByUserID(r.Context(), userID)
 	if err != nil {
 		log.Printf("Error getting connections: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -81,15 +161,21 @@ func (a *API) CreateConnection(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := collector.ValidateConnection(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// TODO: 認証実装後にユーザーIDを取得
 	req.UserID = -1 // 仮のユーザーID（開発用）
 
-	connection, err := db.CreateConnection(context.Background(), a.conn, req)
+	connection, err := a.repos.Connections.CreateConnection(r.Context(), req)
 	if err != nil {
 		log.Printf("Error creating connection: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	a.publish(r.Context(), db.Event{Type: db.EventConnectionCreated, ConnectionID: connection.ID})
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -121,7 +207,7 @@ func (a *API) GetConnection(w http.ResponseWriter, r *http.Request) {
 	// TODO: 認証実装後にユーザーIDを取得
 	// userID := -1 // 仮のユーザーID（開発用）
 
-	connection, err := db.GetConnectionByID(context.Background(), a.conn, id)
+	connection, err := a.repos.Connections.GetConnectionByID(r.Context(), id)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			http.Error(w, "Connection not found", http.StatusNotFound)
@@ -167,7 +253,30 @@ func (a *API) UpdateConnection(w http.ResponseWriter, r *http.Request) {
 	// TODO: 認証実装後にユーザーIDを取得
 	userID := -1 // 仮のユーザーID（開発用）
 
-	connection, err := db.UpdateConnection(context.Background(), a.conn, id, userID, req)
+	// 省略したprivate_keyとhost_keyは保存済みの値が残るので、それを含めて検証する
+	existing, err := a.repos.Connections.GetConnectionByID(r.Context(), id)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			http.Error(w, "Connection not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting connection: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	merged := req
+	if merged.PrivateKey == nil {
+		merged.PrivateKey = existing.PrivateKey
+	}
+	if merged.HostKey == nil {
+		merged.HostKey = existing.HostKey
+	}
+	if err := collector.ValidateConnection(merged); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	connection, err := a.repos.Connections.UpdateConnection(r.Context(), id, userID, req)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			http.Error(w, "Connection not found", http.StatusNotFound)
@@ -177,6 +286,7 @@ func (a *API) UpdateConnection(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	a.publish(r.Context(), db.Event{Type: db.EventConnectionUpdated, ConnectionID: id})
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(connection); err != nil {
@@ -207,7 +317,7 @@ func (a *API) DeleteConnection(w http.ResponseWriter, r *http.Request) {
 	// TODO: 認証実装後にユーザーIDを取得
 	userID := -1 // 仮のユーザーID（開発用）
 
-	err = db.DeleteConnection(context.Background(), a.conn, id, userID)
+	err = a.repos.Connections.DeleteConnection(r.Context(), id, userID)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			http.Error(w, "Connection not found", http.StatusNotFound)
@@ -217,6 +327,208 @@ func (a *API) DeleteConnection(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	a.publish(r.Context(), db.Event{Type: db.EventConnectionDeleted, ConnectionID: id})
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// connectionIDFromPath は /connections/{id}/{action} からconnection IDを取り出す。
+func connectionIDFromPath(path, action string) (int, bool) {
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(pathParts) != 3 || pathParts[0] != "connections" || pathParts[2] != action {
+		return 0, false
+	}
+	id, err := strconv.Atoi(pathParts[1])
+	return id, err == nil
+}
+
+// ScanConnection はconnectionのスキャンジョブを積み、202とジョブを返す。 POST /connections/{id}/scan
+// スキャンはsokoni workerがsokoni scanやスケジューラーと同じスキャナーで行うので、進み具合は/jobs/{id}で、
+// 結果は/connections/{id}/scansで確認できる。
+// 同じconnectionのスキャンジョブが待機中か実行中の場合は、409とそのジョブを返す。
+func (a *API) ScanConnection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, ok := connectionIDFromPath(r.URL.Path, "scan")
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := a.repos.Connections.GetConnectionByID(r.Context(), id); err != nil {
+		if err == pgx.ErrNoRows {
+			http.Error(w, "Connection not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting connection: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	job, created, err := service.EnqueueScan(r.Context(), a.repos.Jobs, id, false)
+	if err != nil {
+		log.Printf("Error enqueuing scan: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusAccepted
+	if created {
+		a.publish(r.Context(), db.Event{Type: db.EventScanRequested, ConnectionID: id, JobID: job.ID})
+	} else {
+		status = http.StatusConflict
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(job)
+}
+
+// GetScanRuns はconnectionのスキャン実行を新しい順に返す。 GET /connections/{id}/scans
+func (a *API) GetScanRuns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, ok := connectionIDFromPath(r.URL.Path, "scans")
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	runs, err := a.repos.ScanRuns.ListScanRuns(r.Context(), id, scanRunsLimit)
+	if err != nil {
+		log.Printf("Error listing scan runs: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if runs == nil {
+		runs = []*db.ScanRun{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(runs); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// GetJobs はジョブを新しい順に返す。 GET /jobs?status=dead
+// statusを指定するとその状態のものだけを返すので、デッドレターの確認に使える。
+func (a *API) GetJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jobs, err := a.repos.Jobs.ListJobs(r.Context(), r.URL.Query().Get("status"), jobsLimit)
+	if err != nil {
+		log.Printf("Error listing jobs: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if jobs == nil {
+		jobs = []*db.Job{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(jobs); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// GetJob はジョブを返す。 GET /jobs/{id}
+func (a *API) GetJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/jobs/"))
+	if err != nil {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+
+	job, err := a.repos.Jobs.GetJob(r.Context(), id)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting job: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// CancelJob はジョブを取り消す。 DELETE /jobs/{id}
+// 待機中のジョブはすぐに取り消して200を返す。実行中のジョブは処理しているワーカーに止めるよう知らせて202を返し、
+// ワーカーが止めるとcancelledになる（進み具合はGET /jobs/{id}で確認できる）。
+// 成功したかdeadになったジョブは取り消せないので409を返す。どの場合もジョブを返す。
+func (a *API) CancelJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/jobs/"))
+	if err != nil {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+
+	job, err := a.repos.Jobs.CancelJob(r.Context(), id)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error cancelling job: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	switch job.Status {
+	case db.JobRunning:
+		a.publish(r.Context(), db.Event{Type: db.EventJobCancelled, ConnectionID: derefInt(job.ConnectionID), JobID: job.ID})
+		status = http.StatusAccepted
+	case db.JobSucceeded, db.JobDead:
+		status = http.StatusConflict
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(job)
+}
+
+func derefInt(p *int) int {
+	if p == nil {
+		return 0
+	}
+	return *p
+}
+
+// Health はDBに問い合わせできればOKを返す。 /health
+// DBに接続できない場合は503を返すので、ロードバランサー等の死活監視に使える。
+func (a *API) Health(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+	if err := a.repos.Ping(ctx); err != nil {
+		log.Printf("Health check failed: %v", err)
+		http.Error(w, "Database unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
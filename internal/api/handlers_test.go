@@ -2,28 +2,31 @@ package api
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
-	"github.com/jackc/pgx/v5"
 	"github.com/koplec/sokoni/internal/db"
 	"github.com/koplec/sokoni/internal/model"
+	"golang.org/x/crypto/ssh"
 )
 
 func TestSearchFiles(t *testing.T) {
 	ctx := context.Background()
-	conn, err := db.Connect(ctx)
-	if err != nil {
-		t.Skipf("Database connection failed: %v", err)
-	}
-	defer conn.Close(ctx)
+	repos := db.NewMemoryRepositories()
+	api := NewAPI(repos)
 
-	api := NewAPI(conn)
-
-	insertTestData(t, ctx, conn)
+	insertTestData(t, ctx, repos)
 
 	req := httptest.NewRequest("GET", "/search?q=test", nil)
 	w := httptest.NewRecorder()
@@ -34,26 +37,21 @@ func TestSearchFiles(t *testing.T) {
 		t.Errorf("Expected status 200, got %d", w.Code)
 	}
 
-	var files []model.FileInfo
-	err = json.Unmarshal(w.Body.Bytes(), &files)
+	var files []db.FileSearchResult
+	err := json.Unmarshal(w.Body.Bytes(), &files)
 	if err != nil {
 		t.Fatalf("Failed to decode response: %v", err)
 	}
 
 	if len(files) == 0 {
 		t.Error("Expected to find test files")
+	} else if files[0].ConnectionID == 0 {
+		t.Error("Expected search results to include the connection ID")
 	}
 }
 
 func TestSearchFilesNoQuery(t *testing.T) {
-	ctx := context.Background()
-	conn, err := db.Connect(ctx)
-	if err != nil {
-		t.Skipf("Database connection failed: %v", err)
-	}
-	defer conn.Close(ctx)
-
-	api := NewAPI(conn)
+	api := NewAPI(db.NewMemoryRepositories())
 
 	req := httptest.NewRequest("GET", "/search", nil)
 	w := httptest.NewRecorder()
@@ -65,14 +63,10 @@ func TestSearchFilesNoQuery(t *testing.T) {
 	}
 }
 
-func insertTestData(t *testing.T, ctx context.Context, conn *pgx.Conn) {
-	conn.Exec(ctx, "DELETE FROM files")
-	conn.Exec(ctx, "DELETE FROM connections")
-
-	_, err := conn.Exec(ctx, `
-		INSERT INTO connections (id, name, base_path, remote_path) 
-		VALUES (1, 'test', '/test', '//test/share')
-	`)
+func insertTestData(t *testing.T, ctx context.Context, repos db.Repositories) int {
+	connection, err := repos.Connections.CreateConnection(ctx, db.CreateConnectionRequest{
+		Name: "test", BasePath: "/test", RemotePath: "//test/share",
+	})
 	if err != nil {
 		t.Fatalf("Failed to insert test connection: %v", err)
 	}
@@ -84,8 +78,386 @@ func insertTestData(t *testing.T, ctx context.Context, conn *pgx.Conn) {
 		ModTime: time.Now(),
 	}
 
-	err = db.InsertFile(ctx, conn, 1, testFile)
+	err = repos.Files.InsertFile(ctx, connection.ID, testFile)
 	if err != nil {
 		t.Fatalf("Failed to insert test file: %v", err)
 	}
-}
\ No newline at end of file
+	return connection.ID
+}
+func TestCreateConnectionInvalidOptions(t *testing.T) {
+	api := NewAPI(db.NewMemoryRepositories())
+
+	body := `{"name": "nas", "base_path": "/mnt/nas", "remote_path": "//nas/share", "options": "vers=1.0"}`
+	req := httptest.NewRequest("POST", "/connections", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	api.CreateConnection(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+}
+
+func TestDownloadFile(t *testing.T) {
+	ctx := context.Background()
+	repos := db.NewMemoryRepositories()
+	api := NewAPI(repos)
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "invoice.pdf"), []byte("%PDF-1.4"), 0644)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("notes"), 0644)
+	connection, err := repos.Connections.CreateConnection(ctx, db.CreateConnectionRequest{Name: "local", BasePath: dir, RemotePath: dir})
+	if err != nil {
+		t.Fatalf("Failed to insert test connection: %v", err)
+	}
+	// 同じパスを記録した別のconnectionのファイルは返さない
+	otherDir := t.TempDir()
+	other, err := repos.Connections.CreateConnection(ctx, db.CreateConnectionRequest{Name: "other", BasePath: otherDir, RemotePath: otherDir})
+	if err != nil {
+		t.Fatalf("Failed to insert test connection: %v", err)
+	}
+	path := filepath.Join(dir, "invoice.pdf")
+	repos.Files.InsertFile(ctx, connection.ID, model.FileInfo{Path: path, Name: "invoice.pdf", Size: 8, ModTime: time.Now()})
+	repos.Files.InsertFile(ctx, connection.ID, model.FileInfo{Path: filepath.Join(dir, "notes.txt"), Name: "notes.txt", Size: 5, ModTime: time.Now()})
+	repos.Files.InsertFile(ctx, other.ID, model.FileInfo{Path: path, Name: "invoice.pdf", Size: 8, ModTime: time.Now()})
+	query := func(connectionID int, path string) string {
+		return fmt.Sprintf("?connection_id=%d&path=%s", connectionID, url.QueryEscape(path))
+	}
+
+	tests := []struct {
+		query string
+		code  int
+	}{
+		{query(connection.ID, path), http.StatusOK},
+		{query(connection.ID, filepath.Join(dir, "missing.pdf")), http.StatusNotFound},
+		{query(other.ID+1, path), http.StatusNotFound},
+		{"?path=" + url.QueryEscape(path), http.StatusBadRequest},
+		{fmt.Sprintf("?connection_id=%d", connection.ID), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		api.DownloadFile(w, httptest.NewRequest("GET", "/files/download"+tt.query, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s: expected status %d, got %d", tt.query, tt.code, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	api.DownloadFile(w, httptest.NewRequest("GET", "/files/download"+query(connection.ID, path), nil))
+	if w.Body.String() != "%PDF-1.4" || !strings.Contains(w.Header().Get("Content-Disposition"), "invoice.pdf") || w.Header().Get("Content-Type") != "application/pdf" {
+		t.Errorf("unexpected response: %q %v", w.Body.String(), w.Header())
+	}
+	// Content-Typeはファイル名から決める
+	w = httptest.NewRecorder()
+	api.DownloadFile(w, httptest.NewRequest("GET", "/files/download"+query(connection.ID, filepath.Join(dir, "notes.txt")), nil))
+	if w.Body.String() != "notes" || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("unexpected response: %q %v", w.Body.String(), w.Header())
+	}
+	// 別のconnectionは接続先から読めなければ502
+	w = httptest.NewRecorder()
+	api.DownloadFile(w, httptest.NewRequest("GET", "/files/download"+query(other.ID, path), nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected the other connection's source to be used, got %d", w.Code)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewAPI(db.NewMemoryRepositories()).Health(w, httptest.NewRequest("GET", "/health", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", w.Code)
+	}
+}
+
+func TestScanConnection(t *testing.T) {
+	ctx := context.Background()
+	repos := db.NewMemoryRepositories()
+	api := NewAPI(repos)
+
+	dir := t.TempDir()
+	connection, err := repos.Connections.CreateConnection(ctx, db.CreateConnectionRequest{Name: "local", BasePath: dir, RemotePath: dir})
+	if err != nil {
+		t.Fatalf("Failed to insert test connection: %v", err)
+	}
+
+	// スキャンはワーカーが行うので、APIはジョブを積むだけ
+	w := httptest.NewRecorder()
+	api.ScanConnection(w, httptest.NewRequest("POST", fmt.Sprintf("/connections/%d/scan", connection.ID), nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status 202, got %d", w.Code)
+	}
+	var job db.Job
+	if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if job.Type != db.JobTypeScan || job.Status != db.JobQueued || job.Priority != db.JobPriorityManual || *job.ConnectionID != connection.ID {
+		t.Errorf("Unexpected job: %+v", job)
+	}
+
+	// 同じconnectionのジョブが待機中の間は積まない
+	w = httptest.NewRecorder()
+	api.ScanConnection(w, httptest.NewRequest("POST", fmt.Sprintf("/connections/%d/scan", connection.ID), nil))
+	var existing db.Job
+	json.Unmarshal(w.Body.Bytes(), &existing)
+	if w.Code != http.StatusConflict || existing.ID != job.ID {
+		t.Errorf("Expected status 409 with job %d, got %d %+v", job.ID, w.Code, existing)
+	}
+
+	w = httptest.NewRecorder()
+	api.GetJob(w, httptest.NewRequest("GET", fmt.Sprintf("/jobs/%d", job.ID), nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"queued"`) {
+		t.Errorf("Unexpected job response: %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	api.GetJob(w, httptest.NewRequest("GET", "/jobs/999", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for missing job, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	api.GetJobs(w, httptest.NewRequest("GET", "/jobs?status=dead", nil))
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("Expected no dead jobs, got %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	api.GetJobs(w, httptest.NewRequest("GET", "/jobs", nil))
+	var jobs []db.Job
+	if err := json.Unmarshal(w.Body.Bytes(), &jobs); err != nil || len(jobs) != 1 {
+		t.Errorf("Expected 1 job, got %v %v", jobs, err)
+	}
+
+	w = httptest.NewRecorder()
+	api.GetScanRuns(w, httptest.NewRequest("GET", fmt.Sprintf("/connections/%d/scans", connection.ID), nil))
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("Expected no scan runs before the worker runs, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	api.ScanConnection(w, httptest.NewRequest("POST", "/connections/999/scan", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for missing connection, got %d", w.Code)
+	}
+}
+
+func TestCreateConnectionSchedule(t *testing.T) {
+	api := NewAPI(db.NewMemoryRepositories())
+
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{"name": "nas", "base_path": "/mnt/nas", "remote_path": "/mnt/nas", "schedule": "0 2 * * *", "blackout_windows": "01:00-04:00"}`, http.StatusCreated},
+		{`{"name": "nas", "base_path": "/mnt/nas", "remote_path": "/mnt/nas", "schedule": "every night"}`, http.StatusBadRequest},
+		{`{"name": "nas", "base_path": "/mnt/nas", "remote_path": "/mnt/nas", "blackout_windows": "night"}`, http.StatusBadRequest},
+		{`{"name": "nas", "base_path": "/mnt/nas", "remote_path": "/mnt/nas", "throttle": "bytes=50MB; mon-fri 09:00-18:00 listings=5,requests=1"}`, http.StatusCreated},
+		{`{"name": "nas", "base_path": "/mnt/nas", "remote_path": "/mnt/nas", "throttle": "iops=100"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		api.CreateConnection(w, httptest.NewRequest("POST", "/connections", strings.NewReader(tt.body)))
+		if w.Code != tt.code {
+			t.Errorf("%s: expected status %d, got %d", tt.body, tt.code, w.Code)
+			continue
+		}
+		if tt.code != http.StatusCreated {
+			continue
+		}
+		var connection db.ConnectionResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &connection); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		// 一度もスキャンしていないので、停止時間帯でなければすぐに対象になる
+		if connection.NextScan == nil || connection.NextScan.After(time.Now().Add(3*time.Hour)) {
+			t.Errorf("Unexpected next_scan: %v", connection.NextScan)
+		}
+	}
+}
+
+func TestConnectionEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	repos := db.NewMemoryRepositories()
+	api := NewAPI(repos)
+	events, err := repos.Events.ListenEvents(ctx)
+	if err != nil {
+		t.Fatalf("ListenEvents failed: %v", err)
+	}
+
+	body := `{"name": "nas", "base_path": "/mnt/nas", "remote_path": "/mnt/nas"}`
+	w := httptest.NewRecorder()
+	api.CreateConnection(w, httptest.NewRequest("POST", "/connections", strings.NewReader(body)))
+	var connection db.ConnectionResponse
+	json.Unmarshal(w.Body.Bytes(), &connection)
+	id := connection.ID
+	path := fmt.Sprintf("/connections/%d", id)
+
+	api.UpdateConnection(httptest.NewRecorder(), httptest.NewRequest("PUT", path, strings.NewReader(body)))
+	w = httptest.NewRecorder()
+	api.ScanConnection(w, httptest.NewRequest("POST", path+"/scan", nil))
+	var job db.Job
+	json.Unmarshal(w.Body.Bytes(), &job)
+	// すでに積まれているスキャンは知らせない
+	api.ScanConnection(httptest.NewRecorder(), httptest.NewRequest("POST", path+"/scan", nil))
+	api.DeleteConnection(httptest.NewRecorder(), httptest.NewRequest("DELETE", path, nil))
+
+	for _, want := range []db.Event{
+		{Type: db.EventConnectionCreated, ConnectionID: id},
+		{Type: db.EventConnectionUpdated, ConnectionID: id},
+		{Type: db.EventScanRequested, ConnectionID: id, JobID: job.ID},
+		{Type: db.EventConnectionDeleted, ConnectionID: id},
+	} {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Errorf("Expected event %+v, got %+v", want, got)
+			}
+		default:
+			t.Errorf("Expected event %+v, got none", want)
+		}
+	}
+	select {
+	case got := <-events:
+		t.Errorf("Unexpected event %+v", got)
+	default:
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	repos := db.NewMemoryRepositories()
+	api := NewAPI(repos)
+	events, err := repos.Events.ListenEvents(ctx)
+	if err != nil {
+		t.Fatalf("ListenEvents failed: %v", err)
+	}
+
+	cancelJob := func(id int) (int, db.Job) {
+		w := httptest.NewRecorder()
+		api.CancelJob(w, httptest.NewRequest("DELETE", fmt.Sprintf("/jobs/%d", id), nil))
+		var job db.Job
+		json.Unmarshal(w.Body.Bytes(), &job)
+		return w.Code, job
+	}
+
+	// 待機中のジョブはすぐに取り消す
+	queued, _, _ := repos.Jobs.EnqueueJob(ctx, db.EnqueueJobRequest{Type: "test"})
+	if code, job := cancelJob(queued.ID); code != http.StatusOK || job.Status != db.JobCancelled {
+		t.Errorf("Expected status 200 with cancelled job, got %d %+v", code, job)
+	}
+
+	// 実行中のジョブはワーカーに知らせる
+	connection, err := repos.Connections.CreateConnection(ctx, db.CreateConnectionRequest{Name: "local", BasePath: "/data", RemotePath: "/data"})
+	if err != nil {
+		t.Fatalf("Failed to insert test connection: %v", err)
+	}
+	running, _, _ := repos.Jobs.EnqueueJob(ctx, db.EnqueueJobRequest{Type: "test", ConnectionID: &connection.ID})
+	repos.Jobs.DequeueJob(ctx, "worker", []string{"test"}, time.Minute)
+	if code, job := cancelJob(running.ID); code != http.StatusAccepted || job.Status != db.JobRunning || job.CancelRequestedAt == nil {
+		t.Errorf("Expected status 202 with cancel requested, got %d %+v", code, job)
+	}
+	want := db.Event{Type: db.EventJobCancelled, ConnectionID: connection.ID, JobID: running.ID}
+	select {
+	case got := <-events:
+		if got != want {
+			t.Errorf("Expected event %+v, got %+v", want, got)
+		}
+	default:
+		t.Errorf("Expected event %+v, got none", want)
+	}
+
+	// 成功したジョブは取り消せない
+	done, _, _ := repos.Jobs.EnqueueJob(ctx, db.EnqueueJobRequest{Type: "done"})
+	repos.Jobs.DequeueJob(ctx, "worker", []string{"done"}, time.Minute)
+	repos.Jobs.CompleteJob(ctx, done.ID, "worker")
+	if code, job := cancelJob(done.ID); code != http.StatusConflict || job.Status != db.JobSucceeded {
+		t.Errorf("Expected status 409 with succeeded job, got %d %+v", code, job)
+	}
+
+	if code, _ := cancelJob(999); code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for missing job, got %d", code)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	repos := db.NewMemoryRepositories()
+	routes := NewAPI(repos).Routes()
+
+	body := `{"name": "nas", "base_path": "/mnt/nas", "remote_path": "/mnt/nas"}`
+	for _, tt := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"GET", "/health", "", http.StatusOK},
+		{"POST", "/connections", body, http.StatusCreated},
+		{"GET", "/connections/1", "", http.StatusOK},
+		{"PUT", "/connections/1", body, http.StatusOK},
+		{"POST", "/connections/1/scan", "", http.StatusAccepted},
+		{"GET", "/connections/1/scans", "", http.StatusOK},
+		{"GET", "/jobs", "", http.StatusOK},
+		{"GET", "/jobs/1", "", http.StatusOK},
+		{"DELETE", "/jobs/1", "", http.StatusOK},
+		{"DELETE", "/connections/1", "", http.StatusNoContent},
+		{"GET", "/connections/1", "", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+		if w.Code != tt.code {
+			t.Errorf("%s %s: expected status %d, got %d", tt.method, tt.path, tt.code, w.Code)
+		}
+	}
+}
+
+func TestUpdateConnectionKeepsPrivateKey(t *testing.T) {
+	ctx := context.Background()
+	repos := db.NewMemoryRepositories()
+	api := NewAPI(repos)
+
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatalf("Failed to marshal private key: %v", err)
+	}
+	privateKey := string(pem.EncodeToMemory(block))
+	hostKey := "SHA256:abc"
+	connection, err := repos.Connections.CreateConnection(ctx, db.CreateConnectionRequest{
+		Name: "sftp", BasePath: "/mnt/sftp", RemotePath: "sftp://nas/share", PrivateKey: &privateKey, HostKey: &hostKey, UserID: -1,
+	})
+	if err != nil {
+		t.Fatalf("Failed to insert test connection: %v", err)
+	}
+
+	// 秘密鍵はレスポンスに含めないので、取得した設定を送り返すとprivate_keyは省略される
+	w := httptest.NewRecorder()
+	api.GetConnection(w, httptest.NewRequest("GET", fmt.Sprintf("/connections/%d", connection.ID), nil))
+	var fetched map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &fetched); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if _, ok := fetched["private_key"]; ok {
+		t.Fatalf("Expected private_key to be omitted from the response")
+	}
+	fetched["name"] = "renamed"
+	body, _ := json.Marshal(fetched)
+	w = httptest.NewRecorder()
+	api.UpdateConnection(w, httptest.NewRequest("PUT", fmt.Sprintf("/connections/%d", connection.ID), strings.NewReader(string(body))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	got, err := repos.Connections.GetConnectionByID(ctx, connection.ID)
+	if err != nil {
+		t.Fatalf("GetConnectionByID failed: %v", err)
+	}
+	if got.Name != "renamed" || got.PrivateKey == nil || *got.PrivateKey != privateKey || got.HostKey == nil || *got.HostKey != hostKey {
+		t.Errorf("Expected the private key and host key to survive the update, got %+v", got)
+	}
+
+	// 空文字列を指定すると解除する。パスワードもないので認証方式がなくなり、更新できない
+	w = httptest.NewRecorder()
+	api.UpdateConnection(w, httptest.NewRequest("PUT", fmt.Sprintf("/connections/%d", connection.ID),
+		strings.NewReader(`{"name": "sftp", "base_path": "/mnt/sftp", "remote_path": "sftp://nas/share", "private_key": ""}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Routes はAPIのパスとハンドラを対応付けたhttp.Handlerを返す。
+func (a *API) Routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/search", a.SearchFiles)
+	mux.HandleFunc("/files/download", a.DownloadFile)
+	connections := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/connections" && r.Method == "GET" {
+			a.GetConnections(w, r)
+		} else if r.URL.Path == "/connections" && r.Method == "POST" {
+			a.CreateConnection(w, r)
+		} else if strings.HasSuffix(r.URL.Path, "/scan") {
+			a.ScanConnection(w, r)
+		} else if strings.HasSuffix(r.URL.Path, "/scans") {
+			a.GetScanRuns(w, r)
+		} else if r.Method == "PUT" {
+			a.UpdateConnection(w, r)
+		} else if r.Method == "DELETE" {
+			a.DeleteConnection(w, r)
+		} else {
+			a.GetConnection(w, r)
+		}
+	}
+	mux.HandleFunc("/connections", connections)
+	mux.HandleFunc("/connections/", connections) // /connections/{id} 以下
+	mux.HandleFunc("/jobs", a.GetJobs)
+	mux.HandleFunc("/jobs/", func(w http.ResponseWriter, r *http.Request) { // /jobs/{id}
+		if r.Method == "DELETE" {
+			a.CancelJob(w, r)
+		} else {
+			a.GetJob(w, r)
+		}
+	})
+	mux.HandleFunc("/health", a.Health)
+	return mux
+}
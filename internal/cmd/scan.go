@@ -2,23 +2,125 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
+	"github.com/koplec/sokoni/internal/db"
 	"github.com/koplec/sokoni/internal/service"
 )
 
-// ScanConnection は指定されたconnection IDのNAS/ローカルパスをスキャンして、
-// 見つかったPDFファイルの情報をデータベースに保存する。
-// - connectionID: データベースに登録されているconnection ID
-// - scanner: 実際のスキャン処理を行うスキャナー（依存性注入）
-func ScanConnection(connectionID int, scanner service.ConnectionScanner) error {
-	ctx := context.Background()
+// jobPollInterval はジョブの終了を待つ間に状態を確認する間隔。
+const jobPollInterval = time.Second
 
-	userID := -1 // 仮のユーザーID（開発用）
-	
-	err := scanner(ctx, connectionID, userID)
+// EnqueueScan は指定されたconnectionのスキャンジョブを積む（sokoni scan <connection_id>）。
+// スキャンはsokoni workerが行う。waitがtrueの場合はジョブが終わるまで待ち、失敗したらエラーを返す。
+// 同じconnectionのスキャンジョブが待機中か実行中であれば、新しく積まずにそのジョブを待つ。
+func EnqueueScan(ctx context.Context, repos db.Repositories, connectionID int, wait bool) error {
+	job, created, err := service.EnqueueScan(ctx, repos.Jobs, connectionID, false)
 	if err != nil {
-		return fmt.Errorf("failed to scan connection %d: %w", connectionID, err)
+		return fmt.Errorf("failed to enqueue scan of connection %d: %w", connectionID, err)
 	}
-	return nil
-}
\ No newline at end of file
+	if created {
+		fmt.Printf("Queued scan job %d for connection %d\n", job.ID, connectionID)
+		// ワーカーがpollIntervalを待たずに取り出せるよう知らせる（届かなくても取り出される）
+		err := repos.Events.PublishEvent(ctx, db.Event{Type: db.EventScanRequested, ConnectionID: connectionID, JobID: job.ID})
+		if err != nil {
+			fmt.Printf("Warning: failed to notify workers: %v\n", err)
+		}
+	} else {
+		fmt.Printf("Scan job %d for connection %d is already %s\n", job.ID, connectionID, job.Status)
+	}
+	if !wait {
+		return nil
+	}
+	return WaitForJob(ctx, repos.Jobs, job.ID)
+}
+
+// CancelScan はスキャンジョブを取り消す（sokoni scan cancel <job_id>）。
+// 実行中のジョブはワーカーに止めるよう知らせ、止まる（cancelledになる）まで待つ。
+// 成功したかdeadになったジョブは取り消せないのでエラーを返す。
+func CancelScan(ctx context.Context, repos db.Repositories, jobID int) error {
+	job, err := repos.Jobs.CancelJob(ctx, jobID)
+	if err != nil {
+		return fmt.Errorf("failed to cancel job %d: %w", jobID, err)
+	}
+	switch job.Status {
+	case db.JobCancelled:
+		fmt.Printf("Job %d was cancelled\n", job.ID)
+		return nil
+	case db.JobRunning:
+		fmt.Printf("Requested cancellation of job %d; waiting for the worker to stop it\n", job.ID)
+		// 届かなくてもワーカーはハートビートで取り消しに気づく
+		var connectionID int
+		if job.ConnectionID != nil {
+			connectionID = *job.ConnectionID
+		}
+		err := repos.Events.PublishEvent(ctx, db.Event{Type: db.EventJobCancelled, ConnectionID: connectionID, JobID: job.ID})
+		if err != nil {
+			fmt.Printf("Warning: failed to notify workers: %v\n", err)
+		}
+		err = WaitForJob(ctx, repos.Jobs, job.ID)
+		if errors.Is(err, service.ErrCancelled) {
+			return nil
+		}
+		if err == nil && ctx.Err() == nil {
+			// 取り消す前にスキャンが終わった
+			return fmt.Errorf("job %d finished before it could be cancelled", job.ID)
+		}
+		return err
+	default:
+		return fmt.Errorf("job %d is already %s", job.ID, job.Status)
+	}
+}
+
+// WaitForJob はジョブが成功するかdeadになるまで待ち、状態が変わるたびに表示する。
+// 取り消された場合はservice.ErrCancelledを包んだエラーを返す。
+// ctxをキャンセル（Ctrl-C）しても待つのをやめるだけで、ジョブはワーカーで続く。
+func WaitForJob(ctx context.Context, jobs db.JobRepository, jobID int) error {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	var last db.Job
+	for {
+		job, err := jobs.GetJob(ctx, jobID)
+		if ctx.Err() != nil {
+			fmt.Printf("Stopped waiting; job %d continues in the worker\n", jobID)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get job %d: %w", jobID, err)
+		}
+
+		if job.Status != last.Status || job.Attempts != last.Attempts {
+			switch {
+			case job.Status == db.JobRunning:
+				fmt.Printf("Job %d is running (attempt %d/%d)\n", job.ID, job.Attempts, job.MaxAttempts)
+			case job.Status == db.JobQueued && job.LastError != nil:
+				fmt.Printf("Job %d failed: %s (retrying at %s)\n", job.ID, *job.LastError, job.RunAfter.Format(time.TimeOnly))
+			case job.Status == db.JobQueued:
+				fmt.Printf("Job %d is waiting for a worker\n", job.ID)
+			}
+		}
+		switch job.Status {
+		case db.JobSucceeded:
+			fmt.Printf("Job %d succeeded\n", job.ID)
+			return nil
+		case db.JobDead:
+			message := "unknown error"
+			if job.LastError != nil {
+				message = *job.LastError
+			}
+			return fmt.Errorf("job %d failed: %s", job.ID, message)
+		case db.JobCancelled:
+			fmt.Printf("Job %d was cancelled\n", job.ID)
+			return fmt.Errorf("job %d: %w", job.ID, service.ErrCancelled)
+		}
+		last = *job
+
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+	}
+}
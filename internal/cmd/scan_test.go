@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/koplec/sokoni/internal/db"
+)
+
+func TestEnqueueScanWait(t *testing.T) {
+	ctx := context.Background()
+	repos := db.NewMemoryRepositories()
+	c, err := repos.Connections.CreateConnection(ctx, db.CreateConnectionRequest{Name: "local", BasePath: "/data", RemotePath: "/data"})
+	if err != nil {
+		t.Fatalf("failed to insert connection: %v", err)
+	}
+
+	if err := EnqueueScan(ctx, repos, c.ID, false); err != nil {
+		t.Fatalf("EnqueueScan failed: %v", err)
+	}
+	jobs, _ := repos.Jobs.ListJobs(ctx, db.JobQueued, 10)
+	if len(jobs) != 1 || jobs[0].Priority != db.JobPriorityManual {
+		t.Fatalf("expected one manual scan job, got %+v", jobs)
+	}
+
+	// ワーカーの代わりにジョブをdeadにすると、待っていた側はエラーになる
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		job, _ := repos.Jobs.DequeueJob(ctx, "test", []string{db.JobTypeScan}, time.Minute)
+		repos.Jobs.FailJob(ctx, job.ID, "test", "logon failure", 0, true)
+	}()
+	err = EnqueueScan(ctx, repos, c.ID, true)
+	if err == nil || !strings.Contains(err.Error(), "logon failure") {
+		t.Errorf("expected job failure, got %v", err)
+	}
+
+	// Ctrl-Cで待つのをやめてもエラーにはしない
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := EnqueueScan(ctx, repos, c.ID, true); err != nil {
+		t.Errorf("expected no error after giving up waiting, got %v", err)
+	}
+}
+
+func TestCancelScan(t *testing.T) {
+	ctx := context.Background()
+	repos := db.NewMemoryRepositories()
+	c, err := repos.Connections.CreateConnection(ctx, db.CreateConnectionRequest{Name: "local", BasePath: "/data", RemotePath: "/data"})
+	if err != nil {
+		t.Fatalf("failed to insert connection: %v", err)
+	}
+
+	// 待機中のジョブはすぐに取り消す
+	queued, _, _ := repos.Jobs.EnqueueJob(ctx, db.EnqueueJobRequest{Type: db.JobTypeScan, ConnectionID: &c.ID})
+	if err := CancelScan(ctx, repos, queued.ID); err != nil {
+		t.Fatalf("CancelScan failed: %v", err)
+	}
+	if job, _ := repos.Jobs.GetJob(ctx, queued.ID); job.Status != db.JobCancelled {
+		t.Errorf("expected queued job to be cancelled, got %s", job.Status)
+	}
+
+	// 実行中のジョブはワーカーが止めるまで待つ
+	running, _, _ := repos.Jobs.EnqueueJob(ctx, db.EnqueueJobRequest{Type: db.JobTypeScan, ConnectionID: &c.ID})
+	repos.Jobs.DequeueJob(ctx, "test", []string{db.JobTypeScan}, time.Minute)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		repos.Jobs.ReleaseJob(ctx, running.ID, "test", 0)
+	}()
+	if err := CancelScan(ctx, repos, running.ID); err != nil {
+		t.Errorf("expected running job to be cancelled, got %v", err)
+	}
+
+	// 成功したジョブは取り消せない
+	done, _, _ := repos.Jobs.EnqueueJob(ctx, db.EnqueueJobRequest{Type: db.JobTypeScan, ConnectionID: &c.ID})
+	repos.Jobs.DequeueJob(ctx, "test", []string{db.JobTypeScan}, time.Minute)
+	repos.Jobs.CompleteJob(ctx, done.ID, "test")
+	if err := CancelScan(ctx, repos, done.ID); err == nil || !strings.Contains(err.Error(), "already succeeded") {
+		t.Errorf("expected error for finished job, got %v", err)
+	}
+	if err := CancelScan(ctx, repos, 999); err == nil {
+		t.Error("expected error for missing job")
+	}
+}
@@ -0,0 +1,426 @@
+package collector
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/koplec/sokoni/internal/db"
+	"github.com/koplec/sokoni/internal/model"
+)
+
+// アーカイブ内のファイルは "bundle.zip!/2024/inv.pdf" のように、アーカイブのパスに "!/" を挟んで記録する。
+// アーカイブ自体は "bundle.zip!" という仮想ディレクトリとして扱い、通常のディレクトリと同じく
+// チェックポイント・削除検出・差分スキャンの対象にする。
+const (
+	archiveMarker    = "!"
+	archiveSeparator = archiveMarker + "/"
+)
+
+// errArchiveTooLarge はアーカイブがArchiveMaxSizeを超えていたときに返される。
+var errArchiveTooLarge = errors.New("archive exceeds size limit")
+
+// archiveFormat はファイル名から対応するアーカイブ形式（"zip", "tar", "tar.gz"）を返す。対応しない場合は空。
+func archiveFormat(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return "zip"
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(lower, ".tar"):
+		return "tar"
+	}
+	return ""
+}
+
+// splitArchivePath は記録したパスを、接続先上のファイルのパスと、アーカイブ内を順にたどるパスに分ける。
+// 例: "a/outer.zip!/inner.tar!/x.pdf" → "a/outer.zip", ["inner.tar", "x.pdf"]
+// "!/" の前がアーカイブでない場合（"!"で終わるディレクトリ名）は区切りとみなさない。
+func splitArchivePath(p string) (string, []string) {
+	var parts []string
+	current := ""
+	for i, segment := range strings.Split(p, archiveSeparator) {
+		if i > 0 {
+			if archiveFormat(current) != "" {
+				parts = append(parts, current)
+				current = segment
+				continue
+			}
+			current += archiveSeparator
+		}
+		current += segment
+	}
+	parts = append(parts, current)
+	return parts[0], parts[1:]
+}
+
+// archiveMember はアーカイブ内の通常ファイル1件。
+type archiveMember struct {
+	name    string // アーカイブ内のパス（"/"区切り、先頭の"/"と".."を除いたもの）
+	size    int64  // 展開後のサイズ
+	modTime time.Time
+	open    func() (io.ReadCloser, error) // eachMemberのコールバックの中でだけ使える
+}
+
+// archiveMemberInfo はアーカイブ内のファイルのfs.FileInfo。入れ子のアーカイブの差分判定に使う。
+type archiveMemberInfo struct {
+	m archiveMember
+}
+
+func (i archiveMemberInfo) Name() string       { return path.Base(i.m.name) }
+func (i archiveMemberInfo) Size() int64        { return i.m.size }
+func (i archiveMemberInfo) ModTime() time.Time { return i.m.modTime }
+func (i archiveMemberInfo) IsDir() bool        { return false }
+func (i archiveMemberInfo) Mode() fs.FileMode  { return 0444 }
+func (i archiveMemberInfo) Sys() any           { return nil }
+
+// memberName はアーカイブ内のエントリ名を正規化する。空を返した場合は飛ばす。
+func memberName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(name, `\`, "/")), "/")
+}
+
+// eachMember はアーカイブ内の通常ファイルを順にfnに渡す。fnがエラーを返すとそのエラーで終える。
+// zipは末尾の中央ディレクトリを読むためランダムアクセスが必要なので、rがReaderAtでなければ
+// 一時ファイルに書き出してから読む。sizeが負の場合はrのStatで調べる。
+func eachMember(format string, r io.Reader, size, maxSize int64, fn func(archiveMember) error) error {
+	switch format {
+	case "zip":
+		ra, ok := r.(io.ReaderAt)
+		if ok && size < 0 {
+			if st, isStater := r.(interface{ Stat() (fs.FileInfo, error) }); isStater {
+				if info, err := st.Stat(); err == nil {
+					size = info.Size()
+				}
+			}
+		}
+		if !ok || size < 0 {
+			tmp, n, err := spool(r, maxSize)
+			if err != nil {
+				return err
+			}
+			defer tmp.Close()
+			ra, size = tmp, n
+		}
+		z, err := zip.NewReader(ra, size)
+		if err != nil {
+			return err
+		}
+		for _, f := range z.File {
+			name := memberName(f.Name)
+			if f.FileInfo().IsDir() || name == "" {
+				continue
+			}
+			err := fn(archiveMember{
+				name:    name,
+				size:    int64(f.UncompressedSize64),
+				modTime: f.Modified,
+				open:    func() (io.ReadCloser, error) { return f.Open() },
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "tar", "tar.gz":
+		if format == "tar.gz" {
+			gz, err := gzip.NewReader(r)
+			if err != nil {
+				return err
+			}
+			defer gz.Close()
+			r = gz
+		}
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			name := memberName(hdr.Name)
+			if hdr.Typeflag != tar.TypeReg || name == "" {
+				continue
+			}
+			err = fn(archiveMember{
+				name:    name,
+				size:    hdr.Size,
+				modTime: hdr.ModTime,
+				open:    func() (io.ReadCloser, error) { return io.NopCloser(tr), nil },
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("unsupported archive format %q", format)
+}
+
+// tempFile は閉じると削除される一時ファイル。
+type tempFile struct {
+	*os.File
+}
+
+func (t *tempFile) Close() error {
+	err := t.File.Close()
+	os.Remove(t.Name())
+	return err
+}
+
+// spool はrを一時ファイルに書き出して先頭から読める状態で返す。maxSizeが正でそれを超えた場合はエラー。
+func spool(r io.Reader, maxSize int64) (*tempFile, int64, error) {
+	f, err := os.CreateTemp("", "sokoni-archive-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	tmp := &tempFile{File: f}
+
+	src := r
+	if maxSize > 0 {
+		src = io.LimitReader(r, maxSize+1)
+	}
+	n, err := io.Copy(tmp, src)
+	if err == nil && maxSize > 0 && n > maxSize {
+		err = errArchiveTooLarge
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		return nil, 0, err
+	}
+	return tmp, n, nil
+}
+
+// errMemberFound はopenArchiveMemberで目的のファイルを見つけたときに走査を終えるための目印。
+var errMemberFound = errors.New("member found")
+
+// openArchiveMember はアーカイブrc（パスはouter）の中から、membersを順にたどったファイルを開く。
+// 途中の入れ子のアーカイブと目的のファイルは一時ファイルに書き出し、rcは閉じる。
+func openArchiveMember(rc io.ReadCloser, outer string, members []string, maxSize int64) (io.ReadCloser, error) {
+	current, currentName := rc, outer
+	for i, target := range members {
+		limit := maxSize
+		if i == len(members)-1 {
+			limit = 0 // 目的のファイル自体はアーカイブではないので制限しない
+		}
+
+		var found *tempFile
+		err := eachMember(archiveFormat(currentName), current, -1, maxSize, func(m archiveMember) error {
+			if m.name != target {
+				return nil
+			}
+			r, err := m.open()
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			found, _, err = spool(r, limit)
+			if err != nil {
+				return err
+			}
+			return errMemberFound
+		})
+		current.Close()
+		if found == nil {
+			if err == nil {
+				err = fs.ErrNotExist
+			}
+			return nil, fmt.Errorf("failed to open %s in %s: %w", target, currentName, err)
+		}
+		current, currentName = found, target
+	}
+	return current, nil
+}
+
+// archive はアーカイブを仮想ディレクトリ（displayPath + "!"）として走査する。
+// depthはこのアーカイブの入れ子の深さ（ディレクトリ直下のアーカイブが1）。
+// 読めないアーカイブはparentにエラーとして記録して続ける。
+func (w *walker) archive(displayPath string, info fs.FileInfo, open func() (io.ReadCloser, error), depth int, parent *dirFrame) error {
+	root := displayPath + archiveMarker
+	if w.opts.SkipDir != nil && w.opts.SkipDir(root) {
+		w.result.SkippedDirs++
+		return nil
+	}
+	if w.opts.ArchiveMaxSize > 0 && info.Size() > w.opts.ArchiveMaxSize {
+		w.result.SkippedArchives++
+		return nil
+	}
+
+	// 前回から変わっていないアーカイブは開かない
+	if ok, err := w.unchangedArchive(root, info); ok || err != nil {
+		return err
+	}
+
+	rc, err := open()
+	if err != nil {
+		if ctxErr := w.ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return w.record(parent, root, err)
+	}
+	defer rc.Close()
+
+	size := info.Size()
+	if depth > 1 {
+		size = -1 // 入れ子のアーカイブは展開しながら読むので、ReaderAtとしては使えない
+	}
+	return w.readArchive(root, info.ModTime(), rc, size, depth, parent)
+}
+
+// readArchive はアーカイブの中のPDFをhandleに渡し、中のディレクトリごとにDirDoneを呼ぶ。
+// 入れ子のアーカイブはArchiveDepthまで開く。
+func (w *walker) readArchive(root string, modTime time.Time, r io.Reader, size int64, depth int, parent *dirFrame) error {
+	listedAt := time.Now()
+	frames := map[string]*dirFrame{}
+	var dirFrameOf func(p string) *dirFrame
+	dirFrameOf = func(p string) *dirFrame {
+		if f, ok := frames[p]; ok {
+			return f
+		}
+		f := &dirFrame{DirResult: DirResult{Path: p}}
+		f.State.ModTime = modTime
+		f.State.ListedAt = listedAt
+		frames[p] = f
+		if p != root {
+			up := dirFrameOf(filepath.Dir(p))
+			up.State.Subdirs = append(up.State.Subdirs, filepath.Base(p))
+			up.State.EntryCount++
+		}
+		return f
+	}
+	dirFrameOf(root)
+
+	// fnが返したエラー（handleの失敗やエラーバジェット超過）はアーカイブの読み取りエラーと区別して中断する
+	var fatal error
+	err := eachMember(archiveFormat(strings.TrimSuffix(root, archiveMarker)), r, size, w.opts.ArchiveMaxSize, func(m archiveMember) error {
+		if fatal = w.ctx.Err(); fatal != nil {
+			return fatal
+		}
+		fullPath := filepath.Join(root, filepath.FromSlash(m.name))
+		frame := dirFrameOf(filepath.Dir(fullPath))
+		frame.State.EntryCount++
+		name := path.Base(m.name)
+
+		if depth < w.opts.ArchiveDepth && archiveFormat(name) != "" {
+			frame.State.Subdirs = append(frame.State.Subdirs, name+archiveMarker)
+			fatal = w.archive(fullPath, archiveMemberInfo{m}, m.open, depth+1, frame)
+			return fatal
+		}
+
+		// .pdfのみ対象
+		if !strings.HasSuffix(strings.ToLower(name), ".pdf") {
+			return nil
+		}
+		frame.Files = append(frame.Files, fullPath)
+		frame.State.FileCount++
+		if fatal = w.handle(model.FileInfo{Path: fullPath, Name: name, Size: m.size, ModTime: m.modTime}); fatal != nil {
+			return fatal
+		}
+		w.result.Files++
+		return nil
+	})
+	if fatal != nil {
+		return fatal
+	}
+	if err != nil {
+		// 壊れたアーカイブ等。途中まで読めた分は反映するが、削除検出の対象にはしない
+		if errors.Is(err, errArchiveTooLarge) {
+			w.result.SkippedArchives++
+			return nil
+		}
+		for _, f := range frames {
+			parent.Errors = append(parent.Errors, f.Errors...)
+		}
+		return w.record(parent, root, err)
+	}
+
+	// 子から親の順にDirDoneを呼ぶ
+	paths := make([]string, 0, len(frames))
+	for p := range frames {
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		di, dj := strings.Count(paths[i], string(filepath.Separator)), strings.Count(paths[j], string(filepath.Separator))
+		if di != dj {
+			return di > dj
+		}
+		return paths[i] < paths[j]
+	})
+	for _, p := range paths {
+		if err := w.done(frames[p]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unchangedArchive はアーカイブが前回のスキャンから変わっていない（mtimeが同じ）場合に、
+// 前回記録した中のディレクトリをすべて変更なしとしてDirDoneに渡してtrueを返す。
+// 中のディレクトリの記録が欠けている場合は開き直す。
+func (w *walker) unchangedArchive(root string, info fs.FileInfo) (bool, error) {
+	prev, ok := w.unchanged(root, info)
+	if !ok {
+		return false, nil
+	}
+
+	var dirs []DirResult
+	var collect func(p string, state db.DirState) bool
+	collect = func(p string, state db.DirState) bool {
+		for _, sub := range state.Subdirs {
+			subPath := filepath.Join(p, sub)
+			subState, ok := w.opts.PreviousState(subPath)
+			if !ok || !collect(subPath, subState) {
+				return false
+			}
+		}
+		dirs = append(dirs, DirResult{Path: p, State: state, Unchanged: true})
+		return true
+	}
+	if !collect(root, prev) {
+		return false, nil
+	}
+
+	for _, dir := range dirs {
+		w.result.UnchangedDirs++
+		w.result.UnchangedFiles += dir.State.FileCount
+		if err := w.done(&dirFrame{DirResult: dir}); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// runArchive はアーカイブ1つだけを走査する（監視モードでアーカイブの追加・更新を検出したとき用）。
+func (w *walker) runArchive(name, displayPath string) (*ScanResult, error) {
+	info, err := w.fsys.Stat(name)
+	if err != nil {
+		w.result.Status = StatusFailed
+		return &w.result, err
+	}
+	frame := &dirFrame{}
+	err = w.archive(displayPath, info, w.opener(name), 1, frame)
+	if err != nil {
+		w.result.Status = StatusFailed
+		return &w.result, err
+	}
+	w.result.Status = StatusCompleted
+	if len(w.result.Errors) > 0 {
+		w.result.Status = StatusPartial
+	}
+	return &w.result, nil
+}
@@ -0,0 +1,281 @@
+package collector
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/koplec/sokoni/internal/db"
+	"github.com/koplec/sokoni/internal/model"
+)
+
+func zipBytes(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Date(2024, 4, 1, 9, 30, 0, 0, time.UTC)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(files[name])
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarGzBytes(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, data := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now(), Typeflag: tar.TypeReg})
+		tw.Write(data)
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// createArchiveTree は通常のPDFと、PDFを含むZIP・tar.gz（ZIPの中にさらにZIP）を置いたディレクトリを作る。
+func createArchiveTree(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	inner := zipBytes(t, map[string][]byte{"deep.pdf": []byte("deep pdf")})
+	os.MkdirAll(filepath.Join(root, "invoices"), 0755)
+	os.WriteFile(filepath.Join(root, "top.pdf"), []byte("dummy"), 0644)
+	os.WriteFile(filepath.Join(root, "invoices", "bundle.zip"), zipBytes(t, map[string][]byte{
+		"2024/inv.pdf":   []byte("invoice pdf"),
+		"2024/notes.txt": []byte("notes"),
+		"inner.zip":      inner,
+	}), 0644)
+	os.WriteFile(filepath.Join(root, "invoices", "old.tar.gz"), tarGzBytes(t, map[string][]byte{
+		"/abs/old.PDF": []byte("old pdf"),
+	}), 0644)
+	return root
+}
+
+func scanArchiveTree(t *testing.T, root string, opts ScanOptions) ([]string, []DirResult, *ScanResult) {
+	t.Helper()
+	var paths []string
+	var dirs []DirResult
+	opts.MaxErrors = -1
+	opts.DirDone = func(dir DirResult) error {
+		dirs = append(dirs, dir)
+		return nil
+	}
+	result, err := scanWith(context.Background(), root, opts, func(f model.FileInfo) error {
+		rel, _ := filepath.Rel(root, f.Path)
+		paths = append(paths, rel)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	sort.Strings(paths)
+	return paths, dirs, result
+}
+
+func TestScanArchives(t *testing.T) {
+	root := createArchiveTree(t)
+
+	tests := []struct {
+		depth int
+		want  []string
+	}{
+		{0, []string{"top.pdf"}},
+		{1, []string{"invoices/bundle.zip!/2024/inv.pdf", "invoices/old.tar.gz!/abs/old.PDF", "top.pdf"}},
+		{2, []string{"invoices/bundle.zip!/2024/inv.pdf", "invoices/bundle.zip!/inner.zip!/deep.pdf", "invoices/old.tar.gz!/abs/old.PDF", "top.pdf"}},
+	}
+	for _, tt := range tests {
+		paths, _, _ := scanArchiveTree(t, root, ScanOptions{ArchiveDepth: tt.depth})
+		if strings.Join(paths, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("depth %d: scanned %v, want %v", tt.depth, paths, tt.want)
+		}
+	}
+
+	// アーカイブの中のディレクトリも子から親の順にDirDoneに渡される
+	_, dirs, _ := scanArchiveTree(t, root, ScanOptions{ArchiveDepth: 2})
+	order := map[string]int{}
+	for i, d := range dirs {
+		rel, _ := filepath.Rel(root, d.Path)
+		order[rel] = i
+	}
+	for _, p := range []string{"invoices/bundle.zip!/inner.zip!", "invoices/bundle.zip!/2024", "invoices/bundle.zip!", "invoices"} {
+		if _, ok := order[p]; !ok {
+			t.Fatalf("DirDone not called for %s: %v", p, order)
+		}
+	}
+	if !(order["invoices/bundle.zip!/inner.zip!"] < order["invoices/bundle.zip!"] &&
+		order["invoices/bundle.zip!/2024"] < order["invoices/bundle.zip!"] &&
+		order["invoices/bundle.zip!"] < order["invoices"]) {
+		t.Errorf("DirDone order is not child-first: %v", order)
+	}
+	for _, d := range dirs {
+		if strings.HasSuffix(d.Path, "bundle.zip!") {
+			sort.Strings(d.State.Subdirs)
+			if strings.Join(d.State.Subdirs, ",") != "2024,inner.zip!" {
+				t.Errorf("unexpected subdirs of archive root: %v", d.State.Subdirs)
+			}
+		}
+	}
+}
+
+func TestScanArchiveLimits(t *testing.T) {
+	root := createArchiveTree(t)
+
+	// サイズ上限を超えるアーカイブは開かない
+	paths, _, result := scanArchiveTree(t, root, ScanOptions{ArchiveDepth: 1, ArchiveMaxSize: 64})
+	if strings.Join(paths, ",") != "top.pdf" || result.SkippedArchives != 2 {
+		t.Errorf("expected archives to be skipped, got %v (%d skipped)", paths, result.SkippedArchives)
+	}
+
+	// 壊れたアーカイブはエラーとして記録して続ける
+	os.WriteFile(filepath.Join(root, "broken.zip"), []byte("not a zip"), 0644)
+	_, _, result = scanArchiveTree(t, root, ScanOptions{ArchiveDepth: 1})
+	if result.Status != StatusPartial || len(result.Errors) != 1 || filepath.Base(result.Errors[0].Path) != "broken.zip!" {
+		t.Errorf("expected broken archive to be recorded, got %s %v", result.Status, result.Errors)
+	}
+}
+
+func TestScanArchiveIncremental(t *testing.T) {
+	root := createArchiveTree(t)
+	old := time.Now().Add(-time.Hour)
+	for _, p := range []string{"invoices/bundle.zip", "invoices/old.tar.gz", "invoices", "."} {
+		os.Chtimes(filepath.Join(root, p), old, old)
+	}
+
+	_, dirs, _ := scanArchiveTree(t, root, ScanOptions{ArchiveDepth: 2})
+	states := map[string]db.DirState{}
+	for _, d := range dirs {
+		states[d.Path] = d.State
+	}
+	previous := func(p string) (db.DirState, bool) {
+		s, ok := states[p]
+		return s, ok
+	}
+
+	// 変わっていないアーカイブは開かずに、中のディレクトリを変更なしとして渡す
+	paths, dirs, result := scanArchiveTree(t, root, ScanOptions{ArchiveDepth: 2, PreviousState: previous})
+	if strings.Join(paths, ",") != "top.pdf" {
+		t.Errorf("expected only top-level files to be rescanned, got %v", paths)
+	}
+	unchanged := map[string]bool{}
+	for _, d := range dirs {
+		if d.Unchanged {
+			rel, _ := filepath.Rel(root, d.Path)
+			unchanged[rel] = true
+		}
+	}
+	for _, p := range []string{"invoices", "invoices/bundle.zip!", "invoices/bundle.zip!/2024", "invoices/bundle.zip!/inner.zip!", "invoices/old.tar.gz!/abs"} {
+		if !unchanged[p] {
+			t.Errorf("expected %s to be unchanged, got %v", p, unchanged)
+		}
+	}
+	if result.UnchangedFiles != 3 {
+		t.Errorf("expected 3 unchanged files, got %d", result.UnchangedFiles)
+	}
+
+	// 書き換えたアーカイブだけ開き直す
+	os.WriteFile(filepath.Join(root, "invoices", "bundle.zip"), zipBytes(t, map[string][]byte{"new.pdf": []byte("new")}), 0644)
+	paths, _, _ = scanArchiveTree(t, root, ScanOptions{ArchiveDepth: 2, PreviousState: previous})
+	if strings.Join(paths, ",") != "invoices/bundle.zip!/new.pdf,top.pdf" {
+		t.Errorf("expected modified archive to be reread, got %v", paths)
+	}
+}
+
+func TestOpenFileInArchive(t *testing.T) {
+	root := createArchiveTree(t)
+	connection := &db.Connection{RemotePath: root, BasePath: root}
+
+	tests := map[string]string{
+		"top.pdf":                                  "dummy",
+		"invoices/bundle.zip!/2024/inv.pdf":        "invoice pdf",
+		"invoices/bundle.zip!/inner.zip!/deep.pdf": "deep pdf",
+		"invoices/old.tar.gz!/abs/old.PDF":         "old pdf",
+	}
+	for rel, want := range tests {
+		rc, err := OpenFile(context.Background(), connection, filepath.Join(root, rel))
+		if err != nil {
+			t.Errorf("OpenFile(%s): %v", rel, err)
+			continue
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(data) != want {
+			t.Errorf("OpenFile(%s) = %q, want %q", rel, data, want)
+		}
+	}
+
+	for _, rel := range []string{"invoices/bundle.zip!/missing.pdf", "../outside.pdf"} {
+		if _, err := OpenFile(context.Background(), connection, filepath.Join(root, rel)); err == nil {
+			t.Errorf("OpenFile(%s) expected error", rel)
+		}
+	}
+}
+
+func TestScanArchiveWebDAV(t *testing.T) {
+	root := createArchiveTree(t)
+	server := startWebDAVServer(t, root, func(*http.Request) bool { return true })
+	connection := &db.Connection{RemotePath: server.URL + "/dav/"}
+
+	var paths []string
+	_, err := ScanConnectionWith(context.Background(), connection, ScanOptions{MaxErrors: -1, ArchiveDepth: 2}, func(f model.FileInfo) error {
+		paths = append(paths, f.Path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	sort.Strings(paths)
+	want := "invoices/bundle.zip!/2024/inv.pdf,invoices/bundle.zip!/inner.zip!/deep.pdf,invoices/old.tar.gz!/abs/old.PDF,top.pdf"
+	if strings.Join(paths, ",") != want {
+		t.Errorf("scanned %v, want %s", paths, want)
+	}
+
+	rc, err := OpenFile(context.Background(), connection, "invoices/bundle.zip!/inner.zip!/deep.pdf")
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	defer rc.Close()
+	if data, _ := io.ReadAll(rc); string(data) != "deep pdf" {
+		t.Errorf("unexpected contents %q", data)
+	}
+}
+
+func TestSplitArchivePath(t *testing.T) {
+	tests := []struct {
+		path    string
+		outer   string
+		members []string
+	}{
+		{"a/b.pdf", "a/b.pdf", nil},
+		{"a/bundle.zip!/2024/inv.pdf", "a/bundle.zip", []string{"2024/inv.pdf"}},
+		{"a/outer.ZIP!/x/inner.tgz!/deep.pdf", "a/outer.ZIP", []string{"x/inner.tgz", "deep.pdf"}},
+		{"wow!/bundle.zip!/a.pdf", "wow!/bundle.zip", []string{"a.pdf"}},
+	}
+	for _, tt := range tests {
+		outer, members := splitArchivePath(tt.path)
+		if outer != tt.outer || strings.Join(members, "|") != strings.Join(tt.members, "|") {
+			t.Errorf("splitArchivePath(%q) = %q, %v", tt.path, outer, members)
+		}
+	}
+}
@@ -1,15 +1,17 @@
 package collector
 
 import (
+	"context"
 	"fmt"
-	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
-	"github.com/hirochachacha/go-smb2"
 	"github.com/koplec/sokoni/internal/db"
 	"github.com/koplec/sokoni/internal/model"
+	"github.com/koplec/sokoni/internal/schedule"
 )
 
 func Scan(root string) ([]model.FileInfo, error) {
@@ -49,55 +51,198 @@ func Scan(root string) ([]model.FileInfo, error) {
 	return files, nil
 }
 
-func scanWith(root string, handle func(model.FileInfo) error) error {
-	return filepath.WalkDir(root, func(path string, f os.DirEntry, err error) error {
+func scanWith(ctx context.Context, root string, opts ScanOptions, handle func(model.FileInfo) error) (*ScanResult, error) {
+	return newWalker(ctx, localFS{}, opts, handle).run(root, root)
+}
+
+// ScanConnectionWith はconnectionの種類に応じてローカルまたはリモートの接続先を走査し、
+// 見つかったPDFファイルをhandleに渡す。
+// 読み取れないエントリはScanResult.Errorsに記録して走査を続ける。
+// エラー数がopts.MaxErrorsを超えた場合やhandleがエラーを返した場合は中断し、
+// Status=StatusFailedの結果とエラーを返す。
+//
+// ctxのキャンセル、またはopts.Timeout（リモート接続ではoptionsのscan_timeoutが優先）の経過でも中断する。
+func ScanConnectionWith(ctx context.Context, connection *db.Connection, opts ScanOptions, handle func(model.FileInfo) error) (*ScanResult, error) {
+	failed := &ScanResult{Status: StatusFailed}
+
+	timeout := opts.Timeout
+	if !IsLocalPath(connection.RemotePath) {
+		scanTimeout, _, err := remoteOptions(connection)
 		if err != nil {
-			return err
+			return failed, err
+		}
+		if scanTimeout > 0 {
+			timeout = scanTimeout
 		}
+	}
+	ctx, cancel := withScanTimeout(ctx, timeout)
+	defer cancel()
 
-		// ここでnilを返しても再帰は続く
-		if f.IsDir() {
-			return nil
+	src, err := openSource(ctx, connection)
+	if err != nil {
+		return failed, err
+	}
+	defer src.Close()
+
+	return newWalker(ctx, src.fsys, opts, handle).run(src.root, src.displayRoot)
+}
+
+// defaultWatchInterval は監視モードでwatch_intervalが未指定のときのリモート接続の確認間隔。
+// リモートの監視は変更通知ではなくポーリング（ディレクトリの一覧し直し）なので、NASの負荷を考えて長めにしている。
+const defaultWatchInterval = 15 * time.Minute
+
+// WatchInterval はリモートのconnectionを監視モードで確認する間隔（optionsのwatch_interval）を返す。
+func WatchInterval(connection *db.Connection) (time.Duration, error) {
+	_, interval, err := remoteOptions(connection)
+	return interval, err
+}
+
+// remoteOptions はリモート接続のoptionsからスキャン期限（scan_timeout、未指定は0）と
+// 監視モードの確認間隔を取り出す。
+func remoteOptions(connection *db.Connection) (scanTimeout, pollInterval time.Duration, err error) {
+	options := getStringValue(connection.Options)
+	switch {
+	case IsSFTPPath(connection.RemotePath):
+		cfg, err := ParseSFTPOptions(options)
+		if err != nil {
+			return 0, 0, err
+		}
+		return cfg.ScanTimeout, cfg.PollInterval(), nil
+	case IsWebDAVPath(connection.RemotePath):
+		cfg, err := ParseWebDAVOptions(options)
+		if err != nil {
+			return 0, 0, err
+		}
+		return cfg.ScanTimeout, cfg.PollInterval(), nil
+	case IsS3Path(connection.RemotePath):
+		cfg, err := ParseS3Options(options)
+		if err != nil {
+			return 0, 0, err
+		}
+		return cfg.ScanTimeout, cfg.PollInterval(), nil
+	case IsFTPPath(connection.RemotePath):
+		cfg, err := ParseFTPOptions(options)
+		if err != nil {
+			return 0, 0, err
 		}
+		return cfg.ScanTimeout, cfg.PollInterval(), nil
+	}
+	cfg, err := ParseSMBOptions(options)
+	if err != nil {
+		return 0, 0, err
+	}
+	return cfg.ScanTimeout, cfg.PollInterval(), nil
+}
 
-		// .pdfのみ対象
-		if strings.HasSuffix(strings.ToLower(f.Name()), ".pdf") {
-			info, err := f.Info()
-			if err != nil {
-				return err
-			}
+// IsLocalPath はconnectionがローカル（マウント済み）のパスを走査するかどうかを返す。
+func IsLocalPath(remotePath string) bool {
+	return !IsSMBPath(remotePath) && !IsSFTPPath(remotePath) && !IsWebDAVPath(remotePath) && !IsS3Path(remotePath) && !IsFTPPath(remotePath)
+}
 
-			file := model.FileInfo{
-				Path:    path,
-				Name:    f.Name(),
-				Size:    info.Size(),
-				ModTime: info.ModTime(),
+// Host はconnectionの接続先のホスト名を返す。同じNASへの同時スキャン数を制限するために使う。
+// ローカル（マウント済み）のパスはまとめて "localhost"、S3はエンドポイントのホスト（未指定ならバケットごと）とする。
+func Host(connection *db.Connection) string {
+	remotePath := connection.RemotePath
+	switch {
+	case IsSMBPath(remotePath):
+		server, _, _ := strings.Cut(strings.TrimPrefix(remotePath, "//"), "/")
+		return strings.ToLower(server)
+	case IsS3Path(remotePath):
+		if cfg, err := ParseS3Options(getStringValue(connection.Options)); err == nil && cfg.Endpoint != "" {
+			if u, err := url.Parse(cfg.Endpoint); err == nil && u.Hostname() != "" {
+				return strings.ToLower(u.Hostname())
 			}
+		}
+		bucket, _, _ := parseS3URL(remotePath)
+		return "s3://" + bucket
+	case IsSFTPPath(remotePath) || IsWebDAVPath(remotePath) || IsFTPPath(remotePath):
+		if u, err := url.Parse(remotePath); err == nil && u.Hostname() != "" {
+			return strings.ToLower(u.Hostname())
+		}
+	}
+	return "localhost"
+}
 
-			if err := handle(file); err != nil {
+// ValidateConnection はconnection作成・更新時に接続種別ごとの設定を検証する。
+// - SMB: optionsを解析できること
+// - SFTP: URL・options・ホスト鍵・秘密鍵を解析できること
+// - WebDAV: URL・optionsを解析でき、bearer認証ではトークン（password）があること
+// - S3: URL・optionsを解析でき、アクセスキーとシークレットキーが揃っていること
+// - FTP: URL・optionsを解析できること
+//
+// 接続種別によらず、スケジュール（cron式）と停止時間帯、負荷の上限（throttle）も解析できることを確認する。
+func ValidateConnection(req db.CreateConnectionRequest) error {
+	if _, err := schedule.Parse(getStringValue(req.Schedule), 0, getStringValue(req.BlackoutWindows)); err != nil {
+		return err
+	}
+	if _, err := ParseThrottle(getStringValue(req.Throttle)); err != nil {
+		return err
+	}
+
+	options := getStringValue(req.Options)
+	switch {
+	case IsSMBPath(req.RemotePath):
+		_, err := ParseSMBOptions(options)
+		return err
+	case IsSFTPPath(req.RemotePath):
+		if _, _, err := parseSFTPURL(req.RemotePath); err != nil {
+			return err
+		}
+		if _, err := ParseSFTPOptions(options); err != nil {
+			return err
+		}
+		if req.HostKey != nil && strings.TrimSpace(*req.HostKey) != "" {
+			if _, _, err := parseHostKey(*req.HostKey); err != nil {
 				return err
 			}
 		}
-
-		return nil
-	})
+		_, err := sftpAuthMethods(req.PrivateKey, req.Password)
+		return err
+	case IsWebDAVPath(req.RemotePath):
+		if _, err := parseWebDAVURL(req.RemotePath); err != nil {
+			return err
+		}
+		cfg, err := ParseWebDAVOptions(options)
+		if err != nil {
+			return err
+		}
+		if cfg.Auth == WebDAVAuthBearer && getStringValue(req.Password) == "" {
+			return fmt.Errorf("WebDAV bearer authentication requires a token in the password field")
+		}
+	case IsS3Path(req.RemotePath):
+		if _, _, err := parseS3URL(req.RemotePath); err != nil {
+			return err
+		}
+		if _, err := ParseS3Options(options); err != nil {
+			return err
+		}
+		// 匿名アクセス（両方空）は許可する
+		if (getStringValue(req.Username) == "") != (getStringValue(req.Password) == "") {
+			return fmt.Errorf("S3 connection requires both access key (username) and secret key (password)")
+		}
+	case IsFTPPath(req.RemotePath):
+		if _, _, _, err := parseFTPURL(req.RemotePath); err != nil {
+			return err
+		}
+		_, err := ParseFTPOptions(options)
+		return err
+	}
+	return nil
 }
 
-func ScanConnectionWith(connection *db.Connection, handle func(model.FileInfo) error) error {
-	// ローカルパスの場合は既存のscanWithを使用
-	if !strings.HasPrefix(connection.RemotePath, "//") {
-		return scanWith(connection.BasePath, handle)
+func withScanTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
 	}
-
-	// SMB/CIFSパスの場合はSMB接続
-	return scanSMBWith(connection, handle)
+	return context.WithTimeout(ctx, timeout)
 }
 
-func scanSMBWith(connection *db.Connection, handle func(model.FileInfo) error) error {
+// openSMBSource はSMBの共有にマウントする。パスは共有内の相対パスで記録する。
+func openSMBSource(ctx context.Context, connection *db.Connection) (*source, error) {
 	// SMBパスを解析: //server/share/path
 	parts := strings.Split(strings.TrimPrefix(connection.RemotePath, "//"), "/")
 	if len(parts) < 2 {
-		return fmt.Errorf("invalid SMB path: %s", connection.RemotePath)
+		return nil, fmt.Errorf("invalid SMB path: %s", connection.RemotePath)
 	}
 
 	server := parts[0]
@@ -107,68 +252,45 @@ func scanSMBWith(connection *db.Connection, handle func(model.FileInfo) error) e
 		remotePath = strings.Join(parts[2:], "/")
 	}
 
-	// SMB接続を確立
-	conn, err := net.Dial("tcp", server+":445")
+	cfg, err := ParseSMBOptions(getStringValue(connection.Options))
 	if err != nil {
-		return fmt.Errorf("failed to connect to SMB server: %w", err)
-	}
-	defer conn.Close()
-
-	d := &smb2.Dialer{
-		Initiator: &smb2.NTLMInitiator{
-			User:     getStringValue(connection.Username),
-			Password: getStringValue(connection.Password),
-		},
+		return nil, err
 	}
 
-	s, err := d.Dial(conn)
+	// SMB接続を確立
+	s, err := dialSMB(ctx, server, cfg, getStringValue(connection.Username), getStringValue(connection.Password))
 	if err != nil {
-		return fmt.Errorf("failed to authenticate SMB: %w", err)
+		return nil, err
 	}
-	defer s.Logoff()
 
 	// 共有にマウント
 	fs, err := s.Mount(share)
 	if err != nil {
-		return fmt.Errorf("failed to mount share: %w", err)
-	}
-	defer fs.Umount()
-
-	// ディレクトリを再帰的にスキャン
-	return walkSMBDir(fs, remotePath, "", handle)
-}
-
-func walkSMBDir(fs *smb2.Share, dirPath, basePath string, handle func(model.FileInfo) error) error {
-	entries, err := fs.ReadDir(dirPath)
-	if err != nil {
-		return fmt.Errorf("failed to read directory %s: %w", dirPath, err)
+		s.Close()
+		return nil, fmt.Errorf("failed to mount share: %w", err)
 	}
-
-	for _, entry := range entries {
-		fullPath := filepath.Join(basePath, entry.Name())
-		if entry.IsDir() {
-			// ディレクトリの場合は再帰
-			subDirPath := filepath.Join(dirPath, entry.Name())
-			if err := walkSMBDir(fs, subDirPath, fullPath, handle); err != nil {
-				return err
-			}
-		} else if strings.HasSuffix(strings.ToLower(entry.Name()), ".pdf") {
-			// PDFファイルの場合は処理
-			info := entry.Sys().(*smb2.FileStat)
-			file := model.FileInfo{
-				Path:    fullPath,
-				Name:    entry.Name(),
-				Size:    info.Size(),
-				ModTime: info.ModTime(),
-			}
-
-			if err := handle(file); err != nil {
-				return err
-			}
+	// sealは暗号化を求めるだけでは足りないので、サーバーが暗号化しない共有と、暗号化されているか分からない共有の内容は読まない
+	if cfg.RequireEncryption {
+		encrypted, err := smbEncrypted(fs)
+		if err == nil && !encrypted {
+			err = fmt.Errorf("share is not encrypted: seal requires the server to encrypt the session or share")
+		}
+		if err != nil {
+			fs.Umount()
+			s.Close()
+			return nil, fmt.Errorf("refusing SMB share %s: %w", share, err)
 		}
 	}
 
-	return nil
+	return &source{
+		fsys:        smbFS{share: fs},
+		root:        remotePath,
+		displayRoot: ".",
+		close: func() {
+			fs.Umount()
+			s.Close()
+		},
+	}, nil
 }
 
 func getStringValue(s *string) string {
@@ -1,11 +1,16 @@
 package collector
 
 import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/koplec/sokoni/internal/db"
 	"github.com/koplec/sokoni/internal/model"
 )
 
@@ -60,11 +65,15 @@ func TestScanWithPDFs(t *testing.T) {
 		return nil
 	}
 
-	err := scanWith(dir, handle)
+	result, err := scanWith(context.Background(), dir, DefaultScanOptions(), handle)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
+	if result.Status != StatusCompleted {
+		t.Errorf("expected status %s, got %s", StatusCompleted, result.Status)
+	}
+
 	if len(called) != 1 {
 		t.Errorf("expected 1 file to be handled, got %d", len(called))
 	}
@@ -73,3 +82,327 @@ func TestScanWithPDFs(t *testing.T) {
 		t.Errorf("unexpected file handled: %s", called[0])
 	}
 }
+
+// fakeFS はディレクトリごとのエントリとエラーを返すテスト用のdirReader
+type fakeFS struct {
+	dirs   map[string][]fs.DirEntry
+	errors map[string]error
+	mods   map[string]time.Time // Statで返すディレクトリのmtime
+}
+
+func (f fakeFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err, ok := f.errors[name]; ok {
+		return nil, err
+	}
+	return f.dirs[name], nil
+}
+
+func (f fakeFS) Stat(name string) (fs.FileInfo, error) {
+	if err, ok := f.errors[name]; ok {
+		return nil, err
+	}
+	if _, ok := f.dirs[name]; ok {
+		return fakeEntry{name: filepath.Base(name), isDir: true, mod: f.mods[name]}, nil
+	}
+	return nil, fs.ErrNotExist
+}
+
+func (f fakeFS) Open(name string) (io.ReadCloser, error) {
+	return nil, fs.ErrPermission
+}
+
+type fakeEntry struct {
+	name  string
+	isDir bool
+	mod   time.Time
+}
+
+func (e fakeEntry) Name() string               { return e.name }
+func (e fakeEntry) IsDir() bool                { return e.isDir }
+func (e fakeEntry) Type() fs.FileMode          { return e.Mode().Type() }
+func (e fakeEntry) Info() (fs.FileInfo, error) { return e, nil }
+func (e fakeEntry) Size() int64                { return 5 }
+func (e fakeEntry) ModTime() time.Time         { return e.mod }
+func (e fakeEntry) Sys() any                   { return nil }
+func (e fakeEntry) Mode() fs.FileMode {
+	if e.isDir {
+		return fs.ModeDir
+	}
+	return 0
+}
+
+func newDeniedFS() fakeFS {
+	return fakeFS{
+		dirs: map[string][]fs.DirEntry{
+			"root": {
+				fakeEntry{name: "a.pdf"},
+				fakeEntry{name: "denied1", isDir: true},
+				fakeEntry{name: "denied2", isDir: true},
+				fakeEntry{name: "ok", isDir: true},
+			},
+			"root/ok": {fakeEntry{name: "b.pdf"}},
+		},
+		errors: map[string]error{
+			"root/denied1": fs.ErrPermission,
+			"root/denied2": fs.ErrPermission,
+		},
+	}
+}
+
+func TestWalkSkipsUnreadableDirectories(t *testing.T) {
+	var called []string
+	handle := func(file model.FileInfo) error {
+		called = append(called, file.Path)
+		return nil
+	}
+
+	result, err := newWalker(context.Background(), newDeniedFS(), ScanOptions{MaxErrors: 10}, handle).run("root", "root")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if result.Status != StatusPartial {
+		t.Errorf("expected status %s, got %s", StatusPartial, result.Status)
+	}
+	if len(called) != 2 || result.Files != 2 {
+		t.Errorf("expected 2 files to be handled, got %v (Files=%d)", called, result.Files)
+	}
+	if len(result.Errors) != 2 {
+		t.Fatalf("expected 2 recorded errors, got %d", len(result.Errors))
+	}
+	if result.Errors[0].Path != "root/denied1" || !errors.Is(result.Errors[0], fs.ErrPermission) {
+		t.Errorf("unexpected recorded error: %v", result.Errors[0])
+	}
+}
+
+func TestWalkFailsWhenErrorBudgetExceeded(t *testing.T) {
+	handle := func(file model.FileInfo) error { return nil }
+
+	result, err := newWalker(context.Background(), newDeniedFS(), ScanOptions{MaxErrors: 1}, handle).run("root", "root")
+	if !errors.Is(err, ErrTooManyErrors) {
+		t.Fatalf("expected ErrTooManyErrors, got %v", err)
+	}
+	if result.Status != StatusFailed {
+		t.Errorf("expected status %s, got %s", StatusFailed, result.Status)
+	}
+}
+
+func TestWalkFailsWhenRootUnreadable(t *testing.T) {
+	fsys := fakeFS{errors: map[string]error{"root": fs.ErrPermission}}
+
+	result, err := newWalker(context.Background(), fsys, ScanOptions{MaxErrors: -1}, func(model.FileInfo) error { return nil }).run("root", "root")
+	if err == nil {
+		t.Fatal("expected error for unreadable root")
+	}
+	if result.Status != StatusFailed || len(result.Errors) != 0 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+}
+
+func TestScanConnectionWithCancelled(t *testing.T) {
+	dir := setupTestDir(t)
+	connection := &db.Connection{BasePath: dir, RemotePath: dir}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	result, err := ScanConnectionWith(ctx, connection, DefaultScanOptions(), func(model.FileInfo) error { return nil })
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if result.Status != StatusFailed {
+		t.Errorf("expected status %s, got %s", StatusFailed, result.Status)
+	}
+}
+
+func TestWalkCheckpointHooks(t *testing.T) {
+	fsys := newDeniedFS()
+	fsys.dirs["root"] = append(fsys.dirs["root"], fakeEntry{name: "done", isDir: true})
+	fsys.dirs["root/done"] = []fs.DirEntry{fakeEntry{name: "c.pdf"}}
+
+	var doneDirs []DirResult
+	opts := ScanOptions{
+		MaxErrors: -1,
+		SkipDir:   func(path string) bool { return path == "root/done" },
+		DirDone: func(dir DirResult) error {
+			doneDirs = append(doneDirs, dir)
+			return nil
+		},
+	}
+
+	result, err := newWalker(context.Background(), fsys, opts, func(model.FileInfo) error { return nil }).run("root", "root/")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.SkippedDirs != 1 || result.Files != 2 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	// 子から親の順に、読めなかったディレクトリを除いて通知される
+	if len(doneDirs) != 2 || doneDirs[0].Path != "root/ok" || doneDirs[1].Path != "root" {
+		t.Fatalf("unexpected DirDone calls: %+v", doneDirs)
+	}
+	if len(doneDirs[0].Files) != 1 || doneDirs[0].Files[0] != "root/ok/b.pdf" {
+		t.Errorf("unexpected files for root/ok: %v", doneDirs[0].Files)
+	}
+	// 読めなかった子ディレクトリのエラーは親に記録される
+	if len(doneDirs[1].Errors) != 2 {
+		t.Errorf("expected 2 errors on root, got %v", doneDirs[1].Errors)
+	}
+}
+
+func TestWalkIncrementalSkipsUnchangedDirectories(t *testing.T) {
+	old := time.Now().Add(-time.Hour)
+	changed := time.Now().Add(-time.Minute)
+	fsys := fakeFS{
+		dirs: map[string][]fs.DirEntry{
+			"root": {
+				fakeEntry{name: "same", isDir: true, mod: old},
+				fakeEntry{name: "changed", isDir: true, mod: changed},
+			},
+			"root/same":      {fakeEntry{name: "a.pdf"}, fakeEntry{name: "deep", isDir: true, mod: old}},
+			"root/same/deep": {fakeEntry{name: "new.pdf"}},
+			"root/changed":   {fakeEntry{name: "b.pdf"}},
+		},
+		mods: map[string]time.Time{"root/same/deep": changed},
+	}
+
+	previous := map[string]db.DirState{
+		"root/same":      {ModTime: old, FileCount: 1, Subdirs: []string{"deep"}, ListedAt: old.Add(time.Minute)},
+		"root/same/deep": {ModTime: old, ListedAt: old.Add(time.Minute)},
+		"root/changed":   {ModTime: old, FileCount: 1, ListedAt: old.Add(time.Minute)},
+	}
+
+	var called []string
+	var unchanged []string
+	opts := ScanOptions{
+		MaxErrors: -1,
+		PreviousState: func(path string) (db.DirState, bool) {
+			state, ok := previous[path]
+			return state, ok
+		},
+		DirDone: func(dir DirResult) error {
+			if dir.Unchanged {
+				unchanged = append(unchanged, dir.Path)
+			}
+			return nil
+		},
+	}
+	handle := func(file model.FileInfo) error {
+		called = append(called, file.Path)
+		return nil
+	}
+
+	result, err := newWalker(context.Background(), fsys, opts, handle).run("root", "root")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// root/same は一覧を取らず、mtimeの変わった root/same/deep と root/changed だけを走査する
+	if len(called) != 2 || called[0] != "root/same/deep/new.pdf" || called[1] != "root/changed/b.pdf" {
+		t.Errorf("unexpected files handled: %v", called)
+	}
+	if result.UnchangedDirs != 1 || result.UnchangedFiles != 1 {
+		t.Errorf("expected 1 unchanged dir with 1 file, got %d dirs, %d files", result.UnchangedDirs, result.UnchangedFiles)
+	}
+	if len(unchanged) != 1 || unchanged[0] != "root/same" {
+		t.Errorf("unexpected unchanged dirs: %v", unchanged)
+	}
+}
+
+// countedEntry は直下のエントリ数を返せるディレクトリ（WebDAVのchildcount等）。
+type countedEntry struct {
+	fakeEntry
+	entries int
+}
+
+func (e countedEntry) Info() (fs.FileInfo, error) { return e, nil }
+func (e countedEntry) EntryCount() (int, bool)    { return e.entries, true }
+
+func TestWalkIncrementalComparesEntryCount(t *testing.T) {
+	old := time.Now().Add(-time.Hour)
+	fsys := fakeFS{
+		dirs: map[string][]fs.DirEntry{
+			"root": {
+				countedEntry{fakeEntry{name: "same", isDir: true, mod: old}, 1},
+				countedEntry{fakeEntry{name: "added", isDir: true, mod: old}, 2},
+			},
+			"root/same":  {fakeEntry{name: "a.pdf"}},
+			"root/added": {fakeEntry{name: "b.pdf"}, fakeEntry{name: "c.pdf"}},
+		},
+	}
+	// root/added はmtimeが同じままエントリが増えた
+	previous := map[string]db.DirState{
+		"root/same":  {ModTime: old, EntryCount: 1, FileCount: 1, ListedAt: old.Add(time.Minute)},
+		"root/added": {ModTime: old, EntryCount: 1, FileCount: 1, ListedAt: old.Add(time.Minute)},
+	}
+
+	var called []string
+	opts := ScanOptions{
+		MaxErrors: -1,
+		PreviousState: func(path string) (db.DirState, bool) {
+			state, ok := previous[path]
+			return state, ok
+		},
+	}
+	result, err := newWalker(context.Background(), fsys, opts, func(file model.FileInfo) error {
+		called = append(called, file.Path)
+		return nil
+	}).run("root", "root")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(called) != 2 || called[0] != "root/added/b.pdf" || called[1] != "root/added/c.pdf" {
+		t.Errorf("expected only the directory with a different entry count to be listed, got %v", called)
+	}
+	if result.UnchangedDirs != 1 {
+		t.Errorf("expected 1 unchanged dir, got %d", result.UnchangedDirs)
+	}
+}
+
+func TestWalkFullScanRecordsSubdirectoryModTimes(t *testing.T) {
+	mod := time.Now().Add(-time.Hour)
+	fsys := fakeFS{
+		dirs: map[string][]fs.DirEntry{
+			"root":     {fakeEntry{name: "sub", isDir: true, mod: mod}},
+			"root/sub": {fakeEntry{name: "a.pdf"}},
+		},
+	}
+
+	// フルスキャン（PreviousStateなし）でも、次の差分スキャンのためにmtimeを記録する
+	states := map[string]db.DirState{}
+	opts := ScanOptions{
+		MaxErrors: -1,
+		DirDone: func(dir DirResult) error {
+			states[dir.Path] = dir.State
+			return nil
+		},
+	}
+	if _, err := newWalker(context.Background(), fsys, opts, func(model.FileInfo) error { return nil }).run("root", "root"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !states["root/sub"].ModTime.Equal(mod) {
+		t.Errorf("expected root/sub mtime %v to be recorded, got %v", mod, states["root/sub"].ModTime)
+	}
+}
+
+func TestHost(t *testing.T) {
+	options := "endpoint=http://MinIO.local:9000"
+	tests := []struct {
+		connection db.Connection
+		want       string
+	}{
+		{db.Connection{RemotePath: "//NAS01/share/scans"}, "nas01"},
+		{db.Connection{RemotePath: "sftp://user@files.example.com:2222/data"}, "files.example.com"},
+		{db.Connection{RemotePath: "https://cloud.example.com/remote.php/dav/files/user/"}, "cloud.example.com"},
+		{db.Connection{RemotePath: "ftps://copier.local/scan"}, "copier.local"},
+		{db.Connection{RemotePath: "s3://archive/scans/", Options: &options}, "minio.local"},
+		{db.Connection{RemotePath: "s3://archive/scans/"}, "s3://archive"},
+		{db.Connection{RemotePath: "/mnt/nas"}, "localhost"},
+	}
+	for _, tt := range tests {
+		if got := Host(&tt.connection); got != tt.want {
+			t.Errorf("Host(%s) = %q, want %q", tt.connection.RemotePath, got, tt.want)
+		}
+	}
+}
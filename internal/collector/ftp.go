@@ -0,0 +1,381 @@
+package collector
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+	"github.com/koplec/sokoni/internal/db"
+)
+
+const (
+	defaultFTPPort        = "21"
+	defaultFTPDialTimeout = 10 * time.Second
+)
+
+// FTPConfig はFTP/FTPS接続のconnections.optionsから読み取った設定。
+type FTPConfig struct {
+	DialTimeout    time.Duration
+	ScanTimeout    time.Duration // 0の場合はScanOptions.Timeoutを使う
+	WatchInterval  time.Duration // 監視モードの確認間隔。0の場合は既定（1分）
+	DisableMLSD    bool          // MLSDを使わず常にLISTで一覧する
+	DisableEPSV    bool          // EPSVを使わずPASVでデータ接続を開く
+	TLSFingerprint string        // FTPSで受け入れるサーバー証明書のSHA-256（16進）。空の場合は通常の証明書検証
+}
+
+// ParseFTPOptions はFTP接続のオプション文字列（例: "mlsd=off,epsv=off,dial_timeout=30s"）を解析する。
+//
+// 対応するオプション:
+// - dial_timeout=D      : 接続のタイムアウト
+// - scan_timeout=D      : この接続のスキャン全体の期限
+// - watch_interval=D    : 監視モードで変更を確認する間隔
+// - mlsd=auto|off       : autoはサーバーがMLSTに対応していればMLSD、offは常にLIST
+// - epsv=auto|off       : offはEPSVを使わずPASVだけを使う（NAT越しの古い機器向け）
+// - tls_fingerprint=HEX : FTPSのサーバー証明書をSHA-256で固定する（自己署名証明書の複合機向け）
+func ParseFTPOptions(options string) (*FTPConfig, error) {
+	cfg := &FTPConfig{DialTimeout: defaultFTPDialTimeout}
+
+	for _, opt := range strings.Split(options, ",") {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(opt, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "dial_timeout", "scan_timeout", "watch_interval":
+			d, err := parseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid FTP option %q: must be a positive duration", opt)
+			}
+			switch key {
+			case "dial_timeout":
+				cfg.DialTimeout = d
+			case "scan_timeout":
+				cfg.ScanTimeout = d
+			default:
+				cfg.WatchInterval = d
+			}
+		case "mlsd", "epsv":
+			var off bool
+			switch strings.ToLower(value) {
+			case "auto":
+			case "off":
+				off = true
+			default:
+				return nil, fmt.Errorf("invalid FTP option %q: must be auto or off", opt)
+			}
+			if key == "mlsd" {
+				cfg.DisableMLSD = off
+			} else {
+				cfg.DisableEPSV = off
+			}
+		case "tls_fingerprint":
+			fingerprint, err := parseCertFingerprint(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid FTP option %q: %w", opt, err)
+			}
+			cfg.TLSFingerprint = fingerprint
+		default:
+			return nil, fmt.Errorf("unknown FTP option %q", key)
+		}
+	}
+	return cfg, nil
+}
+
+// PollInterval は監視モードで変更を確認する間隔を返す。
+func (c *FTPConfig) PollInterval() time.Duration {
+	if c.WatchInterval > 0 {
+		return c.WatchInterval
+	}
+	return defaultWatchInterval
+}
+
+// parseCertFingerprint は証明書のSHA-256フィンガープリント（コロン区切りも可）を小文字の16進に正規化する。
+func parseCertFingerprint(value string) (string, error) {
+	fingerprint := strings.ToLower(strings.ReplaceAll(value, ":", ""))
+	if b, err := hex.DecodeString(fingerprint); err != nil || len(b) != sha256.Size {
+		return "", errors.New("must be a SHA-256 fingerprint in hex")
+	}
+	return fingerprint, nil
+}
+
+// IsFTPPath はremote_pathがFTPのURL（ftp://またはftps://）かどうかを返す。
+func IsFTPPath(remotePath string) bool {
+	lower := strings.ToLower(remotePath)
+	return strings.HasPrefix(lower, "ftp://") || strings.HasPrefix(lower, "ftps://")
+}
+
+// parseFTPURL はftp(s)://host:port/pathを接続先アドレスと走査するディレクトリに分ける。
+// ftps://は明示的TLS（AUTH TLS）で接続する。パスを省略した場合はログインディレクトリを走査する。
+func parseFTPURL(remotePath string) (addr, dir string, explicitTLS bool, err error) {
+	u, err := url.Parse(remotePath)
+	if err != nil || !IsFTPPath(remotePath) || u.Hostname() == "" {
+		return "", "", false, fmt.Errorf("invalid FTP path: %s", remotePath)
+	}
+	if u.User != nil {
+		return "", "", false, fmt.Errorf("invalid FTP path %s: set credentials in the username/password fields", remotePath)
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultFTPPort
+	}
+	dir = u.Path
+	if dir == "" {
+		dir = "."
+	}
+	return net.JoinHostPort(u.Hostname(), port), dir, strings.EqualFold(u.Scheme, "ftps"), nil
+}
+
+// ftpTLSConfig はFTPSの制御・データ接続で使うTLS設定を作る。
+// 多くのFTPSサーバーはデータ接続で制御接続のTLSセッションの再利用を求めるため、セッションキャッシュを持たせる。
+func ftpTLSConfig(host string, cfg *FTPConfig) *tls.Config {
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	if cfg.TLSFingerprint != "" {
+		// 固定した証明書だけを受け入れるので、CAによる検証は行わない
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("FTPS server presented no certificate")
+			}
+			got := certFingerprint(cs.PeerCertificates[0])
+			if got != cfg.TLSFingerprint {
+				return fmt.Errorf("FTPS certificate mismatch: got %s, pinned %s", got, cfg.TLSFingerprint)
+			}
+			return nil
+		}
+	}
+	return tlsConfig
+}
+
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// ftpDialer はFTPサーバーへのログイン済みの制御接続を開く。
+// MLSDに失敗したときはMLSDを無効にして開き直すため、接続設定をまとめて持つ。
+type ftpDialer struct {
+	ctx         context.Context
+	addr        string
+	explicitTLS bool
+	cfg         *FTPConfig
+	user        string
+	password    string
+}
+
+func (d *ftpDialer) dial(disableMLSD bool) (*ftp.ServerConn, error) {
+	options := []ftp.DialOption{
+		ftp.DialWithContext(d.ctx),
+		ftp.DialWithTimeout(d.cfg.DialTimeout),
+		ftp.DialWithDisabledMLSD(disableMLSD),
+		ftp.DialWithDisabledEPSV(d.cfg.DisableEPSV),
+	}
+	if d.explicitTLS {
+		host, _, _ := net.SplitHostPort(d.addr)
+		options = append(options, ftp.DialWithExplicitTLS(ftpTLSConfig(host, d.cfg)))
+	}
+
+	c, err := ftp.Dial(d.addr, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to FTP server: %w", err)
+	}
+
+	user, password := d.user, d.password
+	if user == "" {
+		user, password = "anonymous", "anonymous"
+	}
+	if err := c.Login(user, password); err != nil {
+		c.Quit()
+		return nil, fmt.Errorf("failed to log in to FTP server: %w", err)
+	}
+	return c, nil
+}
+
+// ftpFileInfo はMLSD/LISTの結果1件分のfs.FileInfo。
+type ftpFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (i *ftpFileInfo) Name() string       { return i.name }
+func (i *ftpFileInfo) Size() int64        { return i.size }
+func (i *ftpFileInfo) ModTime() time.Time { return i.modTime }
+func (i *ftpFileInfo) IsDir() bool        { return i.isDir }
+func (i *ftpFileInfo) Sys() any           { return nil }
+
+func (i *ftpFileInfo) Mode() fs.FileMode {
+	if i.isDir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+// ftpFS はFTPの制御接続1本でディレクトリを一覧するdirReader。
+// jlaffaye/ftpの接続は同時に1つのデータ転送しか扱えないが、walkerは逐次に呼ぶので問題ない。
+type ftpFS struct {
+	dialer *ftpDialer
+	conn   *ftp.ServerConn
+	// サーバーがMLSTを宣言していてもMLSDが失敗した場合、LISTに切り替えて開き直す
+	listFallback bool
+}
+
+func (f *ftpFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	list, err := f.conn.List(name)
+	if err != nil && f.conn.IsTimePreciseInList() && isFTPNotImplemented(err) && !f.listFallback {
+		log.Printf("FTP server rejected MLSD (%v), falling back to LIST", err)
+		if err := f.reconnect(true); err != nil {
+			return nil, err
+		}
+		list, err = f.conn.List(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("list %s: %w", name, err)
+	}
+
+	entries := make([]fs.DirEntry, 0, len(list))
+	for _, e := range list {
+		// MLSDのcdir/pdirやLISTの.と..は飛ばす
+		if e.Name == "" || e.Name == "." || e.Name == ".." || strings.Contains(e.Name, "/") {
+			continue
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(f.fileInfo(e.Name, e)))
+	}
+	return entries, nil
+}
+
+func (f *ftpFS) Stat(name string) (fs.FileInfo, error) {
+	if f.conn.IsTimePreciseInList() {
+		e, err := f.conn.GetEntry(name)
+		if err != nil {
+			return nil, fmt.Errorf("stat %s: %w", name, err)
+		}
+		return f.fileInfo(path.Base(name), e), nil
+	}
+
+	// MLSTがなければ親ディレクトリを一覧して探す
+	entries, err := f.ReadDir(path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.Name() == path.Base(name) {
+			return entry.Info()
+		}
+	}
+	return nil, fmt.Errorf("stat %s: %w", name, fs.ErrNotExist)
+}
+
+// fileInfo はエントリをfs.FileInfoに変換する。
+// LISTの日時は分単位（古いファイルは日単位）しかないため、LISTで得たディレクトリのmtimeは記録しない。
+// 差分スキャンでディレクトリの変更を見落とさないよう、その場合は常に一覧を取り直す。
+func (f *ftpFS) fileInfo(name string, e *ftp.Entry) *ftpFileInfo {
+	info := &ftpFileInfo{
+		name:    name,
+		size:    int64(e.Size),
+		modTime: e.Time,
+		isDir:   e.Type == ftp.EntryTypeFolder,
+	}
+	if info.isDir && !f.conn.IsTimePreciseInList() {
+		info.modTime = time.Time{}
+	}
+	return info
+}
+
+// Open はnameのファイルをRETRで取得する。閉じるまで同じ接続で他のコマンドは送れない。
+func (f *ftpFS) Open(name string) (io.ReadCloser, error) {
+	resp, err := f.conn.Retr(name)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve %s: %w", name, err)
+	}
+	return resp, nil
+}
+
+func (f *ftpFS) reconnect(disableMLSD bool) error {
+	conn, err := f.dialer.dial(disableMLSD)
+	if err != nil {
+		return err
+	}
+	f.conn.Quit()
+	f.conn = conn
+	f.listFallback = disableMLSD
+	return nil
+}
+
+func (f *ftpFS) Close() error {
+	return f.conn.Quit()
+}
+
+// isFTPNotImplemented はコマンドが未実装・構文エラーとして拒否されたかどうかを返す。
+func isFTPNotImplemented(err error) bool {
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) {
+		return false
+	}
+	switch protoErr.Code {
+	case ftp.StatusBadCommand, ftp.StatusBadArguments, ftp.StatusNotImplemented, ftp.StatusNotImplementedParameter:
+		return true
+	}
+	return false
+}
+
+// openFTPSource はFTPサーバーにログインする。
+// SMBと同じく、パスは走査するディレクトリからの相対パスで記録する。
+func openFTPSource(ctx context.Context, connection *db.Connection) (*source, error) {
+	addr, dir, explicitTLS, err := parseFTPURL(connection.RemotePath)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ParseFTPOptions(getStringValue(connection.Options))
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &ftpDialer{
+		ctx:         ctx,
+		addr:        addr,
+		explicitTLS: explicitTLS,
+		cfg:         cfg,
+		user:        getStringValue(connection.Username),
+		password:    getStringValue(connection.Password),
+	}
+	conn, err := dialer.dial(cfg.DisableMLSD)
+	if err != nil {
+		return nil, err
+	}
+	fsys := &ftpFS{dialer: dialer, conn: conn, listFallback: cfg.DisableMLSD}
+
+	// ctxがキャンセルされたら制御接続を閉じ、応答待ちの一覧をすぐに終わらせる
+	stop := context.AfterFunc(ctx, func() { fsys.Close() })
+	return &source{
+		fsys:        fsys,
+		root:        dir,
+		displayRoot: ".",
+		close: func() {
+			if stop() {
+				fsys.Close()
+			}
+		},
+	}, nil
+}
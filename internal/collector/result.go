@@ -0,0 +1,160 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/koplec/sokoni/internal/db"
+)
+
+// ErrTooManyErrors はエントリ単位のエラーがエラーバジェットを超えたときに返される。
+var ErrTooManyErrors = errors.New("too many scan errors")
+
+const (
+	// defaultMaxErrors はSOKONI_SCAN_MAX_ERRORSが未設定のときのエラーバジェット。
+	defaultMaxErrors = 100
+	// defaultScanTimeout はSOKONI_SCAN_TIMEOUTが未設定のときの1接続あたりのスキャン期限。
+	defaultScanTimeout = 12 * time.Hour
+	// defaultArchiveDepth はSOKONI_ARCHIVE_DEPTHが未設定のときに開くアーカイブの入れ子の深さ。
+	defaultArchiveDepth = 1
+	// defaultArchiveMaxSize はSOKONI_ARCHIVE_MAX_SIZEが未設定のときに開くアーカイブの最大サイズ。
+	defaultArchiveMaxSize = 256 << 20
+)
+
+// ScanStatus はスキャン全体の結果を表す。
+type ScanStatus string
+
+const (
+	StatusCompleted ScanStatus = "completed" // エラーなしで完了
+	StatusPartial   ScanStatus = "partial"   // エラーはあったがバジェット内で完了
+	StatusFailed    ScanStatus = "failed"    // 中断された
+)
+
+// ScanError は読み取れなかったディレクトリやファイル1件分のエラー。
+type ScanError struct {
+	Path string
+	Err  error
+}
+
+func (e ScanError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+func (e ScanError) Unwrap() error {
+	return e.Err
+}
+
+// ScanResult は1回のスキャンの集計結果。
+type ScanResult struct {
+	Files       int         // handleに渡したPDFファイル数
+	Errors      []ScanError // スキップしたエントリとその理由
+	SkippedDirs int         // SkipDirにより走査しなかったディレクトリ数
+	// ArchiveMaxSizeを超えたため開かなかったアーカイブ数
+	SkippedArchives int
+	Status          ScanStatus
+
+	// 差分スキャンで前回から変わっていないため一覧を取り直さなかったディレクトリと、その直下のファイル数
+	UnchangedDirs  int
+	UnchangedFiles int
+}
+
+// DirResult は配下をすべて走査し終えたディレクトリの記録。
+type DirResult struct {
+	Path   string      // 表示用（DBに記録する）パス
+	Files  []string    // 直下に存在したPDFファイルのパス
+	Errors []ScanError // このディレクトリの走査中に記録したエラー（完了済みの子ディレクトリの分は除く）
+
+	State     db.DirState // 次回の差分スキャン用の状態（Pathは使わない）
+	Unchanged bool        // 前回から変わっていないため一覧を取らなかった（Filesは空）
+}
+
+// ScanOptions はスキャン時の挙動を指定する。
+type ScanOptions struct {
+	// MaxErrors はスキャンを中断せずに許容するエントリ単位のエラー数。
+	// これを超えるとスキャンは失敗扱いになる。負の値は無制限。
+	MaxErrors int
+
+	// Timeout は1接続のスキャン全体の期限。0以下は期限なし。
+	// SMB接続ではoptionsのscan_timeoutが優先される。
+	Timeout time.Duration
+
+	// SkipDir がtrueを返したディレクトリは配下ごと走査しない。
+	// 中断したスキャンを再開するときに完了済みのディレクトリを飛ばすために使う。
+	SkipDir func(path string) bool
+
+	// DirDone はディレクトリの配下をすべて走査し終えたときに呼ばれる（子から親の順）。
+	// 一覧を最後まで読めなかったディレクトリについては呼ばれない。
+	DirDone func(dir DirResult) error
+
+	// PreviousState は前回のスキャンで記録したディレクトリの状態を返す。
+	// 指定すると差分スキャンになり、mtimeが変わっていないディレクトリは一覧を取らずに
+	// 記録済みのサブディレクトリだけを確認する。nilの場合はすべて走査する。
+	PreviousState func(path string) (db.DirState, bool)
+
+	// ArchiveDepth はPDFを探して開くアーカイブ（ZIP・tar・tar.gz）の入れ子の深さ。
+	// 1はディレクトリにあるアーカイブだけ、2はその中のアーカイブも開く。0以下は開かない。
+	ArchiveDepth int
+
+	// ArchiveMaxSize はこれを超えるサイズ（バイト）のアーカイブを開かずに飛ばす。0以下は無制限。
+	// 入れ子のアーカイブは展開後のサイズで判定する。
+	ArchiveMaxSize int64
+}
+
+// DefaultScanOptions は環境変数から既定のScanOptionsを作る。
+// - SOKONI_SCAN_MAX_ERRORS: エラーバジェット（既定100、負の値で無制限）
+// - SOKONI_SCAN_TIMEOUT: 1接続あたりのスキャン期限（既定12h、0で無制限）
+// - SOKONI_ARCHIVE_DEPTH: 開くアーカイブの入れ子の深さ（既定1、0で開かない）
+// - SOKONI_ARCHIVE_MAX_SIZE: 開くアーカイブの最大サイズ（既定256MB、0で無制限）
+func DefaultScanOptions() ScanOptions {
+	opts := ScanOptions{
+		MaxErrors:      defaultMaxErrors,
+		Timeout:        defaultScanTimeout,
+		ArchiveDepth:   defaultArchiveDepth,
+		ArchiveMaxSize: defaultArchiveMaxSize,
+	}
+	if v := os.Getenv("SOKONI_SCAN_MAX_ERRORS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			opts.MaxErrors = n
+		}
+	}
+	if v := os.Getenv("SOKONI_SCAN_TIMEOUT"); v != "" {
+		if d, err := parseDuration(v); err == nil {
+			opts.Timeout = d
+		}
+	}
+	if v := os.Getenv("SOKONI_ARCHIVE_DEPTH"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			opts.ArchiveDepth = n
+		}
+	}
+	if v := os.Getenv("SOKONI_ARCHIVE_MAX_SIZE"); v != "" {
+		if n, err := parseSize(v); err == nil {
+			opts.ArchiveMaxSize = n
+		}
+	}
+	return opts
+}
+
+// parseSize はバイト数を解析する。KB・MB・GB（1024単位）の接尾辞を受け付ける。
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	for _, u := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * unit, nil
+}
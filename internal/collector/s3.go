@@ -0,0 +1,475 @@
+package collector
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/koplec/sokoni/internal/db"
+)
+
+const (
+	defaultS3Region         = "us-east-1"
+	defaultS3RequestTimeout = 30 * time.Second
+	// emptyPayloadHash はボディのないリクエストのx-amz-content-sha256
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Config はS3互換ストレージ接続のconnections.optionsから読み取った設定。
+type S3Config struct {
+	Endpoint       string // 例: https://minio.local:9000。空の場合はAWSのリージョンエンドポイント
+	Region         string
+	PathStyle      bool // https://endpoint/bucket 形式でアクセスする（MinIO等）
+	RequestTimeout time.Duration
+	ScanTimeout    time.Duration // 0の場合はScanOptions.Timeoutを使う
+	WatchInterval  time.Duration // 監視モードの確認間隔。0の場合は既定（1分）
+}
+
+// ParseS3Options はS3接続のオプション文字列（例: "endpoint=https://minio.local:9000,region=ap-northeast-1"）を解析する。
+//
+// 対応するオプション:
+// - endpoint=URL       : S3互換ストレージのURL。指定した場合は既定でパス形式のアクセスになる
+// - region=NAME        : 署名に使うリージョン（既定us-east-1）
+// - path_style         : https://endpoint/bucket 形式でアクセスする
+// - virtual_host       : https://bucket.endpoint 形式でアクセスする
+// - request_timeout=D  : ListObjectsV2 1回あたりのタイムアウト
+// - scan_timeout=D     : この接続のスキャン全体の期限
+// - watch_interval=D   : 監視モードで変更を確認する間隔
+//
+// オプション文字列はカンマ区切りのため、endpointのURLにはカンマを含められない。
+func ParseS3Options(options string) (*S3Config, error) {
+	cfg := &S3Config{Region: defaultS3Region, RequestTimeout: defaultS3RequestTimeout}
+	var pathStyle, virtualHost bool
+
+	for _, opt := range strings.Split(options, ",") {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(opt, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "endpoint":
+			u, err := url.Parse(value)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("invalid S3 option %q: endpoint must be an http(s) URL", opt)
+			}
+			cfg.Endpoint = strings.TrimSuffix(value, "/")
+		case "region":
+			if value == "" {
+				return nil, fmt.Errorf("invalid S3 option %q: value is required", opt)
+			}
+			cfg.Region = value
+		case "path_style":
+			pathStyle = true
+		case "virtual_host":
+			virtualHost = true
+		case "request_timeout", "scan_timeout", "watch_interval":
+			d, err := parseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid S3 option %q: must be a positive duration", opt)
+			}
+			switch key {
+			case "request_timeout":
+				cfg.RequestTimeout = d
+			case "scan_timeout":
+				cfg.ScanTimeout = d
+			default:
+				cfg.WatchInterval = d
+			}
+		default:
+			return nil, fmt.Errorf("unknown S3 option %q", key)
+		}
+	}
+
+	if pathStyle && virtualHost {
+		return nil, fmt.Errorf("invalid S3 options: path_style and virtual_host are exclusive")
+	}
+	cfg.PathStyle = pathStyle || (cfg.Endpoint != "" && !virtualHost)
+	return cfg, nil
+}
+
+// PollInterval は監視モードで変更を確認する間隔を返す。
+func (c *S3Config) PollInterval() time.Duration {
+	if c.WatchInterval > 0 {
+		return c.WatchInterval
+	}
+	return defaultWatchInterval
+}
+
+// bucketURL はバケットに対するリクエストのURLを返す。
+func (c *S3Config) bucketURL(bucket string) (*url.URL, error) {
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + c.Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if c.PathStyle {
+		u.Path = path.Join("/", u.Path, bucket)
+	} else {
+		u.Host = bucket + "." + u.Host
+		if u.Path == "" {
+			u.Path = "/"
+		}
+	}
+	return u, nil
+}
+
+// IsS3Path はremote_pathがS3のURL（s3://bucket/prefix）かどうかを返す。
+func IsS3Path(remotePath string) bool {
+	return strings.HasPrefix(strings.ToLower(remotePath), "s3://")
+}
+
+// parseS3URL はs3://bucket/prefixをバケットとプレフィックス（末尾の/なし）に分ける。
+func parseS3URL(remotePath string) (bucket, prefix string, err error) {
+	rest := remotePath[len("s3://"):]
+	bucket, prefix, _ = strings.Cut(rest, "/")
+	if bucket == "" || strings.ContainsAny(bucket, "@:?#") {
+		return "", "", fmt.Errorf("invalid S3 path: %s", remotePath)
+	}
+	return bucket, strings.Trim(prefix, "/"), nil
+}
+
+// s3Object はオブジェクトまたはプレフィックス1件分。ETagを返せるfs.FileInfo。
+type s3Object struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+	etag    string
+}
+
+func (o *s3Object) Name() string       { return o.name }
+func (o *s3Object) Size() int64        { return o.size }
+func (o *s3Object) ModTime() time.Time { return o.modTime } // プレフィックスはゼロ値
+func (o *s3Object) IsDir() bool        { return o.isDir }
+func (o *s3Object) Sys() any           { return nil }
+func (o *s3Object) ETag() string       { return o.etag }
+
+func (o *s3Object) Mode() fs.FileMode {
+	if o.isDir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+type listBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// s3FS はキーのプレフィックスをディレクトリとみなしてListObjectsV2で一覧するdirReader。
+// 名前はバケット内のプレフィックス（"."はバケットのルート）。
+type s3FS struct {
+	ctx       context.Context
+	client    *http.Client
+	cfg       *S3Config
+	bucketURL *url.URL
+	accessKey string
+	secretKey string
+	now       func() time.Time
+}
+
+// dirPrefix はディレクトリ名をListObjectsV2のprefixに変換する。
+func dirPrefix(name string) string {
+	if name == "." || name == "" {
+		return ""
+	}
+	return strings.Trim(name, "/") + "/"
+}
+
+func (s *s3FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	prefix := dirPrefix(name)
+	var entries []fs.DirEntry
+	token := ""
+	for {
+		page, err := s.list(prefix, token, 0)
+		if err != nil {
+			return entries, err
+		}
+		for _, p := range page.CommonPrefixes {
+			entries = append(entries, fs.FileInfoToDirEntry(&s3Object{
+				name:  path.Base(strings.TrimSuffix(p.Prefix, "/")),
+				isDir: true,
+			}))
+		}
+		for _, c := range page.Contents {
+			// コンソール等で作られるフォルダ用の空オブジェクトは飛ばす
+			if c.Key == prefix || strings.HasSuffix(c.Key, "/") {
+				continue
+			}
+			entries = append(entries, fs.FileInfoToDirEntry(&s3Object{
+				name:    c.Key[len(prefix):],
+				size:    c.Size,
+				modTime: c.LastModified,
+				etag:    c.ETag,
+			}))
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return entries, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// Stat はプレフィックスの下にオブジェクトが1つでもあればディレクトリとして返す。
+func (s *s3FS) Stat(name string) (fs.FileInfo, error) {
+	prefix := dirPrefix(name)
+	page, err := s.list(prefix, "", 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(page.Contents) == 0 && len(page.CommonPrefixes) == 0 {
+		return nil, fmt.Errorf("S3 prefix %s: %w", prefix, fs.ErrNotExist)
+	}
+	return &s3Object{name: path.Base(name), isDir: true}, nil
+}
+
+// Open はnameをキーとするオブジェクトをGETで取得する。
+func (s *s3FS) Open(name string) (io.ReadCloser, error) {
+	key := strings.Trim(name, "/")
+	u := *s.bucketURL
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	u.RawPath = canonicalURI(u.Path) // 署名と同じエンコードで送る
+
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.accessKey != "" {
+		signV4(req, s.accessKey, s.secretKey, s.cfg.Region, emptyPayloadHash, s.now())
+	}
+
+	resp, err := getWithHeaderTimeout(s.client, req, s.cfg.RequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var e s3Error
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		xml.Unmarshal(body, &e)
+		if e.Code == "NoSuchKey" || resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("S3 get %q: %w", key, fs.ErrNotExist)
+		}
+		return nil, fmt.Errorf("S3 get %q: %s %s %s", key, resp.Status, e.Code, e.Message)
+	}
+	return resp.Body, nil
+}
+
+// list はListObjectsV2を1ページ分呼び出す。maxKeysが0の場合はサーバーの既定（最大1000件）。
+func (s *s3FS) list(prefix, token string, maxKeys int) (*listBucketResult, error) {
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("delimiter", "/")
+	query.Set("prefix", prefix)
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	if maxKeys > 0 {
+		query.Set("max-keys", fmt.Sprint(maxKeys))
+	}
+	u := *s.bucketURL
+	u.RawQuery = query.Encode()
+
+	ctx, cancel := context.WithTimeout(s.ctx, s.cfg.RequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.accessKey != "" {
+		signV4(req, s.accessKey, s.secretKey, s.cfg.Region, emptyPayloadHash, s.now())
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e s3Error
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		xml.Unmarshal(body, &e)
+		if e.Code == "NoSuchBucket" {
+			return nil, fmt.Errorf("S3 list %q: %s: %w", prefix, e.Code, fs.ErrNotExist)
+		}
+		return nil, fmt.Errorf("S3 list %q: %s %s %s", prefix, resp.Status, e.Code, e.Message)
+	}
+
+	var result listBucketResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("S3 list %q: invalid response: %w", prefix, err)
+	}
+	return &result, nil
+}
+
+// signV4 はAWS Signature Version 4でreqに署名する（host, x-amz-content-sha256, x-amz-dateに加え、
+// 既に設定済みのRangeヘッダーも署名対象にする）。
+func signV4(req *http.Request, accessKey, secretKey, region, payloadHash string, now time.Time) {
+	const service = "s3"
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if r := req.Header.Get("Range"); r != "" {
+		headers["range"] = r
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex(canonicalRequest)
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func canonicalURI(p string) string {
+	if p == "" {
+		return "/"
+	}
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = uriEncode(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+func canonicalQuery(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		vs := append([]string(nil), values[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			pairs = append(pairs, uriEncode(k)+"="+uriEncode(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode はSigV4の規則（RFC 3986の非予約文字以外をすべて%XXにする）でエンコードする。
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// openS3Source はremote_pathのバケットを開く。
+// SMBと同じく、パスはremote_pathのプレフィックスからの相対パスで記録する。
+func openS3Source(ctx context.Context, connection *db.Connection) (*source, error) {
+	bucket, prefix, err := parseS3URL(connection.RemotePath)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ParseS3Options(getStringValue(connection.Options))
+	if err != nil {
+		return nil, err
+	}
+	bucketURL, err := cfg.bucketURL(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	fsys := &s3FS{
+		ctx:       ctx,
+		client:    &http.Client{},
+		cfg:       cfg,
+		bucketURL: bucketURL,
+		accessKey: getStringValue(connection.Username),
+		secretKey: getStringValue(connection.Password),
+		now:       time.Now,
+	}
+
+	root := prefix
+	if root == "" {
+		root = "."
+	}
+	return &source{fsys: fsys, root: root, displayRoot: "."}, nil
+}
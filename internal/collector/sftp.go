@@ -0,0 +1,274 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/koplec/sokoni/internal/db"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultSFTPPort        = "22"
+	defaultSFTPDialTimeout = 10 * time.Second
+)
+
+// SFTPConfig はSFTP接続のconnections.optionsから読み取った設定。
+type SFTPConfig struct {
+	DialTimeout   time.Duration
+	ScanTimeout   time.Duration // 0の場合はScanOptions.Timeoutを使う
+	WatchInterval time.Duration // 監視モードの確認間隔。0の場合は既定（1分）
+}
+
+// ParseSFTPOptions はSFTP接続のオプション文字列（例: "dial_timeout=30s,scan_timeout=2h"）を解析する。
+//
+// 対応するオプション:
+// - dial_timeout=D   : 接続・SSHハンドシェイクのタイムアウト
+// - scan_timeout=D   : この接続のスキャン全体の期限
+// - watch_interval=D : 監視モードで変更を確認する間隔
+func ParseSFTPOptions(options string) (*SFTPConfig, error) {
+	cfg := &SFTPConfig{DialTimeout: defaultSFTPDialTimeout}
+
+	for _, opt := range strings.Split(options, ",") {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(opt, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+
+		switch key {
+		case "dial_timeout", "scan_timeout", "watch_interval":
+			d, err := parseDuration(strings.TrimSpace(value))
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid SFTP option %q: must be a positive duration", opt)
+			}
+			switch key {
+			case "dial_timeout":
+				cfg.DialTimeout = d
+			case "scan_timeout":
+				cfg.ScanTimeout = d
+			default:
+				cfg.WatchInterval = d
+			}
+		default:
+			return nil, fmt.Errorf("unknown SFTP option %q", key)
+		}
+	}
+	return cfg, nil
+}
+
+// PollInterval は監視モードで変更を確認する間隔を返す。
+func (c *SFTPConfig) PollInterval() time.Duration {
+	if c.WatchInterval > 0 {
+		return c.WatchInterval
+	}
+	return defaultWatchInterval
+}
+
+// IsSFTPPath はremote_pathがSFTPのURL（sftp://host:port/path）かどうかを返す。
+func IsSFTPPath(remotePath string) bool {
+	return strings.HasPrefix(strings.ToLower(remotePath), "sftp://")
+}
+
+// parseSFTPURL はsftp://host:port/pathを接続先アドレスと走査するディレクトリに分ける。
+// パスを省略した場合はログインディレクトリを走査する。
+func parseSFTPURL(remotePath string) (addr, dir string, err error) {
+	u, err := url.Parse(remotePath)
+	if err != nil || !strings.EqualFold(u.Scheme, "sftp") || u.Hostname() == "" {
+		return "", "", fmt.Errorf("invalid SFTP path: %s", remotePath)
+	}
+	if u.User != nil {
+		return "", "", fmt.Errorf("invalid SFTP path %s: set credentials in the username/password fields", remotePath)
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultSFTPPort
+	}
+	dir = u.Path
+	if dir == "" {
+		dir = "."
+	}
+	return net.JoinHostPort(u.Hostname(), port), dir, nil
+}
+
+// parseHostKey はconnections.host_keyを検証する。
+// authorized_keys形式（"ssh-ed25519 AAAA..."）か、"SHA256:"で始まるフィンガープリントを受け付ける。
+func parseHostKey(hostKey string) (ssh.PublicKey, string, error) {
+	hostKey = strings.TrimSpace(hostKey)
+	if strings.HasPrefix(hostKey, "SHA256:") {
+		return nil, hostKey, nil
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hostKey))
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid host key: %w", err)
+	}
+	return key, ssh.FingerprintSHA256(key), nil
+}
+
+// hostKeyCallback はconnections.host_keyに固定したホスト鍵だけを受け入れる。
+// 未設定の場合は接続せず、設定すべきフィンガープリントをエラーに含める。
+func hostKeyCallback(hostKey *string) (ssh.HostKeyCallback, error) {
+	if hostKey == nil || strings.TrimSpace(*hostKey) == "" {
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return fmt.Errorf("host key for %s is not pinned: set host_key to %q", hostname, ssh.FingerprintSHA256(key))
+		}, nil
+	}
+
+	pinned, fingerprint, err := parseHostKey(*hostKey)
+	if err != nil {
+		return nil, err
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if pinned != nil && key.Type() == pinned.Type() && bytes.Equal(key.Marshal(), pinned.Marshal()) {
+			return nil
+		}
+		if pinned == nil && ssh.FingerprintSHA256(key) == fingerprint {
+			return nil
+		}
+		return fmt.Errorf("host key mismatch for %s: got %s, pinned %s", hostname, ssh.FingerprintSHA256(key), fingerprint)
+	}, nil
+}
+
+// sftpAuthMethods はconnectionの認証情報からSSHの認証方式を作る。
+// 秘密鍵があれば公開鍵認証を先に試し、パスワードがあればパスワード認証も試す。
+// 秘密鍵が暗号化されている場合はパスワードをパスフレーズとして使う。
+func sftpAuthMethods(privateKey, password *string) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+	if privateKey != nil && strings.TrimSpace(*privateKey) != "" {
+		signer, err := parsePrivateKey(*privateKey, password)
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+	if password != nil && *password != "" {
+		methods = append(methods, ssh.Password(*password))
+	}
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("SFTP connection requires a password or private key")
+	}
+	return methods, nil
+}
+
+func parsePrivateKey(privateKey string, password *string) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey([]byte(privateKey))
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) && password != nil && *password != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(privateKey), []byte(*password))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	return signer, nil
+}
+
+// sftpSession はSFTPクライアントとその下のSSH接続をまとめて閉じるためのもの。
+type sftpSession struct {
+	*sftp.Client
+	ssh  *ssh.Client
+	stop func() bool
+}
+
+func (s *sftpSession) Close() error {
+	s.stop()
+	s.Client.Close()
+	return s.ssh.Close()
+}
+
+// dialSFTP はconnectionの接続先にSSHで接続してSFTPセッションを開く。
+// ctxがキャンセルされるとTCP接続を閉じて応答待ちの要求をすぐに終わらせる。
+func dialSFTP(ctx context.Context, addr string, connection *db.Connection, cfg *SFTPConfig) (*sftpSession, error) {
+	callback, err := hostKeyCallback(connection.HostKey)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := sftpAuthMethods(connection.PrivateKey, connection.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: cfg.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SFTP server: %w", err)
+	}
+
+	// SSHハンドシェイクと認証にもDialTimeoutを適用する
+	conn.SetDeadline(time.Now().Add(cfg.DialTimeout))
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User:            getStringValue(connection.Username),
+		Auth:            auth,
+		HostKeyCallback: callback,
+	})
+	if err != nil {
+		stop()
+		conn.Close()
+		return nil, fmt.Errorf("failed to authenticate SFTP: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	client := ssh.NewClient(sshConn, chans, reqs)
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		stop()
+		client.Close()
+		return nil, fmt.Errorf("failed to start SFTP session: %w", err)
+	}
+	return &sftpSession{Client: sc, ssh: client, stop: stop}, nil
+}
+
+type sftpFS struct {
+	client *sftp.Client
+}
+
+func (s sftpFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	infos, err := s.client.ReadDir(name)
+	entries := make([]fs.DirEntry, 0, len(infos))
+	for _, info := range infos {
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	return entries, err
+}
+
+func (s sftpFS) Stat(name string) (fs.FileInfo, error) {
+	return s.client.Stat(name)
+}
+
+func (s sftpFS) Open(name string) (io.ReadCloser, error) {
+	return s.client.Open(name)
+}
+
+// openSFTPSource はSFTPセッションを開く。
+// SMBと同じく、パスは走査するディレクトリからの相対パスで記録する。
+func openSFTPSource(ctx context.Context, connection *db.Connection) (*source, error) {
+	addr, dir, err := parseSFTPURL(connection.RemotePath)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ParseSFTPOptions(getStringValue(connection.Options))
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := dialSFTP(ctx, addr, connection, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &source{
+		fsys:        sftpFS{client: s.Client},
+		root:        dir,
+		displayRoot: ".",
+		close:       func() { s.Close() },
+	}, nil
+}
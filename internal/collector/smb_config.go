@@ -0,0 +1,369 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hirochachacha/go-smb2"
+)
+
+// SMBダイアレクト（MS-SMB2 2.2.3 の DialectRevision）
+const (
+	SMB202 uint16 = 0x0202
+	SMB210 uint16 = 0x0210
+	SMB300 uint16 = 0x0300
+	SMB302 uint16 = 0x0302
+	SMB311 uint16 = 0x0311
+)
+
+// 新しいものから順に並べたクライアントがサポートするダイアレクト
+var smbDialects = []uint16{SMB311, SMB302, SMB300, SMB210, SMB202}
+
+var smbVersions = map[string]uint16{
+	"2.0":   SMB202,
+	"2.02":  SMB202,
+	"2.1":   SMB210,
+	"3.0":   SMB300,
+	"3.02":  SMB302,
+	"3.0.2": SMB302,
+	"3.1.1": SMB311,
+	"3.11":  SMB311,
+}
+
+const (
+	defaultSMBPort        = 445
+	defaultSMBDialTimeout = 10 * time.Second
+	// smbCleanupTimeout はキャンセル後のUmount/Logoffを待つ上限。
+	smbCleanupTimeout = 5 * time.Second
+)
+
+// mount.cifs向けのオプションのうち、スキャンには影響しないため受け付けて無視するもの。
+// db/sample_data.sql.sample のようにfstabと同じ文字列を保存できるようにしている。
+var ignoredSMBOptions = map[string]bool{
+	"ro": true, "rw": true, "uid": true, "gid": true, "forceuid": true, "forcegid": true,
+	"file_mode": true, "dir_mode": true, "cache": true, "iocharset": true,
+	"noperm": true, "nounix": true, "serverino": true, "noserverino": true,
+	"soft": true, "hard": true, "actimeo": true, "nobrl": true, "mfsymlinks": true,
+}
+
+// SMBConfig はconnections.optionsから読み取ったSMB接続設定。
+type SMBConfig struct {
+	Domain            string
+	Port              int
+	MinDialect        uint16 // 0の場合はクライアントの既定（SMB 2.0.2〜3.1.1をネゴシエート）
+	MaxDialect        uint16
+	RequireSigning    bool
+	RequireEncryption bool // SMB3以上に限定し、サーバーがセッションか共有を暗号化しない場合（判断できない場合も）は接続しない
+	DialTimeout       time.Duration
+	ScanTimeout       time.Duration // 0の場合はScanOptions.Timeoutを使う
+	WatchInterval     time.Duration // 監視モードの確認間隔。0の場合は既定（1分）
+}
+
+// ParseSMBOptions はmount.cifs形式のオプション文字列（例: "domain=COMPANY,vers=3.0,ro"）を
+// SMBConfigに変換する。サポートしていない値や未知のオプションはエラーにする。
+//
+// 対応するオプション:
+// - domain=NAME               : NTLM認証のドメイン
+// - port=N                    : 接続先ポート（既定445）
+// - vers=X                    : ダイアレクトを固定（2.0, 2.1, 3.0, 3.02, 3.1.1）。3 は3.0以上、defaultは自動
+// - minvers=X, maxvers=X      : ダイアレクトの範囲指定
+// - sec=ntlm|ntlmv2|ntlmssp   : 認証方式（いずれもNTLM）。末尾にiを付けると署名必須
+// - sign                      : メッセージ署名を必須にする
+// - seal                      : 暗号化を必須にする（SMB3以上に限定し、サーバーが暗号化しない共有には接続しない）
+// - dial_timeout=D            : 接続・ネゴシエーションのタイムアウト（"30s"のような期間か秒数）
+// - scan_timeout=D            : この接続のスキャン全体の期限
+// - watch_interval=D          : 監視モードで変更を確認する間隔
+func ParseSMBOptions(options string) (*SMBConfig, error) {
+	cfg := &SMBConfig{
+		Port:        defaultSMBPort,
+		DialTimeout: defaultSMBDialTimeout,
+	}
+
+	for _, opt := range strings.Split(options, ",") {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+		key, value, hasValue := strings.Cut(opt, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if !hasValue && requiresValue(key) {
+			return nil, fmt.Errorf("invalid SMB option %q: value is required", key)
+		}
+
+		switch key {
+		case "domain", "dom", "workgroup":
+			cfg.Domain = value
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil || port < 1 || port > 65535 {
+				return nil, fmt.Errorf("invalid SMB option %q: port must be 1-65535", opt)
+			}
+			cfg.Port = port
+		case "vers":
+			min, max, err := parseSMBVersion(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid SMB option %q: %w", opt, err)
+			}
+			cfg.MinDialect, cfg.MaxDialect = min, max
+		case "minvers", "maxvers":
+			dialect, ok := smbVersions[value]
+			if !ok {
+				return nil, fmt.Errorf("invalid SMB option %q: unsupported version", opt)
+			}
+			if key == "minvers" {
+				cfg.MinDialect = dialect
+			} else {
+				cfg.MaxDialect = dialect
+			}
+		case "sec":
+			switch strings.ToLower(value) {
+			case "ntlm", "ntlmv2", "ntlmssp":
+			case "ntlmi", "ntlmv2i", "ntlmsspi":
+				cfg.RequireSigning = true
+			case "krb5", "krb5i", "none":
+				return nil, fmt.Errorf("invalid SMB option %q: only NTLM authentication is supported", opt)
+			default:
+				return nil, fmt.Errorf("invalid SMB option %q: unknown security type", opt)
+			}
+		case "sign":
+			cfg.RequireSigning = true
+		case "seal":
+			cfg.RequireEncryption = true
+		case "dial_timeout", "scan_timeout", "watch_interval":
+			d, err := parseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid SMB option %q: must be a positive duration", opt)
+			}
+			switch key {
+			case "dial_timeout":
+				cfg.DialTimeout = d
+			case "scan_timeout":
+				cfg.ScanTimeout = d
+			default:
+				cfg.WatchInterval = d
+			}
+		case "user", "username", "pass", "password", "credentials":
+			return nil, fmt.Errorf("invalid SMB option %q: set credentials in the username/password fields", key)
+		default:
+			if !ignoredSMBOptions[key] {
+				return nil, fmt.Errorf("unknown SMB option %q", key)
+			}
+		}
+	}
+
+	if cfg.RequireEncryption {
+		if cfg.MaxDialect != 0 && cfg.MaxDialect < SMB300 {
+			return nil, fmt.Errorf("invalid SMB options: seal requires SMB 3.0 or later")
+		}
+		if cfg.MinDialect < SMB300 {
+			cfg.MinDialect = SMB300
+		}
+	}
+	if cfg.MinDialect != 0 && cfg.MaxDialect != 0 && cfg.MinDialect > cfg.MaxDialect {
+		return nil, fmt.Errorf("invalid SMB options: minvers is newer than maxvers")
+	}
+
+	return cfg, nil
+}
+
+func requiresValue(key string) bool {
+	switch key {
+	case "domain", "dom", "workgroup", "port", "vers", "minvers", "maxvers", "sec", "dial_timeout", "scan_timeout", "watch_interval":
+		return true
+	}
+	return false
+}
+
+// parseSMBVersion はvers=の値をダイアレクトの範囲に変換する。
+func parseSMBVersion(value string) (uint16, uint16, error) {
+	switch value {
+	case "default":
+		return 0, 0, nil
+	case "3":
+		return SMB300, SMB311, nil
+	case "1.0":
+		return 0, 0, fmt.Errorf("SMB1 is not supported")
+	}
+	dialect, ok := smbVersions[value]
+	if !ok {
+		return 0, 0, fmt.Errorf("unsupported version")
+	}
+	return dialect, dialect, nil
+}
+
+// parseDuration は"30s"のような期間表記か、単位なしの秒数を受け付ける。
+func parseDuration(value string) (time.Duration, error) {
+	if n, err := strconv.Atoi(value); err == nil {
+		return time.Duration(n) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// PollInterval は監視モードで変更を確認する間隔を返す。
+func (c *SMBConfig) PollInterval() time.Duration {
+	if c.WatchInterval > 0 {
+		return c.WatchInterval
+	}
+	return defaultWatchInterval
+}
+
+// dialects は試行するダイアレクトを新しい順に返す。
+// 範囲指定がない場合はnil（ライブラリの既定のネゴシエーションに任せる）。
+func (c *SMBConfig) dialects() []uint16 {
+	if c.MinDialect == 0 && c.MaxDialect == 0 {
+		return nil
+	}
+	var dialects []uint16
+	for _, d := range smbDialects {
+		if c.MinDialect != 0 && d < c.MinDialect {
+			continue
+		}
+		if c.MaxDialect != 0 && d > c.MaxDialect {
+			continue
+		}
+		dialects = append(dialects, d)
+	}
+	return dialects
+}
+
+// セッション・共有の暗号化を示すフラグ（MS-SMB2 2.2.6 SessionFlags、2.2.10 ShareFlags）
+const (
+	smbSessionFlagEncryptData = 0x0004
+	smbShareFlagEncryptData   = 0x00008000
+)
+
+// smbEncrypted はマウントした共有の通信が暗号化されるかを返す。
+// go-smb2はサーバーがセッションか共有に暗号化を求めた場合にだけ暗号化し、クライアントから求めることも
+// その状態を知ることもできないので、非公開のフィールド（treeConn.shareFlags・session.sessionFlags）を読む。
+// フィールドの名前と型はgo-smb2 v1.1.0のもので、更新して読めなくなった場合は暗号化されているか判断できないというエラーを返す。
+func smbEncrypted(share *smb2.Share) (bool, error) {
+	return encryptedFlags(reflect.ValueOf(share))
+}
+
+// encryptedFlags はsmbEncryptedの本体。share（*smb2.Share）からフラグをたどる。
+func encryptedFlags(share reflect.Value) (bool, error) {
+	tc, err := smbField(share, "treeConn")
+	if err != nil {
+		return false, err
+	}
+	shareFlags, err := smbField(tc, "shareFlags")
+	if err != nil {
+		return false, err
+	}
+	session, err := smbField(tc, "session")
+	if err != nil {
+		return false, err
+	}
+	sessionFlags, err := smbField(session, "sessionFlags")
+	if err != nil {
+		return false, err
+	}
+	if shareFlags.Kind() != reflect.Uint32 || sessionFlags.Kind() != reflect.Uint16 {
+		return false, fmt.Errorf("cannot determine SMB encryption: unexpected flag types %s and %s", shareFlags.Type(), sessionFlags.Type())
+	}
+	return shareFlags.Uint()&smbShareFlagEncryptData != 0 || sessionFlags.Uint()&smbSessionFlagEncryptData != 0, nil
+}
+
+// smbField は構造体へのポインタvのフィールドnameを返す。
+func smbField(v reflect.Value, name string) (reflect.Value, error) {
+	if v.Kind() != reflect.Pointer || v.Type().Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("cannot determine SMB encryption: cannot read %s from %s", name, v.Kind())
+	}
+	if v.IsNil() {
+		return reflect.Value{}, fmt.Errorf("cannot determine SMB encryption: %s is nil", v.Type())
+	}
+	f := v.Elem().FieldByName(name)
+	if !f.IsValid() {
+		return reflect.Value{}, fmt.Errorf("cannot determine SMB encryption: %s has no field %s", v.Type().Elem(), name)
+	}
+	return f, nil
+}
+
+// smbSession はSMBセッションとその下のTCP接続をまとめて閉じるためのもの。
+type smbSession struct {
+	*smb2.Session
+	conn net.Conn
+	stop func() bool
+}
+
+// Close はセッションをログオフしてTCP接続を閉じる。
+// サーバーが応答しない場合でも smbCleanupTimeout で打ち切る。
+func (s *smbSession) Close() error {
+	s.stop()
+	ctx, cancel := context.WithTimeout(context.Background(), smbCleanupTimeout)
+	defer cancel()
+	s.WithContext(ctx).Logoff()
+	return s.conn.Close()
+}
+
+// dialSMB はcfgに従ってserverに接続し、認証済みのセッションを返す。
+// ダイアレクトの範囲が指定されている場合は新しいものから順に試す
+// （go-smb2は単一のダイアレクトしか指定できないため）。
+// 返されるセッションはctxを引き継ぎ、ctxがキャンセルされるとTCP接続を閉じて
+// 応答待ちの要求をすぐに終わらせる。
+func dialSMB(ctx context.Context, server string, cfg *SMBConfig, user, password string) (*smbSession, error) {
+	dialects := cfg.dialects()
+	if dialects == nil {
+		dialects = []uint16{0}
+	}
+
+	var lastErr error
+	for _, dialect := range dialects {
+		s, err := dialSMBDialect(ctx, server, cfg, dialect, user, password)
+		if err == nil {
+			return s, nil
+		}
+		// TCP接続自体に失敗した場合やキャンセルされた場合は別のダイアレクトを試しても無駄なので終える
+		var opErr *net.OpError
+		if errors.As(err, &opErr) || ctx.Err() != nil {
+			return nil, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func dialSMBDialect(ctx context.Context, server string, cfg *SMBConfig, dialect uint16, user, password string) (*smbSession, error) {
+	addr := net.JoinHostPort(server, strconv.Itoa(cfg.Port))
+	dialer := &net.Dialer{Timeout: cfg.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SMB server: %w", err)
+	}
+
+	d := &smb2.Dialer{
+		Negotiator: smb2.Negotiator{
+			RequireMessageSigning: cfg.RequireSigning,
+			SpecifiedDialect:      dialect,
+		},
+		Initiator: &smb2.NTLMInitiator{
+			User:     user,
+			Password: password,
+			Domain:   cfg.Domain,
+		},
+	}
+
+	// ネゴシエーションと認証にもDialTimeoutを適用する
+	dialCtx, cancel := context.WithTimeout(ctx, cfg.DialTimeout)
+	defer cancel()
+	s, err := d.DialContext(dialCtx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to authenticate SMB: %w", err)
+	}
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	return &smbSession{Session: s.WithContext(ctx), conn: conn, stop: stop}, nil
+}
+
+// IsSMBPath はremote_pathがSMB/CIFSのUNCパス（//server/share/...）かどうかを返す。
+func IsSMBPath(remotePath string) bool {
+	return strings.HasPrefix(remotePath, "//")
+}
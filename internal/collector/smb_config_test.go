@@ -0,0 +1,192 @@
+package collector
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hirochachacha/go-smb2"
+)
+
+func TestParseSMBOptions(t *testing.T) {
+	tests := []struct {
+		options string
+		want    SMBConfig
+	}{
+		{
+			options: "",
+			want:    SMBConfig{Port: 445, DialTimeout: 10 * time.Second},
+		},
+		{
+			options: "domain=COMPANY,vers=3.0,ro",
+			want:    SMBConfig{Domain: "COMPANY", Port: 445, MinDialect: SMB300, MaxDialect: SMB300, DialTimeout: 10 * time.Second},
+		},
+		{
+			options: "domain=HQ,vers=3.0,ro,cache=none",
+			want:    SMBConfig{Domain: "HQ", Port: 445, MinDialect: SMB300, MaxDialect: SMB300, DialTimeout: 10 * time.Second},
+		},
+		{
+			options: "vers=2.1,sec=ntlmssp",
+			want:    SMBConfig{Port: 445, MinDialect: SMB210, MaxDialect: SMB210, DialTimeout: 10 * time.Second},
+		},
+		{
+			options: "port=1445,minvers=2.1,maxvers=3.0,sec=ntlmsspi,dial_timeout=30s",
+			want:    SMBConfig{Port: 1445, MinDialect: SMB210, MaxDialect: SMB300, RequireSigning: true, DialTimeout: 30 * time.Second},
+		},
+		{
+			options: "scan_timeout=2h,watch_interval=30s",
+			want:    SMBConfig{Port: 445, DialTimeout: 10 * time.Second, ScanTimeout: 2 * time.Hour, WatchInterval: 30 * time.Second},
+		},
+		{
+			options: "seal,dial_timeout=5",
+			want:    SMBConfig{Port: 445, MinDialect: SMB300, RequireEncryption: true, DialTimeout: 5 * time.Second},
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseSMBOptions(tt.options)
+		if err != nil {
+			t.Errorf("ParseSMBOptions(%q) unexpected error: %v", tt.options, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("ParseSMBOptions(%q) = %+v, want %+v", tt.options, *got, tt.want)
+		}
+	}
+}
+
+func TestParseSMBOptionsInvalid(t *testing.T) {
+	invalid := []string{
+		"vers=1.0",
+		"vers=4.0",
+		"port=0",
+		"port=abc",
+		"sec=krb5",
+		"domain",
+		"password=secret",
+		"minvers=3.0,maxvers=2.1",
+		"vers=2.1,seal",
+		"dial_timeout=-1s",
+		"watch_interval=0",
+		"unknown=1",
+	}
+
+	for _, options := range invalid {
+		if _, err := ParseSMBOptions(options); err == nil {
+			t.Errorf("ParseSMBOptions(%q) expected error", options)
+		}
+	}
+}
+
+func TestSMBConfigDialects(t *testing.T) {
+	cfg := SMBConfig{MinDialect: SMB210, MaxDialect: SMB302}
+	want := []uint16{SMB302, SMB300, SMB210}
+	if got := cfg.dialects(); !reflect.DeepEqual(got, want) {
+		t.Errorf("dialects() = %x, want %x", got, want)
+	}
+
+	if got := (&SMBConfig{}).dialects(); got != nil {
+		t.Errorf("dialects() without range = %x, want nil", got)
+	}
+}
+
+func TestDialSMBTimeout(t *testing.T) {
+	// 接続は受け付けるが何も応答しないサーバー（ハングしたNASの代わり）
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	cfg, err := ParseSMBOptions("port=" + port + ",dial_timeout=200ms")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	start := time.Now()
+	_, err = dialSMB(context.Background(), host, cfg, "user", "pass")
+	if err == nil {
+		t.Fatal("expected dial to fail against a silent server")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("dial did not honor timeout, took %v", elapsed)
+	}
+}
+
+func TestSMBEncryptedFields(t *testing.T) {
+	// go-smb2を更新して非公開のフィールドが変わると、sealの接続がすべて失敗するので気づけるようにする
+	tc, ok := reflect.TypeOf(smb2.Share{}).FieldByName("treeConn")
+	if !ok || tc.Type.Kind() != reflect.Pointer {
+		t.Fatalf("smb2.Share has no treeConn pointer")
+	}
+	if f, ok := tc.Type.Elem().FieldByName("shareFlags"); !ok || f.Type.Kind() != reflect.Uint32 {
+		t.Errorf("treeConn has no uint32 shareFlags")
+	}
+	session, ok := tc.Type.Elem().FieldByName("session")
+	if !ok || session.Type.Kind() != reflect.Pointer {
+		t.Fatalf("treeConn has no session pointer")
+	}
+	if f, ok := session.Type.Elem().FieldByName("sessionFlags"); !ok || f.Type.Kind() != reflect.Uint16 {
+		t.Errorf("session has no uint16 sessionFlags")
+	}
+
+	// マウントしていない共有は暗号化されているか判断できない
+	if _, err := smbEncrypted(&smb2.Share{}); err == nil {
+		t.Errorf("expected an error for an unmounted share")
+	}
+}
+
+func TestEncryptedFlags(t *testing.T) {
+	// go-smb2 v1.1.0のShare・treeConn・Sessionと同じ形の構造体
+	type session struct{ sessionFlags uint16 }
+	type treeConn struct {
+		session    *session
+		shareFlags uint32
+	}
+	type share struct{ treeConn *treeConn }
+	type renamedTreeConn struct {
+		session *session
+		flags   uint32
+	}
+	type renamedShare struct{ treeConn *renamedTreeConn }
+	type widenedSession struct{ sessionFlags uint32 }
+	type widenedTreeConn struct {
+		session    *widenedSession
+		shareFlags uint32
+	}
+	type widenedShare struct{ treeConn *widenedTreeConn }
+
+	tests := []struct {
+		name    string
+		share   any
+		want    bool
+		wantErr bool
+	}{
+		{"share encrypted", &share{&treeConn{&session{}, smbShareFlagEncryptData}}, true, false},
+		{"session encrypted", &share{&treeConn{&session{smbSessionFlagEncryptData}, 0}}, true, false},
+		{"not encrypted", &share{&treeConn{&session{0x0001}, 0x0010}}, false, false},
+		{"no tree connection", &share{}, false, true},
+		{"no session", &share{&treeConn{nil, smbShareFlagEncryptData}}, false, true},
+		{"renamed field", &renamedShare{&renamedTreeConn{&session{}, smbShareFlagEncryptData}}, false, true},
+		{"changed type", &widenedShare{&widenedTreeConn{&widenedSession{smbSessionFlagEncryptData}, 0}}, false, true},
+		{"not a pointer", share{}, false, true},
+	}
+	for _, tt := range tests {
+		got, err := encryptedFlags(reflect.ValueOf(tt.share))
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: got %v, %v; want %v (error %v)", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/koplec/sokoni/internal/db"
+)
+
+// sourceFS は走査に加えてファイルの中身を読み出せるdirReader。
+// アーカイブの中の走査と、ファイルのダウンロードに使う。
+type sourceFS interface {
+	dirReader
+	Open(name string) (io.ReadCloser, error)
+}
+
+// source は接続を開いた状態の接続先。
+// rootから走査し、見つかったファイルはdisplayRootを起点としたパスで記録する。
+type source struct {
+	fsys        sourceFS
+	root        string
+	displayRoot string
+	close       func()
+}
+
+func (s *source) Close() {
+	if s.close != nil {
+		s.close()
+	}
+}
+
+// name は記録したパスをfsys上の名前に変換する。
+func (s *source) name(recorded string) (string, error) {
+	rel, err := filepath.Rel(s.displayRoot, recorded)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("path %s is outside of the connection root", recorded)
+	}
+	return filepath.Join(s.root, rel), nil
+}
+
+// openSource はconnectionの種類に応じて接続先を開く。
+// throttleが指定されていれば、接続先への要求はctxが続く間その上限に従って待たせる。
+func openSource(ctx context.Context, connection *db.Connection) (*source, error) {
+	t, err := connectionThrottle(connection)
+	if err != nil {
+		return nil, err
+	}
+	src, err := dialSource(ctx, connection)
+	if err != nil || t == nil {
+		return src, err
+	}
+	src.fsys = throttledFS{sourceFS: src.fsys, ctx: ctx, t: t}
+	return src, nil
+}
+
+func dialSource(ctx context.Context, connection *db.Connection) (*source, error) {
+	switch {
+	case IsLocalPath(connection.RemotePath):
+		return &source{fsys: localFS{}, root: connection.BasePath, displayRoot: connection.BasePath}, nil
+	case IsSFTPPath(connection.RemotePath):
+		return openSFTPSource(ctx, connection)
+	case IsWebDAVPath(connection.RemotePath):
+		return openWebDAVSource(ctx, connection)
+	case IsS3Path(connection.RemotePath):
+		return openS3Source(ctx, connection)
+	case IsFTPPath(connection.RemotePath):
+		return openFTPSource(ctx, connection)
+	}
+	return openSMBSource(ctx, connection)
+}
+
+// OpenFile はconnectionの記録済みのパスのファイルを開く。
+// アーカイブ内のファイル（例: "scans/bundle.zip!/2024/inv.pdf"）はアーカイブを開いて中身を返す。
+// 返したReadCloserを閉じると接続も閉じる。
+func OpenFile(ctx context.Context, connection *db.Connection, path string) (io.ReadCloser, error) {
+	src, err := openSource(ctx, connection)
+	if err != nil {
+		return nil, err
+	}
+
+	outer, members := splitArchivePath(path)
+	name, err := src.name(outer)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	rc, err := src.fsys.Open(name)
+	if err != nil {
+		src.Close()
+		return nil, fmt.Errorf("failed to open %s: %w", outer, err)
+	}
+	if len(members) > 0 {
+		rc, err = openArchiveMember(rc, outer, members, DefaultScanOptions().ArchiveMaxSize)
+		if err != nil {
+			src.Close()
+			return nil, err
+		}
+	}
+	return &sourceFile{ReadCloser: rc, src: src}, nil
+}
+
+// sourceFile は閉じるときに接続も閉じるファイル。
+type sourceFile struct {
+	io.ReadCloser
+	src *source
+}
+
+func (f *sourceFile) Close() error {
+	err := f.ReadCloser.Close()
+	f.src.Close()
+	return err
+}
+
+// getWithHeaderTimeout はreqを送り、レスポンスヘッダーが届くまでにtimeoutを過ぎたら中断する。
+// ボディの読み出しには期限をかけないので、大きなファイルのダウンロードにも使える。
+func getWithHeaderTimeout(client *http.Client, req *http.Request, timeout time.Duration) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(timeout, cancel)
+	resp, err := client.Do(req.WithContext(ctx))
+	if !timer.Stop() || err != nil {
+		cancel()
+		if err == nil {
+			resp.Body.Close()
+			err = context.DeadlineExceeded
+		}
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
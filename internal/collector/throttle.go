@@ -0,0 +1,364 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/koplec/sokoni/internal/db"
+	"github.com/koplec/sokoni/internal/schedule"
+)
+
+// ThrottleLimits は接続先への負荷の上限。0は無制限。
+type ThrottleLimits struct {
+	Listings float64 // 1秒あたりのディレクトリ一覧の取得数
+	Bytes    int64   // 1秒あたりに読むファイルの中身のバイト数（アーカイブの展開・ダウンロード）
+	Requests int     // 同時に行う要求（一覧・Stat・Open・Read）の数
+}
+
+// Throttle はconnections.throttleから読み取った負荷の上限。時間帯ごとに上限を変えられる。
+type Throttle struct {
+	defaults ThrottleLimits
+	rules    []throttleRule
+}
+
+// throttleRule は時間帯の上限。指定しなかった項目（負の値）は時間帯外の上限に従う。
+type throttleRule struct {
+	window schedule.Window
+	limits ThrottleLimits
+}
+
+// ParseThrottle は ";" 区切りの上限の指定を解析する。空文字列の場合はnilを返す。
+// それぞれは "[[曜日[-曜日] ]HH:MM-HH:MM ]項目=値,..." の形式で、時間帯を省略したものは時間帯外の上限になる。
+// 時間帯が重なる場合は先に書いたものを使う。
+//
+// 項目:
+// - listings=N : 1秒あたりのディレクトリ一覧の取得数（0.5のような小数も可）
+// - bytes=SIZE : 1秒あたりに読むバイト数（KB・MB・GBの接尾辞を受け付ける）
+// - requests=N : 同時に行う要求の数
+//
+// 例: "bytes=50MB; mon-fri 09:00-18:00 listings=5,bytes=2MB,requests=1"
+func ParseThrottle(s string) (*Throttle, error) {
+	var t Throttle
+	hasDefaults := false
+	for _, part := range strings.Split(s, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		var when []string
+		limits := ThrottleLimits{Listings: -1, Bytes: -1, Requests: -1}
+		fields := strings.FieldsFunc(part, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+		for i, field := range fields {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				if i != len(when) {
+					return nil, fmt.Errorf("invalid throttle %q: time window must come before the limits", strings.TrimSpace(part))
+				}
+				when = append(when, field)
+				continue
+			}
+			if err := limits.set(strings.ToLower(key), value); err != nil {
+				return nil, fmt.Errorf("invalid throttle %q: %w", strings.TrimSpace(part), err)
+			}
+		}
+		if len(when) == len(fields) {
+			return nil, fmt.Errorf("invalid throttle %q: no limits", strings.TrimSpace(part))
+		}
+
+		if len(when) == 0 {
+			if hasDefaults {
+				return nil, fmt.Errorf("invalid throttle %q: limits outside of time windows are given twice", strings.TrimSpace(part))
+			}
+			hasDefaults = true
+			t.defaults = limits.or(ThrottleLimits{})
+			continue
+		}
+		window, err := schedule.ParseWindow(strings.Join(when, " "))
+		if err != nil {
+			return nil, err
+		}
+		t.rules = append(t.rules, throttleRule{window: window, limits: limits})
+	}
+	if !hasDefaults && len(t.rules) == 0 {
+		return nil, nil
+	}
+	return &t, nil
+}
+
+func (l *ThrottleLimits) set(key, value string) error {
+	switch key {
+	case "listings":
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("listings must be a non-negative number")
+		}
+		l.Listings = n
+	case "bytes":
+		n, err := parseSize(value)
+		if err != nil {
+			return fmt.Errorf("bytes must be a size such as 10MB")
+		}
+		l.Bytes = n
+	case "requests":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("requests must be a non-negative integer")
+		}
+		l.Requests = n
+	default:
+		return fmt.Errorf("unknown limit %q", key)
+	}
+	return nil
+}
+
+// or は指定しなかった項目をdefaultsで埋める。
+func (l ThrottleLimits) or(defaults ThrottleLimits) ThrottleLimits {
+	if l.Listings < 0 {
+		l.Listings = defaults.Listings
+	}
+	if l.Bytes < 0 {
+		l.Bytes = defaults.Bytes
+	}
+	if l.Requests < 0 {
+		l.Requests = defaults.Requests
+	}
+	return l
+}
+
+// At はtの時点の上限を返す。tはアプリケーションのタイムゾーンで評価する。
+func (t *Throttle) At(now time.Time) ThrottleLimits {
+	for _, r := range t.rules {
+		if r.window.Contains(now) {
+			return r.limits.or(t.defaults)
+		}
+	}
+	return t.defaults
+}
+
+// throttles はconnectionごとの負荷の制限。同じconnectionへのスキャン・監視・ダウンロードで共有する。
+// 上限はプロセスごとにかかる。
+var throttles = struct {
+	sync.Mutex
+	m map[int]*throttle
+}{m: make(map[int]*throttle)}
+
+// connectionThrottle はconnectionのthrottleに従う制限を返す。指定がなければnil。
+// 設定が変わっていれば、そのconnectionを使っている走査にもすぐに反映する。
+func connectionThrottle(connection *db.Connection) (*throttle, error) {
+	config, err := ParseThrottle(getStringValue(connection.Throttle))
+	if err != nil {
+		return nil, err
+	}
+
+	throttles.Lock()
+	defer throttles.Unlock()
+	if config == nil {
+		delete(throttles.m, connection.ID)
+		return nil, nil
+	}
+	t, ok := throttles.m[connection.ID]
+	if !ok {
+		t = &throttle{released: make(chan struct{})}
+		throttles.m[connection.ID] = t
+	}
+	t.mu.Lock()
+	t.config = config
+	t.mu.Unlock()
+	return t, nil
+}
+
+// throttle はThrottleの上限に従って接続先への要求を待たせる。上限は要求のたびに時刻から決める。
+type throttle struct {
+	mu       sync.Mutex
+	config   *Throttle
+	listings bucket
+	bytes    bucket
+	inFlight int
+	released chan struct{} // 要求が終わるたびに閉じて作り直す
+}
+
+// bucket はトークンバケット。容量は1秒分で、足りない分は前借りして返し終わるまで待たせる。
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take はrate（毎秒）で溜まるトークンをn個取り、取れるまでの待ち時間を返す。rateが0以下なら待たない。
+func (b *bucket) take(now time.Time, n, rate float64) time.Duration {
+	if rate <= 0 {
+		b.last = time.Time{}
+		return 0
+	}
+	capacity := max(rate, 1)
+	if b.last.IsZero() {
+		b.tokens = capacity
+	} else {
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*rate, capacity)
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+func (t *throttle) waitListing(ctx context.Context) error {
+	t.mu.Lock()
+	now := time.Now()
+	d := t.listings.take(now, 1, t.config.At(now).Listings)
+	t.mu.Unlock()
+	return sleep(ctx, d)
+}
+
+func (t *throttle) waitBytes(ctx context.Context, n int) error {
+	t.mu.Lock()
+	now := time.Now()
+	d := t.bytes.take(now, float64(n), float64(t.config.At(now).Bytes))
+	t.mu.Unlock()
+	return sleep(ctx, d)
+}
+
+// acquire は同時に行う要求の数が上限を下回るまで待つ。終わったらreleaseを呼ぶこと。
+func (t *throttle) acquire(ctx context.Context) error {
+	for {
+		t.mu.Lock()
+		limit := t.config.At(time.Now()).Requests
+		if limit <= 0 || t.inFlight < limit {
+			t.inFlight++
+			t.mu.Unlock()
+			return nil
+		}
+		released := t.released
+		t.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (t *throttle) release() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inFlight--
+	close(t.released)
+	t.released = make(chan struct{})
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledFS は接続先への要求をthrottleの上限に従って待たせるsourceFS。
+// 接続先の種類によらず、ローカル・SMB・SFTP等の走査に同じ制限をかける。
+type throttledFS struct {
+	sourceFS
+	ctx context.Context
+	t   *throttle
+}
+
+func (f throttledFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := f.t.waitListing(f.ctx); err != nil {
+		return nil, err
+	}
+	if err := f.t.acquire(f.ctx); err != nil {
+		return nil, err
+	}
+	defer f.t.release()
+	return f.sourceFS.ReadDir(name)
+}
+
+func (f throttledFS) Stat(name string) (fs.FileInfo, error) {
+	if err := f.t.acquire(f.ctx); err != nil {
+		return nil, err
+	}
+	defer f.t.release()
+	return f.sourceFS.Stat(name)
+}
+
+func (f throttledFS) Open(name string) (io.ReadCloser, error) {
+	if err := f.t.acquire(f.ctx); err != nil {
+		return nil, err
+	}
+	rc, err := f.sourceFS.Open(name)
+	f.t.release()
+	if err != nil {
+		return nil, err
+	}
+	file := &throttledFile{rc: rc, fs: f}
+	// zipは中央ディレクトリと必要なエントリだけを読めるよう、ReaderAtであればそのまま使えるようにする
+	if ra, ok := rc.(io.ReaderAt); ok {
+		return &throttledFileAt{throttledFile: file, ra: ra}, nil
+	}
+	return file, nil
+}
+
+// throttledFile は読んだバイト数に応じて待たせるファイル。
+type throttledFile struct {
+	rc io.ReadCloser
+	fs throttledFS
+}
+
+func (r *throttledFile) Read(p []byte) (int, error) {
+	if err := r.fs.t.acquire(r.fs.ctx); err != nil {
+		return 0, err
+	}
+	n, err := r.rc.Read(p)
+	r.fs.t.release()
+	if waitErr := r.fs.t.waitBytes(r.fs.ctx, n); waitErr != nil && err == nil {
+		err = waitErr
+	}
+	return n, err
+}
+
+func (r *throttledFile) Close() error {
+	return r.rc.Close()
+}
+
+type throttledFileAt struct {
+	*throttledFile
+	ra io.ReaderAt
+}
+
+func (r *throttledFileAt) ReadAt(p []byte, off int64) (int, error) {
+	if err := r.fs.t.acquire(r.fs.ctx); err != nil {
+		return 0, err
+	}
+	n, err := r.ra.ReadAt(p, off)
+	r.fs.t.release()
+	if waitErr := r.fs.t.waitBytes(r.fs.ctx, n); waitErr != nil && err == nil {
+		err = waitErr
+	}
+	return n, err
+}
+
+// Stat はサイズを調べられるファイル（eachMember参照）であれば、その情報を返す。
+func (r *throttledFileAt) Stat() (fs.FileInfo, error) {
+	st, ok := r.rc.(interface{ Stat() (fs.FileInfo, error) })
+	if !ok {
+		return nil, fmt.Errorf("stat is not supported")
+	}
+	if err := r.fs.t.acquire(r.fs.ctx); err != nil {
+		return nil, err
+	}
+	defer r.fs.t.release()
+	return st.Stat()
+}
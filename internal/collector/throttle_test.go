@@ -0,0 +1,192 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/koplec/sokoni/internal/db"
+	"github.com/koplec/sokoni/internal/model"
+	"github.com/koplec/sokoni/internal/tztime"
+)
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func TestParseThrottle(t *testing.T) {
+	// 2026-10-19は月曜日
+	weekday := time.Date(2026, 10, 19, 12, 0, 0, 0, tztime.Zone())
+	night := time.Date(2026, 10, 19, 23, 0, 0, 0, tztime.Zone())
+	tests := []struct {
+		spec    string
+		at      time.Time
+		want    ThrottleLimits
+		wantErr bool
+	}{
+		{spec: "listings=10,bytes=1MB,requests=2", at: weekday, want: ThrottleLimits{10, 1 << 20, 2}},
+		{spec: "listings=0.5 requests=1", at: night, want: ThrottleLimits{Listings: 0.5, Requests: 1}},
+		// 時間帯に指定しなかった項目は時間帯外の上限に従う
+		{spec: "bytes=50MB,requests=4; mon-fri 09:00-18:00 listings=5,bytes=2MB", at: weekday, want: ThrottleLimits{5, 2 << 20, 4}},
+		{spec: "bytes=50MB,requests=4; mon-fri 09:00-18:00 listings=5,bytes=2MB", at: night, want: ThrottleLimits{0, 50 << 20, 4}},
+		// 時間帯外の上限がなければ無制限
+		{spec: "09:00-18:00 requests=1", at: night, want: ThrottleLimits{}},
+		// 重なる場合は先に書いたもの
+		{spec: "09:00-18:00 requests=1; mon 00:00-24:00 requests=3", at: weekday, want: ThrottleLimits{Requests: 1}},
+		{spec: "requests=1; requests=2", wantErr: true},
+		{spec: "mon-fri 09:00-18:00", wantErr: true},
+		{spec: "requests=1 09:00-18:00", wantErr: true},
+		{spec: "weekdays 09:00-18:00 requests=1", wantErr: true},
+		{spec: "iops=100", wantErr: true},
+		{spec: "bytes=fast", wantErr: true},
+		{spec: "requests=-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		throttle, err := ParseThrottle(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseThrottle(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if err == nil && throttle.At(tt.at) != tt.want {
+			t.Errorf("ParseThrottle(%q).At(%s) = %+v, want %+v", tt.spec, tt.at, throttle.At(tt.at), tt.want)
+		}
+	}
+
+	if throttle, err := ParseThrottle(" ; "); throttle != nil || err != nil {
+		t.Errorf("expected no throttle for an empty spec, got %+v %v", throttle, err)
+	}
+}
+
+func TestBucket(t *testing.T) {
+	var b bucket
+	now := time.Now()
+	// 1秒分（10個）までは待たない
+	for i := 0; i < 10; i++ {
+		if d := b.take(now, 1, 10); d != 0 {
+			t.Fatalf("take %d: expected no wait within the burst, got %s", i, d)
+		}
+	}
+	if d := b.take(now, 1, 10); d != 100*time.Millisecond {
+		t.Errorf("expected 100ms wait once the burst is used, got %s", d)
+	}
+	// 前借りした分も返してから溜まる
+	if d := b.take(now.Add(200*time.Millisecond), 1, 10); d != 0 {
+		t.Errorf("expected no wait after the tokens were refilled, got %s", d)
+	}
+	if d := b.take(now, 5, 0); d != 0 {
+		t.Errorf("expected no wait without a limit, got %s", d)
+	}
+}
+
+func TestConnectionThrottle(t *testing.T) {
+	connection := &db.Connection{ID: 1001, Throttle: stringPtr("requests=1")}
+	first, err := connectionThrottle(connection)
+	if err != nil || first == nil {
+		t.Fatalf("connectionThrottle failed: %v", err)
+	}
+	// 同じconnectionでは制限を共有し、変わった設定はすぐに反映する
+	connection.Throttle = stringPtr("requests=2")
+	second, _ := connectionThrottle(connection)
+	if second != first || second.config.At(time.Now()).Requests != 2 {
+		t.Errorf("expected the throttle to be shared and updated, got %p %p", first, second)
+	}
+	connection.Throttle = nil
+	if third, err := connectionThrottle(connection); third != nil || err != nil {
+		t.Errorf("expected no throttle once it is cleared, got %v %v", third, err)
+	}
+}
+
+// countingFS は同時に処理中の要求の最大数を数える。
+type countingFS struct {
+	sourceFS
+	mu       sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (c *countingFS) Stat(name string) (fs.FileInfo, error) {
+	c.mu.Lock()
+	c.inFlight++
+	c.max = max(c.max, c.inFlight)
+	c.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	c.mu.Lock()
+	c.inFlight--
+	c.mu.Unlock()
+	return c.sourceFS.Stat(name)
+}
+
+func TestThrottledFSRequests(t *testing.T) {
+	dir := t.TempDir()
+	counting := &countingFS{sourceFS: localFS{}}
+	config, _ := ParseThrottle("requests=2")
+	fsys := throttledFS{sourceFS: counting, ctx: context.Background(), t: &throttle{config: config, released: make(chan struct{})}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := fsys.Stat(dir); err != nil {
+				t.Errorf("Stat failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if counting.max != 2 {
+		t.Errorf("expected at most 2 concurrent requests, got %d", counting.max)
+	}
+
+	// 上限に達している間はctxのキャンセルで待つのをやめる
+	ctx, cancel := context.WithCancel(context.Background())
+	blocked := throttledFS{sourceFS: localFS{}, ctx: ctx, t: fsys.t}
+	fsys.t.acquire(context.Background())
+	fsys.t.acquire(context.Background())
+	cancel()
+	if _, err := blocked.Stat(dir); err != context.Canceled {
+		t.Errorf("expected Stat to give up when cancelled, got %v", err)
+	}
+}
+
+func TestThrottledScan(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 30; i++ {
+		os.MkdirAll(filepath.Join(dir, fmt.Sprintf("d%02d", i)), 0755)
+	}
+	os.WriteFile(filepath.Join(dir, "big.pdf"), make([]byte, 96<<10), 0644)
+
+	// ローカルのconnectionの走査にもかかる（31回の一覧のうち20回分は1秒分のバースト）
+	connection := &db.Connection{ID: 1002, BasePath: dir, RemotePath: dir, Throttle: stringPtr("listings=20")}
+	start := time.Now()
+	result, err := ScanConnectionWith(context.Background(), connection, ScanOptions{MaxErrors: -1}, func(model.FileInfo) error { return nil })
+	if err != nil || result.Files != 1 {
+		t.Fatalf("scan failed: %v %+v", err, result)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("expected listings to be throttled, took %s", elapsed)
+	}
+
+	// ファイルの中身は読んだバイト数に応じて待つ。zipを読めるようReaderAtのまま返す
+	connection = &db.Connection{ID: 1003, BasePath: dir, RemotePath: dir, Throttle: stringPtr("bytes=64KB")}
+	rc, err := OpenFile(context.Background(), connection, filepath.Join(dir, "big.pdf"))
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	defer rc.Close()
+	if _, ok := rc.(*sourceFile).ReadCloser.(io.ReaderAt); !ok {
+		t.Errorf("expected throttled file to keep ReadAt")
+	}
+	start = time.Now()
+	if n, err := io.Copy(io.Discard, rc); err != nil || n != 96<<10 {
+		t.Fatalf("read failed: %d %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("expected reads to be throttled, took %s", elapsed)
+	}
+}
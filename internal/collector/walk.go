@@ -0,0 +1,346 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hirochachacha/go-smb2"
+	"github.com/koplec/sokoni/internal/db"
+	"github.com/koplec/sokoni/internal/model"
+	"github.com/koplec/sokoni/internal/tztime"
+)
+
+// dirReader はディレクトリの一覧を返すファイルシステムの抽象。
+// ローカルとSMBで同じ走査・エラー処理を使うために用意している。
+type dirReader interface {
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Stat(name string) (fs.FileInfo, error)
+}
+
+// etagger はETagを返せるfs.FileInfo（WebDAV等）。
+type etagger interface {
+	ETag() string
+}
+
+// entryCounter は一覧を取らずに直下のエントリ数を返せるディレクトリのfs.FileInfo（WebDAVのchildcount等）。
+// 返せない場合はfalseを返す。
+type entryCounter interface {
+	EntryCount() (int, bool)
+}
+
+type localFS struct{}
+
+func (localFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (localFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (localFS) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+type smbFS struct {
+	share *smb2.Share
+}
+
+func (s smbFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	infos, err := s.share.ReadDir(name)
+	entries := make([]fs.DirEntry, 0, len(infos))
+	for _, info := range infos {
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	return entries, err
+}
+
+func (s smbFS) Stat(name string) (fs.FileInfo, error) {
+	return s.share.Stat(name)
+}
+
+func (s smbFS) Open(name string) (io.ReadCloser, error) {
+	return s.share.Open(name)
+}
+
+// walker はdirReaderを再帰的に走査し、PDFファイルをhandleに渡す。
+// 読み取れないディレクトリやファイルはresultに記録して走査を続け、
+// エラー数がMaxErrorsを超えた時点かctxがキャンセルされた時点で中断する。
+type walker struct {
+	ctx    context.Context
+	fsys   sourceFS
+	opts   ScanOptions
+	handle func(model.FileInfo) error
+	result ScanResult
+}
+
+// RacyWindow より前に一覧を取ったディレクトリでないとmtimeを信用しない。
+// 一覧を取った直後の変更はmtimeの粒度によっては前回と同じ値になり得るため。
+// ファイルのmtimeを一覧を取った日時と比べる場合も、この分の余裕を持たせること。
+const RacyWindow = 2 * time.Second
+
+// dirFrame は走査中のディレクトリ1つ分の記録。配下をすべて走査し終えたらDirDoneに渡す。
+type dirFrame struct {
+	DirResult
+	incomplete bool // 一覧を最後まで読めなかった
+}
+
+func newWalker(ctx context.Context, fsys sourceFS, opts ScanOptions, handle func(model.FileInfo) error) *walker {
+	return &walker{ctx: ctx, fsys: fsys, opts: opts, handle: handle}
+}
+
+// run はrootから走査を始めて結果を返す。
+// rootそのものが読めない場合は記録せずにエラーとして返す。
+func (w *walker) run(root, displayRoot string) (*ScanResult, error) {
+	displayRoot = filepath.Clean(displayRoot)
+
+	if err := w.ctx.Err(); err != nil {
+		w.result.Status = StatusFailed
+		return &w.result, err
+	}
+
+	if w.opts.SkipDir != nil && w.opts.SkipDir(displayRoot) {
+		w.result.SkippedDirs++
+		w.result.Status = StatusCompleted
+		return &w.result, nil
+	}
+
+	listedAt := time.Now()
+	entries, err := w.fsys.ReadDir(root)
+	if err != nil {
+		w.result.Status = StatusFailed
+		return &w.result, fmt.Errorf("failed to read directory %s: %w", root, err)
+	}
+
+	frame := &dirFrame{DirResult: DirResult{Path: displayRoot}}
+	frame.State.ListedAt = listedAt
+	frame.State.EntryCount = len(entries)
+	err = w.visit(root, frame, entries)
+	if err == nil {
+		err = w.done(frame)
+	}
+	if err != nil {
+		w.result.Status = StatusFailed
+		return &w.result, err
+	}
+
+	w.result.Status = StatusCompleted
+	if len(w.result.Errors) > 0 {
+		w.result.Status = StatusPartial
+	}
+	return &w.result, nil
+}
+
+// walk はディレクトリを走査する。infoは親の一覧から得たこのディレクトリの情報（なければnil）。
+func (w *walker) walk(dirPath, displayPath string, info fs.FileInfo, parent *dirFrame) error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+
+	// 前回のスキャンで完了済みのディレクトリは配下ごと飛ばす
+	if w.opts.SkipDir != nil && w.opts.SkipDir(displayPath) {
+		w.result.SkippedDirs++
+		return nil
+	}
+
+	// 前回から変わっていないディレクトリは一覧を取り直さない
+	if prev, ok := w.unchanged(displayPath, info); ok {
+		return w.walkUnchanged(dirPath, displayPath, prev)
+	}
+
+	frame := &dirFrame{DirResult: DirResult{Path: displayPath}}
+	frame.State.ListedAt = time.Now()
+	if info != nil {
+		frame.State.ModTime = info.ModTime()
+	}
+
+	entries, err := w.fsys.ReadDir(dirPath)
+	if err != nil {
+		// キャンセルやタイムアウトはエントリ単位のエラーではなく中断として扱う
+		if ctxErr := w.ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err := w.record(parent, displayPath, err); err != nil {
+			return err
+		}
+		// os.ReadDirは途中まで読めたエントリも返すので、あればそれは処理する
+		if len(entries) == 0 {
+			return nil
+		}
+		frame.incomplete = true
+	}
+	frame.State.EntryCount = len(entries)
+
+	if err := w.visit(dirPath, frame, entries); err != nil {
+		return err
+	}
+
+	// 一覧が不完全なディレクトリは完了扱いにせず、記録したエラーは親に引き継ぐ
+	if frame.incomplete {
+		parent.Errors = append(parent.Errors, frame.Errors...)
+		return nil
+	}
+	return w.done(frame)
+}
+
+// unchanged は前回の一覧からディレクトリが変わっていないとみなせる場合にその状態を返す。
+// ディレクトリのmtimeはエントリの追加・削除・名前変更で更新されるので、
+// mtimeが同じなら直下のエントリ構成は前回と同じと判断できる。
+// 接続先がエントリ数も返す場合は、mtimeの分解能が粗くて同じ時刻のまま追加・削除された場合に気づけるよう、前回の数と比べる。
+// mtimeを持たないディレクトリ（S3のプレフィックス等）は常に一覧を取り直す。
+func (w *walker) unchanged(path string, info fs.FileInfo) (db.DirState, bool) {
+	if w.opts.PreviousState == nil || info == nil || info.ModTime().IsZero() {
+		return db.DirState{}, false
+	}
+	prev, ok := w.opts.PreviousState(path)
+	if !ok || !tztime.EqualTime(prev.ModTime, info.ModTime()) {
+		return db.DirState{}, false
+	}
+	if prev.ListedAt.Sub(info.ModTime()) < RacyWindow {
+		return db.DirState{}, false
+	}
+	if c, ok := info.(entryCounter); ok {
+		if n, ok := c.EntryCount(); ok && n != prev.EntryCount {
+			return db.DirState{}, false
+		}
+	}
+	return prev, true
+}
+
+// walkUnchanged は変わっていないディレクトリの直下のファイルを飛ばし、
+// 前回記録したサブディレクトリだけを確認する。
+// 深い階層の変更は祖先のmtimeに反映されないため、サブディレクトリはStatで個別に確認する。
+func (w *walker) walkUnchanged(dirPath, displayPath string, prev db.DirState) error {
+	w.result.UnchangedDirs++
+	w.result.UnchangedFiles += prev.FileCount
+
+	frame := &dirFrame{DirResult: DirResult{Path: displayPath, State: prev, Unchanged: true}}
+	for _, name := range prev.Subdirs {
+		if err := w.ctx.Err(); err != nil {
+			return err
+		}
+		// "bundle.zip!" はアーカイブの仮想ディレクトリ
+		isArchive := strings.HasSuffix(name, archiveMarker)
+		if isArchive && w.opts.ArchiveDepth <= 0 {
+			continue
+		}
+		subPath := filepath.Join(dirPath, strings.TrimSuffix(name, archiveMarker))
+		subDisplay := filepath.Join(displayPath, name)
+		info, err := w.fsys.Stat(subPath)
+		if err != nil {
+			if ctxErr := w.ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			if err := w.record(frame, subDisplay, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if isArchive {
+			err = w.archive(strings.TrimSuffix(subDisplay, archiveMarker), info, w.opener(subPath), 1, frame)
+		} else {
+			err = w.walk(subPath, subDisplay, info, frame)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return w.done(frame)
+}
+
+func (w *walker) visit(dirPath string, frame *dirFrame, entries []fs.DirEntry) error {
+	for _, entry := range entries {
+		fullPath := filepath.Join(frame.Path, entry.Name())
+		if entry.IsDir() {
+			frame.State.Subdirs = append(frame.State.Subdirs, entry.Name())
+
+			// サブディレクトリのmtimeは差分スキャンでの比較と、次回のための記録に使う
+			info, _ := entry.Info()
+
+			// ディレクトリの場合は再帰
+			if err := w.walk(filepath.Join(dirPath, entry.Name()), fullPath, info, frame); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// アーカイブは中のPDFを仮想ディレクトリとして走査する
+		if w.opts.ArchiveDepth > 0 && archiveFormat(entry.Name()) != "" {
+			frame.State.Subdirs = append(frame.State.Subdirs, entry.Name()+archiveMarker)
+			info, err := entry.Info()
+			if err != nil {
+				if err := w.record(frame, fullPath+archiveMarker, err); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := w.archive(fullPath, info, w.opener(filepath.Join(dirPath, entry.Name())), 1, frame); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// .pdfのみ対象
+		if !strings.HasSuffix(strings.ToLower(entry.Name()), ".pdf") {
+			continue
+		}
+
+		// 読めなかったファイルも存在はしているので、削除検出の対象外にするためFilesに含める
+		frame.Files = append(frame.Files, fullPath)
+		frame.State.FileCount++
+
+		info, err := entry.Info()
+		if err != nil {
+			if err := w.record(frame, fullPath, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		file := model.FileInfo{
+			Path:    fullPath,
+			Name:    entry.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+		if e, ok := info.(etagger); ok {
+			file.ETag = e.ETag()
+		}
+		if err := w.handle(file); err != nil {
+			return err
+		}
+		w.result.Files++
+	}
+	return nil
+}
+
+// opener はfsys上のnameを開く関数を返す。
+func (w *walker) opener(name string) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return w.fsys.Open(name)
+	}
+}
+
+func (w *walker) done(frame *dirFrame) error {
+	if w.opts.DirDone == nil {
+		return nil
+	}
+	return w.opts.DirDone(frame.DirResult)
+}
+
+// record はエントリ単位のエラーを記録し、バジェットを超えたらエラーを返す。
+func (w *walker) record(frame *dirFrame, path string, err error) error {
+	e := ScanError{Path: path, Err: err}
+	w.result.Errors = append(w.result.Errors, e)
+	frame.Errors = append(frame.Errors, e)
+	if w.opts.MaxErrors >= 0 && len(w.result.Errors) > w.opts.MaxErrors {
+		return fmt.Errorf("%w: %d errors (max %d)", ErrTooManyErrors, len(w.result.Errors), w.opts.MaxErrors)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/koplec/sokoni/internal/model"
+)
+
+// watchSettle は同じパスへのイベントをまとめて反映するまでの待ち時間。
+// コピー中のPDFは書き込みイベントが続くので、落ち着いてから1回だけ反映する。
+const watchSettle = time.Second
+
+// WatchHandler は監視で検出した変更の反映先。
+type WatchHandler struct {
+	// Upsert は作成・更新されたPDFファイルを受け取る。
+	Upsert func(file model.FileInfo) error
+
+	// Remove は削除（または監視範囲の外へ移動）されたパスを受け取る。
+	// ファイルかディレクトリかは区別できないため、ディレクトリの場合は配下すべてを対象にすること。
+	Remove func(path string) error
+
+	// Resync はイベントを取りこぼした可能性があるときに呼ばれる。
+	// 監視を始めた直後と、inotifyのキューがあふれたときに呼ばれる。
+	// 差分スキャンで変わったディレクトリだけを走査し直すことを想定している。
+	Resync func() error
+}
+
+// localWatcher はローカルのディレクトリツリーをinotify（fsnotify）で監視する。
+type localWatcher struct {
+	ctx     context.Context
+	root    string
+	fsw     *fsnotify.Watcher
+	handler WatchHandler
+	pending map[string]time.Time // 反映待ちのパスと最後にイベントを受けた日時
+}
+
+// WatchLocal はrootを再帰的に監視し、PDFファイルの作成・更新・削除を数秒以内にhandlerへ渡す。
+// 新しくできたディレクトリは監視に加えて配下を走査する。
+// ctxがキャンセルされるとnilを返し、handlerがエラーを返した場合はそのエラーで終了する。
+//
+// inotifyはディレクトリごとに監視を登録するため、fs.inotify.max_user_watches を
+// 超えるディレクトリ数のツリーでは一部が監視されない（その部分はスケジュールされたスキャンで反映される）。
+func WatchLocal(ctx context.Context, root string, handler WatchHandler) error {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to start watcher: %w", err)
+	}
+	defer fsw.Close()
+
+	w := &localWatcher{
+		ctx:     ctx,
+		root:    filepath.Clean(root),
+		fsw:     fsw,
+		handler: handler,
+		pending: make(map[string]time.Time),
+	}
+	if err := fsw.Add(w.root); err != nil {
+		return fmt.Errorf("failed to watch %s: %w", w.root, err)
+	}
+	w.addTree(w.root)
+
+	// 監視を登録するまでの変更を拾う
+	if err := handler.Resync(); err != nil {
+		return err
+	}
+	return w.loop()
+}
+
+func (w *localWatcher) loop() error {
+	ticker := time.NewTicker(watchSettle / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.ctx.Done():
+			return nil
+
+		case event, ok := <-w.fsw.Events:
+			if !ok {
+				return nil
+			}
+			// 属性の変更だけではサイズも更新日時も変わらない
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			w.pending[filepath.Clean(event.Name)] = time.Now()
+
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return nil
+			}
+			if !errors.Is(err, fsnotify.ErrEventOverflow) {
+				log.Printf("Watch error on %s: %v", w.root, err)
+				continue
+			}
+			// どのイベントを取りこぼしたか分からないので、作られたかもしれない
+			// ディレクトリを監視に加え直してから差分スキャンで追いつく
+			log.Printf("Watch queue overflowed on %s, rescanning changed directories", w.root)
+			clear(w.pending)
+			w.addTree(w.root)
+			if err := w.handler.Resync(); err != nil {
+				return err
+			}
+
+		case now := <-ticker.C:
+			if err := w.flush(now); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// flush はwatchSettle以上イベントが来ていないパスを反映する。
+// 親ディレクトリを子より先に処理するためパス順に並べる。
+func (w *localWatcher) flush(now time.Time) error {
+	var ready []string
+	for path, at := range w.pending {
+		if now.Sub(at) >= watchSettle {
+			ready = append(ready, path)
+		}
+	}
+	sort.Strings(ready)
+
+	for _, path := range ready {
+		delete(w.pending, path)
+		if err := w.apply(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply はパスの現在の状態を確認してhandlerに反映する。
+// イベントの種類ではなく現在の状態を見るので、作成直後の削除や名前変更の途中経過は反映されない。
+func (w *localWatcher) apply(path string) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if archiveFormat(path) != "" {
+			// アーカイブの中のファイルは "bundle.zip!/..." として記録されている
+			if err := w.handler.Remove(path + archiveMarker); err != nil {
+				return err
+			}
+		}
+		return w.handler.Remove(path)
+	}
+	if err != nil {
+		log.Printf("Skipped %s: %v", path, err)
+		return nil
+	}
+
+	if info.IsDir() {
+		// 作成・移動されてきたディレクトリ。監視を登録する前に置かれたファイルもあるので配下を走査する
+		w.addTree(path)
+		result, err := newWalker(w.ctx, localFS{}, watchScanOptions(), w.handler.Upsert).run(path, path)
+		if err != nil && w.ctx.Err() == nil {
+			return err
+		}
+		for _, e := range result.Errors {
+			log.Printf("Skipped %s: %v", e.Path, e.Err)
+		}
+		return nil
+	}
+
+	if archiveFormat(info.Name()) != "" && watchScanOptions().ArchiveDepth > 0 {
+		// 中身が入れ替わった場合に備えて、前の中身を消してから読み直す
+		if err := w.handler.Remove(path + archiveMarker); err != nil {
+			return err
+		}
+		result, err := newWalker(w.ctx, localFS{}, watchScanOptions(), w.handler.Upsert).runArchive(path, path)
+		if err != nil && w.ctx.Err() == nil {
+			return err
+		}
+		for _, e := range result.Errors {
+			log.Printf("Skipped %s: %v", e.Path, e.Err)
+		}
+		return nil
+	}
+
+	if !strings.HasSuffix(strings.ToLower(info.Name()), ".pdf") {
+		return nil
+	}
+	return w.handler.Upsert(model.FileInfo{
+		Path:    path,
+		Name:    info.Name(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	})
+}
+
+// watchScanOptions は監視で検出したディレクトリ・アーカイブを走査するときのScanOptions。
+// エラーは記録してログに出すだけなので無制限にし、アーカイブの設定は通常のスキャンに合わせる。
+func watchScanOptions() ScanOptions {
+	defaults := DefaultScanOptions()
+	return ScanOptions{MaxErrors: -1, ArchiveDepth: defaults.ArchiveDepth, ArchiveMaxSize: defaults.ArchiveMaxSize}
+}
+
+// addTree はdir配下のディレクトリをすべて監視に加える。登録済みのディレクトリは何もしない。
+// 読めないディレクトリや監視数の上限に達した場合はログを出して続ける。
+func (w *localWatcher) addTree(dir string) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("Skipped watching %s: %v", path, err)
+			return nil
+		}
+		if !d.IsDir() || path == w.root {
+			return nil
+		}
+		if err := w.fsw.Add(path); err != nil {
+			log.Printf("Skipped watching %s: %v", path, err)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
@@ -0,0 +1,117 @@
+package collector
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/koplec/sokoni/internal/model"
+)
+
+// watchRecorder はWatchHandlerに渡された変更を記録する。
+type watchRecorder struct {
+	mu       sync.Mutex
+	upserted map[string]bool
+	removed  map[string]bool
+	resyncs  int
+}
+
+func newWatchRecorder() *watchRecorder {
+	return &watchRecorder{upserted: map[string]bool{}, removed: map[string]bool{}}
+}
+
+func (r *watchRecorder) handler() WatchHandler {
+	return WatchHandler{
+		Upsert: func(file model.FileInfo) error {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.upserted[file.Path] = true
+			return nil
+		},
+		Remove: func(path string) error {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.removed[path] = true
+			return nil
+		},
+		Resync: func() error {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.resyncs++
+			return nil
+		},
+	}
+}
+
+// waitFor はcondがtrueになるまで待つ。
+func (r *watchRecorder) waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		r.mu.Lock()
+		ok := cond()
+		r.mu.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestWatchLocal(t *testing.T) {
+	root := t.TempDir()
+	os.Mkdir(filepath.Join(root, "existing"), 0755)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rec := newWatchRecorder()
+	done := make(chan error, 1)
+	go func() {
+		done <- WatchLocal(ctx, root, rec.handler())
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("WatchLocal returned error: %v", err)
+		}
+	}()
+
+	// 監視開始時に取りこぼし分の再走査が要求されること
+	rec.waitFor(t, "initial resync", func() bool { return rec.resyncs == 1 })
+
+	// 既存のサブディレクトリへのPDF追加とPDF以外の無視
+	pdf := filepath.Join(root, "existing", "new.pdf")
+	os.WriteFile(pdf, []byte("dummy"), 0644)
+	os.WriteFile(filepath.Join(root, "existing", "note.txt"), []byte("dummy"), 0644)
+	rec.waitFor(t, "upsert of new.pdf", func() bool { return rec.upserted[pdf] })
+	if rec.upserted[filepath.Join(root, "existing", "note.txt")] {
+		t.Errorf("non-PDF file should not be upserted")
+	}
+
+	// 新しいディレクトリは配下ごと反映され、以後も監視されること
+	os.MkdirAll(filepath.Join(root, "added", "deep"), 0755)
+	deep := filepath.Join(root, "added", "deep", "a.pdf")
+	os.WriteFile(deep, []byte("dummy"), 0644)
+	rec.waitFor(t, "upsert in new directory", func() bool { return rec.upserted[deep] })
+
+	later := filepath.Join(root, "added", "deep", "b.pdf")
+	os.WriteFile(later, []byte("dummy"), 0644)
+	rec.waitFor(t, "upsert in watched new directory", func() bool { return rec.upserted[later] })
+
+	// 削除
+	os.Remove(pdf)
+	rec.waitFor(t, "removal of new.pdf", func() bool { return rec.removed[pdf] })
+
+	os.RemoveAll(filepath.Join(root, "added"))
+	rec.waitFor(t, "removal of directory", func() bool { return rec.removed[filepath.Join(root, "added")] })
+}
+
+func TestWatchLocalMissingRoot(t *testing.T) {
+	err := WatchLocal(context.Background(), filepath.Join(t.TempDir(), "missing"), newWatchRecorder().handler())
+	if err == nil {
+		t.Fatal("expected error for missing root")
+	}
+}
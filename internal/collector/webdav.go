@@ -0,0 +1,364 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/koplec/sokoni/internal/db"
+)
+
+const defaultWebDAVRequestTimeout = 30 * time.Second
+
+// WebDAV認証方式
+const (
+	WebDAVAuthBasic  = "basic"  // username/passwordでBasic認証
+	WebDAVAuthBearer = "bearer" // passwordをBearerトークンとして送る
+)
+
+// WebDAVConfig はWebDAV接続のconnections.optionsから読み取った設定。
+type WebDAVConfig struct {
+	Auth           string
+	RequestTimeout time.Duration
+	ScanTimeout    time.Duration // 0の場合はScanOptions.Timeoutを使う
+	WatchInterval  time.Duration // 監視モードの確認間隔。0の場合は既定（1分）
+}
+
+// ParseWebDAVOptions はWebDAV接続のオプション文字列（例: "auth=bearer,request_timeout=1m"）を解析する。
+//
+// 対応するオプション:
+// - auth=basic|bearer  : 認証方式（既定basic）。bearerはpasswordをトークンとして使う
+// - request_timeout=D  : PROPFIND 1回あたりのタイムアウト
+// - scan_timeout=D     : この接続のスキャン全体の期限
+// - watch_interval=D   : 監視モードで変更を確認する間隔
+func ParseWebDAVOptions(options string) (*WebDAVConfig, error) {
+	cfg := &WebDAVConfig{Auth: WebDAVAuthBasic, RequestTimeout: defaultWebDAVRequestTimeout}
+
+	for _, opt := range strings.Split(options, ",") {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(opt, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "auth":
+			switch strings.ToLower(value) {
+			case WebDAVAuthBasic, WebDAVAuthBearer:
+				cfg.Auth = strings.ToLower(value)
+			default:
+				return nil, fmt.Errorf("invalid WebDAV option %q: auth must be basic or bearer", opt)
+			}
+		case "request_timeout", "scan_timeout", "watch_interval":
+			d, err := parseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid WebDAV option %q: must be a positive duration", opt)
+			}
+			switch key {
+			case "request_timeout":
+				cfg.RequestTimeout = d
+			case "scan_timeout":
+				cfg.ScanTimeout = d
+			default:
+				cfg.WatchInterval = d
+			}
+		default:
+			return nil, fmt.Errorf("unknown WebDAV option %q", key)
+		}
+	}
+	return cfg, nil
+}
+
+// PollInterval は監視モードで変更を確認する間隔を返す。
+func (c *WebDAVConfig) PollInterval() time.Duration {
+	if c.WatchInterval > 0 {
+		return c.WatchInterval
+	}
+	return defaultWatchInterval
+}
+
+// IsWebDAVPath はremote_pathがWebDAVのURL（http://またはhttps://）かどうかを返す。
+// Nextcloudの場合は https://host/remote.php/dav/files/USER/path のように指定する。
+func IsWebDAVPath(remotePath string) bool {
+	lower := strings.ToLower(remotePath)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+func parseWebDAVURL(remotePath string) (*url.URL, error) {
+	u, err := url.Parse(remotePath)
+	if err != nil || u.Host == "" || !IsWebDAVPath(remotePath) {
+		return nil, fmt.Errorf("invalid WebDAV URL: %s", remotePath)
+	}
+	if u.User != nil {
+		return nil, fmt.Errorf("invalid WebDAV URL %s: set credentials in the username/password fields", remotePath)
+	}
+	u.RawQuery, u.Fragment = "", ""
+	return u, nil
+}
+
+// PROPFINDで要求するプロパティ
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:">
+  <d:prop>
+    <d:resourcetype/>
+    <d:getcontentlength/>
+    <d:getlastmodified/>
+    <d:getetag/>
+    <d:childcount/>
+  </d:prop>
+</d:propfind>`
+
+type davMultistatus struct {
+	Responses []davResponse `xml:"DAV: response"`
+}
+
+type davResponse struct {
+	Href     string        `xml:"DAV: href"`
+	Propstat []davPropstat `xml:"DAV: propstat"`
+}
+
+type davPropstat struct {
+	Status string `xml:"DAV: status"`
+	Prop   struct {
+		ResourceType struct {
+			Collection *struct{} `xml:"DAV: collection"`
+		} `xml:"DAV: resourcetype"`
+		ContentLength string `xml:"DAV: getcontentlength"`
+		LastModified  string `xml:"DAV: getlastmodified"`
+		ETag          string `xml:"DAV: getetag"`
+		ChildCount    string `xml:"DAV: childcount"` // 対応していないサーバーは返さない
+	} `xml:"DAV: prop"`
+}
+
+// davFileInfo はPROPFINDの結果1件分。ETagと、コレクションの場合は直下のエントリ数（childcount）を返せるfs.FileInfo。
+type davFileInfo struct {
+	name       string
+	size       int64
+	modTime    time.Time
+	isDir      bool
+	etag       string
+	childCount int // -1はサーバーが返さなかった
+}
+
+func (i *davFileInfo) Name() string       { return i.name }
+func (i *davFileInfo) Size() int64        { return i.size }
+func (i *davFileInfo) ModTime() time.Time { return i.modTime }
+func (i *davFileInfo) IsDir() bool        { return i.isDir }
+func (i *davFileInfo) Sys() any           { return nil }
+func (i *davFileInfo) ETag() string       { return i.etag }
+
+func (i *davFileInfo) EntryCount() (int, bool) {
+	return i.childCount, i.isDir && i.childCount >= 0
+}
+
+func (i *davFileInfo) Mode() fs.FileMode {
+	if i.isDir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+// webdavFS はWebDAVのコレクションをPROPFIND（Depth: 1）で一覧するdirReader。
+// 名前はbaseからの相対パス。
+type webdavFS struct {
+	ctx    context.Context
+	client *http.Client
+	base   *url.URL
+	cfg    *WebDAVConfig
+	user   string
+	secret string
+}
+
+func (w *webdavFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	self, infos, err := w.propfind(name, "1")
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]fs.DirEntry, 0, len(infos))
+	for _, info := range infos {
+		if info == self {
+			continue
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	return entries, nil
+}
+
+func (w *webdavFS) Stat(name string) (fs.FileInfo, error) {
+	self, _, err := w.propfind(name, "0")
+	if err != nil {
+		return nil, err
+	}
+	if self == nil {
+		return nil, fmt.Errorf("PROPFIND %s: resource not in response", name)
+	}
+	return self, nil
+}
+
+// resourceURL はbaseからの相対パスnameのURLを返す。
+func (w *webdavFS) resourceURL(name string) *url.URL {
+	u := *w.base
+	u.RawPath = ""
+	u.Path = path.Join(w.base.Path, name)
+	if name == "." || name == "" {
+		u.Path = w.base.Path
+	}
+	return &u
+}
+
+// propfind はnameに対してPROPFINDを行い、name自身と結果のすべてのエントリを返す。
+func (w *webdavFS) propfind(name, depth string) (*davFileInfo, []*davFileInfo, error) {
+	target := w.resourceURL(name)
+	if depth == "1" && !strings.HasSuffix(target.Path, "/") {
+		target.Path += "/" // コレクションのURLは末尾に/を付けるのが正式
+	}
+	ctx, cancel := context.WithTimeout(w.ctx, w.cfg.RequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", target.String(), bytes.NewBufferString(propfindBody))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Depth", depth)
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	w.authorize(req)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMultiStatus {
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, nil, fmt.Errorf("PROPFIND %s: %w", name, fs.ErrNotExist)
+		}
+		return nil, nil, fmt.Errorf("PROPFIND %s: %s", name, resp.Status)
+	}
+
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, nil, fmt.Errorf("PROPFIND %s: invalid response: %w", name, err)
+	}
+
+	selfPath := strings.TrimSuffix(target.Path, "/")
+	var self *davFileInfo
+	infos := make([]*davFileInfo, 0, len(ms.Responses))
+	for _, r := range ms.Responses {
+		info, hrefPath, err := parseDAVResponse(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("PROPFIND %s: %w", name, err)
+		}
+		if info == nil {
+			continue
+		}
+		if hrefPath == selfPath {
+			self = info
+		}
+		infos = append(infos, info)
+	}
+	return self, infos, nil
+}
+
+// Open はnameのファイルをGETで取得する。
+func (w *webdavFS) Open(name string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodGet, w.resourceURL(name).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	w.authorize(req)
+
+	resp, err := getWithHeaderTimeout(w.client, req, w.cfg.RequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("GET %s: %w", name, fs.ErrNotExist)
+		}
+		return nil, fmt.Errorf("GET %s: %s", name, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (w *webdavFS) authorize(req *http.Request) {
+	switch w.cfg.Auth {
+	case WebDAVAuthBearer:
+		req.Header.Set("Authorization", "Bearer "+w.secret)
+	default:
+		if w.user != "" || w.secret != "" {
+			req.SetBasicAuth(w.user, w.secret)
+		}
+	}
+}
+
+// parseDAVResponse はresponse要素1件をdavFileInfoに変換する。
+// 成功（200）のpropstatがない場合はnilを返す。
+func parseDAVResponse(r davResponse) (*davFileInfo, string, error) {
+	href, err := url.Parse(r.Href)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid href %q", r.Href)
+	}
+	hrefPath := strings.TrimSuffix(href.Path, "/")
+
+	for _, ps := range r.Propstat {
+		if !strings.Contains(ps.Status, " 200 ") {
+			continue
+		}
+		info := &davFileInfo{
+			name:       path.Base(hrefPath),
+			isDir:      ps.Prop.ResourceType.Collection != nil,
+			etag:       ps.Prop.ETag,
+			childCount: -1,
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(ps.Prop.ChildCount)); err == nil && n >= 0 {
+			info.childCount = n
+		}
+		if ps.Prop.ContentLength != "" {
+			info.size, _ = strconv.ParseInt(strings.TrimSpace(ps.Prop.ContentLength), 10, 64)
+		}
+		if ps.Prop.LastModified != "" {
+			if t, err := http.ParseTime(strings.TrimSpace(ps.Prop.LastModified)); err == nil {
+				info.modTime = t
+			}
+		}
+		return info, hrefPath, nil
+	}
+	return nil, hrefPath, nil
+}
+
+// openWebDAVSource はremote_pathのコレクションを開く。
+// SMBと同じく、パスはremote_pathのコレクションからの相対パスで記録する。
+func openWebDAVSource(ctx context.Context, connection *db.Connection) (*source, error) {
+	base, err := parseWebDAVURL(connection.RemotePath)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ParseWebDAVOptions(getStringValue(connection.Options))
+	if err != nil {
+		return nil, err
+	}
+
+	fsys := &webdavFS{
+		ctx:    ctx,
+		client: &http.Client{},
+		base:   base,
+		cfg:    cfg,
+		user:   getStringValue(connection.Username),
+		secret: getStringValue(connection.Password),
+	}
+	return &source{fsys: fsys, root: ".", displayRoot: "."}, nil
+}
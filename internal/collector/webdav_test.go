@@ -0,0 +1,217 @@
+package collector
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/koplec/sokoni/internal/db"
+	"github.com/koplec/sokoni/internal/model"
+	"golang.org/x/net/webdav"
+)
+
+// startWebDAVServer はrootを/dav/以下で公開するWebDAVサーバーを起動する。
+// authorizeがfalseを返すリクエストは401にする。
+func startWebDAVServer(t *testing.T, root string, authorize func(*http.Request) bool) *httptest.Server {
+	t.Helper()
+	handler := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.Dir(root),
+		LockSystem: webdav.NewMemLS(),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorize(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func createWebDAVTree(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "Projects", "2024 Q1"), 0755)
+	os.WriteFile(filepath.Join(root, "top.pdf"), []byte("dummy"), 0644)
+	os.WriteFile(filepath.Join(root, "readme.md"), []byte("dummy"), 0644)
+	os.WriteFile(filepath.Join(root, "Projects", "2024 Q1", "見積書.pdf"), []byte("dummy contents"), 0644)
+	return root
+}
+
+func scanWebDAV(t *testing.T, connection *db.Connection) ([]model.FileInfo, error) {
+	t.Helper()
+	var files []model.FileInfo
+	_, err := ScanConnectionWith(context.Background(), connection, ScanOptions{MaxErrors: -1}, func(f model.FileInfo) error {
+		files = append(files, f)
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, err
+}
+
+func TestScanWebDAVBasicAuth(t *testing.T) {
+	root := createWebDAVTree(t)
+	server := startWebDAVServer(t, root, func(r *http.Request) bool {
+		user, pass, ok := r.BasicAuth()
+		return ok && user == "alice" && pass == "secret"
+	})
+
+	user, pass := "alice", "secret"
+	connection := &db.Connection{RemotePath: server.URL + "/dav/", Username: &user, Password: &pass}
+	files, err := scanWebDAV(t, connection)
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+
+	if len(files) != 2 {
+		t.Fatalf("expected 2 PDF files, got %+v", files)
+	}
+	nested := files[0]
+	if nested.Path != "Projects/2024 Q1/見積書.pdf" || nested.Name != "見積書.pdf" {
+		t.Errorf("unexpected nested file: %+v", nested)
+	}
+	if nested.Size != int64(len("dummy contents")) {
+		t.Errorf("expected size from getcontentlength, got %d", nested.Size)
+	}
+	info, _ := os.Stat(filepath.Join(root, "Projects", "2024 Q1", "見積書.pdf"))
+	if !nested.ModTime.Equal(info.ModTime().Truncate(1e9)) {
+		t.Errorf("expected mod time from getlastmodified %v, got %v", info.ModTime(), nested.ModTime)
+	}
+	if nested.ETag == "" {
+		t.Errorf("expected ETag from getetag")
+	}
+	if files[1].Path != "top.pdf" {
+		t.Errorf("unexpected file: %+v", files[1])
+	}
+
+	// ファイルが変わるとETagも変わること
+	os.WriteFile(filepath.Join(root, "top.pdf"), []byte("changed contents"), 0644)
+	changed, err := scanWebDAV(t, connection)
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if changed[1].ETag == files[1].ETag {
+		t.Errorf("expected ETag to change after modification")
+	}
+
+	// 認証に失敗した場合はルートが読めないのでエラー
+	wrong := "wrong"
+	connection.Password = &wrong
+	if _, err := scanWebDAV(t, connection); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected 401 error, got %v", err)
+	}
+}
+
+func TestScanWebDAVBearerAuth(t *testing.T) {
+	root := createWebDAVTree(t)
+	server := startWebDAVServer(t, root, func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Bearer app-token"
+	})
+
+	token, options := "app-token", "auth=bearer"
+	connection := &db.Connection{RemotePath: server.URL + "/dav", Password: &token, Options: &options}
+	files, err := scanWebDAV(t, connection)
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if len(files) != 2 {
+		t.Errorf("expected 2 PDF files, got %+v", files)
+	}
+}
+
+func TestScanWebDAVIncremental(t *testing.T) {
+	root := createWebDAVTree(t)
+	server := startWebDAVServer(t, root, func(r *http.Request) bool { return true })
+	connection := &db.Connection{RemotePath: server.URL + "/dav/"}
+
+	// 1回目の状態を記録し、2回目はmtimeの変わっていないコレクションを一覧しない
+	states := map[string]db.DirState{}
+	opts := ScanOptions{MaxErrors: -1, DirDone: func(dir DirResult) error {
+		dir.State.ListedAt = dir.State.ListedAt.Add(RacyWindow)
+		states[dir.Path] = dir.State
+		return nil
+	}}
+	if _, err := ScanConnectionWith(context.Background(), connection, opts, func(model.FileInfo) error { return nil }); err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+
+	opts.PreviousState = func(path string) (db.DirState, bool) {
+		s, ok := states[path]
+		return s, ok
+	}
+	result, err := ScanConnectionWith(context.Background(), connection, opts, func(model.FileInfo) error { return nil })
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if result.UnchangedDirs != 2 || result.UnchangedFiles != 1 {
+		t.Errorf("expected 2 unchanged collections, got UnchangedDirs=%d UnchangedFiles=%d", result.UnchangedDirs, result.UnchangedFiles)
+	}
+}
+
+func TestParseDAVResponseChildCount(t *testing.T) {
+	const body = `<?xml version="1.0" encoding="utf-8"?>
+<d:multistatus xmlns:d="DAV:">
+  <d:response>
+    <d:href>/dav/counted/</d:href>
+    <d:propstat>
+      <d:prop><d:resourcetype><d:collection/></d:resourcetype><d:childcount>3</d:childcount></d:prop>
+      <d:status>HTTP/1.1 200 OK</d:status>
+    </d:propstat>
+  </d:response>
+  <d:response>
+    <d:href>/dav/plain/</d:href>
+    <d:propstat>
+      <d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop>
+      <d:status>HTTP/1.1 200 OK</d:status>
+    </d:propstat>
+    <d:propstat>
+      <d:prop><d:childcount/></d:prop>
+      <d:status>HTTP/1.1 404 Not Found</d:status>
+    </d:propstat>
+  </d:response>
+</d:multistatus>`
+	var ms davMultistatus
+	if err := xml.Unmarshal([]byte(body), &ms); err != nil {
+		t.Fatalf("failed to parse multistatus: %v", err)
+	}
+
+	counted, _, err := parseDAVResponse(ms.Responses[0])
+	if err != nil {
+		t.Fatalf("parseDAVResponse failed: %v", err)
+	}
+	if n, ok := counted.EntryCount(); !ok || n != 3 {
+		t.Errorf("expected childcount 3, got %d %v", n, ok)
+	}
+	// childcountに対応していないサーバーでは数を返さない
+	plain, _, err := parseDAVResponse(ms.Responses[1])
+	if err != nil {
+		t.Fatalf("parseDAVResponse failed: %v", err)
+	}
+	if _, ok := plain.EntryCount(); ok {
+		t.Errorf("expected no entry count without childcount")
+	}
+}
+
+func TestParseWebDAVOptions(t *testing.T) {
+	cfg, err := ParseWebDAVOptions("auth=Bearer,request_timeout=1m,watch_interval=5m")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Auth != WebDAVAuthBearer || cfg.RequestTimeout.Minutes() != 1 || cfg.PollInterval().Minutes() != 5 {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+
+	for _, invalid := range []string{"auth=digest", "request_timeout=0", "vers=3.0"} {
+		if _, err := ParseWebDAVOptions(invalid); err == nil {
+			t.Errorf("ParseWebDAVOptions(%q) expected error", invalid)
+		}
+	}
+}
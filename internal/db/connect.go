@@ -2,12 +2,110 @@ package db
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func Connect(ctx context.Context) (*pgx.Conn, error) {
-	url := os.Getenv("DATABASE_URL")
-	return pgx.Connect(ctx, url)
+// poolHeadroom は占有される接続のほかに、リースの更新・ジョブの延長・APIのリクエスト等のために空けておく接続の数。
+const poolHeadroom = 2
+
+// Connect はDATABASE_URLのDBへのコネクションプールを作り、接続できることを確認して返す。
+// reservedは接続を占有し続ける処理（並行するスキャンとLISTEN）の数。LISTENもプールの接続を使う（切り離さない）ので、
+// 最大接続数がそのままこのプロセスのDB接続数の上限になる。プールの設定はPoolConfigを参照。
+func Connect(ctx context.Context, reserved int) (*pgxpool.Pool, error) {
+	config, err := PoolConfig(reserved)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return pool, nil
+}
+
+// PoolConfig はDATABASE_URLと環境変数からコネクションプールの設定を作る。
+// DATABASE_URLのpool_max_conns等も使えるが、次の環境変数が設定されていればそちらを優先する。
+// - SOKONI_DB_MAX_CONNS: 最大接続数（既定はmax(4, CPU数, reserved+poolHeadroom)）
+// - SOKONI_DB_MIN_CONNS: 維持する最小接続数（既定0）
+// - SOKONI_DB_MAX_CONN_LIFETIME: 接続を作り直すまでの時間（既定1h）
+// - SOKONI_DB_MAX_CONN_IDLE_TIME: 使われていない接続を閉じるまでの時間（既定30m）
+// - SOKONI_DB_HEALTH_CHECK_PERIOD: 使われていない接続を確認する間隔（既定1m）
+//
+// reservedの処理が接続を占有するとほかの処理が接続を待ち続けるので、最大接続数を明示していて
+// reserved+poolHeadroomに満たない場合はエラーを返す。
+func PoolConfig(reserved int) (*pgxpool.Config, error) {
+	config, err := pgxpool.ParseConfig(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range []struct {
+		env string
+		set func(string) error
+	}{
+		{"SOKONI_DB_MAX_CONNS", intSetter(&config.MaxConns)},
+		{"SOKONI_DB_MIN_CONNS", intSetter(&config.MinConns)},
+		{"SOKONI_DB_MAX_CONN_LIFETIME", durationSetter(&config.MaxConnLifetime)},
+		{"SOKONI_DB_MAX_CONN_IDLE_TIME", durationSetter(&config.MaxConnIdleTime)},
+		{"SOKONI_DB_HEALTH_CHECK_PERIOD", durationSetter(&config.HealthCheckPeriod)},
+	} {
+		s := os.Getenv(v.env)
+		if s == "" {
+			continue
+		}
+		if err := v.set(s); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", v.env, err)
+		}
+	}
+	if config.MaxConns < 1 {
+		return nil, fmt.Errorf("invalid SOKONI_DB_MAX_CONNS: must be at least 1")
+	}
+	if need := int32(reserved + poolHeadroom); reserved > 0 && config.MaxConns < need {
+		if os.Getenv("SOKONI_DB_MAX_CONNS") != "" || strings.Contains(os.Getenv("DATABASE_URL"), "pool_max_conns") {
+			return nil, fmt.Errorf("invalid SOKONI_DB_MAX_CONNS: %d is too small, %d connections are held by scans and listeners (need at least %d)", config.MaxConns, reserved, need)
+		}
+		config.MaxConns = need
+	}
+	if config.MinConns > config.MaxConns {
+		return nil, fmt.Errorf("invalid SOKONI_DB_MIN_CONNS: %d exceeds max conns %d", config.MinConns, config.MaxConns)
+	}
+	return config, nil
+}
+
+func intSetter(dst *int32) func(string) error {
+	return func(s string) error {
+		n, err := strconv.ParseInt(s, 10, 32)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("must not be negative")
+		}
+		*dst = int32(n)
+		return nil
+	}
+}
+
+func durationSetter(dst *time.Duration) func(string) error {
+	return func(s string) error {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("must be positive")
+		}
+		*dst = d
+		return nil
+	}
 }
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPoolConfig(t *testing.T) {
+	t.Setenv("DATABASE_URL", "postgres://sokoni@localhost:5432/sokoni?pool_max_conns=8")
+	t.Setenv("SOKONI_DB_MIN_CONNS", "2")
+	t.Setenv("SOKONI_DB_MAX_CONN_IDLE_TIME", "5m")
+
+	config, err := PoolConfig(0)
+	if err != nil {
+		t.Fatalf("PoolConfig failed: %v", err)
+	}
+	if config.MaxConns != 8 || config.MinConns != 2 || config.MaxConnIdleTime != 5*time.Minute {
+		t.Errorf("unexpected config: max=%d min=%d idle=%s", config.MaxConns, config.MinConns, config.MaxConnIdleTime)
+	}
+
+	// 環境変数はDATABASE_URLの設定より優先する
+	t.Setenv("SOKONI_DB_MAX_CONNS", "16")
+	config, err = PoolConfig(0)
+	if err != nil {
+		t.Fatalf("PoolConfig failed: %v", err)
+	}
+	if config.MaxConns != 16 {
+		t.Errorf("expected max conns 16, got %d", config.MaxConns)
+	}
+
+	for env, value := range map[string]string{
+		"SOKONI_DB_MAX_CONNS":           "0",
+		"SOKONI_DB_MIN_CONNS":           "32",
+		"SOKONI_DB_MAX_CONN_LIFETIME":   "forever",
+		"SOKONI_DB_HEALTH_CHECK_PERIOD": "-1s",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, value)
+			if _, err := PoolConfig(0); err == nil {
+				t.Errorf("expected error for %s=%s", env, value)
+			}
+		})
+	}
+}
+
+func TestPoolConfigReserved(t *testing.T) {
+	t.Setenv("DATABASE_URL", "postgres://sokoni@localhost:5432/sokoni")
+	t.Setenv("SOKONI_DB_MAX_CONNS", "")
+
+	// 占有される接続の分だけ既定の最大接続数を増やす
+	config, err := PoolConfig(64)
+	if err != nil {
+		t.Fatalf("PoolConfig failed: %v", err)
+	}
+	if config.MaxConns != 64+poolHeadroom {
+		t.Errorf("expected max conns %d, got %d", 64+poolHeadroom, config.MaxConns)
+	}
+
+	// 明示した最大接続数が足りなければ始めない
+	t.Setenv("SOKONI_DB_MAX_CONNS", "5")
+	if _, err := PoolConfig(4); err == nil {
+		t.Errorf("expected error when max conns is smaller than the reserved connections")
+	}
+	t.Setenv("SOKONI_DB_MAX_CONNS", "")
+	t.Setenv("DATABASE_URL", "postgres://sokoni@localhost:5432/sokoni?pool_max_conns=5")
+	if _, err := PoolConfig(4); err == nil {
+		t.Errorf("expected error when pool_max_conns is smaller than the reserved connections")
+	}
+	if config, err := PoolConfig(3); err != nil || config.MaxConns != 5 {
+		t.Errorf("expected max conns 5 to be enough, got %v %v", config, err)
+	}
+}
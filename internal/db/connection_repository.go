@@ -2,40 +2,71 @@ package db
 
 import (
 	"context"
+	"fmt"
+	"log"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/koplec/sokoni/internal/schedule"
+	"github.com/koplec/sokoni/internal/tztime"
 )
 
 type Connection struct {
-	ID           int        `json:"id"`
-	Name         string     `json:"name"`
-	BasePath     string     `json:"base_path"`
-	RemotePath   string     `json:"remote_path"`
-	Username     *string    `json:"username,omitempty"`
-	Password     *string    `json:"password,omitempty"`
-	Options      *string    `json:"options,omitempty"`
-	UserID       int        `json:"user_id"`
-	LastScan     *time.Time `json:"last_scan,omitempty"`
-	ScanInterval int        `json:"scan_interval"`
-	AutoScan     bool       `json:"auto_scan"`
-	CreatedAt    time.Time  `json:"-"` // 監査用カラム - APIレスポンスに含めない
-	UpdatedAt    time.Time  `json:"-"` // 監査用カラム - APIレスポンスに含めない
+	ID              int        `json:"id"`
+	Name            string     `json:"name"`
+	BasePath        string     `json:"base_path"`
+	RemotePath      string     `json:"remote_path"`
+	Username        *string    `json:"username,omitempty"`
+	Password        *string    `json:"password,omitempty"`
+	Options         *string    `json:"options,omitempty"`
+	PrivateKey      *string    `json:"private_key,omitempty"`
+	HostKey         *string    `json:"host_key,omitempty"`
+	UserID          int        `json:"user_id"`
+	LastScan        *time.Time `json:"last_scan,omitempty"`
+	ScanInterval    int        `json:"scan_interval"`
+	Schedule        *string    `json:"schedule,omitempty"`
+	BlackoutWindows *string    `json:"blackout_windows,omitempty"`
+	Throttle        *string    `json:"throttle,omitempty"`
+	AutoScan        bool       `json:"auto_scan"`
+	Watch           bool       `json:"watch"`
+	CreatedAt       time.Time  `json:"-"` // 監査用カラム - APIレスポンスに含めない
+	UpdatedAt       time.Time  `json:"-"` // 監査用カラム - APIレスポンスに含めない
+
+	ScanFailures
 }
 
 // APIレスポンス用の構造体（監査カラムを除外）
 type ConnectionResponse struct {
-	ID           int        `json:"id"`
-	Name         string     `json:"name"`
-	BasePath     string     `json:"base_path"`
-	RemotePath   string     `json:"remote_path"`
-	Username     *string    `json:"username,omitempty"`
-	Password     *string    `json:"password,omitempty"`
-	Options      *string    `json:"options,omitempty"`
-	UserID       int        `json:"user_id"`
-	LastScan     *time.Time `json:"last_scan,omitempty"`
-	ScanInterval int        `json:"scan_interval"`
-	AutoScan     bool       `json:"auto_scan"`
+	ID              int        `json:"id"`
+	Name            string     `json:"name"`
+	BasePath        string     `json:"base_path"`
+	RemotePath      string     `json:"remote_path"`
+	Username        *string    `json:"username,omitempty"`
+	Password        *string    `json:"password,omitempty"`
+	Options         *string    `json:"options,omitempty"`
+	HostKey         *string    `json:"host_key,omitempty"` // 秘密鍵はレスポンスに含めない
+	UserID          int        `json:"user_id"`
+	LastScan        *time.Time `json:"last_scan,omitempty"`
+	ScanInterval    int        `json:"scan_interval"`
+	Schedule        *string    `json:"schedule,omitempty"`
+	BlackoutWindows *string    `json:"blackout_windows,omitempty"`
+	Throttle        *string    `json:"throttle,omitempty"`
+	NextScan        *time.Time `json:"next_scan,omitempty"` // 次の定期スキャンの予定（自動スキャンが無効ならなし）
+	AutoScan        bool       `json:"auto_scan"`
+	Watch           bool       `json:"watch"`
+
+	ScanFailures
+}
+
+// ScanFailures は定期スキャンの失敗の記録。失敗が続くと指数バックオフで再試行を遅らせ、
+// 一定回数を超えると定期スキャンを停止する（RecordScanFailure参照）。
+// スキャンが成功するか、connectionの設定を更新すると消える。
+type ScanFailures struct {
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastFailureAt       *time.Time `json:"last_failure_at,omitempty"`
+	LastError           *string    `json:"last_error,omitempty"`
+	SuspendedAt         *time.Time `json:"suspended_at,omitempty"`
+	SuspendedReason     *string    `json:"suspended_reason,omitempty"`
 }
 
 type CreateConnectionRequest struct {
@@ -45,31 +76,115 @@ type CreateConnectionRequest struct {
 	Username     *string `json:"username,omitempty"`
 	Password     *string `json:"password,omitempty"`
 	Options      *string `json:"options,omitempty"`
+	PrivateKey   *string `json:"private_key,omitempty"`
+	HostKey      *string `json:"host_key,omitempty"`
 	UserID       int     `json:"user_id"`
 	ScanInterval *int    `json:"scan_interval,omitempty"`
-	AutoScan     *bool   `json:"auto_scan,omitempty"`
+	// Schedule・BlackoutWindows・Throttleは空文字列を指定すると解除する
+	Schedule        *string `json:"schedule,omitempty"`
+	BlackoutWindows *string `json:"blackout_windows,omitempty"`
+	Throttle        *string `json:"throttle,omitempty"`
+	AutoScan        *bool   `json:"auto_scan,omitempty"`
+	Watch           *bool   `json:"watch,omitempty"`
 }
 
 func (c *Connection) ToResponse() *ConnectionResponse {
 	return &ConnectionResponse{
-		ID:           c.ID,
-		Name:         c.Name,
-		BasePath:     c.BasePath,
-		RemotePath:   c.RemotePath,
-		Username:     c.Username,
-		Password:     c.Password,
-		Options:      c.Options,
-		UserID:       c.UserID,
-		LastScan:     c.LastScan,
-		ScanInterval: c.ScanInterval,
-		AutoScan:     c.AutoScan,
+		ID:              c.ID,
+		Name:            c.Name,
+		BasePath:        c.BasePath,
+		RemotePath:      c.RemotePath,
+		Username:        c.Username,
+		Password:        c.Password,
+		Options:         c.Options,
+		HostKey:         c.HostKey,
+		UserID:          c.UserID,
+		LastScan:        c.LastScan,
+		ScanInterval:    c.ScanInterval,
+		Schedule:        c.Schedule,
+		BlackoutWindows: c.BlackoutWindows,
+		Throttle:        c.Throttle,
+		NextScan:        c.NextScanAt(tztime.Now()),
+		AutoScan:        c.AutoScan,
+		Watch:           c.Watch,
+		ScanFailures:    c.ScanFailures,
+	}
+}
+
+// ScanSchedule はconnectionの定期スキャンの予定を返す。scheduleが未設定ならscan_interval間隔。
+func (c *Connection) ScanSchedule() (*schedule.Schedule, error) {
+	return schedule.Parse(stringValue(c.Schedule), time.Duration(c.ScanInterval)*time.Second, stringValue(c.BlackoutWindows))
+}
+
+// NextScanAt はnow以降で次に定期スキャンする時刻を返す。
+// 自動スキャンが無効な場合、停止中の場合、スケジュールを解析できない場合はnil。
+func (c *Connection) NextScanAt(now time.Time) *time.Time {
+	next, _ := c.nextScan(now)
+	return next
+}
+
+func (c *Connection) nextScan(now time.Time) (*time.Time, error) {
+	if !c.AutoScan || c.SuspendedAt != nil {
+		return nil, nil
+	}
+	s, err := c.ScanSchedule()
+	if err != nil {
+		return nil, err
+	}
+	next := s.Next(c.LastScan, now)
+	// 失敗が続いている間は、スケジュールより後でも指数バックオフの待ち時間が過ぎるまで再試行しない
+	if c.ConsecutiveFailures > 0 && c.LastFailureAt != nil {
+		retry := c.LastFailureAt.Add(schedule.BackoffFromEnv().Delay(c.ConsecutiveFailures))
+		if retry.After(next) {
+			next = s.Next(nil, retry)
+		}
+	}
+	return &next, nil
+}
+
+// isDue はconnectionをnowの時点で定期スキャンすべきかを返す。
+// スケジュールを解析できない場合は（作成時に検証しているので通常は起きないが）スキャンしない。
+func (c *Connection) isDue(now time.Time) bool {
+	next, err := c.nextScan(now)
+	if err != nil {
+		log.Printf("Skipping connection %d with invalid schedule: %v", c.ID, err)
+		return false
+	}
+	return next != nil && !next.After(now)
+}
+
+// suspendReason はsuspendAfter回続けて失敗して定期スキャンを停止したときの理由。
+func suspendReason(failures int, message string) string {
+	return fmt.Sprintf("scheduled scans suspended after %d consecutive failures: %s", failures, message)
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
 	}
+	return *s
 }
 
-func GetConnectionsByUserID(ctx context.Context, conn *pgx.Conn, userID int) ([]*ConnectionResponse, error) {
+const connectionColumns = `id, name, base_path, remote_path, username, password, options, private_key, host_key,
+	user_id, last_scan, scan_interval, schedule, blackout_windows, throttle, auto_scan, watch,
+	consecutive_failures, last_failure_at, last_error, suspended_at, suspended_reason, created_at, updated_at`
+
+func scanConnection(row pgx.Row) (*Connection, error) {
+	var c Connection
+	err := row.Scan(
+		&c.ID, &c.Name, &c.BasePath, &c.RemotePath, &c.Username, &c.Password, &c.Options, &c.PrivateKey, &c.HostKey,
+		&c.UserID, &c.LastScan, &c.ScanInterval, &c.Schedule, &c.BlackoutWindows, &c.Throttle, &c.AutoScan, &c.Watch,
+		&c.ConsecutiveFailures, &c.LastFailureAt, &c.LastError, &c.SuspendedAt, &c.SuspendedReason, &c.CreatedAt, &c.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func GetConnectionsByUserID(ctx context.Context, conn Querier, userID int) ([]*ConnectionResponse, error) {
 	query := `
-		SELECT id, name, base_path, remote_path, username, password, options,
-		       user_id, last_scan, scan_interval, auto_scan, created_at, updated_at
+		SELECT ` + connectionColumns + `
 		FROM connections
 		WHERE user_id = $1
 		ORDER BY created_at DESC
@@ -83,11 +198,7 @@ func GetConnectionsByUserID(ctx context.Context, conn *pgx.Conn, userID int) ([]
 
 	var connections []*ConnectionResponse
 	for rows.Next() {
-		var c Connection
-		err := rows.Scan(
-			&c.ID, &c.Name, &c.BasePath, &c.RemotePath, &c.Username, &c.Password, &c.Options,
-			&c.UserID, &c.LastScan, &c.ScanInterval, &c.AutoScan, &c.CreatedAt, &c.UpdatedAt,
-		)
+		c, err := scanConnection(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -97,27 +208,102 @@ func GetConnectionsByUserID(ctx context.Context, conn *pgx.Conn, userID int) ([]
 	return connections, rows.Err()
 }
 
-func GetConnectionByID(ctx context.Context, conn *pgx.Conn, id int) (*Connection, error) {
+func GetConnectionByID(ctx context.Context, conn Querier, id int) (*Connection, error) {
 	query := `
-		SELECT id, name, base_path, remote_path, username, password, options,
-		       user_id, last_scan, scan_interval, auto_scan, created_at, updated_at
+		SELECT ` + connectionColumns + `
 		FROM connections
 		WHERE id = $1
 	`
 
-	var c Connection
-	err := conn.QueryRow(ctx, query, id).Scan(
-		&c.ID, &c.Name, &c.BasePath, &c.RemotePath, &c.Username, &c.Password, &c.Options,
-		&c.UserID, &c.LastScan, &c.ScanInterval, &c.AutoScan, &c.CreatedAt, &c.UpdatedAt,
-	)
+	return scanConnection(conn.QueryRow(ctx, query, id))
+}
+
+// GetDueConnections は自動スキャンが有効で、スケジュール上スキャンの時刻になったconnectionを返す。
+// cron式と停止時間帯はSQLでは評価できないので、自動スキャンが有効なものを読み込んでから絞り込む。
+func GetDueConnections(ctx context.Context, conn Querier) ([]*Connection, error) {
+	query := `
+		SELECT ` + connectionColumns + `
+		FROM connections
+		WHERE auto_scan = true
+		ORDER BY id
+	`
+
+	rows, err := conn.Query(ctx, query)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return &c, nil
+	now := time.Now()
+	var connections []*Connection
+	for rows.Next() {
+		c, err := scanConnection(rows)
+		if err != nil {
+			return nil, err
+		}
+		if c.isDue(now) {
+			connections = append(connections, c)
+		}
+	}
+
+	return connections, rows.Err()
+}
+
+// GetWatchedConnections はwatchが有効なconnectionを返す。
+func GetWatchedConnections(ctx context.Context, conn Querier) ([]*Connection, error) {
+	query := `
+		SELECT ` + connectionColumns + `
+		FROM connections
+		WHERE watch = true
+		ORDER BY id
+	`
+
+	rows, err := conn.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var connections []*Connection
+	for rows.Next() {
+		c, err := scanConnection(rows)
+		if err != nil {
+			return nil, err
+		}
+		connections = append(connections, c)
+	}
+
+	return connections, rows.Err()
 }
 
-func CreateConnection(ctx context.Context, conn *pgx.Conn, req CreateConnectionRequest) (*ConnectionResponse, error) {
+// UpdateLastScan はconnectionの最終スキャン日時を現在にする。
+// スキャンが成功したので、失敗の記録と定期スキャンの停止も解除する。
+func UpdateLastScan(ctx context.Context, conn Querier, id int) error {
+	_, err := conn.Exec(ctx, `
+		UPDATE connections
+		SET last_scan = now(), consecutive_failures = 0, last_failure_at = NULL, last_error = NULL,
+		    suspended_at = NULL, suspended_reason = NULL
+		WHERE id = $1
+	`, id)
+	return err
+}
+
+// RecordScanFailure は定期スキャンの失敗を記録し、続けて失敗した回数を返す。
+// suspendAfter回（0以下なら無制限）続けて失敗したら定期スキャンを停止し、理由を記録する。
+func RecordScanFailure(ctx context.Context, conn Querier, id int, message string, suspendAfter int) (int, error) {
+	var failures int
+	err := conn.QueryRow(ctx, `
+		UPDATE connections
+		SET consecutive_failures = consecutive_failures + 1, last_failure_at = now(), last_error = $2,
+		    suspended_at = CASE WHEN $3 > 0 AND consecutive_failures + 1 >= $3 THEN COALESCE(suspended_at, now()) ELSE suspended_at END,
+		    suspended_reason = CASE WHEN $3 > 0 AND consecutive_failures + 1 >= $3 THEN COALESCE(suspended_reason, $4) ELSE suspended_reason END
+		WHERE id = $1
+		RETURNING consecutive_failures
+	`, id, message, suspendAfter, suspendReason(suspendAfter, message)).Scan(&failures)
+	return failures, err
+}
+
+func CreateConnection(ctx context.Context, conn Querier, req CreateConnectionRequest) (*ConnectionResponse, error) {
 	scanInterval := 604800 // 1週間デフォルト
 	if req.ScanInterval != nil {
 		scanInterval = *req.ScanInterval
@@ -128,21 +314,21 @@ func CreateConnection(ctx context.Context, conn *pgx.Conn, req CreateConnectionR
 		autoScan = *req.AutoScan
 	}
 
+	watch := false
+	if req.Watch != nil {
+		watch = *req.Watch
+	}
+
 	query := `
-		INSERT INTO connections (name, base_path, remote_path, username, password, options, user_id, scan_interval, auto_scan)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
-		RETURNING id, name, base_path, remote_path, username, password, options,
-		          user_id, last_scan, scan_interval, auto_scan, created_at, updated_at
-	`
+		INSERT INTO connections (name, base_path, remote_path, username, password, options, private_key, host_key,
+		                         user_id, scan_interval, auto_scan, watch, schedule, blackout_windows, throttle)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, NULLIF($13, ''), NULLIF($14, ''), NULLIF($15, ''))
+		RETURNING ` + connectionColumns
 
-	var c Connection
-	err := conn.QueryRow(ctx, query,
-		req.Name, req.BasePath, req.RemotePath, req.Username, req.Password, req.Options,
-		req.UserID, scanInterval, autoScan,
-	).Scan(
-		&c.ID, &c.Name, &c.BasePath, &c.RemotePath, &c.Username, &c.Password, &c.Options,
-		&c.UserID, &c.LastScan, &c.ScanInterval, &c.AutoScan, &c.CreatedAt, &c.UpdatedAt,
-	)
+	c, err := scanConnection(conn.QueryRow(ctx, query,
+		req.Name, req.BasePath, req.RemotePath, req.Username, req.Password, req.Options, req.PrivateKey, req.HostKey,
+		req.UserID, scanInterval, autoScan, watch, req.Schedule, req.BlackoutWindows, req.Throttle,
+	))
 	if err != nil {
 		return nil, err
 	}
@@ -150,24 +336,31 @@ func CreateConnection(ctx context.Context, conn *pgx.Conn, req CreateConnectionR
 	return c.ToResponse(), nil
 }
 
-func UpdateConnection(ctx context.Context, conn *pgx.Conn, id int, userID int, req CreateConnectionRequest) (*ConnectionResponse, error) {
+// UpdateConnection はconnectionの設定を更新する。接続先や認証情報を直した後にすぐ再試行できるよう、
+// 失敗の記録と定期スキャンの停止も解除する。
+// 秘密鍵はレスポンスに含めないので、取得した設定を送り返すと省略される。private_keyとhost_keyは省略すると保存済みの値を残し、
+// 空文字列を指定すると解除する。
+func UpdateConnection(ctx context.Context, conn Querier, id int, userID int, req CreateConnectionRequest) (*ConnectionResponse, error) {
 	query := `
 		UPDATE connections 
 		SET name = $3, base_path = $4, remote_path = $5, username = $6, password = $7, options = $8,
-		    scan_interval = COALESCE($9, scan_interval), auto_scan = COALESCE($10, auto_scan), updated_at = now()
+		    private_key = CASE WHEN $9::text IS NULL THEN private_key ELSE NULLIF($9, '') END,
+		    host_key = CASE WHEN $10::text IS NULL THEN host_key ELSE NULLIF($10, '') END,
+		    scan_interval = COALESCE($11, scan_interval), auto_scan = COALESCE($12, auto_scan),
+		    watch = COALESCE($13, watch),
+		    schedule = CASE WHEN $14::text IS NULL THEN schedule ELSE NULLIF($14, '') END,
+		    blackout_windows = CASE WHEN $15::text IS NULL THEN blackout_windows ELSE NULLIF($15, '') END,
+		    throttle = CASE WHEN $16::text IS NULL THEN throttle ELSE NULLIF($16, '') END,
+		    consecutive_failures = 0, last_failure_at = NULL, last_error = NULL, suspended_at = NULL, suspended_reason = NULL,
+		    updated_at = now()
 		WHERE id = $1 AND user_id = $2
-		RETURNING id, name, base_path, remote_path, username, password, options,
-		          user_id, last_scan, scan_interval, auto_scan, created_at, updated_at
-	`
+		RETURNING ` + connectionColumns
 
-	var c Connection
-	err := conn.QueryRow(ctx, query,
+	c, err := scanConnection(conn.QueryRow(ctx, query,
 		id, userID, req.Name, req.BasePath, req.RemotePath, req.Username, req.Password, req.Options,
-		req.ScanInterval, req.AutoScan,
-	).Scan(
-		&c.ID, &c.Name, &c.BasePath, &c.RemotePath, &c.Username, &c.Password, &c.Options,
-		&c.UserID, &c.LastScan, &c.ScanInterval, &c.AutoScan, &c.CreatedAt, &c.UpdatedAt,
-	)
+		req.PrivateKey, req.HostKey, req.ScanInterval, req.AutoScan, req.Watch, req.Schedule, req.BlackoutWindows,
+		req.Throttle,
+	))
 	if err != nil {
 		return nil, err
 	}
@@ -175,7 +368,7 @@ func UpdateConnection(ctx context.Context, conn *pgx.Conn, id int, userID int, r
 	return c.ToResponse(), nil
 }
 
-func DeleteConnection(ctx context.Context, conn *pgx.Conn, id int, userID int) error {
+func DeleteConnection(ctx context.Context, conn Querier, id int, userID int) error {
 	result, err := conn.Exec(ctx, "DELETE FROM connections WHERE id = $1 AND user_id = $2", id, userID)
 	if err != nil {
 		return err
@@ -0,0 +1,132 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// EventChannel は変更を知らせるLISTEN/NOTIFYのチャンネル。
+const EventChannel = "sokoni_events"
+
+// 変更の種類
+const (
+	EventConnectionCreated = "connection_created"
+	EventConnectionUpdated = "connection_updated" // スケジュールや監視の設定が変わった可能性がある
+	EventConnectionDeleted = "connection_deleted"
+	EventScanRequested     = "scan_requested" // スキャンジョブが積まれた
+	EventJobCancelled      = "job_cancelled"  // 実行中のジョブの取り消しを頼んだ
+	// EventResync は受け取れなかった通知がある可能性を表す（LISTENの接続を張り直したとき）。
+	// 受け取った側はすべてを確認し直すこと。
+	EventResync = "resync"
+)
+
+// listenRetryInterval はLISTENの接続が切れたときに張り直すまでの待ち時間。
+const listenRetryInterval = 5 * time.Second
+
+// eventBuffer は受け取った変更を、受け取る側が読むまで溜めておく件数。
+const eventBuffer = 64
+
+// Event はNOTIFYで知らせる変更。
+type Event struct {
+	Type         string `json:"type"`
+	ConnectionID int    `json:"connection_id,omitempty"`
+	JobID        int    `json:"job_id,omitempty"`
+}
+
+// PublishEvent はEventChannelにeventを通知する。
+// トランザクションの中で呼んだ場合、通知はコミットしたときに届く。
+func PublishEvent(ctx context.Context, conn Querier, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec(ctx, "SELECT pg_notify($1, $2)", EventChannel, string(payload))
+	return err
+}
+
+// ListenEvents はEventChannelをLISTENし、届いた変更を返すチャネルに送る。チャネルはctxがキャンセルされると閉じる。
+// LISTENにはプールから取り出した接続を占有する（プールの最大接続数に含まれる）。接続が切れた場合はlistenRetryIntervalごとに張り直し、
+// その間の通知は届かないのでEventResyncを送る。
+func ListenEvents(ctx context.Context, pool *pgxpool.Pool) (<-chan Event, error) {
+	c, err := listen(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan Event, eventBuffer)
+	go func() {
+		defer close(events)
+		for {
+			err := receiveEvents(ctx, c.Conn(), events)
+			unlisten(c)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Event listener disconnected: %v (reconnecting in %s)", err, listenRetryInterval)
+
+			for {
+				select {
+				case <-time.After(listenRetryInterval):
+				case <-ctx.Done():
+					return
+				}
+				if c, err = listen(ctx, pool); err == nil {
+					break
+				}
+				log.Printf("Failed to reconnect event listener: %v", err)
+			}
+			select {
+			case events <- Event{Type: EventResync}:
+			case <-ctx.Done():
+				unlisten(c)
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// listen はプールから接続を取り出してEventChannelをLISTENする。
+// 接続はプールから切り離さないので、LISTENしている間もプールの最大接続数に数えられる。使い終わったらunlistenで返す。
+func listen(ctx context.Context, pool *pgxpool.Pool) (*pgxpool.Conn, error) {
+	c, err := pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Exec(ctx, "LISTEN "+pgx.Identifier{EventChannel}.Sanitize()); err != nil {
+		unlisten(c)
+		return nil, err
+	}
+	return c, nil
+}
+
+// unlisten はLISTENした接続を閉じてプールに返す。LISTENしたままの接続をほかの処理に使わせないよう、
+// 閉じてから返すことでプールに破棄させる（プールは必要になれば新しい接続を作る）。
+func unlisten(c *pgxpool.Conn) {
+	c.Conn().Close(context.Background())
+	c.Release()
+}
+
+func receiveEvents(ctx context.Context, c *pgx.Conn, events chan<- Event) error {
+	for {
+		n, err := c.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		var event Event
+		if err := json.Unmarshal([]byte(n.Payload), &event); err != nil {
+			log.Printf("Ignoring invalid event %q: %v", n.Payload, err)
+			continue
+		}
+		select {
+		case events <- event:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
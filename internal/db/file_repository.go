@@ -2,26 +2,151 @@ package db
 
 import (
 	"context"
+	"fmt"
+	"path/filepath"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/koplec/sokoni/internal/model"
 )
 
-func InsertFile(ctx context.Context, conn *pgx.Conn, connectionID int, file model.FileInfo) error {
+// FileBatchSize はUpsertFilesやCommitScanBatchに1回で渡すファイル数の目安。
+// COPYは件数が多いほど1件あたりの往復が減るが、1トランザクションが長くなりすぎないようにしている。
+const FileBatchSize = 1000
+
+func InsertFile(ctx context.Context, conn Querier, connectionID int, file model.FileInfo) error {
 	_, err := conn.Exec(ctx, `
-	INSERT into files (connection_id, path, size, name, mod_time)
-	VALUES ($1, $2, $3, $4, $5)
-	ON CONFLICT (path) DO UPDATE
+	INSERT into files (connection_id, path, size, name, mod_time, dir_path, etag)
+	VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''))
+	ON CONFLICT (connection_id, path) DO UPDATE
 	SET size = EXCLUDED.size, 
 		mod_time = EXCLUDED.mod_time,
+		etag = EXCLUDED.etag,
 		updated_at = now()
-	`, connectionID, file.Path, file.Size, file.Name, file.ModTime)
+	`, connectionID, file.Path, file.Size, file.Name, file.ModTime, filepath.Dir(file.Path), file.ETag)
 	return err
 }
 
-func SearchFilesByName(ctx context.Context, conn *pgx.Conn, query string) ([]model.FileInfo, error) {
+// UpsertFiles はfilesを1つのトランザクションでまとめて書き込む（upsertFileBatch）。
+// 戻り値は実際に書き込んだ（新規または変更のあった）行数。
+func UpsertFiles(ctx context.Context, conn Querier, connectionID int, files []model.FileInfo) (int64, error) {
+	if len(files) == 0 {
+		return 0, nil
+	}
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	written, err := upsertFileBatch(ctx, tx, connectionID, files)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return written, nil
+}
+
+// stagingColumns はupsertFileBatchでCOPYする一時テーブルの列。
+var stagingColumns = []string{"ord", "path", "name", "size", "mod_time", "dir_path", "etag"}
+
+// upsertFileBatch は複数のファイル情報をCOPYで一時テーブルに送り、1つの文でfilesにUPSERT（INSERT or UPDATE）する。
+// 新規ファイルは挿入し、既存ファイルはサイズ・更新日時・ETagのいずれかが変わった場合だけ更新する。
+// 同じパスが複数回含まれる場合は後のものを使う。戻り値は実際に書き込んだ行数。
+//
+// 一時テーブルはセッションごとに1度だけ作られ、コミット時に中身が消える（ON COMMIT DELETE ROWS）。
+// 1つのトランザクションで何度呼んでも前の呼び出しの行を書き込み直さないよう、COPYの前に空にする。
+func upsertFileBatch(ctx context.Context, tx pgx.Tx, connectionID int, files []model.FileInfo) (int64, error) {
+	if len(files) == 0 {
+		return 0, nil
+	}
+
+	_, err := tx.Exec(ctx, `
+		CREATE TEMP TABLE IF NOT EXISTS files_staging (
+			ord INT NOT NULL,
+			path TEXT NOT NULL,
+			name TEXT NOT NULL,
+			size BIGINT,
+			mod_time TIMESTAMP WITH TIME ZONE,
+			dir_path TEXT NOT NULL,
+			etag TEXT
+		) ON COMMIT DELETE ROWS
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create staging table: %w", err)
+	}
+	if _, err := tx.Exec(ctx, "TRUNCATE files_staging"); err != nil {
+		return 0, fmt.Errorf("failed to clear staging table: %w", err)
+	}
+
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"files_staging"}, stagingColumns,
+		pgx.CopyFromSlice(len(files), func(i int) ([]any, error) {
+			f := files[i]
+			return []any{i, f.Path, f.Name, f.Size, f.ModTime, filepath.Dir(f.Path), f.ETag}, nil
+		}))
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy %d files: %w", len(files), err)
+	}
+
+	// ON CONFLICT DO UPDATEは同じ行を2回更新できないので、パスごとに最後の1件にしてから反映する
+	result, err := tx.Exec(ctx, `
+		INSERT INTO files (connection_id, path, size, name, mod_time, dir_path, etag)
+		SELECT DISTINCT ON (path) $1, path, size, name, mod_time, dir_path, NULLIF(etag, '')
+		FROM files_staging
+		ORDER BY path, ord DESC
+		ON CONFLICT (connection_id, path) DO UPDATE
+		SET size = EXCLUDED.size,
+			mod_time = EXCLUDED.mod_time,
+			etag = EXCLUDED.etag,
+			updated_at = now()
+		WHERE files.size IS DISTINCT FROM EXCLUDED.size
+		OR files.mod_time IS DISTINCT FROM EXCLUDED.mod_time
+		OR files.etag IS DISTINCT FROM EXCLUDED.etag
+	`, connectionID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to merge %d files: %w", len(files), err)
+	}
+	return result.RowsAffected(), nil
+}
+
+// DeleteFilesUnder はconnectionのファイルのうち、pathそのもの、またはpath配下のものを削除する。
+// pathがファイルかディレクトリか分からない場合（監視で削除を検出したとき等）に使う。
+func DeleteFilesUnder(ctx context.Context, conn Querier, connectionID int, path string) (int64, error) {
+	result, err := conn.Exec(ctx, `
+		DELETE FROM files
+		WHERE connection_id = $1 AND (path = $2 OR starts_with(path, $2 || '/'))
+	`, connectionID, path)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+// GetFileByPath はconnectionのpathのファイルを返す。見つからない場合はpgx.ErrNoRows。
+func GetFileByPath(ctx context.Context, conn Querier, connectionID int, path string) (model.FileInfo, error) {
+	var file model.FileInfo
+	var etag *string
+	err := conn.QueryRow(ctx, `
+		SELECT path, name, size, mod_time, etag
+		FROM files
+		WHERE connection_id = $1 AND path = $2
+	`, connectionID, path).Scan(&file.Path, &file.Name, &file.Size, &file.ModTime, &etag)
+	if etag != nil {
+		file.ETag = *etag
+	}
+	return file, err
+}
+
+// FileSearchResult はファイル名検索の結果。パスはconnectionごとに一意なので、ファイルを指すにはConnectionIDも使う。
+type FileSearchResult struct {
+	model.FileInfo
+	ConnectionID int
+}
+
+func SearchFilesByName(ctx context.Context, conn Querier, query string) ([]FileSearchResult, error) {
 	rows, err := conn.Query(ctx, `
-		SELECT path, name, size, mod_time 
+		SELECT connection_id, path, name, size, mod_time 
 		FROM files 
 		WHERE name ILIKE '%' || $1 || '%'
 		ORDER BY name
@@ -31,13 +156,42 @@ func SearchFilesByName(ctx context.Context, conn *pgx.Conn, query string) ([]mod
 	}
 	defer rows.Close()
 
+	var files []FileSearchResult
+	for rows.Next() {
+		var file FileSearchResult
+		err := rows.Scan(&file.ConnectionID, &file.Path, &file.Name, &file.Size, &file.ModTime)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	return files, rows.Err()
+}
+
+// ListFiles はconnectionのファイルをパス順に返す。
+func ListFiles(ctx context.Context, conn Querier, connectionID int) ([]model.FileInfo, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT path, name, size, mod_time, etag
+		FROM files
+		WHERE connection_id = $1
+		ORDER BY path
+	`, connectionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
 	var files []model.FileInfo
 	for rows.Next() {
 		var file model.FileInfo
-		err := rows.Scan(&file.Path, &file.Name, &file.Size, &file.ModTime)
-		if err != nil {
+		var etag *string
+		if err := rows.Scan(&file.Path, &file.Name, &file.Size, &file.ModTime, &etag); err != nil {
 			return nil, err
 		}
+		if etag != nil {
+			file.ETag = *etag
+		}
 		files = append(files, file)
 	}
 
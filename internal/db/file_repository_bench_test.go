@@ -0,0 +1,113 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/joho/godotenv"
+	"github.com/koplec/sokoni/internal/model"
+)
+
+// benchFileCount は1回の反復で書き込むファイル数（大きなNASの1回のスキャンを想定）。
+const benchFileCount = 100_000
+
+// setupBenchConnection はベンチマーク用のconnectionを作り、終了時に（ファイルごと）削除する。
+// DBに接続できない場合はスキップする。
+func setupBenchConnection(b *testing.B) (*pgxpool.Pool, int) {
+	b.Helper()
+	godotenv.Load(filepath.Join("..", "..", "test.env"))
+	ctx := context.Background()
+	pool, err := Connect(ctx, 0)
+	if err != nil {
+		b.Skipf("Database connection failed: %v", err)
+	}
+	b.Cleanup(pool.Close)
+
+	var connectionID int
+	err = pool.QueryRow(ctx, `
+		INSERT INTO connections (name, base_path, remote_path) VALUES ('bench', '/bench', '/bench')
+		RETURNING id
+	`).Scan(&connectionID)
+	if err != nil {
+		b.Fatalf("failed to insert connection: %v", err)
+	}
+	b.Cleanup(func() {
+		pool.Exec(ctx, "DELETE FROM connections WHERE id = $1", connectionID)
+	})
+	return pool, connectionID
+}
+
+func benchFiles(prefix string, n int) []model.FileInfo {
+	modTime := time.Now().Truncate(time.Second)
+	files := make([]model.FileInfo, n)
+	for i := range files {
+		name := fmt.Sprintf("invoice-%06d.pdf", i)
+		files[i] = model.FileInfo{
+			Path:    fmt.Sprintf("%s/%03d/%s", prefix, i/1000, name),
+			Name:    name,
+			Size:    int64(i),
+			ModTime: modTime,
+		}
+	}
+	return files
+}
+
+// BenchmarkUpsertFiles はFileBatchSize件ずつCOPYで書き込むときのスループットを測る。
+// 新規の行と、変更がなく書き込みを省く行（2回目のスキャン）の両方を測る。
+//
+//	go test -run '^$' -bench UpsertFiles -benchtime 3x ./internal/db
+func BenchmarkUpsertFiles(b *testing.B) {
+	pool, connectionID := setupBenchConnection(b)
+	ctx := context.Background()
+
+	upsertAll := func(b *testing.B, files []model.FileInfo) {
+		for start := 0; start < len(files); start += FileBatchSize {
+			end := min(start+FileBatchSize, len(files))
+			if _, err := UpsertFiles(ctx, pool, connectionID, files[start:end]); err != nil {
+				b.Fatalf("UpsertFiles failed: %v", err)
+			}
+		}
+	}
+
+	b.Run("insert", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			files := benchFiles(fmt.Sprintf("/bench/insert-%d-%d", time.Now().UnixNano(), i), benchFileCount)
+			b.StartTimer()
+			upsertAll(b, files)
+		}
+		b.ReportMetric(float64(benchFileCount*b.N)/b.Elapsed().Seconds(), "files/s")
+	})
+
+	b.Run("unchanged", func(b *testing.B) {
+		files := benchFiles(fmt.Sprintf("/bench/unchanged-%d", time.Now().UnixNano()), benchFileCount)
+		upsertAll(b, files)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			upsertAll(b, files)
+		}
+		b.ReportMetric(float64(benchFileCount*b.N)/b.Elapsed().Seconds(), "files/s")
+	})
+}
+
+// BenchmarkInsertFile は比較のため、1件ずつInsertFileで書き込むときのスループットを測る。
+func BenchmarkInsertFile(b *testing.B) {
+	pool, connectionID := setupBenchConnection(b)
+	ctx := context.Background()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		files := benchFiles(fmt.Sprintf("/bench/row-%d-%d", time.Now().UnixNano(), i), benchFileCount)
+		b.StartTimer()
+		for _, f := range files {
+			if err := InsertFile(ctx, pool, connectionID, f); err != nil {
+				b.Fatalf("InsertFile failed: %v", err)
+			}
+		}
+	}
+	b.ReportMetric(float64(benchFileCount*b.N)/b.Elapsed().Seconds(), "files/s")
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
@@ -104,3 +105,53 @@ func TestInsertFile(t *testing.T) {
 	}
 
 }
+
+// TestUpsertFileBatchTwice は1つのトランザクションで2回書き込んでも、前の呼び出しの行を書き込み直さないことを確かめる。
+func TestUpsertFileBatchTwice(t *testing.T) {
+	godotenv.Load(filepath.Join("..", "..", "test.env"))
+	ctx := context.Background()
+	pool, err := Connect(ctx, 0)
+	if err != nil {
+		t.Skipf("Database connection failed: %v", err)
+	}
+	defer pool.Close()
+
+	var connectionID int
+	err = pool.QueryRow(ctx, `
+		INSERT INTO connections (name, base_path, remote_path) VALUES ('staging-test', '/staging', '/staging')
+		RETURNING id
+	`).Scan(&connectionID)
+	if err != nil {
+		t.Fatalf("failed to insert connection: %v", err)
+	}
+	defer pool.Exec(ctx, "DELETE FROM connections WHERE id = $1", connectionID)
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	modTime := tztime.Now().Truncate(time.Second)
+	prefix := fmt.Sprintf("/staging-%d", time.Now().UnixNano())
+	first := model.FileInfo{Path: prefix + "/first.pdf", Name: "first.pdf", Size: 1, ModTime: modTime}
+	second := model.FileInfo{Path: prefix + "/second.pdf", Name: "second.pdf", Size: 1, ModTime: modTime}
+	if _, err := upsertFileBatch(ctx, tx, connectionID, []model.FileInfo{first}); err != nil {
+		t.Fatalf("upsertFileBatch failed: %v", err)
+	}
+	// 1回目の行が一時テーブルに残っていれば、変えたサイズを元に戻してしまう
+	if _, err := tx.Exec(ctx, "UPDATE files SET size = 5 WHERE connection_id = $1 AND path = $2", connectionID, first.Path); err != nil {
+		t.Fatalf("failed to update file: %v", err)
+	}
+	written, err := upsertFileBatch(ctx, tx, connectionID, []model.FileInfo{second})
+	if err != nil {
+		t.Fatalf("upsertFileBatch failed: %v", err)
+	}
+	var size int64
+	if err := tx.QueryRow(ctx, "SELECT size FROM files WHERE connection_id = $1 AND path = $2", connectionID, first.Path).Scan(&size); err != nil {
+		t.Fatalf("failed to fetch file: %v", err)
+	}
+	if written != 1 || size != 5 {
+		t.Errorf("expected only the second batch to be written, got %d rows written and size %d", written, size)
+	}
+}
@@ -0,0 +1,260 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ジョブの種類
+const (
+	JobTypeScan = "scan" // connectionのスキャン
+)
+
+// ジョブの状態
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobDead      = "dead" // 再試行の上限に達したか、再試行しても成功しない失敗（デッドレター）
+	JobCancelled = "cancelled"
+)
+
+// ジョブの優先度。大きいものから取り出す。
+const (
+	JobPriorityScheduled = 0  // スケジューラが積んだもの
+	JobPriorityManual    = 10 // APIやCLIから利用者が頼んだもの
+)
+
+// DefaultJobMaxAttempts はEnqueueJobRequest.MaxAttemptsが0のときの再試行の上限。
+const DefaultJobMaxAttempts = 3
+
+type Job struct {
+	ID                int             `json:"id"`
+	Type              string          `json:"type"`
+	ConnectionID      *int            `json:"connection_id,omitempty"`
+	Payload           json.RawMessage `json:"payload"`
+	Priority          int             `json:"priority"`
+	Status            string          `json:"status"`
+	Attempts          int             `json:"attempts"`
+	MaxAttempts       int             `json:"max_attempts"`
+	DedupeKey         *string         `json:"dedupe_key,omitempty"`
+	RunAfter          time.Time       `json:"run_after"`
+	LockedBy          *string         `json:"locked_by,omitempty"`
+	LockedUntil       *time.Time      `json:"locked_until,omitempty"`
+	LastError         *string         `json:"last_error,omitempty"`
+	CancelRequestedAt *time.Time      `json:"cancel_requested_at,omitempty"` // 実行中に取り消しを頼まれた日時
+	StartedAt         *time.Time      `json:"started_at,omitempty"`
+	FinishedAt        *time.Time      `json:"finished_at,omitempty"`
+	CreatedAt         time.Time       `json:"created_at"`
+}
+
+// EnqueueJobRequest はキューに積むジョブ。
+type EnqueueJobRequest struct {
+	Type         string
+	ConnectionID *int
+	Payload      json.RawMessage // nilなら{}
+	Priority     int
+	MaxAttempts  int     // 0ならDefaultJobMaxAttempts
+	DedupeKey    *string // 同じキーの待機中・実行中のジョブがあれば積まない
+}
+
+const jobColumns = `id, type, connection_id, payload, priority, status, attempts, max_attempts, dedupe_key,
+	run_after, locked_by, locked_until, last_error, cancel_requested_at, started_at, finished_at, created_at`
+
+func scanJob(row pgx.Row) (*Job, error) {
+	var j Job
+	err := row.Scan(
+		&j.ID, &j.Type, &j.ConnectionID, &j.Payload, &j.Priority, &j.Status, &j.Attempts, &j.MaxAttempts, &j.DedupeKey,
+		&j.RunAfter, &j.LockedBy, &j.LockedUntil, &j.LastError, &j.CancelRequestedAt, &j.StartedAt, &j.FinishedAt, &j.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// normalize は省略された項目を既定値にする。
+func (req EnqueueJobRequest) normalize() EnqueueJobRequest {
+	if req.Payload == nil {
+		req.Payload = json.RawMessage(`{}`)
+	}
+	if req.MaxAttempts <= 0 {
+		req.MaxAttempts = DefaultJobMaxAttempts
+	}
+	return req
+}
+
+// EnqueueJob はジョブをキューに積む。DedupeKeyが同じ待機中・実行中のジョブがあれば積まずに
+// そのジョブを返し、2つ目の戻り値をfalseにする。
+func EnqueueJob(ctx context.Context, conn Querier, req EnqueueJobRequest) (*Job, bool, error) {
+	req = req.normalize()
+	// 既存のジョブがちょうど終わった場合に備えて、積み直しを数回試す
+	for i := 0; ; i++ {
+		job, err := scanJob(conn.QueryRow(ctx, `
+			INSERT INTO jobs (type, connection_id, payload, priority, max_attempts, dedupe_key)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (dedupe_key) WHERE dedupe_key IS NOT NULL AND status IN ('queued', 'running') DO NOTHING
+			RETURNING `+jobColumns,
+			req.Type, req.ConnectionID, req.Payload, req.Priority, req.MaxAttempts, req.DedupeKey))
+		if err != pgx.ErrNoRows {
+			return job, err == nil, err
+		}
+
+		job, err = scanJob(conn.QueryRow(ctx, `
+			SELECT `+jobColumns+`
+			FROM jobs
+			WHERE dedupe_key = $1 AND status IN ($2, $3)
+		`, req.DedupeKey, JobQueued, JobRunning))
+		if err != pgx.ErrNoRows || i == 2 {
+			return job, false, err
+		}
+	}
+}
+
+// DequeueJob はtypesのうち実行できるジョブを優先度の高い順に1件取り出し、workerが実行中にする。
+// 可視性タイムアウト（visibility）が切れた実行中のジョブ（ワーカーが落ちたもの）も取り出し直す。
+// そのうち再試行の上限に達しているものはdeadに、取り消しを頼まれていたものはcancelledにする。
+// 複数のワーカーが同時に呼んでも、FOR UPDATE SKIP LOCKEDにより同じジョブは1つにしか渡らない。
+// 取り出せるジョブがなければpgx.ErrNoRowsを返す。
+func DequeueJob(ctx context.Context, conn Querier, worker string, types []string, visibility time.Duration) (*Job, error) {
+	_, err := conn.Exec(ctx, `
+		UPDATE jobs
+		SET status = CASE WHEN cancel_requested_at IS NOT NULL THEN $3 ELSE $1 END,
+			last_error = CASE WHEN cancel_requested_at IS NULL THEN 'worker did not finish within the visibility timeout' ELSE last_error END,
+			locked_by = NULL, locked_until = NULL, finished_at = now(), updated_at = now()
+		WHERE status = $2 AND locked_until < now() AND (attempts >= max_attempts OR cancel_requested_at IS NOT NULL)
+	`, JobDead, JobRunning, JobCancelled)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanJob(conn.QueryRow(ctx, `
+		UPDATE jobs
+		SET status = $3, attempts = attempts + 1, locked_by = $1, locked_until = now() + make_interval(secs => $4),
+			started_at = now(), updated_at = now()
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE type = ANY($2)
+				AND ((status = $5 AND run_after <= now()) OR (status = $3 AND locked_until < now()))
+			ORDER BY priority DESC, run_after, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+jobColumns, worker, types, JobRunning, visibility.Seconds(), JobQueued))
+}
+
+// ExtendJob はworkerが実行中のジョブの可視性タイムアウトをいまからvisibility後に延ばし（ハートビート）、
+// 延ばしたジョブを返す。取り消しを頼まれているかはCancelRequestedAtで分かる。
+// ほかのワーカーに取り出し直されていた場合はpgx.ErrNoRowsを返す。
+func ExtendJob(ctx context.Context, conn Querier, id int, worker string, visibility time.Duration) (*Job, error) {
+	return scanJob(conn.QueryRow(ctx, `
+		UPDATE jobs
+		SET locked_until = now() + make_interval(secs => $3), updated_at = now()
+		WHERE id = $1 AND locked_by = $2 AND status = $4
+		RETURNING `+jobColumns, id, worker, visibility.Seconds(), JobRunning))
+}
+
+// CompleteJob はworkerが実行中のジョブを成功にする。
+// ほかのワーカーに取り出し直されていた場合はpgx.ErrNoRowsを返す。
+func CompleteJob(ctx context.Context, conn Querier, id int, worker string) error {
+	return finishJob(ctx, conn, `
+		UPDATE jobs
+		SET status = $3, locked_by = NULL, locked_until = NULL, finished_at = now(), updated_at = now()
+		WHERE id = $1 AND locked_by = $2 AND status = $4
+	`, id, worker, JobSucceeded, JobRunning)
+}
+
+// FailJob はworkerが実行中のジョブの失敗を記録する。再試行の上限に達したかpermanentの場合はdeadにし、
+// そうでなければretryIn後に取り出せるよう待機中に戻す。取り消しを頼まれていた場合は再試行せずにcancelledにする。
+// 戻り値は新しい状態。
+// ほかのワーカーに取り出し直されていた場合はpgx.ErrNoRowsを返す。
+func FailJob(ctx context.Context, conn Querier, id int, worker string, message string, retryIn time.Duration, permanent bool) (string, error) {
+	var status string
+	err := conn.QueryRow(ctx, `
+		UPDATE jobs
+		SET status = CASE WHEN cancel_requested_at IS NOT NULL THEN $9 WHEN $5 OR attempts >= max_attempts THEN $6 ELSE $7 END,
+			run_after = now() + make_interval(secs => $4),
+			finished_at = CASE WHEN cancel_requested_at IS NOT NULL OR $5 OR attempts >= max_attempts THEN now() END,
+			last_error = $3, locked_by = NULL, locked_until = NULL, updated_at = now()
+		WHERE id = $1 AND locked_by = $2 AND status = $8
+		RETURNING status
+	`, id, worker, message, retryIn.Seconds(), permanent, JobDead, JobQueued, JobRunning, JobCancelled).Scan(&status)
+	return status, err
+}
+
+// ReleaseJob はworkerが処理を止めたジョブを、回数に数えずに待機中へ戻す（ワーカーを止めるとき、
+// 接続先のホストが混んでいて始められなかったとき）。ジョブはdelayの後に取り出せるようになる。
+// 取り消しを頼まれていたジョブはcancelledにする。
+// ほかのワーカーに取り出し直されていた場合はpgx.ErrNoRowsを返す。
+func ReleaseJob(ctx context.Context, conn Querier, id int, worker string, delay time.Duration) error {
+	return finishJob(ctx, conn, `
+		UPDATE jobs
+		SET status = CASE WHEN cancel_requested_at IS NOT NULL THEN $5 ELSE $3 END,
+			finished_at = CASE WHEN cancel_requested_at IS NOT NULL THEN now() END,
+			attempts = attempts - 1, run_after = now() + make_interval(secs => $6),
+			locked_by = NULL, locked_until = NULL, updated_at = now()
+		WHERE id = $1 AND locked_by = $2 AND status = $4
+	`, id, worker, JobQueued, JobRunning, JobCancelled, delay.Seconds())
+}
+
+// CancelJob はジョブの取り消しを頼み、その後のジョブを返す。待機中のジョブはすぐにcancelledにし、
+// 実行中のジョブはCancelRequestedAtを記録する（処理しているワーカーが止めてcancelledにする）。
+// 終わっているジョブは変えずに返す。見つからなければpgx.ErrNoRowsを返す。
+func CancelJob(ctx context.Context, conn Querier, id int) (*Job, error) {
+	return scanJob(conn.QueryRow(ctx, `
+		UPDATE jobs
+		SET status = CASE WHEN status = $2 THEN $4 ELSE status END,
+			finished_at = CASE WHEN status = $2 THEN now() ELSE finished_at END,
+			cancel_requested_at = CASE WHEN status = $3 THEN COALESCE(cancel_requested_at, now()) ELSE cancel_requested_at END,
+			updated_at = now()
+		WHERE id = $1
+		RETURNING `+jobColumns, id, JobQueued, JobRunning, JobCancelled))
+}
+
+func finishJob(ctx context.Context, conn Querier, sql string, args ...any) error {
+	result, err := conn.Exec(ctx, sql, args...)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// GetJob はジョブを返す。
+func GetJob(ctx context.Context, conn Querier, id int) (*Job, error) {
+	return scanJob(conn.QueryRow(ctx, `
+		SELECT `+jobColumns+`
+		FROM jobs
+		WHERE id = $1
+	`, id))
+}
+
+// ListJobs はジョブを新しい順に最大limit件返す。statusが空でなければその状態のものだけを返す。
+func ListJobs(ctx context.Context, conn Querier, status string, limit int) ([]*Job, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT `+jobColumns+`
+		FROM jobs
+		WHERE $1 = '' OR status = $1
+		ORDER BY id DESC
+		LIMIT $2
+	`, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*Job
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
@@ -0,0 +1,1127 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/koplec/sokoni/internal/model"
+)
+
+// NewMemoryRepositories はDBを使わずにメモリ上にデータを持つリポジトリを作る。
+// PostgreSQLの実装と同じ振る舞いをするので（repository_contract_test.go）、DBのないテストで使う。
+// 外部キー・一意制約・カスケード削除もテーブル定義に合わせている（usersテーブルはない）。
+func NewMemoryRepositories() Repositories {
+	m := &memoryStore{
+		connections: make(map[int]*Connection),
+		files:       make(map[memoryFileKey]*memoryFile),
+		scanRuns:    make(map[int]*memoryScanRun),
+		dirStates:   make(map[int]map[string]DirState),
+		leases:      make(map[int]memoryLease),
+		watchLeases: make(map[int]memoryLease),
+		jobs:        make(map[int]*Job),
+		listeners:   make(map[chan Event]bool),
+	}
+	return Repositories{Files: m, Connections: m, ScanRuns: m, Jobs: m, Events: m}
+}
+
+type memoryStore struct {
+	mu sync.Mutex
+
+	lastConnectionID int
+	lastScanRunID    int
+	lastJobID        int
+
+	connections map[int]*Connection
+	files       map[memoryFileKey]*memoryFile
+	scanRuns    map[int]*memoryScanRun
+	dirStates   map[int]map[string]DirState // connection IDごと
+	leases      map[int]memoryLease         // connection IDごと
+	watchLeases map[int]memoryLease         // connection IDごと
+	jobs        map[int]*Job
+	listeners   map[chan Event]bool
+}
+
+type memoryLease struct {
+	owner     string
+	expiresAt time.Time
+}
+
+// memoryFileKey はfilesの一意キー（connection_id, path）。
+type memoryFileKey struct {
+	connectionID int
+	path         string
+}
+
+type memoryFile struct {
+	connectionID int
+	dirPath      string
+	info         model.FileInfo
+}
+
+type memoryScanRun struct {
+	ScanRun
+	checkpoints map[string]bool
+	errors      []ScanErrorRecord
+}
+
+// dbTime はPostgreSQLのtimestamptzと同じくマイクロ秒未満を切り捨てる。
+func dbTime(t time.Time) time.Time {
+	return t.Truncate(time.Microsecond)
+}
+
+func (m *memoryStore) lock(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	return nil
+}
+
+// --- FileRepository ---
+
+func (m *memoryStore) InsertFile(ctx context.Context, connectionID int, file model.FileInfo) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	if m.connections[connectionID] == nil {
+		return fmt.Errorf("connection %d does not exist", connectionID)
+	}
+	m.upsertFile(connectionID, file, true)
+	return nil
+}
+
+func (m *memoryStore) UpsertFiles(ctx context.Context, connectionID int, files []model.FileInfo) (int64, error) {
+	if err := m.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer m.mu.Unlock()
+
+	if len(files) == 0 {
+		return 0, nil
+	}
+	if m.connections[connectionID] == nil {
+		return 0, fmt.Errorf("connection %d does not exist", connectionID)
+	}
+	return m.upsertFiles(connectionID, files), nil
+}
+
+// upsertFiles はfilesを書き込み、新規または変更のあった件数を返す。
+// 同じパスが複数回含まれる場合は後のものを使い、1件として数える。
+func (m *memoryStore) upsertFiles(connectionID int, files []model.FileInfo) int64 {
+	last := make(map[string]model.FileInfo, len(files))
+	for _, f := range files {
+		last[f.Path] = f
+	}
+	var written int64
+	for _, f := range last {
+		if m.upsertFile(connectionID, f, false) {
+			written++
+		}
+	}
+	return written
+}
+
+// upsertFile はファイルを追加か更新し、書き込んだらtrueを返す。
+// alwaysがfalseの場合、サイズ・更新日時・ETagが変わっていなければ書き込まない。
+// 既存の行のファイル名は変えない（ON CONFLICT DO UPDATEと同じ）。
+func (m *memoryStore) upsertFile(connectionID int, file model.FileInfo, always bool) bool {
+	file.ModTime = dbTime(file.ModTime)
+	key := memoryFileKey{connectionID, file.Path}
+	existing, ok := m.files[key]
+	if !ok {
+		m.files[key] = &memoryFile{connectionID: connectionID, dirPath: filepath.Dir(file.Path), info: file}
+		return true
+	}
+	if !always && existing.info.Size == file.Size && existing.info.ModTime.Equal(file.ModTime) && existing.info.ETag == file.ETag {
+		return false
+	}
+	existing.info.Size = file.Size
+	existing.info.ModTime = file.ModTime
+	existing.info.ETag = file.ETag
+	return true
+}
+
+func (m *memoryStore) DeleteFilesUnder(ctx context.Context, connectionID int, path string) (int64, error) {
+	if err := m.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer m.mu.Unlock()
+
+	return m.deleteFiles(func(f *memoryFile) bool {
+		return f.connectionID == connectionID && isUnder(f.info.Path, path)
+	}), nil
+}
+
+func (m *memoryStore) deleteFiles(match func(f *memoryFile) bool) int64 {
+	var n int64
+	for key, f := range m.files {
+		if match(f) {
+			delete(m.files, key)
+			n++
+		}
+	}
+	return n
+}
+
+// isUnder はpathがdirそのものかdir配下ならtrueを返す（path = dir OR starts_with(path, dir || '/')）。
+func isUnder(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+func (m *memoryStore) GetFileByPath(ctx context.Context, connectionID int, path string) (model.FileInfo, error) {
+	if err := m.lock(ctx); err != nil {
+		return model.FileInfo{}, err
+	}
+	defer m.mu.Unlock()
+
+	f, ok := m.files[memoryFileKey{connectionID, path}]
+	if !ok {
+		return model.FileInfo{}, pgx.ErrNoRows
+	}
+	return f.info, nil
+}
+
+func (m *memoryStore) SearchFilesByName(ctx context.Context, query string) ([]FileSearchResult, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	pattern := likePattern("%" + query + "%")
+	var files []FileSearchResult
+	for _, f := range m.files {
+		if pattern.MatchString(f.info.Name) {
+			// 検索結果にETagは含めない
+			files = append(files, FileSearchResult{
+				FileInfo:     model.FileInfo{Path: f.info.Path, Name: f.info.Name, Size: f.info.Size, ModTime: f.info.ModTime},
+				ConnectionID: f.connectionID,
+			})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Name != files[j].Name {
+			return files[i].Name < files[j].Name
+		}
+		if files[i].Path != files[j].Path {
+			return files[i].Path < files[j].Path
+		}
+		return files[i].ConnectionID < files[j].ConnectionID
+	})
+	return files, nil
+}
+
+// likePattern はILIKEのパターン（%・_・\によるエスケープ）を正規表現にする。
+func likePattern(like string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("(?is)^")
+	escaped := false
+	for _, r := range like {
+		switch {
+		case escaped:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			b.WriteString(".*")
+		case r == '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+func (m *memoryStore) ListFiles(ctx context.Context, connectionID int) ([]model.FileInfo, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	var files []model.FileInfo
+	for _, f := range m.files {
+		if f.connectionID == connectionID {
+			files = append(files, f.info)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+// --- ConnectionRepository ---
+
+// copyConnection は呼び出し側が書き換えても保存した値に影響しないようにコピーを返す。
+// nullIfEmpty はNULLIF(s, ”)に合わせ、空文字列をnilにする。
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func copyConnection(c *Connection) *Connection {
+	copied := *c
+	return &copied
+}
+
+func (m *memoryStore) GetConnectionsByUserID(ctx context.Context, userID int) ([]*ConnectionResponse, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	var connections []*Connection
+	for _, c := range m.connections {
+		if c.UserID == userID {
+			connections = append(connections, c)
+		}
+	}
+	sort.Slice(connections, func(i, j int) bool {
+		if !connections[i].CreatedAt.Equal(connections[j].CreatedAt) {
+			return connections[i].CreatedAt.After(connections[j].CreatedAt)
+		}
+		return connections[i].ID > connections[j].ID
+	})
+
+	var responses []*ConnectionResponse
+	for _, c := range connections {
+		responses = append(responses, copyConnection(c).ToResponse())
+	}
+	return responses, nil
+}
+
+func (m *memoryStore) GetConnectionByID(ctx context.Context, id int) (*Connection, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	c, ok := m.connections[id]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	return copyConnection(c), nil
+}
+
+func (m *memoryStore) GetDueConnections(ctx context.Context) ([]*Connection, error) {
+	return m.filterConnections(ctx, func(c *Connection) bool {
+		return c.isDue(time.Now())
+	})
+}
+
+func (m *memoryStore) GetWatchedConnections(ctx context.Context) ([]*Connection, error) {
+	return m.filterConnections(ctx, func(c *Connection) bool {
+		return c.Watch
+	})
+}
+
+func (m *memoryStore) filterConnections(ctx context.Context, match func(c *Connection) bool) ([]*Connection, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	var connections []*Connection
+	for _, c := range m.connections {
+		if match(c) {
+			connections = append(connections, copyConnection(c))
+		}
+	}
+	sort.Slice(connections, func(i, j int) bool { return connections[i].ID < connections[j].ID })
+	return connections, nil
+}
+
+func (m *memoryStore) CreateConnection(ctx context.Context, req CreateConnectionRequest) (*ConnectionResponse, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	now := dbTime(time.Now())
+	m.lastConnectionID++
+	c := &Connection{
+		ID:           m.lastConnectionID,
+		ScanInterval: 604800, // 1週間デフォルト
+		AutoScan:     true,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	applyConnectionRequest(c, req)
+	c.UserID = req.UserID
+	m.connections[c.ID] = c
+	return copyConnection(c).ToResponse(), nil
+}
+
+// applyConnectionRequest はreqの内容をcに反映する。ScanInterval・Schedule・BlackoutWindows・Throttle・AutoScan・Watchは
+// 指定された場合だけ変え、Schedule・BlackoutWindows・Throttleは空文字列ならNULLにする。
+func applyConnectionRequest(c *Connection, req CreateConnectionRequest) {
+	c.Name = req.Name
+	c.BasePath = req.BasePath
+	c.RemotePath = req.RemotePath
+	c.Username = req.Username
+	c.Password = req.Password
+	c.Options = req.Options
+	if req.PrivateKey != nil {
+		c.PrivateKey = nullIfEmpty(*req.PrivateKey)
+	}
+	if req.HostKey != nil {
+		c.HostKey = nullIfEmpty(*req.HostKey)
+	}
+	if req.ScanInterval != nil {
+		c.ScanInterval = *req.ScanInterval
+	}
+	if req.Schedule != nil {
+		c.Schedule = nullIfEmpty(*req.Schedule)
+	}
+	if req.BlackoutWindows != nil {
+		c.BlackoutWindows = nullIfEmpty(*req.BlackoutWindows)
+	}
+	if req.Throttle != nil {
+		c.Throttle = nullIfEmpty(*req.Throttle)
+	}
+	if req.AutoScan != nil {
+		c.AutoScan = *req.AutoScan
+	}
+	if req.Watch != nil {
+		c.Watch = *req.Watch
+	}
+}
+
+func (m *memoryStore) UpdateConnection(ctx context.Context, id int, userID int, req CreateConnectionRequest) (*ConnectionResponse, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	c, ok := m.connections[id]
+	if !ok || c.UserID != userID {
+		return nil, pgx.ErrNoRows
+	}
+	applyConnectionRequest(c, req)
+	c.ScanFailures = ScanFailures{}
+	c.UpdatedAt = dbTime(time.Now())
+	return copyConnection(c).ToResponse(), nil
+}
+
+func (m *memoryStore) DeleteConnection(ctx context.Context, id int, userID int) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	c, ok := m.connections[id]
+	if !ok || c.UserID != userID {
+		return pgx.ErrNoRows
+	}
+
+	// ON DELETE CASCADE
+	delete(m.connections, id)
+	m.deleteFiles(func(f *memoryFile) bool { return f.connectionID == id })
+	for runID, run := range m.scanRuns {
+		if run.ConnectionID == id {
+			delete(m.scanRuns, runID)
+		}
+	}
+	delete(m.dirStates, id)
+	delete(m.leases, id)
+	delete(m.watchLeases, id)
+	for jobID, job := range m.jobs {
+		if job.ConnectionID != nil && *job.ConnectionID == id {
+			delete(m.jobs, jobID)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) UpdateLastScan(ctx context.Context, id int) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	if c, ok := m.connections[id]; ok {
+		now := dbTime(time.Now())
+		c.LastScan = &now
+		c.ScanFailures = ScanFailures{}
+	}
+	return nil
+}
+
+func (m *memoryStore) RecordScanFailure(ctx context.Context, id int, message string, suspendAfter int) (int, error) {
+	if err := m.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer m.mu.Unlock()
+
+	c, ok := m.connections[id]
+	if !ok {
+		return 0, pgx.ErrNoRows
+	}
+	now := dbTime(time.Now())
+	c.ConsecutiveFailures++
+	c.LastFailureAt = &now
+	c.LastError = &message
+	if suspendAfter > 0 && c.ConsecutiveFailures >= suspendAfter && c.SuspendedAt == nil {
+		reason := suspendReason(suspendAfter, message)
+		c.SuspendedAt = &now
+		c.SuspendedReason = &reason
+	}
+	return c.ConsecutiveFailures, nil
+}
+
+// --- ScanRunRepository ---
+
+func copyScanRun(r *memoryScanRun) *ScanRun {
+	copied := r.ScanRun
+	return &copied
+}
+
+func (m *memoryStore) CreateScanRun(ctx context.Context, connectionID int, fullScan bool) (*ScanRun, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	if m.connections[connectionID] == nil {
+		return nil, fmt.Errorf("connection %d does not exist", connectionID)
+	}
+	m.lastScanRunID++
+	run := &memoryScanRun{
+		ScanRun: ScanRun{
+			ID:           m.lastScanRunID,
+			ConnectionID: connectionID,
+			Status:       ScanRunRunning,
+			FullScan:     fullScan,
+			StartedAt:    dbTime(time.Now()),
+		},
+		checkpoints: make(map[string]bool),
+	}
+	m.scanRuns[run.ID] = run
+	return copyScanRun(run), nil
+}
+
+func (m *memoryStore) GetScanRun(ctx context.Context, id int) (*ScanRun, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	run, ok := m.scanRuns[id]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	return copyScanRun(run), nil
+}
+
+// connectionRuns はconnectionのスキャン実行を新しい順に返す。
+func (m *memoryStore) connectionRuns(connectionID int) []*memoryScanRun {
+	var runs []*memoryScanRun
+	for _, run := range m.scanRuns {
+		if run.ConnectionID == connectionID {
+			runs = append(runs, run)
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].ID > runs[j].ID })
+	return runs
+}
+
+func (m *memoryStore) ListScanRuns(ctx context.Context, connectionID int, limit int) ([]*ScanRun, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	var runs []*ScanRun
+	for _, run := range m.connectionRuns(connectionID) {
+		if len(runs) >= limit {
+			break
+		}
+		runs = append(runs, copyScanRun(run))
+	}
+	return runs, nil
+}
+
+func (m *memoryStore) GetLastFullScanAt(ctx context.Context, connectionID int) (*time.Time, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	var last *time.Time
+	for _, run := range m.connectionRuns(connectionID) {
+		if !run.FullScan || (run.Status != ScanRunCompleted && run.Status != ScanRunPartial) {
+			continue
+		}
+		if last == nil || run.StartedAt.After(*last) {
+			startedAt := run.StartedAt
+			last = &startedAt
+		}
+	}
+	return last, nil
+}
+
+func (m *memoryStore) GetResumableScanRun(ctx context.Context, connectionID int) (*ScanRun, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	runs := m.connectionRuns(connectionID)
+	if len(runs) == 0 || (runs[0].Status != ScanRunRunning && runs[0].Status != ScanRunInterrupted) {
+		return nil, pgx.ErrNoRows
+	}
+	return copyScanRun(runs[0]), nil
+}
+
+func (m *memoryStore) ResumeScanRun(ctx context.Context, id int) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	if run, ok := m.scanRuns[id]; ok {
+		now := dbTime(time.Now())
+		run.Status = ScanRunRunning
+		run.ErrorMessage = nil
+		run.ResumedAt = &now
+	}
+	return nil
+}
+
+func (m *memoryStore) GetScanCheckpoints(ctx context.Context, scanRunID int) (map[string]bool, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	done := make(map[string]bool)
+	if run, ok := m.scanRuns[scanRunID]; ok {
+		for path := range run.checkpoints {
+			done[path] = true
+		}
+	}
+	return done, nil
+}
+
+func (m *memoryStore) CommitScanBatch(ctx context.Context, connectionID, scanRunID int, owner string, batch ScanBatch) (int64, int64, error) {
+	if err := m.lock(ctx); err != nil {
+		return 0, 0, err
+	}
+	defer m.mu.Unlock()
+
+	if !m.holdsScanLease(connectionID, owner) {
+		return 0, 0, ErrLeaseNotHeld
+	}
+	// 途中で失敗して一部だけ反映されることがないよう、先に外部キーを確認する
+	if m.connections[connectionID] == nil {
+		return 0, 0, fmt.Errorf("connection %d does not exist", connectionID)
+	}
+	run, ok := m.scanRuns[scanRunID]
+	if !ok {
+		return 0, 0, fmt.Errorf("scan run %d does not exist", scanRunID)
+	}
+
+	written := m.upsertFiles(connectionID, batch.Files)
+
+	var deleted int64
+	for _, dir := range batch.Dirs {
+		if dir.Listed {
+			present := make(map[string]bool, len(dir.Files))
+			for _, path := range dir.Files {
+				present[path] = true
+			}
+			deleted += m.deleteFiles(func(f *memoryFile) bool {
+				return f.connectionID == connectionID && f.dirPath == dir.Path && !present[f.info.Path]
+			})
+
+			state := dir.State
+			state.Path = dir.Path
+			state.ModTime = dbTime(state.ModTime)
+			state.ListedAt = dbTime(state.ListedAt)
+			state.Subdirs = append([]string{}, state.Subdirs...)
+			if m.dirStates[connectionID] == nil {
+				m.dirStates[connectionID] = make(map[string]DirState)
+			}
+			m.dirStates[connectionID][dir.Path] = state
+		}
+		run.errors = append(run.errors, dir.Errors...)
+		run.checkpoints[dir.Path] = true
+	}
+	return written, deleted, nil
+}
+
+func (m *memoryStore) FinishScanRun(ctx context.Context, id int, owner string, status string, stats ScanRunStats, errorMessage *string) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	run, ok := m.scanRuns[id]
+	if !ok {
+		return nil
+	}
+	if !m.holdsScanLease(run.ConnectionID, owner) {
+		return ErrLeaseNotHeld
+	}
+	now := dbTime(time.Now())
+	run.Status = status
+	run.FilesSeen += stats.FilesSeen
+	run.FilesWritten += stats.FilesWritten
+	run.FilesDeleted += stats.FilesDeleted
+	run.ErrorCount += stats.ErrorCount
+	run.DirsUnchanged += stats.DirsUnchanged
+	run.FilesUnchanged += stats.FilesUnchanged
+	if errorMessage != nil {
+		msg := *errorMessage
+		errorMessage = &msg
+	}
+	run.ErrorMessage = errorMessage
+	run.FinishedAt = &now
+	return nil
+}
+
+func (m *memoryStore) PruneScanRuns(ctx context.Context, connectionID int, olderThan time.Duration) (int64, error) {
+	if err := m.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer m.mu.Unlock()
+
+	runs := m.connectionRuns(connectionID)
+	var lastFull *memoryScanRun
+	for _, run := range runs {
+		if run.FullScan && (run.Status == ScanRunCompleted || run.Status == ScanRunPartial) &&
+			(lastFull == nil || run.StartedAt.After(lastFull.StartedAt)) {
+			lastFull = run
+		}
+	}
+	cutoff := time.Now().Add(-olderThan)
+	var n int64
+	for i, run := range runs {
+		if i > 0 || (run.Status != ScanRunRunning && run.Status != ScanRunInterrupted) {
+			run.checkpoints = make(map[string]bool)
+		}
+		if i > 0 && run != lastFull && run.FinishedAt != nil && !run.FinishedAt.After(cutoff) {
+			delete(m.scanRuns, run.ID)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *memoryStore) ReconcileScanRun(ctx context.Context, connectionID, scanRunID int, owner string) (int64, error) {
+	if err := m.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer m.mu.Unlock()
+
+	if !m.holdsScanLease(connectionID, owner) {
+		return 0, ErrLeaseNotHeld
+	}
+
+	var checkpoints map[string]bool
+	var errors []ScanErrorRecord
+	if run, ok := m.scanRuns[scanRunID]; ok {
+		checkpoints, errors = run.checkpoints, run.errors
+	}
+	underError := func(path string) bool {
+		for _, e := range errors {
+			if isUnder(path, e.Path) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for path := range m.dirStates[connectionID] {
+		if !checkpoints[path] && !underError(path) {
+			delete(m.dirStates[connectionID], path)
+		}
+	}
+	return m.deleteFiles(func(f *memoryFile) bool {
+		return f.connectionID == connectionID && !checkpoints[f.dirPath] && !underError(f.info.Path)
+	}), nil
+}
+
+func (m *memoryStore) GetDirStates(ctx context.Context, connectionID int) (map[string]DirState, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	states := make(map[string]DirState)
+	for path, state := range m.dirStates[connectionID] {
+		state.Subdirs = append([]string{}, state.Subdirs...)
+		states[path] = state
+	}
+	return states, nil
+}
+
+func (m *memoryStore) AcquireScanLease(ctx context.Context, connectionID int, owner string, ttl time.Duration) (bool, error) {
+	return m.acquireLease(ctx, m.leases, connectionID, owner, ttl)
+}
+
+func (m *memoryStore) RenewScanLease(ctx context.Context, connectionID int, owner string, ttl time.Duration) (bool, error) {
+	return m.renewLease(ctx, m.leases, connectionID, owner, ttl)
+}
+
+func (m *memoryStore) ReleaseScanLease(ctx context.Context, connectionID int, owner string) error {
+	return m.releaseLease(ctx, m.leases, connectionID, owner)
+}
+
+func (m *memoryStore) AcquireWatchLease(ctx context.Context, connectionID int, owner string, ttl time.Duration) (bool, error) {
+	return m.acquireLease(ctx, m.watchLeases, connectionID, owner, ttl)
+}
+
+func (m *memoryStore) RenewWatchLease(ctx context.Context, connectionID int, owner string, ttl time.Duration) (bool, error) {
+	return m.renewLease(ctx, m.watchLeases, connectionID, owner, ttl)
+}
+
+func (m *memoryStore) ReleaseWatchLease(ctx context.Context, connectionID int, owner string) error {
+	return m.releaseLease(ctx, m.watchLeases, connectionID, owner)
+}
+
+// holdsScanLease はownerがconnectionのスキャンのリースを期限内に持っているかを返す（db.holdScanLease）。
+// m.muを持った状態で呼ぶこと。
+func (m *memoryStore) holdsScanLease(connectionID int, owner string) bool {
+	l, ok := m.leases[connectionID]
+	return ok && l.owner == owner && l.expiresAt.After(time.Now())
+}
+
+// acquireLease・renewLease・releaseLease はスキャンと監視のリース（leases・watchLeases）に共通の処理。
+func (m *memoryStore) acquireLease(ctx context.Context, leases map[int]memoryLease, connectionID int, owner string, ttl time.Duration) (bool, error) {
+	if err := m.lock(ctx); err != nil {
+		return false, err
+	}
+	defer m.mu.Unlock()
+
+	if m.connections[connectionID] == nil {
+		return false, fmt.Errorf("connection %d does not exist", connectionID)
+	}
+	now := time.Now()
+	if l, ok := leases[connectionID]; ok && l.expiresAt.After(now) {
+		return false, nil
+	}
+	leases[connectionID] = memoryLease{owner: owner, expiresAt: now.Add(ttl)}
+	return true, nil
+}
+
+func (m *memoryStore) renewLease(ctx context.Context, leases map[int]memoryLease, connectionID int, owner string, ttl time.Duration) (bool, error) {
+	if err := m.lock(ctx); err != nil {
+		return false, err
+	}
+	defer m.mu.Unlock()
+
+	l, ok := leases[connectionID]
+	if !ok || l.owner != owner {
+		return false, nil
+	}
+	leases[connectionID] = memoryLease{owner: owner, expiresAt: time.Now().Add(ttl)}
+	return true, nil
+}
+
+func (m *memoryStore) releaseLease(ctx context.Context, leases map[int]memoryLease, connectionID int, owner string) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	if l, ok := leases[connectionID]; ok && l.owner == owner {
+		delete(leases, connectionID)
+	}
+	return nil
+}
+
+// --- JobRepository ---
+
+func copyJob(j *Job) *Job {
+	copied := *j
+	copied.Payload = append(json.RawMessage{}, j.Payload...)
+	return &copied
+}
+
+// activeJob は待機中か実行中か（一意キーの対象か）を返す。
+func activeJob(j *Job) bool {
+	return j.Status == JobQueued || j.Status == JobRunning
+}
+
+func (m *memoryStore) EnqueueJob(ctx context.Context, req EnqueueJobRequest) (*Job, bool, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, false, err
+	}
+	defer m.mu.Unlock()
+
+	req = req.normalize()
+	if req.ConnectionID != nil && m.connections[*req.ConnectionID] == nil {
+		return nil, false, fmt.Errorf("connection %d does not exist", *req.ConnectionID)
+	}
+	if !json.Valid(req.Payload) {
+		return nil, false, fmt.Errorf("invalid job payload")
+	}
+	if req.DedupeKey != nil {
+		for _, j := range m.jobs {
+			if activeJob(j) && j.DedupeKey != nil && *j.DedupeKey == *req.DedupeKey {
+				return copyJob(j), false, nil
+			}
+		}
+	}
+
+	m.lastJobID++
+	now := dbTime(time.Now())
+	job := &Job{
+		ID:           m.lastJobID,
+		Type:         req.Type,
+		ConnectionID: req.ConnectionID,
+		Payload:      req.Payload,
+		Priority:     req.Priority,
+		Status:       JobQueued,
+		MaxAttempts:  req.MaxAttempts,
+		DedupeKey:    req.DedupeKey,
+		RunAfter:     now,
+		CreatedAt:    now,
+	}
+	m.jobs[job.ID] = job
+	return copyJob(job), true, nil
+}
+
+func (m *memoryStore) DequeueJob(ctx context.Context, worker string, types []string, visibility time.Duration) (*Job, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	expired := func(j *Job) bool {
+		return j.Status == JobRunning && j.LockedUntil != nil && j.LockedUntil.Before(now)
+	}
+	var next *Job
+	for _, j := range m.jobs {
+		if expired(j) && (j.Attempts >= j.MaxAttempts || j.CancelRequestedAt != nil) {
+			finished := dbTime(now)
+			if j.CancelRequestedAt != nil {
+				j.Status = JobCancelled
+			} else {
+				message := "worker did not finish within the visibility timeout"
+				j.Status = JobDead
+				j.LastError = &message
+			}
+			j.LockedBy, j.LockedUntil = nil, nil
+			j.FinishedAt = &finished
+			continue
+		}
+		if !slices.Contains(types, j.Type) || !(j.Status == JobQueued && !j.RunAfter.After(now) || expired(j)) {
+			continue
+		}
+		if next == nil || j.Priority > next.Priority ||
+			j.Priority == next.Priority && (j.RunAfter.Before(next.RunAfter) || j.RunAfter.Equal(next.RunAfter) && j.ID < next.ID) {
+			next = j
+		}
+	}
+	if next == nil {
+		return nil, pgx.ErrNoRows
+	}
+
+	started := dbTime(now)
+	until := dbTime(now.Add(visibility))
+	next.Status = JobRunning
+	next.Attempts++
+	next.LockedBy = &worker
+	next.LockedUntil = &until
+	next.StartedAt = &started
+	return copyJob(next), nil
+}
+
+// lockedJob はworkerが実行中のジョブを返す。
+func (m *memoryStore) lockedJob(id int, worker string) *Job {
+	j, ok := m.jobs[id]
+	if !ok || j.Status != JobRunning || j.LockedBy == nil || *j.LockedBy != worker {
+		return nil
+	}
+	return j
+}
+
+func (m *memoryStore) ExtendJob(ctx context.Context, id int, worker string, visibility time.Duration) (*Job, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	j := m.lockedJob(id, worker)
+	if j == nil {
+		return nil, pgx.ErrNoRows
+	}
+	until := dbTime(time.Now().Add(visibility))
+	j.LockedUntil = &until
+	return copyJob(j), nil
+}
+
+func (m *memoryStore) CompleteJob(ctx context.Context, id int, worker string) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	j := m.lockedJob(id, worker)
+	if j == nil {
+		return pgx.ErrNoRows
+	}
+	now := dbTime(time.Now())
+	j.Status = JobSucceeded
+	j.LockedBy, j.LockedUntil = nil, nil
+	j.FinishedAt = &now
+	return nil
+}
+
+func (m *memoryStore) FailJob(ctx context.Context, id int, worker string, message string, retryIn time.Duration, permanent bool) (string, error) {
+	if err := m.lock(ctx); err != nil {
+		return "", err
+	}
+	defer m.mu.Unlock()
+
+	j := m.lockedJob(id, worker)
+	if j == nil {
+		return "", pgx.ErrNoRows
+	}
+	now := time.Now()
+	finished := dbTime(now)
+	j.Status = JobQueued
+	j.RunAfter = dbTime(now.Add(retryIn))
+	switch {
+	case j.CancelRequestedAt != nil:
+		j.Status = JobCancelled
+		j.FinishedAt = &finished
+	case permanent || j.Attempts >= j.MaxAttempts:
+		j.Status = JobDead
+		j.FinishedAt = &finished
+	}
+	j.LastError = &message
+	j.LockedBy, j.LockedUntil = nil, nil
+	return j.Status, nil
+}
+
+func (m *memoryStore) ReleaseJob(ctx context.Context, id int, worker string, delay time.Duration) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	j := m.lockedJob(id, worker)
+	if j == nil {
+		return pgx.ErrNoRows
+	}
+	now := dbTime(time.Now())
+	j.Status = JobQueued
+	if j.CancelRequestedAt != nil {
+		j.Status = JobCancelled
+		j.FinishedAt = &now
+	}
+	j.Attempts--
+	j.RunAfter = dbTime(now.Add(delay))
+	j.LockedBy, j.LockedUntil = nil, nil
+	return nil
+}
+
+func (m *memoryStore) CancelJob(ctx context.Context, id int) (*Job, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	j, ok := m.jobs[id]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	now := dbTime(time.Now())
+	switch {
+	case j.Status == JobQueued:
+		j.Status = JobCancelled
+		j.FinishedAt = &now
+	case j.Status == JobRunning && j.CancelRequestedAt == nil:
+		j.CancelRequestedAt = &now
+	}
+	return copyJob(j), nil
+}
+
+func (m *memoryStore) GetJob(ctx context.Context, id int) (*Job, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	j, ok := m.jobs[id]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	return copyJob(j), nil
+}
+
+func (m *memoryStore) ListJobs(ctx context.Context, status string, limit int) ([]*Job, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	var jobs []*Job
+	for _, j := range m.jobs {
+		if status == "" || j.Status == status {
+			jobs = append(jobs, j)
+		}
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].ID > jobs[k].ID })
+	if len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+	for i, j := range jobs {
+		jobs[i] = copyJob(j)
+	}
+	return jobs, nil
+}
+
+// --- EventRepository ---
+
+// PublishEvent はListenEventsしているすべてのチャネルにeventを送る。
+// 受け取る側が読まずにeventBuffer件溜まっているチャネルには送らない（届かなかった通知として扱う）。
+func (m *memoryStore) PublishEvent(ctx context.Context, event Event) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	for ch := range m.listeners {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) ListenEvents(ctx context.Context) (<-chan Event, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	ch := make(chan Event, eventBuffer)
+	m.listeners[ch] = true
+	go func() {
+		<-ctx.Done()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.listeners, ch)
+		close(ch)
+	}()
+	return ch, nil
+}
@@ -0,0 +1,24 @@
+package db
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Querier はこのパッケージの関数がDBに問い合わせるためのインターフェース。
+// *pgxpool.Pool・*pgx.Conn・pgx.Txのどれでも渡せる。
+// 並行して使う場合は*pgxpool.Poolを渡すこと（*pgx.Connは並行して使えない）。
+type Querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// Ping はDBに問い合わせできるかを確認する。
+func Ping(ctx context.Context, conn Querier) error {
+	var one int
+	return conn.QueryRow(ctx, "SELECT 1").Scan(&one)
+}
@@ -0,0 +1,305 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/koplec/sokoni/internal/model"
+)
+
+// FileRepository はスキャンしたファイルの記録。
+type FileRepository interface {
+	InsertFile(ctx context.Context, connectionID int, file model.FileInfo) error
+	UpsertFiles(ctx context.Context, connectionID int, files []model.FileInfo) (int64, error)
+	DeleteFilesUnder(ctx context.Context, connectionID int, path string) (int64, error)
+	GetFileByPath(ctx context.Context, connectionID int, path string) (model.FileInfo, error)
+	SearchFilesByName(ctx context.Context, query string) ([]FileSearchResult, error)
+	ListFiles(ctx context.Context, connectionID int) ([]model.FileInfo, error)
+}
+
+// ConnectionRepository は接続先の設定。
+type ConnectionRepository interface {
+	GetConnectionsByUserID(ctx context.Context, userID int) ([]*ConnectionResponse, error)
+	GetConnectionByID(ctx context.Context, id int) (*Connection, error)
+	GetDueConnections(ctx context.Context) ([]*Connection, error)
+	GetWatchedConnections(ctx context.Context) ([]*Connection, error)
+	CreateConnection(ctx context.Context, req CreateConnectionRequest) (*ConnectionResponse, error)
+	UpdateConnection(ctx context.Context, id int, userID int, req CreateConnectionRequest) (*ConnectionResponse, error)
+	DeleteConnection(ctx context.Context, id int, userID int) error
+	UpdateLastScan(ctx context.Context, id int) error
+	RecordScanFailure(ctx context.Context, id int, message string, suspendAfter int) (int, error)
+}
+
+// ScanRunRepository はスキャン実行とその途中経過（チェックポイント・差分スキャン用の状態）の記録、
+// および同じconnectionを複数のインスタンスが同時にスキャンしないためのリース。
+// CommitScanBatch・ReconcileScanRun・FinishScanRunは、ownerがスキャンのリースを持っている場合だけ書き込む（ErrLeaseNotHeld）。
+type ScanRunRepository interface {
+	CreateScanRun(ctx context.Context, connectionID int, fullScan bool) (*ScanRun, error)
+	GetScanRun(ctx context.Context, id int) (*ScanRun, error)
+	ListScanRuns(ctx context.Context, connectionID int, limit int) ([]*ScanRun, error)
+	GetLastFullScanAt(ctx context.Context, connectionID int) (*time.Time, error)
+	GetResumableScanRun(ctx context.Context, connectionID int) (*ScanRun, error)
+	ResumeScanRun(ctx context.Context, id int) error
+	GetScanCheckpoints(ctx context.Context, scanRunID int) (map[string]bool, error)
+	CommitScanBatch(ctx context.Context, connectionID, scanRunID int, owner string, batch ScanBatch) (int64, int64, error)
+	FinishScanRun(ctx context.Context, id int, owner string, status string, stats ScanRunStats, errorMessage *string) error
+	ReconcileScanRun(ctx context.Context, connectionID, scanRunID int, owner string) (int64, error)
+	PruneScanRuns(ctx context.Context, connectionID int, olderThan time.Duration) (int64, error)
+	GetDirStates(ctx context.Context, connectionID int) (map[string]DirState, error)
+	AcquireScanLease(ctx context.Context, connectionID int, owner string, ttl time.Duration) (bool, error)
+	RenewScanLease(ctx context.Context, connectionID int, owner string, ttl time.Duration) (bool, error)
+	ReleaseScanLease(ctx context.Context, connectionID int, owner string) error
+	AcquireWatchLease(ctx context.Context, connectionID int, owner string, ttl time.Duration) (bool, error)
+	RenewWatchLease(ctx context.Context, connectionID int, owner string, ttl time.Duration) (bool, error)
+	ReleaseWatchLease(ctx context.Context, connectionID int, owner string) error
+}
+
+// JobRepository はワーカーが処理するジョブのキュー。
+type JobRepository interface {
+	EnqueueJob(ctx context.Context, req EnqueueJobRequest) (*Job, bool, error)
+	DequeueJob(ctx context.Context, worker string, types []string, visibility time.Duration) (*Job, error)
+	ExtendJob(ctx context.Context, id int, worker string, visibility time.Duration) (*Job, error)
+	CompleteJob(ctx context.Context, id int, worker string) error
+	FailJob(ctx context.Context, id int, worker string, message string, retryIn time.Duration, permanent bool) (string, error)
+	ReleaseJob(ctx context.Context, id int, worker string, delay time.Duration) error
+	CancelJob(ctx context.Context, id int) (*Job, error)
+	GetJob(ctx context.Context, id int) (*Job, error)
+	ListJobs(ctx context.Context, status string, limit int) ([]*Job, error)
+}
+
+// EventRepository は変更の通知。APIが変更を知らせ、スケジューラやワーカーが受け取ってすぐに反映する。
+// 通知は届かないこともあるので、受け取る側は定期的な確認も続けること。
+type EventRepository interface {
+	PublishEvent(ctx context.Context, event Event) error
+	ListenEvents(ctx context.Context) (<-chan Event, error)
+}
+
+// Repositories はハンドラやスキャナが使うリポジトリの組。
+// PostgreSQLを使うNewRepositoriesと、メモリ上に持つNewMemoryRepositoriesがある。
+// 見つからない場合はどちらもpgx.ErrNoRowsを返す。
+type Repositories struct {
+	Files       FileRepository
+	Connections ConnectionRepository
+	ScanRuns    ScanRunRepository
+	Jobs        JobRepository
+	Events      EventRepository
+
+	conn Querier // Pingで使う。メモリ上の実装ではnil
+}
+
+// NewRepositories はconnを使うリポジトリを作る。並行して使う場合は*pgxpool.Poolを渡すこと。
+func NewRepositories(conn Querier) Repositories {
+	r := postgresRepository{conn: conn}
+	return Repositories{Files: r, Connections: r, ScanRuns: r, Jobs: r, Events: r, conn: conn}
+}
+
+// Ping はDBに問い合わせできるかを確認する。
+func (r Repositories) Ping(ctx context.Context) error {
+	if r.conn == nil {
+		return nil
+	}
+	return Ping(ctx, r.conn)
+}
+
+// Acquire はプールから1つの接続を取り出し、その接続だけを使うリポジトリを返す。
+// 長く動くワーカーが接続を占有しておけば、バッチの途中でプールの空きを待たずに済む。
+// 使い終わったらreleaseを呼ぶこと。プールを使わない場合（メモリ上の実装など）はrをそのまま返す。
+func (r Repositories) Acquire(ctx context.Context) (Repositories, func(), error) {
+	pool, ok := r.conn.(*pgxpool.Pool)
+	if !ok {
+		return r, func() {}, nil
+	}
+	c, err := pool.Acquire(ctx)
+	if err != nil {
+		return Repositories{}, nil, err
+	}
+	return NewRepositories(c), c.Release, nil
+}
+
+// postgresRepository はこのパッケージの関数でリポジトリのインターフェースを実装する。
+type postgresRepository struct {
+	conn Querier
+}
+
+func (r postgresRepository) InsertFile(ctx context.Context, connectionID int, file model.FileInfo) error {
+	return InsertFile(ctx, r.conn, connectionID, file)
+}
+
+func (r postgresRepository) UpsertFiles(ctx context.Context, connectionID int, files []model.FileInfo) (int64, error) {
+	return UpsertFiles(ctx, r.conn, connectionID, files)
+}
+
+func (r postgresRepository) DeleteFilesUnder(ctx context.Context, connectionID int, path string) (int64, error) {
+	return DeleteFilesUnder(ctx, r.conn, connectionID, path)
+}
+
+func (r postgresRepository) GetFileByPath(ctx context.Context, connectionID int, path string) (model.FileInfo, error) {
+	return GetFileByPath(ctx, r.conn, connectionID, path)
+}
+
+func (r postgresRepository) SearchFilesByName(ctx context.Context, query string) ([]FileSearchResult, error) {
+	return SearchFilesByName(ctx, r.conn, query)
+}
+
+func (r postgresRepository) ListFiles(ctx context.Context, connectionID int) ([]model.FileInfo, error) {
+	return ListFiles(ctx, r.conn, connectionID)
+}
+
+func (r postgresRepository) GetConnectionsByUserID(ctx context.Context, userID int) ([]*ConnectionResponse, error) {
+	return GetConnectionsByUserID(ctx, r.conn, userID)
+}
+
+func (r postgresRepository) GetConnectionByID(ctx context.Context, id int) (*Connection, error) {
+	return GetConnectionByID(ctx, r.conn, id)
+}
+
+func (r postgresRepository) GetDueConnections(ctx context.Context) ([]*Connection, error) {
+	return GetDueConnections(ctx, r.conn)
+}
+
+func (r postgresRepository) GetWatchedConnections(ctx context.Context) ([]*Connection, error) {
+	return GetWatchedConnections(ctx, r.conn)
+}
+
+func (r postgresRepository) CreateConnection(ctx context.Context, req CreateConnectionRequest) (*ConnectionResponse, error) {
+	return CreateConnection(ctx, r.conn, req)
+}
+
+func (r postgresRepository) UpdateConnection(ctx context.Context, id int, userID int, req CreateConnectionRequest) (*ConnectionResponse, error) {
+	return UpdateConnection(ctx, r.conn, id, userID, req)
+}
+
+func (r postgresRepository) DeleteConnection(ctx context.Context, id int, userID int) error {
+	return DeleteConnection(ctx, r.conn, id, userID)
+}
+
+func (r postgresRepository) UpdateLastScan(ctx context.Context, id int) error {
+	return UpdateLastScan(ctx, r.conn, id)
+}
+
+func (r postgresRepository) RecordScanFailure(ctx context.Context, id int, message string, suspendAfter int) (int, error) {
+	return RecordScanFailure(ctx, r.conn, id, message, suspendAfter)
+}
+
+func (r postgresRepository) CreateScanRun(ctx context.Context, connectionID int, fullScan bool) (*ScanRun, error) {
+	return CreateScanRun(ctx, r.conn, connectionID, fullScan)
+}
+
+func (r postgresRepository) GetScanRun(ctx context.Context, id int) (*ScanRun, error) {
+	return GetScanRun(ctx, r.conn, id)
+}
+
+func (r postgresRepository) ListScanRuns(ctx context.Context, connectionID int, limit int) ([]*ScanRun, error) {
+	return ListScanRuns(ctx, r.conn, connectionID, limit)
+}
+
+func (r postgresRepository) GetLastFullScanAt(ctx context.Context, connectionID int) (*time.Time, error) {
+	return GetLastFullScanAt(ctx, r.conn, connectionID)
+}
+
+func (r postgresRepository) GetResumableScanRun(ctx context.Context, connectionID int) (*ScanRun, error) {
+	return GetResumableScanRun(ctx, r.conn, connectionID)
+}
+
+func (r postgresRepository) ResumeScanRun(ctx context.Context, id int) error {
+	return ResumeScanRun(ctx, r.conn, id)
+}
+
+func (r postgresRepository) GetScanCheckpoints(ctx context.Context, scanRunID int) (map[string]bool, error) {
+	return GetScanCheckpoints(ctx, r.conn, scanRunID)
+}
+
+func (r postgresRepository) CommitScanBatch(ctx context.Context, connectionID, scanRunID int, owner string, batch ScanBatch) (int64, int64, error) {
+	return CommitScanBatch(ctx, r.conn, connectionID, scanRunID, owner, batch)
+}
+
+func (r postgresRepository) FinishScanRun(ctx context.Context, id int, owner string, status string, stats ScanRunStats, errorMessage *string) error {
+	return FinishScanRun(ctx, r.conn, id, owner, status, stats, errorMessage)
+}
+
+func (r postgresRepository) ReconcileScanRun(ctx context.Context, connectionID, scanRunID int, owner string) (int64, error) {
+	return ReconcileScanRun(ctx, r.conn, connectionID, scanRunID, owner)
+}
+
+func (r postgresRepository) PruneScanRuns(ctx context.Context, connectionID int, olderThan time.Duration) (int64, error) {
+	return PruneScanRuns(ctx, r.conn, connectionID, olderThan)
+}
+
+func (r postgresRepository) GetDirStates(ctx context.Context, connectionID int) (map[string]DirState, error) {
+	return GetDirStates(ctx, r.conn, connectionID)
+}
+
+func (r postgresRepository) AcquireScanLease(ctx context.Context, connectionID int, owner string, ttl time.Duration) (bool, error) {
+	return AcquireScanLease(ctx, r.conn, connectionID, owner, ttl)
+}
+
+func (r postgresRepository) RenewScanLease(ctx context.Context, connectionID int, owner string, ttl time.Duration) (bool, error) {
+	return RenewScanLease(ctx, r.conn, connectionID, owner, ttl)
+}
+
+func (r postgresRepository) ReleaseScanLease(ctx context.Context, connectionID int, owner string) error {
+	return ReleaseScanLease(ctx, r.conn, connectionID, owner)
+}
+
+func (r postgresRepository) AcquireWatchLease(ctx context.Context, connectionID int, owner string, ttl time.Duration) (bool, error) {
+	return AcquireWatchLease(ctx, r.conn, connectionID, owner, ttl)
+}
+
+func (r postgresRepository) RenewWatchLease(ctx context.Context, connectionID int, owner string, ttl time.Duration) (bool, error) {
+	return RenewWatchLease(ctx, r.conn, connectionID, owner, ttl)
+}
+
+func (r postgresRepository) ReleaseWatchLease(ctx context.Context, connectionID int, owner string) error {
+	return ReleaseWatchLease(ctx, r.conn, connectionID, owner)
+}
+
+func (r postgresRepository) EnqueueJob(ctx context.Context, req EnqueueJobRequest) (*Job, bool, error) {
+	return EnqueueJob(ctx, r.conn, req)
+}
+
+func (r postgresRepository) DequeueJob(ctx context.Context, worker string, types []string, visibility time.Duration) (*Job, error) {
+	return DequeueJob(ctx, r.conn, worker, types, visibility)
+}
+
+func (r postgresRepository) ExtendJob(ctx context.Context, id int, worker string, visibility time.Duration) (*Job, error) {
+	return ExtendJob(ctx, r.conn, id, worker, visibility)
+}
+
+func (r postgresRepository) CompleteJob(ctx context.Context, id int, worker string) error {
+	return CompleteJob(ctx, r.conn, id, worker)
+}
+
+func (r postgresRepository) FailJob(ctx context.Context, id int, worker string, message string, retryIn time.Duration, permanent bool) (string, error) {
+	return FailJob(ctx, r.conn, id, worker, message, retryIn, permanent)
+}
+
+func (r postgresRepository) ReleaseJob(ctx context.Context, id int, worker string, delay time.Duration) error {
+	return ReleaseJob(ctx, r.conn, id, worker, delay)
+}
+
+func (r postgresRepository) CancelJob(ctx context.Context, id int) (*Job, error) {
+	return CancelJob(ctx, r.conn, id)
+}
+
+func (r postgresRepository) GetJob(ctx context.Context, id int) (*Job, error) {
+	return GetJob(ctx, r.conn, id)
+}
+
+func (r postgresRepository) ListJobs(ctx context.Context, status string, limit int) ([]*Job, error) {
+	return ListJobs(ctx, r.conn, status, limit)
+}
+
+func (r postgresRepository) PublishEvent(ctx context.Context, event Event) error {
+	return PublishEvent(ctx, r.conn, event)
+}
+
+// ListenEvents はLISTENする接続をプールから取り出すので、*pgxpool.Poolから作ったリポジトリでだけ使える。
+func (r postgresRepository) ListenEvents(ctx context.Context) (<-chan Event, error) {
+	pool, ok := r.conn.(*pgxpool.Pool)
+	if !ok {
+		return nil, errors.New("listening for events requires a connection pool")
+	}
+	return ListenEvents(ctx, pool)
+}
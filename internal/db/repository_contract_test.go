@@ -0,0 +1,1043 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/joho/godotenv"
+	"github.com/koplec/sokoni/internal/model"
+	"github.com/koplec/sokoni/internal/tztime"
+)
+
+// newRepositories はテストごとに空のconnection・ファイルで始められるリポジトリと、connectionを作れるユーザーIDを返す。
+type newRepositories func(t *testing.T) (Repositories, int)
+
+func TestMemoryRepositories(t *testing.T) {
+	testRepositoryContract(t, func(t *testing.T) (Repositories, int) {
+		return NewMemoryRepositories(), 1
+	})
+}
+
+func TestPostgresRepositories(t *testing.T) {
+	godotenv.Load(filepath.Join("..", "..", "test.env"))
+	ctx := context.Background()
+	pool, err := Connect(ctx, 0)
+	if err != nil {
+		t.Skipf("Database connection failed: %v", err)
+	}
+	t.Cleanup(pool.Close)
+
+	testRepositoryContract(t, func(t *testing.T) (Repositories, int) {
+		// テスト用のユーザーを作り、削除時にconnection以下もカスケードで消す
+		name := fmt.Sprintf("contract-%d", time.Now().UnixNano())
+		var userID int
+		err := pool.QueryRow(ctx, `
+			INSERT INTO users (username, email, password_hash) VALUES ($1, $1 || '@example.com', 'dummy-hash')
+			RETURNING id
+		`, name).Scan(&userID)
+		if err != nil {
+			t.Fatalf("failed to create test user: %v", err)
+		}
+		t.Cleanup(func() {
+			pool.Exec(ctx, "DELETE FROM users WHERE id = $1", userID)
+		})
+		return NewRepositories(pool), userID
+	})
+}
+
+// testRepositoryContract はリポジトリの実装が満たすべき振る舞いを確認する。
+// PostgreSQLでは他のデータが残っていても通るよう、パスやファイル名にテストごとの接頭辞を付けている。
+func testRepositoryContract(t *testing.T, newRepos newRepositories) {
+	t.Run("Connections", func(t *testing.T) {
+		repos, userID := newRepos(t)
+		testConnectionContract(t, repos.Connections, userID)
+	})
+	t.Run("Files", func(t *testing.T) {
+		repos, userID := newRepos(t)
+		testFileContract(t, repos, userID)
+	})
+	t.Run("ScanRuns", func(t *testing.T) {
+		repos, userID := newRepos(t)
+		testScanRunContract(t, repos, userID)
+	})
+	t.Run("PruneScanRuns", func(t *testing.T) {
+		repos, userID := newRepos(t)
+		testPruneScanRunsContract(t, repos, userID)
+	})
+	t.Run("ScanLeases", func(t *testing.T) {
+		repos, userID := newRepos(t)
+		testScanLeaseContract(t, repos, userID)
+	})
+	t.Run("WatchLeases", func(t *testing.T) {
+		repos, userID := newRepos(t)
+		testWatchLeaseContract(t, repos, userID)
+	})
+	t.Run("Jobs", func(t *testing.T) {
+		repos, userID := newRepos(t)
+		testJobContract(t, repos, userID)
+	})
+	t.Run("Events", func(t *testing.T) {
+		repos, _ := newRepos(t)
+		testEventContract(t, repos.Events)
+	})
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func createTestConnection(t *testing.T, connections ConnectionRepository, userID int, req CreateConnectionRequest) *ConnectionResponse {
+	t.Helper()
+	req.UserID = userID
+	if req.Name == "" {
+		req.Name = "test"
+	}
+	if req.BasePath == "" {
+		req.BasePath = "/test"
+		req.RemotePath = "/test"
+	}
+	c, err := connections.CreateConnection(context.Background(), req)
+	if err != nil {
+		t.Fatalf("CreateConnection failed: %v", err)
+	}
+	return c
+}
+
+// holdTestLease はスキャン実行を記録できるよう、connectionのスキャンのリースを取得してownerを返す。
+func holdTestLease(t *testing.T, runs ScanRunRepository, connectionID int) string {
+	t.Helper()
+	owner := fmt.Sprintf("test/%d", connectionID)
+	if ok, err := runs.AcquireScanLease(context.Background(), connectionID, owner, time.Hour); err != nil || !ok {
+		t.Fatalf("expected to acquire scan lease, got %v %v", ok, err)
+	}
+	return owner
+}
+
+func containsConnection(connections []*Connection, id int) bool {
+	for _, c := range connections {
+		if c.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func testConnectionContract(t *testing.T, connections ConnectionRepository, userID int) {
+	ctx := context.Background()
+
+	first := createTestConnection(t, connections, userID, CreateConnectionRequest{Name: "first", Options: ptr("vers=3.0")})
+	if first.ScanInterval != 604800 || !first.AutoScan || first.Watch || *first.Options != "vers=3.0" {
+		t.Errorf("unexpected defaults: %+v", first)
+	}
+	second := createTestConnection(t, connections, userID, CreateConnectionRequest{
+		Name: "second", ScanInterval: ptr(60), AutoScan: ptr(false), Watch: ptr(true), PrivateKey: ptr("key"),
+	})
+	if second.ID == first.ID {
+		t.Fatalf("expected distinct IDs, got %d", second.ID)
+	}
+
+	got, err := connections.GetConnectionByID(ctx, second.ID)
+	if err != nil {
+		t.Fatalf("GetConnectionByID failed: %v", err)
+	}
+	if got.Name != "second" || got.ScanInterval != 60 || got.AutoScan || !got.Watch || *got.PrivateKey != "key" || got.LastScan != nil {
+		t.Errorf("unexpected connection: %+v", got)
+	}
+	if _, err := connections.GetConnectionByID(ctx, -1); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("expected pgx.ErrNoRows for missing connection, got %v", err)
+	}
+
+	list, err := connections.GetConnectionsByUserID(ctx, userID)
+	if err != nil {
+		t.Fatalf("GetConnectionsByUserID failed: %v", err)
+	}
+	if len(list) != 2 || list[0].ID != second.ID || list[1].ID != first.ID {
+		t.Errorf("expected newest connection first, got %+v", list)
+	}
+
+	// 自動スキャンが有効で一度もスキャンしていないものだけが対象
+	due, err := connections.GetDueConnections(ctx)
+	if err != nil {
+		t.Fatalf("GetDueConnections failed: %v", err)
+	}
+	if !containsConnection(due, first.ID) || containsConnection(due, second.ID) {
+		t.Errorf("unexpected due connections: %v", due)
+	}
+	if err := connections.UpdateLastScan(ctx, first.ID); err != nil {
+		t.Fatalf("UpdateLastScan failed: %v", err)
+	}
+	due, _ = connections.GetDueConnections(ctx)
+	if containsConnection(due, first.ID) {
+		t.Errorf("expected connection not to be due right after a scan")
+	}
+	got, _ = connections.GetConnectionByID(ctx, first.ID)
+	if got.LastScan == nil || time.Since(*got.LastScan) > time.Minute {
+		t.Errorf("expected last_scan to be set, got %v", got.LastScan)
+	}
+
+	// cron式のスケジュールと停止時間帯（現在時刻を含む時間帯）
+	now := tztime.Now()
+	blackout := fmt.Sprintf("%s-%s", now.Add(-time.Hour).Format("15:04"), now.Add(time.Hour).Format("15:04"))
+	scheduled := createTestConnection(t, connections, userID, CreateConnectionRequest{
+		Name: "scheduled", Schedule: ptr("@every 2h"), BlackoutWindows: ptr(blackout), Throttle: ptr("requests=2"),
+	})
+	if *scheduled.Schedule != "@every 2h" || *scheduled.BlackoutWindows != blackout || *scheduled.Throttle != "requests=2" {
+		t.Errorf("unexpected schedule: %+v", scheduled)
+	}
+	if scheduled.NextScan == nil || scheduled.NextScan.Before(now.Add(59*time.Minute)) || scheduled.NextScan.After(now.Add(time.Hour)) {
+		t.Errorf("expected next scan at the end of the blackout window, got %v", scheduled.NextScan)
+	}
+	due, _ = connections.GetDueConnections(ctx)
+	if containsConnection(due, scheduled.ID) {
+		t.Errorf("expected connection not to be due during its blackout window")
+	}
+	// 停止時間帯を解除すると、一度もスキャンしていないので対象になる
+	updatedSchedule, err := connections.UpdateConnection(ctx, scheduled.ID, userID, CreateConnectionRequest{
+		Name: "scheduled", BasePath: "/test", RemotePath: "/test", BlackoutWindows: ptr(""),
+	})
+	if err != nil {
+		t.Fatalf("UpdateConnection failed: %v", err)
+	}
+	if updatedSchedule.BlackoutWindows != nil || updatedSchedule.Schedule == nil || updatedSchedule.Throttle == nil {
+		t.Errorf("expected only blackout windows to be cleared, got %+v", updatedSchedule)
+	}
+	due, _ = connections.GetDueConnections(ctx)
+	if !containsConnection(due, scheduled.ID) {
+		t.Errorf("expected connection to be due once the blackout window is cleared")
+	}
+	connections.UpdateLastScan(ctx, scheduled.ID)
+	got, _ = connections.GetConnectionByID(ctx, scheduled.ID)
+	// @everyは秒単位に切り捨てる
+	if next := got.NextScanAt(time.Now()); next == nil || next.Sub(got.LastScan.Truncate(time.Second)) != 2*time.Hour {
+		t.Errorf("expected next scan 2h after last_scan, got %v (last_scan %v)", next, got.LastScan)
+	}
+	connections.DeleteConnection(ctx, scheduled.ID, userID)
+
+	// 失敗が続くと指数バックオフで再試行を遅らせ、suspendAfter回で定期スキャンを停止する
+	failing := createTestConnection(t, connections, userID, CreateConnectionRequest{Name: "failing"})
+	for i := 1; i <= 2; i++ {
+		n, err := connections.RecordScanFailure(ctx, failing.ID, "access denied", 3)
+		if err != nil {
+			t.Fatalf("RecordScanFailure failed: %v", err)
+		}
+		if n != i {
+			t.Errorf("expected %d consecutive failures, got %d", i, n)
+		}
+	}
+	got, _ = connections.GetConnectionByID(ctx, failing.ID)
+	if got.LastError == nil || *got.LastError != "access denied" || got.LastFailureAt == nil || got.SuspendedAt != nil {
+		t.Errorf("unexpected failure record: %+v", got.ScanFailures)
+	}
+	if next := got.NextScanAt(time.Now()); next == nil || next.Before(time.Now().Add(19*time.Minute)) {
+		t.Errorf("expected retry to be delayed by backoff, got %v", next)
+	}
+	due, _ = connections.GetDueConnections(ctx)
+	if containsConnection(due, failing.ID) {
+		t.Errorf("expected failing connection not to be due during backoff")
+	}
+	connections.RecordScanFailure(ctx, failing.ID, "access denied", 3)
+	got, _ = connections.GetConnectionByID(ctx, failing.ID)
+	if got.SuspendedAt == nil || got.SuspendedReason == nil || !strings.Contains(*got.SuspendedReason, "access denied") || got.NextScanAt(time.Now()) != nil {
+		t.Errorf("expected connection to be suspended, got %+v", got.ScanFailures)
+	}
+	// 成功すると記録を消して再開する
+	connections.UpdateLastScan(ctx, failing.ID)
+	got, _ = connections.GetConnectionByID(ctx, failing.ID)
+	if got.ScanFailures != (ScanFailures{}) {
+		t.Errorf("expected failures to be cleared after a successful scan, got %+v", got.ScanFailures)
+	}
+	// 設定を更新しても記録を消す
+	connections.RecordScanFailure(ctx, failing.ID, "timeout", 1)
+	updatedFailing, err := connections.UpdateConnection(ctx, failing.ID, userID, CreateConnectionRequest{Name: "fixed", BasePath: "/test", RemotePath: "/test"})
+	if err != nil {
+		t.Fatalf("UpdateConnection failed: %v", err)
+	}
+	if updatedFailing.ScanFailures != (ScanFailures{}) {
+		t.Errorf("expected failures to be cleared after an update, got %+v", updatedFailing.ScanFailures)
+	}
+	if _, err := connections.RecordScanFailure(ctx, -1, "x", 3); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("expected pgx.ErrNoRows for missing connection, got %v", err)
+	}
+	connections.DeleteConnection(ctx, failing.ID, userID)
+
+	watched, err := connections.GetWatchedConnections(ctx)
+	if err != nil {
+		t.Fatalf("GetWatchedConnections failed: %v", err)
+	}
+	if containsConnection(watched, first.ID) || !containsConnection(watched, second.ID) {
+		t.Errorf("unexpected watched connections: %v", watched)
+	}
+
+	// 指定しなかったスキャン設定は変えない
+	updated, err := connections.UpdateConnection(ctx, first.ID, userID, CreateConnectionRequest{
+		Name: "renamed", BasePath: "/renamed", RemotePath: "//nas/share", Watch: ptr(true),
+	})
+	if err != nil {
+		t.Fatalf("UpdateConnection failed: %v", err)
+	}
+	if updated.Name != "renamed" || updated.RemotePath != "//nas/share" || updated.Options != nil ||
+		updated.ScanInterval != 604800 || !updated.AutoScan || !updated.Watch {
+		t.Errorf("unexpected updated connection: %+v", updated)
+	}
+	if _, err := connections.UpdateConnection(ctx, first.ID, userID+1, CreateConnectionRequest{Name: "x"}); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("expected pgx.ErrNoRows when updating another user's connection, got %v", err)
+	}
+
+	// 省略した秘密鍵とホスト鍵は残し、空文字列で解除する
+	keyed := createTestConnection(t, connections, userID, CreateConnectionRequest{
+		BasePath: "/test", RemotePath: "sftp://nas/share", PrivateKey: ptr("key"), HostKey: ptr("SHA256:abc"),
+	})
+	if _, err := connections.UpdateConnection(ctx, keyed.ID, userID, CreateConnectionRequest{
+		Name: "keyed", BasePath: "/test", RemotePath: "sftp://nas/share",
+	}); err != nil {
+		t.Fatalf("UpdateConnection failed: %v", err)
+	}
+	got, _ = connections.GetConnectionByID(ctx, keyed.ID)
+	if got.PrivateKey == nil || *got.PrivateKey != "key" || got.HostKey == nil || *got.HostKey != "SHA256:abc" {
+		t.Errorf("expected omitted keys to be kept, got private_key %v host_key %v", got.PrivateKey, got.HostKey)
+	}
+	if _, err := connections.UpdateConnection(ctx, keyed.ID, userID, CreateConnectionRequest{
+		Name: "keyed", BasePath: "/test", RemotePath: "sftp://nas/share", PrivateKey: ptr(""),
+	}); err != nil {
+		t.Fatalf("UpdateConnection failed: %v", err)
+	}
+	got, _ = connections.GetConnectionByID(ctx, keyed.ID)
+	if got.PrivateKey != nil || got.HostKey == nil {
+		t.Errorf("expected only the private key to be cleared, got private_key %v host_key %v", got.PrivateKey, got.HostKey)
+	}
+	connections.DeleteConnection(ctx, keyed.ID, userID)
+
+	if err := connections.DeleteConnection(ctx, first.ID, userID+1); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("expected pgx.ErrNoRows when deleting another user's connection, got %v", err)
+	}
+	if err := connections.DeleteConnection(ctx, first.ID, userID); err != nil {
+		t.Fatalf("DeleteConnection failed: %v", err)
+	}
+	if _, err := connections.GetConnectionByID(ctx, first.ID); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("expected deleted connection to be gone, got %v", err)
+	}
+	if err := connections.DeleteConnection(ctx, first.ID, userID); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("expected pgx.ErrNoRows when deleting twice, got %v", err)
+	}
+}
+
+func testFileContract(t *testing.T, repos Repositories, userID int) {
+	ctx := context.Background()
+	files := repos.Files
+	c := createTestConnection(t, repos.Connections, userID, CreateConnectionRequest{})
+	token := fmt.Sprintf("tok%d", time.Now().UnixNano())
+	root := "/" + token
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	if err := files.InsertFile(ctx, -1, model.FileInfo{Path: root + "/orphan.pdf", Name: "orphan.pdf"}); err == nil {
+		t.Errorf("expected error for file of missing connection")
+	}
+
+	for _, f := range []model.FileInfo{
+		{Path: root + "/a/Invoice-" + token + ".pdf", Name: "Invoice-" + token + ".pdf", Size: 10, ModTime: modTime, ETag: `"v1"`},
+		{Path: root + "/a/sub/deep.pdf", Name: "deep.pdf", Size: 20, ModTime: modTime},
+		{Path: root + "/ab.pdf", Name: "ab.pdf", Size: 30, ModTime: modTime},
+	} {
+		if err := files.InsertFile(ctx, c.ID, f); err != nil {
+			t.Fatalf("InsertFile(%s) failed: %v", f.Path, err)
+		}
+	}
+
+	got, err := files.GetFileByPath(ctx, c.ID, root+"/a/Invoice-"+token+".pdf")
+	if err != nil {
+		t.Fatalf("GetFileByPath failed: %v", err)
+	}
+	if got.Size != 10 || !got.ModTime.Equal(modTime) || got.ETag != `"v1"` {
+		t.Errorf("unexpected file: %+v", got)
+	}
+	if _, err := files.GetFileByPath(ctx, c.ID, root+"/missing.pdf"); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("expected pgx.ErrNoRows for missing file, got %v", err)
+	}
+
+	// 同じパスは更新になる
+	if err := files.InsertFile(ctx, c.ID, model.FileInfo{Path: root + "/ab.pdf", Name: "ab.pdf", Size: 31, ModTime: modTime}); err != nil {
+		t.Fatalf("InsertFile failed: %v", err)
+	}
+	list, err := files.ListFiles(ctx, c.ID)
+	if err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	var paths []string
+	for _, f := range list {
+		paths = append(paths, strings.TrimPrefix(f.Path, root))
+	}
+	if strings.Join(paths, ",") != "/a/Invoice-"+token+".pdf,/a/sub/deep.pdf,/ab.pdf" || list[2].Size != 31 {
+		t.Errorf("unexpected files: %v", list)
+	}
+
+	// 名前の部分一致（大文字小文字を区別しない）
+	found, err := files.SearchFilesByName(ctx, "invoice-"+strings.ToUpper(token))
+	if err != nil {
+		t.Fatalf("SearchFilesByName failed: %v", err)
+	}
+	if len(found) != 1 || found[0].Path != root+"/a/Invoice-"+token+".pdf" || found[0].ConnectionID != c.ID {
+		t.Errorf("unexpected search result: %v", found)
+	}
+
+	// ディレクトリを指定すると配下をすべて消すが、名前が前方一致するだけのファイルは残す
+	n, err := files.DeleteFilesUnder(ctx, c.ID, root+"/a")
+	if err != nil {
+		t.Fatalf("DeleteFilesUnder failed: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 files to be deleted, got %d", n)
+	}
+	if n, _ := files.DeleteFilesUnder(ctx, c.ID+1, root+"/ab.pdf"); n != 0 {
+		t.Errorf("expected files of other connections to be kept, got %d deleted", n)
+	}
+	list, _ = files.ListFiles(ctx, c.ID)
+	if len(list) != 1 || list[0].Path != root+"/ab.pdf" {
+		t.Errorf("unexpected files after delete: %v", list)
+	}
+
+	// まとめて書き込む場合は新規か変わったファイルだけを数え、同じパスは後のものを使う
+	bulk := []model.FileInfo{
+		{Path: root + "/bulk/1.pdf", Name: "1.pdf", Size: 1, ModTime: modTime},
+		{Path: root + "/bulk/2.pdf", Name: "2.pdf", Size: 2, ModTime: modTime, ETag: "e2"},
+		{Path: root + "/bulk/1.pdf", Name: "1.pdf", Size: 11, ModTime: modTime},
+		{Path: root + "/ab.pdf", Name: "ab.pdf", Size: 31, ModTime: modTime},
+	}
+	written, err := files.UpsertFiles(ctx, c.ID, bulk)
+	if err != nil {
+		t.Fatalf("UpsertFiles failed: %v", err)
+	}
+	if written != 2 {
+		t.Errorf("expected 2 files to be written, got %d", written)
+	}
+	if got, _ := files.GetFileByPath(ctx, c.ID, root+"/bulk/1.pdf"); got.Size != 11 {
+		t.Errorf("expected the last duplicate to win, got %+v", got)
+	}
+	bulk[1].ETag = "e3"
+	if written, _ := files.UpsertFiles(ctx, c.ID, bulk); written != 1 {
+		t.Errorf("expected only the changed file to be written, got %d", written)
+	}
+	if got, _ := files.GetFileByPath(ctx, c.ID, root+"/bulk/2.pdf"); got.ETag != "e3" {
+		t.Errorf("expected etag to be updated, got %+v", got)
+	}
+	if written, err := files.UpsertFiles(ctx, c.ID, nil); err != nil || written != 0 {
+		t.Errorf("expected empty batch to be a no-op, got %d %v", written, err)
+	}
+	if _, err := files.UpsertFiles(ctx, -1, bulk[:1]); err == nil {
+		t.Errorf("expected error for files of missing connection")
+	}
+
+	// パスはconnectionごとに一意なので、ほかのconnectionの同じパスとは別のファイルになる
+	other := createTestConnection(t, repos.Connections, userID, CreateConnectionRequest{})
+	if written, err := files.UpsertFiles(ctx, other.ID, []model.FileInfo{{Path: root + "/ab.pdf", Name: "ab.pdf", Size: 99, ModTime: modTime}}); err != nil || written != 1 {
+		t.Fatalf("expected the same path of another connection to be inserted, got %d %v", written, err)
+	}
+	if err := files.InsertFile(ctx, other.ID, model.FileInfo{Path: root + "/bulk/1.pdf", Name: "1.pdf", Size: 98, ModTime: modTime}); err != nil {
+		t.Fatalf("InsertFile failed: %v", err)
+	}
+	list, _ = files.ListFiles(ctx, c.ID)
+	if len(list) != 3 || list[0].Path != root+"/ab.pdf" || list[0].Size != 31 || list[1].Size != 11 {
+		t.Errorf("expected files of the first connection to be kept, got %v", list)
+	}
+	if list, _ := files.ListFiles(ctx, other.ID); len(list) != 2 {
+		t.Errorf("expected 2 files in the other connection, got %v", list)
+	}
+	if got, err := files.GetFileByPath(ctx, other.ID, root+"/ab.pdf"); err != nil || got.Size != 99 {
+		t.Errorf("expected the other connection's file, got %+v %v", got, err)
+	}
+	if n, _ := files.DeleteFilesUnder(ctx, other.ID, root+"/ab.pdf"); n != 1 {
+		t.Errorf("expected only the other connection's file to be deleted, got %d", n)
+	}
+
+	// connectionを消すとファイルも消える
+	if err := repos.Connections.DeleteConnection(ctx, c.ID, userID); err != nil {
+		t.Fatalf("DeleteConnection failed: %v", err)
+	}
+	if list, _ := files.ListFiles(ctx, c.ID); len(list) != 0 {
+		t.Errorf("expected files to be deleted with the connection, got %v", list)
+	}
+	if _, err := files.GetFileByPath(ctx, other.ID, root+"/bulk/1.pdf"); err != nil {
+		t.Errorf("expected the other connection's file to be kept, got %v", err)
+	}
+}
+
+func testPruneScanRunsContract(t *testing.T, repos Repositories, userID int) {
+	ctx := context.Background()
+	runs := repos.ScanRuns
+	c := createTestConnection(t, repos.Connections, userID, CreateConnectionRequest{})
+	root := fmt.Sprintf("/prune%d", time.Now().UnixNano())
+	owner := holdTestLease(t, runs, c.ID)
+
+	// 成功したフルスキャン・差分スキャン・失敗・中断（最新）の順に実行したとする
+	var ids []int
+	for _, r := range []struct {
+		full   bool
+		status string
+	}{
+		{true, ScanRunCompleted},
+		{false, ScanRunPartial},
+		{true, ScanRunFailed},
+		{false, ScanRunInterrupted},
+	} {
+		run, err := runs.CreateScanRun(ctx, c.ID, r.full)
+		if err != nil {
+			t.Fatalf("CreateScanRun failed: %v", err)
+		}
+		if _, _, err := runs.CommitScanBatch(ctx, c.ID, run.ID, owner, ScanBatch{Dirs: []ScannedDir{{Path: root}}}); err != nil {
+			t.Fatalf("CommitScanBatch failed: %v", err)
+		}
+		if err := runs.FinishScanRun(ctx, run.ID, owner, r.status, ScanRunStats{}, nil); err != nil {
+			t.Fatalf("FinishScanRun failed: %v", err)
+		}
+		ids = append(ids, run.ID)
+	}
+
+	// 期限内のスキャン実行は消さないが、再開できないもののチェックポイントは消す
+	if n, err := runs.PruneScanRuns(ctx, c.ID, time.Hour); err != nil || n != 0 {
+		t.Errorf("expected no runs to be pruned within the retention, got %d %v", n, err)
+	}
+	for i, id := range ids {
+		done, _ := runs.GetScanCheckpoints(ctx, id)
+		if resumable := i == len(ids)-1; resumable != done[root] {
+			t.Errorf("run %d: expected checkpoints to be kept only for the resumable run, got %v", i, done)
+		}
+	}
+
+	// 最新のものと最後に成功したフルスキャンは残す
+	if n, err := runs.PruneScanRuns(ctx, c.ID, 0); err != nil || n != 2 {
+		t.Errorf("expected 2 runs to be pruned, got %d %v", n, err)
+	}
+	list, _ := runs.ListScanRuns(ctx, c.ID, 10)
+	if len(list) != 2 || list[0].ID != ids[3] || list[1].ID != ids[0] {
+		t.Errorf("unexpected runs after prune: %v", list)
+	}
+	if last, err := runs.GetLastFullScanAt(ctx, c.ID); err != nil || last == nil {
+		t.Errorf("expected the last full scan to be kept, got %v %v", last, err)
+	}
+	if run, err := runs.GetResumableScanRun(ctx, c.ID); err != nil || run.ID != ids[3] {
+		t.Errorf("expected the interrupted run to stay resumable, got %v %v", run, err)
+	}
+}
+
+func testScanRunContract(t *testing.T, repos Repositories, userID int) {
+	ctx := context.Background()
+	runs := repos.ScanRuns
+	c := createTestConnection(t, repos.Connections, userID, CreateConnectionRequest{})
+	root := fmt.Sprintf("/run%d", time.Now().UnixNano())
+	owner := holdTestLease(t, runs, c.ID)
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	file := func(path string, size int64) model.FileInfo {
+		return model.FileInfo{Path: root + path, Name: filepath.Base(path), Size: size, ModTime: modTime}
+	}
+
+	if _, err := runs.GetResumableScanRun(ctx, c.ID); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("expected no resumable run, got %v", err)
+	}
+	if last, err := runs.GetLastFullScanAt(ctx, c.ID); err != nil || last != nil {
+		t.Errorf("expected no full scan yet, got %v %v", last, err)
+	}
+
+	run, err := runs.CreateScanRun(ctx, c.ID, true)
+	if err != nil {
+		t.Fatalf("CreateScanRun failed: %v", err)
+	}
+	if run.Status != ScanRunRunning || !run.FullScan || run.ConnectionID != c.ID {
+		t.Errorf("unexpected scan run: %+v", run)
+	}
+
+	// 1回目のバッチ：ファイルと、一覧を取ったディレクトリ
+	written, deleted, err := runs.CommitScanBatch(ctx, c.ID, run.ID, owner, ScanBatch{
+		Files: []model.FileInfo{file("/a.pdf", 1), file("/sub/b.pdf", 2), file("/gone/c.pdf", 3), file("/locked/d.pdf", 4)},
+		Dirs: []ScannedDir{{
+			Path: root + "/sub", Listed: true, Files: []string{root + "/sub/b.pdf"},
+			State: DirState{ModTime: modTime, EntryCount: 1, FileCount: 1, Subdirs: []string{"x"}, ListedAt: modTime},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("CommitScanBatch failed: %v", err)
+	}
+	if written != 4 || deleted != 0 {
+		t.Errorf("expected 4 written and 0 deleted, got %d %d", written, deleted)
+	}
+
+	// 変わっていないファイルは書き込まず、一覧に無かったファイルは消す
+	written, deleted, err = runs.CommitScanBatch(ctx, c.ID, run.ID, owner, ScanBatch{
+		Files: []model.FileInfo{file("/a.pdf", 1), file("/sub/b.pdf", 5)},
+		Dirs: []ScannedDir{
+			{Path: root + "/sub", Listed: true, Files: []string{}, State: DirState{ModTime: modTime, ListedAt: modTime}},
+			{Path: root, Listed: false, Errors: []ScanErrorRecord{{Path: root + "/locked", Reason: "permission denied"}}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CommitScanBatch failed: %v", err)
+	}
+	if written != 1 || deleted != 1 {
+		t.Errorf("expected 1 written and 1 deleted, got %d %d", written, deleted)
+	}
+
+	if _, _, err := runs.CommitScanBatch(ctx, c.ID, -1, owner, ScanBatch{Files: []model.FileInfo{file("/never.pdf", 1)}, Dirs: []ScannedDir{{Path: root}}}); err == nil {
+		t.Errorf("expected error for missing scan run")
+	}
+	if _, err := repos.Files.GetFileByPath(ctx, c.ID, root+"/never.pdf"); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("expected failed batch not to be applied, got %v", err)
+	}
+
+	checkpoints, err := runs.GetScanCheckpoints(ctx, run.ID)
+	if err != nil {
+		t.Fatalf("GetScanCheckpoints failed: %v", err)
+	}
+	if len(checkpoints) != 2 || !checkpoints[root] || !checkpoints[root+"/sub"] {
+		t.Errorf("unexpected checkpoints: %v", checkpoints)
+	}
+
+	states, err := runs.GetDirStates(ctx, c.ID)
+	if err != nil {
+		t.Fatalf("GetDirStates failed: %v", err)
+	}
+	if s, ok := states[root+"/sub"]; !ok || !s.ModTime.Equal(modTime) || s.Subdirs == nil || len(s.Subdirs) != 0 {
+		t.Errorf("unexpected directory states: %+v", states)
+	}
+
+	// チェックポイントの無いディレクトリのファイルは消すが、読み取れなかったパスの配下は残す
+	deleted, err = runs.ReconcileScanRun(ctx, c.ID, run.ID, owner)
+	if err != nil {
+		t.Fatalf("ReconcileScanRun failed: %v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("expected 1 file to be reconciled, got %d", deleted)
+	}
+	list, _ := repos.Files.ListFiles(ctx, c.ID)
+	var paths []string
+	for _, f := range list {
+		paths = append(paths, strings.TrimPrefix(f.Path, root))
+	}
+	if strings.Join(paths, ",") != "/a.pdf,/locked/d.pdf" {
+		t.Errorf("unexpected files after reconcile: %v", paths)
+	}
+
+	if err := runs.FinishScanRun(ctx, run.ID, owner, ScanRunInterrupted, ScanRunStats{FilesSeen: 4, FilesWritten: 5}, ptr("canceled")); err != nil {
+		t.Fatalf("FinishScanRun failed: %v", err)
+	}
+	resumable, err := runs.GetResumableScanRun(ctx, c.ID)
+	if err != nil || resumable.ID != run.ID || *resumable.ErrorMessage != "canceled" {
+		t.Fatalf("expected interrupted run to be resumable, got %+v %v", resumable, err)
+	}
+	if err := runs.ResumeScanRun(ctx, run.ID); err != nil {
+		t.Fatalf("ResumeScanRun failed: %v", err)
+	}
+	if err := runs.FinishScanRun(ctx, run.ID, owner, ScanRunCompleted, ScanRunStats{FilesSeen: 1, DirsUnchanged: 2}, nil); err != nil {
+		t.Fatalf("FinishScanRun failed: %v", err)
+	}
+
+	got, err := runs.GetScanRun(ctx, run.ID)
+	if err != nil {
+		t.Fatalf("GetScanRun failed: %v", err)
+	}
+	if got.Status != ScanRunCompleted || got.FilesSeen != 5 || got.FilesWritten != 5 || got.DirsUnchanged != 2 ||
+		got.ErrorMessage != nil || got.ResumedAt == nil || got.FinishedAt == nil {
+		t.Errorf("unexpected finished run: %+v", got)
+	}
+	if _, err := runs.GetResumableScanRun(ctx, c.ID); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("expected completed run not to be resumable, got %v", err)
+	}
+	if last, err := runs.GetLastFullScanAt(ctx, c.ID); err != nil || last == nil || !last.Equal(got.StartedAt) {
+		t.Errorf("expected last full scan at %v, got %v %v", got.StartedAt, last, err)
+	}
+	if _, err := runs.GetScanRun(ctx, -1); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("expected pgx.ErrNoRows for missing run, got %v", err)
+	}
+
+	incremental, err := runs.CreateScanRun(ctx, c.ID, false)
+	if err != nil {
+		t.Fatalf("CreateScanRun failed: %v", err)
+	}
+	list2, err := runs.ListScanRuns(ctx, c.ID, 1)
+	if err != nil {
+		t.Fatalf("ListScanRuns failed: %v", err)
+	}
+	if len(list2) != 1 || list2[0].ID != incremental.ID || list2[0].FullScan {
+		t.Errorf("expected newest run first, got %+v", list2)
+	}
+	if _, err := runs.CreateScanRun(ctx, -1, true); err == nil {
+		t.Errorf("expected error for scan run of missing connection")
+	}
+}
+
+func testScanLeaseContract(t *testing.T, repos Repositories, userID int) {
+	ctx := context.Background()
+	runs := repos.ScanRuns
+	c := createTestConnection(t, repos.Connections, userID, CreateConnectionRequest{})
+
+	if ok, err := runs.AcquireScanLease(ctx, c.ID, "a", time.Minute); err != nil || !ok {
+		t.Fatalf("expected to acquire lease, got %v %v", ok, err)
+	}
+	// 期限内のリースはほかのownerも同じownerも取得できない
+	if ok, err := runs.AcquireScanLease(ctx, c.ID, "b", time.Minute); err != nil || ok {
+		t.Errorf("expected lease to be held, got %v %v", ok, err)
+	}
+	if ok, err := runs.AcquireScanLease(ctx, c.ID, "a", time.Minute); err != nil || ok {
+		t.Errorf("expected lease not to be acquired twice, got %v %v", ok, err)
+	}
+	if ok, err := runs.RenewScanLease(ctx, c.ID, "a", time.Minute); err != nil || !ok {
+		t.Errorf("expected owner to renew lease, got %v %v", ok, err)
+	}
+	if ok, err := runs.RenewScanLease(ctx, c.ID, "b", time.Minute); err != nil || ok {
+		t.Errorf("expected other owner not to renew lease, got %v %v", ok, err)
+	}
+	// ほかのownerは手放せない
+	if err := runs.ReleaseScanLease(ctx, c.ID, "b"); err != nil {
+		t.Errorf("ReleaseScanLease failed: %v", err)
+	}
+	if ok, _ := runs.AcquireScanLease(ctx, c.ID, "b", time.Minute); ok {
+		t.Errorf("expected lease to survive release by other owner")
+	}
+	if err := runs.ReleaseScanLease(ctx, c.ID, "a"); err != nil {
+		t.Errorf("ReleaseScanLease failed: %v", err)
+	}
+
+	// 期限切れのリースは延長できず、ほかのownerが引き継ぐ
+	if ok, err := runs.AcquireScanLease(ctx, c.ID, "b", 50*time.Millisecond); err != nil || !ok {
+		t.Fatalf("expected to acquire released lease, got %v %v", ok, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if ok, err := runs.AcquireScanLease(ctx, c.ID, "c", time.Minute); err != nil || !ok {
+		t.Errorf("expected to take over expired lease, got %v %v", ok, err)
+	}
+	if ok, err := runs.RenewScanLease(ctx, c.ID, "b", time.Minute); err != nil || ok {
+		t.Errorf("expected expired owner not to renew lease, got %v %v", ok, err)
+	}
+
+	// リースを失ったownerはスキャン実行を記録できない
+	run, err := runs.CreateScanRun(ctx, c.ID, true)
+	if err != nil {
+		t.Fatalf("CreateScanRun failed: %v", err)
+	}
+	path := fmt.Sprintf("/lease%d/a.pdf", time.Now().UnixNano())
+	batch := ScanBatch{Files: []model.FileInfo{{Path: path, Name: "a.pdf", Size: 1, ModTime: time.Now()}}}
+	if _, _, err := runs.CommitScanBatch(ctx, c.ID, run.ID, "b", batch); !errors.Is(err, ErrLeaseNotHeld) {
+		t.Errorf("expected ErrLeaseNotHeld from CommitScanBatch, got %v", err)
+	}
+	if _, err := repos.Files.GetFileByPath(ctx, c.ID, path); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("expected the batch of a lost lease not to be applied, got %v", err)
+	}
+	if _, err := runs.ReconcileScanRun(ctx, c.ID, run.ID, "b"); !errors.Is(err, ErrLeaseNotHeld) {
+		t.Errorf("expected ErrLeaseNotHeld from ReconcileScanRun, got %v", err)
+	}
+	if err := runs.FinishScanRun(ctx, run.ID, "b", ScanRunFailed, ScanRunStats{}, nil); !errors.Is(err, ErrLeaseNotHeld) {
+		t.Errorf("expected ErrLeaseNotHeld from FinishScanRun, got %v", err)
+	}
+	if got, _ := runs.GetScanRun(ctx, run.ID); got == nil || got.Status != ScanRunRunning {
+		t.Errorf("expected the run of a lost lease not to be finished, got %+v", got)
+	}
+	if _, _, err := runs.CommitScanBatch(ctx, c.ID, run.ID, "c", batch); err != nil {
+		t.Errorf("expected the lease owner to commit, got %v", err)
+	}
+	if err := runs.FinishScanRun(ctx, run.ID, "c", ScanRunCompleted, ScanRunStats{}, nil); err != nil {
+		t.Errorf("expected the lease owner to finish the run, got %v", err)
+	}
+
+	if _, err := runs.AcquireScanLease(ctx, -1, "a", time.Minute); err == nil {
+		t.Errorf("expected error for lease of missing connection")
+	}
+}
+
+func testWatchLeaseContract(t *testing.T, repos Repositories, userID int) {
+	ctx := context.Background()
+	runs := repos.ScanRuns
+	c := createTestConnection(t, repos.Connections, userID, CreateConnectionRequest{})
+
+	// 監視のリースはスキャンのリースとは別に取得する
+	if ok, err := runs.AcquireScanLease(ctx, c.ID, "scan", time.Minute); err != nil || !ok {
+		t.Fatalf("expected to acquire scan lease, got %v %v", ok, err)
+	}
+	if ok, err := runs.AcquireWatchLease(ctx, c.ID, "a", time.Minute); err != nil || !ok {
+		t.Fatalf("expected to acquire watch lease, got %v %v", ok, err)
+	}
+	if ok, err := runs.AcquireWatchLease(ctx, c.ID, "b", time.Minute); err != nil || ok {
+		t.Errorf("expected watch lease to be held, got %v %v", ok, err)
+	}
+	if ok, err := runs.RenewWatchLease(ctx, c.ID, "a", time.Minute); err != nil || !ok {
+		t.Errorf("expected owner to renew watch lease, got %v %v", ok, err)
+	}
+	if ok, err := runs.RenewWatchLease(ctx, c.ID, "b", time.Minute); err != nil || ok {
+		t.Errorf("expected other owner not to renew watch lease, got %v %v", ok, err)
+	}
+	if err := runs.ReleaseWatchLease(ctx, c.ID, "b"); err != nil {
+		t.Errorf("ReleaseWatchLease failed: %v", err)
+	}
+	if ok, _ := runs.AcquireWatchLease(ctx, c.ID, "b", time.Minute); ok {
+		t.Errorf("expected watch lease to survive release by other owner")
+	}
+	if err := runs.ReleaseWatchLease(ctx, c.ID, "a"); err != nil {
+		t.Errorf("ReleaseWatchLease failed: %v", err)
+	}
+	// スキャンのリースは監視のリースを手放しても残る
+	if ok, _ := runs.AcquireScanLease(ctx, c.ID, "b", time.Minute); ok {
+		t.Errorf("expected scan lease to be independent of watch lease")
+	}
+
+	// 期限切れのリースはほかのownerが引き継ぐ
+	if ok, err := runs.AcquireWatchLease(ctx, c.ID, "b", 50*time.Millisecond); err != nil || !ok {
+		t.Fatalf("expected to acquire released watch lease, got %v %v", ok, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if ok, err := runs.AcquireWatchLease(ctx, c.ID, "c", time.Minute); err != nil || !ok {
+		t.Errorf("expected to take over expired watch lease, got %v %v", ok, err)
+	}
+
+	if _, err := runs.AcquireWatchLease(ctx, -1, "a", time.Minute); err == nil {
+		t.Errorf("expected error for watch lease of missing connection")
+	}
+}
+
+func testJobContract(t *testing.T, repos Repositories, userID int) {
+	ctx := context.Background()
+	jobs := repos.Jobs
+	c := createTestConnection(t, repos.Connections, userID, CreateConnectionRequest{})
+	// PostgreSQLでは他のテストのジョブが残っていても取り出さないよう、テストごとの種類を使う
+	jobType := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	types := []string{jobType}
+	key := fmt.Sprintf("%s:%d", jobType, c.ID)
+
+	low, created, err := jobs.EnqueueJob(ctx, EnqueueJobRequest{Type: jobType, ConnectionID: &c.ID, DedupeKey: &key})
+	if err != nil || !created {
+		t.Fatalf("EnqueueJob failed: %v %v", created, err)
+	}
+	if low.Status != JobQueued || low.MaxAttempts != DefaultJobMaxAttempts || string(low.Payload) != "{}" || *low.ConnectionID != c.ID {
+		t.Errorf("unexpected job: %+v", low)
+	}
+	// 待機中のジョブと同じキーでは積まない
+	dup, created, err := jobs.EnqueueJob(ctx, EnqueueJobRequest{Type: jobType, ConnectionID: &c.ID, DedupeKey: &key})
+	if err != nil || created || dup.ID != low.ID {
+		t.Errorf("expected existing job %d, got %+v %v %v", low.ID, dup, created, err)
+	}
+	high, _, err := jobs.EnqueueJob(ctx, EnqueueJobRequest{Type: jobType, Payload: json.RawMessage(`{"a": 1}`), Priority: 10, MaxAttempts: 1})
+	if err != nil {
+		t.Fatalf("EnqueueJob failed: %v", err)
+	}
+
+	// 優先度の高いものから取り出し、同じジョブは2つのワーカーに渡さない
+	got, err := jobs.DequeueJob(ctx, "w1", types, time.Minute)
+	if err != nil || got.ID != high.ID || got.Status != JobRunning || got.Attempts != 1 || *got.LockedBy != "w1" {
+		t.Fatalf("expected high priority job, got %+v %v", got, err)
+	}
+	got, err = jobs.DequeueJob(ctx, "w2", types, 50*time.Millisecond)
+	if err != nil || got.ID != low.ID {
+		t.Fatalf("expected low priority job, got %+v %v", got, err)
+	}
+	if _, err := jobs.DequeueJob(ctx, "w3", types, time.Minute); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("expected no job, got %v", err)
+	}
+	if _, err := jobs.DequeueJob(ctx, "w3", []string{"other"}, time.Minute); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("expected no job of other type, got %v", err)
+	}
+
+	// 上限に達した失敗はdead
+	if status, err := jobs.FailJob(ctx, high.ID, "w1", "boom", 0, false); err != nil || status != JobDead {
+		t.Errorf("expected dead job, got %q %v", status, err)
+	}
+	if j, _ := jobs.GetJob(ctx, high.ID); j.Status != JobDead || *j.LastError != "boom" || j.FinishedAt == nil || j.LockedBy != nil {
+		t.Errorf("unexpected dead job: %+v", j)
+	}
+	if dead, _ := jobs.ListJobs(ctx, JobDead, 100); len(dead) == 0 || dead[0].ID != high.ID {
+		t.Errorf("expected dead job to be listed, got %+v", dead)
+	}
+
+	// 可視性タイムアウトが切れたジョブはほかのワーカーが取り出し直し、元のワーカーは延長も完了もできない
+	time.Sleep(100 * time.Millisecond)
+	got, err = jobs.DequeueJob(ctx, "w3", types, time.Minute)
+	if err != nil || got.ID != low.ID || got.Attempts != 2 || *got.LockedBy != "w3" {
+		t.Fatalf("expected expired job to be dequeued again, got %+v %v", got, err)
+	}
+	if _, err := jobs.ExtendJob(ctx, low.ID, "w2", time.Minute); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("expected stale worker not to extend job, got %v", err)
+	}
+	if err := jobs.CompleteJob(ctx, low.ID, "w2"); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("expected stale worker not to complete job, got %v", err)
+	}
+	if j, err := jobs.ExtendJob(ctx, low.ID, "w3", time.Minute); err != nil || j.ID != low.ID || j.CancelRequestedAt != nil {
+		t.Errorf("expected worker to extend job, got %+v %v", j, err)
+	}
+
+	// 再試行できる失敗は待ち時間の後に取り出せる
+	if status, err := jobs.FailJob(ctx, low.ID, "w3", "flaky", time.Hour, false); err != nil || status != JobQueued {
+		t.Errorf("expected queued job, got %q %v", status, err)
+	}
+	if _, err := jobs.DequeueJob(ctx, "w3", types, time.Minute); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("expected job to wait before retry, got %v", err)
+	}
+
+	// 止めるときに戻したジョブは回数に数えない
+	retry, _, _ := jobs.EnqueueJob(ctx, EnqueueJobRequest{Type: jobType})
+	got, _ = jobs.DequeueJob(ctx, "w4", types, time.Minute)
+	if err := jobs.ReleaseJob(ctx, got.ID, "w4", 0); err != nil {
+		t.Errorf("ReleaseJob failed: %v", err)
+	}
+	got, err = jobs.DequeueJob(ctx, "w4", types, time.Minute)
+	if err != nil || got.ID != retry.ID || got.Attempts != 1 {
+		t.Fatalf("expected released job with 1 attempt, got %+v %v", got, err)
+	}
+	// 遅らせて戻したジョブは、その間ほかのジョブに先を譲る
+	later, _, _ := jobs.EnqueueJob(ctx, EnqueueJobRequest{Type: jobType})
+	if err := jobs.ReleaseJob(ctx, got.ID, "w4", 50*time.Millisecond); err != nil {
+		t.Errorf("ReleaseJob failed: %v", err)
+	}
+	next, err := jobs.DequeueJob(ctx, "w4", types, time.Minute)
+	if err != nil || next.ID != later.ID {
+		t.Fatalf("expected job %d to go before the delayed job, got %+v %v", later.ID, next, err)
+	}
+	jobs.CompleteJob(ctx, next.ID, "w4")
+	if _, err := jobs.DequeueJob(ctx, "w4", types, time.Minute); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("expected the delayed job to wait, got %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	got, err = jobs.DequeueJob(ctx, "w4", types, time.Minute)
+	if err != nil || got.ID != retry.ID || got.Attempts != 1 {
+		t.Fatalf("expected the delayed job with 1 attempt, got %+v %v", got, err)
+	}
+	if err := jobs.CompleteJob(ctx, got.ID, "w4"); err != nil {
+		t.Errorf("CompleteJob failed: %v", err)
+	}
+	if j, _ := jobs.GetJob(ctx, got.ID); j.Status != JobSucceeded || j.FinishedAt == nil {
+		t.Errorf("unexpected completed job: %+v", j)
+	}
+	// permanentな失敗は上限前でもdead
+	perm, _, _ := jobs.EnqueueJob(ctx, EnqueueJobRequest{Type: jobType})
+	jobs.DequeueJob(ctx, "w4", types, time.Minute)
+	if status, err := jobs.FailJob(ctx, perm.ID, "w4", "unknown job type", 0, true); err != nil || status != JobDead {
+		t.Errorf("expected permanent failure to be dead, got %q %v", status, err)
+	}
+
+	// 上限に達したまま可視性タイムアウトが切れたジョブはdeadになる
+	last, _, _ := jobs.EnqueueJob(ctx, EnqueueJobRequest{Type: jobType, MaxAttempts: 1})
+	jobs.DequeueJob(ctx, "w5", types, 50*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	if _, err := jobs.DequeueJob(ctx, "w6", types, time.Minute); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("expected exhausted job not to be dequeued, got %v", err)
+	}
+	if j, _ := jobs.GetJob(ctx, last.ID); j.Status != JobDead {
+		t.Errorf("expected exhausted job to be dead, got %+v", j)
+	}
+
+	// 待機中・実行中のジョブがなくなれば同じキーでも積める
+	doneKey := key + ":done"
+	done, _, _ := jobs.EnqueueJob(ctx, EnqueueJobRequest{Type: jobType, DedupeKey: &doneKey})
+	jobs.DequeueJob(ctx, "w7", types, time.Minute)
+	jobs.CompleteJob(ctx, done.ID, "w7")
+	if again, created, err := jobs.EnqueueJob(ctx, EnqueueJobRequest{Type: jobType, DedupeKey: &doneKey}); err != nil || !created || again.ID == done.ID {
+		t.Errorf("expected new job after the previous one finished, got %+v %v %v", again, created, err)
+	}
+
+	// 待機中のジョブはすぐに取り消す
+	queued, _, _ := jobs.EnqueueJob(ctx, EnqueueJobRequest{Type: jobType, DedupeKey: &doneKey})
+	if j, err := jobs.CancelJob(ctx, queued.ID); err != nil || j.Status != JobCancelled || j.FinishedAt == nil {
+		t.Errorf("expected queued job to be cancelled, got %+v %v", j, err)
+	}
+	if _, err := jobs.DequeueJob(ctx, "w8", types, time.Minute); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("expected cancelled job not to be dequeued, got %v", err)
+	}
+	// 実行中のジョブは取り消しを記録し、ワーカーが止めたらcancelledにする（再試行しない）
+	running, _, _ := jobs.EnqueueJob(ctx, EnqueueJobRequest{Type: jobType, DedupeKey: &doneKey})
+	jobs.DequeueJob(ctx, "w8", types, time.Minute)
+	if j, err := jobs.CancelJob(ctx, running.ID); err != nil || j.Status != JobRunning || j.CancelRequestedAt == nil {
+		t.Errorf("expected cancellation to be requested, got %+v %v", j, err)
+	}
+	if j, err := jobs.ExtendJob(ctx, running.ID, "w8", time.Minute); err != nil || j.CancelRequestedAt == nil {
+		t.Errorf("expected heartbeat to see the cancellation, got %+v %v", j, err)
+	}
+	if status, err := jobs.FailJob(ctx, running.ID, "w8", "context canceled", 0, false); err != nil || status != JobCancelled {
+		t.Errorf("expected failed job with cancellation to be cancelled, got %q %v", status, err)
+	}
+	if j, err := jobs.CancelJob(ctx, running.ID); err != nil || j.Status != JobCancelled {
+		t.Errorf("expected finished job to be left as is, got %+v %v", j, err)
+	}
+	released, _, _ := jobs.EnqueueJob(ctx, EnqueueJobRequest{Type: jobType, DedupeKey: &doneKey})
+	jobs.DequeueJob(ctx, "w9", types, time.Minute)
+	jobs.CancelJob(ctx, released.ID)
+	if err := jobs.ReleaseJob(ctx, released.ID, "w9", 0); err != nil {
+		t.Errorf("ReleaseJob failed: %v", err)
+	}
+	if j, _ := jobs.GetJob(ctx, released.ID); j.Status != JobCancelled {
+		t.Errorf("expected released job with cancellation to be cancelled, got %s", j.Status)
+	}
+	// 取り消しを頼まれたまま可視性タイムアウトが切れた（ワーカーが落ちた）ジョブも取り出し直さない
+	crashed, _, _ := jobs.EnqueueJob(ctx, EnqueueJobRequest{Type: jobType, DedupeKey: &doneKey})
+	jobs.DequeueJob(ctx, "w10", types, 50*time.Millisecond)
+	jobs.CancelJob(ctx, crashed.ID)
+	time.Sleep(100 * time.Millisecond)
+	if _, err := jobs.DequeueJob(ctx, "w11", types, time.Minute); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("expected cancelled job not to be dequeued again, got %v", err)
+	}
+	if j, _ := jobs.GetJob(ctx, crashed.ID); j.Status != JobCancelled {
+		t.Errorf("expected crashed job with cancellation to be cancelled, got %s", j.Status)
+	}
+	if _, err := jobs.CancelJob(ctx, -1); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("expected pgx.ErrNoRows for cancelling missing job, got %v", err)
+	}
+
+	if _, err := jobs.GetJob(ctx, -1); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("expected pgx.ErrNoRows for missing job, got %v", err)
+	}
+	if _, _, err := jobs.EnqueueJob(ctx, EnqueueJobRequest{Type: jobType, ConnectionID: ptr(-1)}); err == nil {
+		t.Errorf("expected error for job of missing connection")
+	}
+}
+
+func testEventContract(t *testing.T, events EventRepository) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// LISTENしているものすべてに届く
+	first, err := events.ListenEvents(ctx)
+	if err != nil {
+		t.Fatalf("ListenEvents failed: %v", err)
+	}
+	second, err := events.ListenEvents(ctx)
+	if err != nil {
+		t.Fatalf("ListenEvents failed: %v", err)
+	}
+	// PostgreSQLでは他のテストの通知も届くので、テストごとのIDで見分ける
+	want := Event{Type: EventScanRequested, ConnectionID: int(time.Now().UnixNano() % 1000000000), JobID: 1}
+	if err := events.PublishEvent(ctx, want); err != nil {
+		t.Fatalf("PublishEvent failed: %v", err)
+	}
+	for _, ch := range []<-chan Event{first, second} {
+		waitForEvent(t, ch, want)
+	}
+
+	// ctxをキャンセルするとチャネルは閉じる
+	cancel()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-first:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("expected channel to be closed after cancel")
+		}
+	}
+}
+
+// waitForEvent はchにwantが届くまで待つ。
+func waitForEvent(t *testing.T, ch <-chan Event, want Event) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case got := <-ch:
+			if got == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("event %+v was not delivered", want)
+		}
+	}
+}
@@ -0,0 +1,560 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/koplec/sokoni/internal/model"
+)
+
+// スキャン実行の状態
+const (
+	ScanRunRunning     = "running"
+	ScanRunCompleted   = "completed"
+	ScanRunPartial     = "partial"
+	ScanRunFailed      = "failed"
+	ScanRunInterrupted = "interrupted" // 停止・タイムアウト・DBエラーなどで中断（再開可能）
+	ScanRunCancelled   = "cancelled"   // 利用者が取り消した（再開せず、削除の検出も行わない）
+)
+
+// ErrLeaseNotHeld はスキャン実行の記録を書き込もうとしたownerが、connectionのスキャンのリースを期限内に持っていないときに返す。
+// リースを引き継いだインスタンスと重ねて記録しないよう、書き込みは行わない。
+var ErrLeaseNotHeld = errors.New("scan lease not held")
+
+type ScanRun struct {
+	ID           int        `json:"id"`
+	ConnectionID int        `json:"connection_id"`
+	Status       string     `json:"status"`
+	FullScan     bool       `json:"full_scan"`
+	ErrorMessage *string    `json:"error_message,omitempty"`
+	StartedAt    time.Time  `json:"started_at"`
+	ResumedAt    *time.Time `json:"resumed_at,omitempty"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+	ScanRunStats
+}
+
+// ScanRunStats はスキャン実行の集計値。
+type ScanRunStats struct {
+	FilesSeen      int `json:"files_seen"`
+	FilesWritten   int `json:"files_written"`
+	FilesDeleted   int `json:"files_deleted"`
+	ErrorCount     int `json:"error_count"`
+	DirsUnchanged  int `json:"dirs_unchanged"`
+	FilesUnchanged int `json:"files_unchanged"`
+}
+
+const scanRunColumns = `id, connection_id, status, full_scan, error_message, started_at, resumed_at, finished_at,
+	files_seen, files_written, files_deleted, error_count, dirs_unchanged, files_unchanged`
+
+func scanScanRun(row pgx.Row) (*ScanRun, error) {
+	var r ScanRun
+	err := row.Scan(
+		&r.ID, &r.ConnectionID, &r.Status, &r.FullScan, &r.ErrorMessage, &r.StartedAt, &r.ResumedAt, &r.FinishedAt,
+		&r.FilesSeen, &r.FilesWritten, &r.FilesDeleted, &r.ErrorCount, &r.DirsUnchanged, &r.FilesUnchanged,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// CreateScanRun は新しいスキャン実行を記録する。
+// fullScanがfalseの場合は差分スキャン（変わっていないディレクトリを飛ばす）として実行する。
+func CreateScanRun(ctx context.Context, conn Querier, connectionID int, fullScan bool) (*ScanRun, error) {
+	return scanScanRun(conn.QueryRow(ctx, `
+		INSERT INTO scan_runs (connection_id, full_scan) VALUES ($1, $2)
+		RETURNING `+scanRunColumns, connectionID, fullScan))
+}
+
+// GetScanRun はスキャン実行を返す。
+func GetScanRun(ctx context.Context, conn Querier, id int) (*ScanRun, error) {
+	return scanScanRun(conn.QueryRow(ctx, `
+		SELECT `+scanRunColumns+`
+		FROM scan_runs
+		WHERE id = $1
+	`, id))
+}
+
+// ListScanRuns はconnectionのスキャン実行を新しい順に最大limit件返す。
+func ListScanRuns(ctx context.Context, conn Querier, connectionID int, limit int) ([]*ScanRun, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT `+scanRunColumns+`
+		FROM scan_runs
+		WHERE connection_id = $1
+		ORDER BY id DESC
+		LIMIT $2
+	`, connectionID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []*ScanRun
+	for rows.Next() {
+		r, err := scanScanRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// GetLastFullScanAt は最後に最後まで走査できたフルスキャンの開始日時を返す。なければnil。
+func GetLastFullScanAt(ctx context.Context, conn Querier, connectionID int) (*time.Time, error) {
+	var startedAt *time.Time
+	err := conn.QueryRow(ctx, `
+		SELECT max(started_at) FROM scan_runs
+		WHERE connection_id = $1 AND full_scan AND status IN ($2, $3)
+	`, connectionID, ScanRunCompleted, ScanRunPartial).Scan(&startedAt)
+	return startedAt, err
+}
+
+// GetResumableScanRun はconnectionの最新のスキャン実行が途中で終わっている場合にそれを返す。
+// 再開できる実行がなければpgx.ErrNoRowsを返す。
+func GetResumableScanRun(ctx context.Context, conn Querier, connectionID int) (*ScanRun, error) {
+	run, err := scanScanRun(conn.QueryRow(ctx, `
+		SELECT `+scanRunColumns+`
+		FROM scan_runs
+		WHERE connection_id = $1
+		ORDER BY id DESC
+		LIMIT 1
+	`, connectionID))
+	if err != nil {
+		return nil, err
+	}
+	if run.Status != ScanRunRunning && run.Status != ScanRunInterrupted {
+		return nil, pgx.ErrNoRows
+	}
+	return run, nil
+}
+
+// ResumeScanRun は中断したスキャン実行を再びrunningにする。
+func ResumeScanRun(ctx context.Context, conn Querier, id int) error {
+	_, err := conn.Exec(ctx, `
+		UPDATE scan_runs
+		SET status = $2, error_message = NULL, resumed_at = now(), updated_at = now()
+		WHERE id = $1
+	`, id, ScanRunRunning)
+	return err
+}
+
+// GetScanCheckpoints はスキャン実行で完了済みのディレクトリを返す。
+func GetScanCheckpoints(ctx context.Context, conn Querier, scanRunID int) (map[string]bool, error) {
+	rows, err := conn.Query(ctx, "SELECT path FROM scan_checkpoints WHERE scan_run_id = $1", scanRunID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	done := make(map[string]bool)
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		done[path] = true
+	}
+	return done, rows.Err()
+}
+
+// FinishScanRun はスキャン実行の結果を記録する。
+// statsは今回の実行分で、再開前の分に加算される。
+// ownerがconnectionのスキャンのリースを持っていなければ記録せずにErrLeaseNotHeldを返す。
+func FinishScanRun(ctx context.Context, conn Querier, id int, owner string, status string, stats ScanRunStats, errorMessage *string) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var connectionID int
+	err = tx.QueryRow(ctx, "SELECT connection_id FROM scan_runs WHERE id = $1", id).Scan(&connectionID)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := holdScanLease(ctx, tx, connectionID, owner); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE scan_runs
+		SET status = $2,
+		    files_seen = files_seen + $3,
+		    files_written = files_written + $4,
+		    files_deleted = files_deleted + $5,
+		    error_count = error_count + $6,
+		    dirs_unchanged = dirs_unchanged + $7,
+		    files_unchanged = files_unchanged + $8,
+		    error_message = $9,
+		    finished_at = now(),
+		    updated_at = now()
+		WHERE id = $1
+	`, id, status, stats.FilesSeen, stats.FilesWritten, stats.FilesDeleted, stats.ErrorCount,
+		stats.DirsUnchanged, stats.FilesUnchanged, errorMessage)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// PruneScanRuns はconnectionの古いスキャン実行の記録を消し、消した件数を返す。
+// 再開できなくなったスキャン実行（最新のもの以外と、終わったもの）のチェックポイントは使わないので、すぐに消す。
+// スキャン実行はfinished_atからolderThanが過ぎたものを、読み取れなかったエントリの記録ごと消す。
+// ただし最新のものと、フルスキャンの間隔を決める最後に成功したフルスキャン（GetLastFullScanAt）は残す。
+func PruneScanRuns(ctx context.Context, conn Querier, connectionID int, olderThan time.Duration) (int64, error) {
+	_, err := conn.Exec(ctx, `
+		DELETE FROM scan_checkpoints c
+		USING scan_runs r
+		WHERE c.scan_run_id = r.id AND r.connection_id = $1
+		AND (r.status NOT IN ($2, $3) OR r.id < (SELECT max(id) FROM scan_runs WHERE connection_id = $1))
+	`, connectionID, ScanRunRunning, ScanRunInterrupted)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := conn.Exec(ctx, `
+		DELETE FROM scan_runs
+		WHERE connection_id = $1
+		AND finished_at <= now() - make_interval(secs => $2)
+		AND id < (SELECT max(id) FROM scan_runs WHERE connection_id = $1)
+		AND id IS DISTINCT FROM (
+			SELECT id FROM scan_runs
+			WHERE connection_id = $1 AND full_scan AND status IN ($3, $4)
+			ORDER BY started_at DESC, id DESC
+			LIMIT 1
+		)
+	`, connectionID, olderThan.Seconds(), ScanRunCompleted, ScanRunPartial)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+// ReconcileScanRun はスキャン実行の最後に、今回存在を確認できなかったディレクトリ配下の
+// ファイルを削除する（ディレクトリごと消えたもの）。同じディレクトリの差分スキャン用の状態も消す。
+// 直下のファイル単位の削除は各ディレクトリのチェックポイント時に行っている。
+// 読み取れずにスキップしたパスの配下は、存在するかどうか分からないので残す。
+// ownerがconnectionのスキャンのリースを持っていなければ削除せずにErrLeaseNotHeldを返す。
+func ReconcileScanRun(ctx context.Context, conn Querier, connectionID, scanRunID int, owner string) (int64, error) {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := holdScanLease(ctx, tx, connectionID, owner); err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(ctx, `
+		DELETE FROM dir_states d
+		WHERE d.connection_id = $1
+		AND NOT EXISTS (
+			SELECT 1 FROM scan_checkpoints c
+			WHERE c.scan_run_id = $2 AND c.path = d.path
+		)
+		AND NOT EXISTS (
+			SELECT 1 FROM scan_errors e
+			WHERE e.scan_run_id = $2
+			AND (d.path = e.path OR starts_with(d.path, e.path || '/'))
+		)
+	`, connectionID, scanRunID)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec(ctx, `
+		DELETE FROM files f
+		WHERE f.connection_id = $1
+		AND NOT EXISTS (
+			SELECT 1 FROM scan_checkpoints c
+			WHERE c.scan_run_id = $2 AND c.path = f.dir_path
+		)
+		AND NOT EXISTS (
+			SELECT 1 FROM scan_errors e
+			WHERE e.scan_run_id = $2
+			AND (f.path = e.path OR starts_with(f.path, e.path || '/'))
+		)
+	`, connectionID, scanRunID)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return result.RowsAffected(), nil
+}
+
+// DirState は差分スキャン用に記録したディレクトリの状態。
+type DirState struct {
+	Path       string
+	ModTime    time.Time
+	EntryCount int
+	FileCount  int
+	Subdirs    []string
+	ListedAt   time.Time
+}
+
+// GetDirStates はconnectionについて前回記録したディレクトリの状態をパスごとに返す。
+func GetDirStates(ctx context.Context, conn Querier, connectionID int) (map[string]DirState, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT path, mod_time, entry_count, file_count, subdirs, listed_at
+		FROM dir_states
+		WHERE connection_id = $1
+	`, connectionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := make(map[string]DirState)
+	for rows.Next() {
+		var d DirState
+		if err := rows.Scan(&d.Path, &d.ModTime, &d.EntryCount, &d.FileCount, &d.Subdirs, &d.ListedAt); err != nil {
+			return nil, err
+		}
+		states[d.Path] = d
+	}
+	return states, rows.Err()
+}
+
+// ScanBatch はスキャン中に1つのトランザクションで反映するファイルと、配下を走査し終えたディレクトリ。
+// Dirsは対応するファイルがすべてFilesかそれ以前のバッチに含まれているものだけを入れること。
+type ScanBatch struct {
+	Files []model.FileInfo
+	Dirs  []ScannedDir
+}
+
+// ScannedDir は配下を走査し終えたディレクトリ1件分の記録。
+type ScannedDir struct {
+	Path   string
+	Listed bool     // 一覧を取り直したか（falseの場合はFilesとStateを使わない）
+	Files  []string // 直下に存在したPDFファイルのパス
+	State  DirState // 次回の差分スキャン用の状態（Pathは使わない）
+	Errors []ScanErrorRecord
+}
+
+// ScanErrorRecord は読み取れずにスキップしたエントリ。
+type ScanErrorRecord struct {
+	Path   string
+	Reason string
+}
+
+// CommitScanBatch はファイルのUPSERTと、配下を走査し終えたディレクトリの記録を1つのトランザクションで行う。
+// ディレクトリごとに以下を行う：
+// - 直下にあったはずのファイルのうち今回見つからなかったものを削除（一覧を取ったディレクトリのみ）
+// - 次回の差分スキャン用にディレクトリの状態を記録（一覧を取ったディレクトリのみ）
+// - スキップしたエントリをscan_errorsに記録
+// - チェックポイントを記録（再開時はこのディレクトリ配下を飛ばす）
+//
+// ownerがconnectionのスキャンのリースを持っていなければ何も書き込まずにErrLeaseNotHeldを返す。
+//
+// 戻り値は書き込んだファイル数と削除したファイル数。
+func CommitScanBatch(ctx context.Context, conn Querier, connectionID, scanRunID int, owner string, batch ScanBatch) (int64, int64, error) {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := holdScanLease(ctx, tx, connectionID, owner); err != nil {
+		return 0, 0, err
+	}
+
+	written, err := upsertFileBatch(ctx, tx, connectionID, batch.Files)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var deleted int64
+	for _, dir := range batch.Dirs {
+		if dir.Listed {
+			n, err := recordListedDir(ctx, tx, connectionID, dir)
+			if err != nil {
+				return 0, 0, err
+			}
+			deleted += n
+		}
+
+		for _, e := range dir.Errors {
+			_, err := tx.Exec(ctx, `
+				INSERT INTO scan_errors (scan_run_id, path, reason) VALUES ($1, $2, $3)
+			`, scanRunID, e.Path, e.Reason)
+			if err != nil {
+				return 0, 0, fmt.Errorf("failed to record scan error for %s: %w", e.Path, err)
+			}
+		}
+
+		_, err = tx.Exec(ctx, `
+			INSERT INTO scan_checkpoints (scan_run_id, path) VALUES ($1, $2)
+			ON CONFLICT DO NOTHING
+		`, scanRunID, dir.Path)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to record checkpoint for %s: %w", dir.Path, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return written, deleted, nil
+}
+
+// holdScanLease はownerがconnectionのスキャンのリースを期限内に持っていることを確かめ、txが終わるまでその行をFOR SHAREでロックする。
+// ロックしている間はほかのインスタンスがリースを引き継げない（AcquireScanLeaseが待つ）ので、
+// リースを失ったインスタンスの書き込みが引き継いだ側の書き込みと重ならない。
+func holdScanLease(ctx context.Context, tx pgx.Tx, connectionID int, owner string) error {
+	var held int
+	err := tx.QueryRow(ctx, `
+		SELECT 1 FROM scan_leases
+		WHERE connection_id = $1 AND owner = $2 AND expires_at > now()
+		FOR SHARE
+	`, connectionID, owner).Scan(&held)
+	if err == pgx.ErrNoRows {
+		return ErrLeaseNotHeld
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check scan lease: %w", err)
+	}
+	return nil
+}
+
+// recordListedDir は一覧を取り直したディレクトリについて、見つからなかった直下のファイルを削除し、
+// 差分スキャン用の状態を記録する。戻り値は削除したファイル数。
+func recordListedDir(ctx context.Context, tx pgx.Tx, connectionID int, dir ScannedDir) (int64, error) {
+	present := dir.Files
+	if present == nil {
+		present = []string{}
+	}
+	result, err := tx.Exec(ctx, `
+		DELETE FROM files
+		WHERE connection_id = $1 AND dir_path = $2 AND NOT (path = ANY($3))
+	`, connectionID, dir.Path, present)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete removed files in %s: %w", dir.Path, err)
+	}
+
+	subdirs := dir.State.Subdirs
+	if subdirs == nil {
+		subdirs = []string{}
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO dir_states (connection_id, path, mod_time, entry_count, file_count, subdirs, listed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (connection_id, path) DO UPDATE
+		SET mod_time = EXCLUDED.mod_time,
+			entry_count = EXCLUDED.entry_count,
+			file_count = EXCLUDED.file_count,
+			subdirs = EXCLUDED.subdirs,
+			listed_at = EXCLUDED.listed_at,
+			updated_at = now()
+	`, connectionID, dir.Path, dir.State.ModTime, dir.State.EntryCount, dir.State.FileCount, subdirs, dir.State.ListedAt)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record directory state for %s: %w", dir.Path, err)
+	}
+	return result.RowsAffected(), nil
+}
+
+// AcquireScanLease はconnectionをスキャンするリースをttlの間取得する。
+// ほかのownerが期限内のリースを持っている場合はfalseを返す。期限切れのリース（クラッシュしたインスタンスのもの）は引き継ぐ。
+// 期限はインスタンス間の時計のずれに左右されないよう、DBの時刻で判定する。
+func AcquireScanLease(ctx context.Context, conn Querier, connectionID int, owner string, ttl time.Duration) (bool, error) {
+	var id int
+	err := conn.QueryRow(ctx, `
+		INSERT INTO scan_leases (connection_id, owner, acquired_at, heartbeat_at, expires_at)
+		VALUES ($1, $2, now(), now(), now() + make_interval(secs => $3))
+		ON CONFLICT (connection_id) DO UPDATE
+		SET owner = EXCLUDED.owner,
+			acquired_at = EXCLUDED.acquired_at,
+			heartbeat_at = EXCLUDED.heartbeat_at,
+			expires_at = EXCLUDED.expires_at
+		WHERE scan_leases.expires_at <= now()
+		RETURNING connection_id
+	`, connectionID, owner, ttl.Seconds()).Scan(&id)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RenewScanLease はownerが持つリースの期限をいまからttl後に延ばす（ハートビート）。
+// リースが期限切れでほかのownerに取られていた場合はfalseを返す。
+func RenewScanLease(ctx context.Context, conn Querier, connectionID int, owner string, ttl time.Duration) (bool, error) {
+	result, err := conn.Exec(ctx, `
+		UPDATE scan_leases
+		SET heartbeat_at = now(), expires_at = now() + make_interval(secs => $3)
+		WHERE connection_id = $1 AND owner = $2
+	`, connectionID, owner, ttl.Seconds())
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() > 0, nil
+}
+
+// ReleaseScanLease はownerが持つリースを手放す。ほかのownerのリースは消さない。
+func ReleaseScanLease(ctx context.Context, conn Querier, connectionID int, owner string) error {
+	_, err := conn.Exec(ctx, `
+		DELETE FROM scan_leases
+		WHERE connection_id = $1 AND owner = $2
+	`, connectionID, owner)
+	return err
+}
+
+// AcquireWatchLease はconnectionを監視するリースをttlの間取得する。
+// 監視は複数のインスタンスで重ならないよう、スキャンのリースとは別に1つのインスタンスだけが持つ。
+// 振る舞いはAcquireScanLeaseと同じ。
+func AcquireWatchLease(ctx context.Context, conn Querier, connectionID int, owner string, ttl time.Duration) (bool, error) {
+	var id int
+	err := conn.QueryRow(ctx, `
+		INSERT INTO watch_leases (connection_id, owner, acquired_at, heartbeat_at, expires_at)
+		VALUES ($1, $2, now(), now(), now() + make_interval(secs => $3))
+		ON CONFLICT (connection_id) DO UPDATE
+		SET owner = EXCLUDED.owner,
+			acquired_at = EXCLUDED.acquired_at,
+			heartbeat_at = EXCLUDED.heartbeat_at,
+			expires_at = EXCLUDED.expires_at
+		WHERE watch_leases.expires_at <= now()
+		RETURNING connection_id
+	`, connectionID, owner, ttl.Seconds()).Scan(&id)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RenewWatchLease はownerが持つ監視のリースの期限をいまからttl後に延ばす（ハートビート）。
+// リースが期限切れでほかのownerに取られていた場合はfalseを返す。
+func RenewWatchLease(ctx context.Context, conn Querier, connectionID int, owner string, ttl time.Duration) (bool, error) {
+	result, err := conn.Exec(ctx, `
+		UPDATE watch_leases
+		SET heartbeat_at = now(), expires_at = now() + make_interval(secs => $3)
+		WHERE connection_id = $1 AND owner = $2
+	`, connectionID, owner, ttl.Seconds())
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() > 0, nil
+}
+
+// ReleaseWatchLease はownerが持つ監視のリースを手放す。ほかのownerのリースは消さない。
+func ReleaseWatchLease(ctx context.Context, conn Querier, connectionID int, owner string) error {
+	_, err := conn.Exec(ctx, `
+		DELETE FROM watch_leases
+		WHERE connection_id = $1 AND owner = $2
+	`, connectionID, owner)
+	return err
+}
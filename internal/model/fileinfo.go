@@ -7,4 +7,5 @@ type FileInfo struct {
 	Name    string
 	Size    int64     //os.FileInfo.SIze()でint64が返る
 	ModTime time.Time // 最終更新日時
+	ETag    string    // WebDAV等で取得できる場合のETag（変更検出用）。取得できない場合は空
 }
@@ -0,0 +1,91 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// EventScanSuspended は失敗が続いたため定期スキャンを停止したときのイベント。
+const EventScanSuspended = "scan_suspended"
+
+// Event は管理者に知らせる出来事。Webhookにはこのままの形のJSONを送る。
+type Event struct {
+	Type                string    `json:"type"`
+	ConnectionID        int       `json:"connection_id"`
+	ConnectionName      string    `json:"connection_name"`
+	RemotePath          string    `json:"remote_path"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Error               string    `json:"error"`
+	Time                time.Time `json:"time"`
+}
+
+// Subject はメールの件名などに使う1行の要約を返す。
+func (e Event) Subject() string {
+	switch e.Type {
+	case EventScanSuspended:
+		return fmt.Sprintf("[sokoni] Scheduled scans suspended for %s", e.ConnectionName)
+	default:
+		return fmt.Sprintf("[sokoni] %s: %s", e.Type, e.ConnectionName)
+	}
+}
+
+// Body はメールの本文などに使う説明を返す。
+func (e Event) Body() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Connection: %s (ID: %d)\n", e.ConnectionName, e.ConnectionID)
+	fmt.Fprintf(&b, "Remote path: %s\n", e.RemotePath)
+	fmt.Fprintf(&b, "Consecutive failures: %d\n", e.ConsecutiveFailures)
+	fmt.Fprintf(&b, "Last error: %s\n", e.Error)
+	fmt.Fprintf(&b, "Time: %s\n", e.Time.Format(time.RFC3339))
+	if e.Type == EventScanSuspended {
+		b.WriteString("\nScheduled scans stay suspended until the connection is updated or a manual scan succeeds.\n")
+	}
+	return b.String()
+}
+
+// Notifier はイベントを管理者に届ける。
+type Notifier interface {
+	Notify(ctx context.Context, event Event) error
+}
+
+// Multi は複数のNotifierにすべて届ける。失敗したものがあってもほかには届け、エラーをまとめて返す。
+type Multi []Notifier
+
+func (m Multi) Notify(ctx context.Context, event Event) error {
+	var errs []error
+	for _, n := range m {
+		if err := n.Notify(ctx, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// FromEnv は環境変数で設定されたNotifierを返す。何も設定されていなければ空のMulti（何もしない）を返す。
+// - SMTP: SOKONI_NOTIFY_SMTP_ADDR・SOKONI_NOTIFY_SMTP_FROM・SOKONI_NOTIFY_SMTP_TO（カンマ区切り）・SOKONI_NOTIFY_SMTP_TLS
+// - Webhook: SOKONI_NOTIFY_WEBHOOK_URL
+func FromEnv() (Notifier, error) {
+	var notifiers Multi
+	if addr := os.Getenv("SOKONI_NOTIFY_SMTP_ADDR"); addr != "" {
+		n, err := NewSMTPNotifier(addr, os.Getenv("SOKONI_NOTIFY_SMTP_FROM"), os.Getenv("SOKONI_NOTIFY_SMTP_TO"))
+		if err != nil {
+			return nil, err
+		}
+		if n.TLS, err = ParseSMTPTLSPolicy(os.Getenv("SOKONI_NOTIFY_SMTP_TLS")); err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, n)
+	}
+	if url := os.Getenv("SOKONI_NOTIFY_WEBHOOK_URL"); url != "" {
+		n, err := NewWebhookNotifier(url)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, n)
+	}
+	return notifiers, nil
+}
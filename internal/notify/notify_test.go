@@ -0,0 +1,289 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEvent() Event {
+	return Event{
+		Type:                EventScanSuspended,
+		ConnectionID:        7,
+		ConnectionName:      "経理NAS",
+		RemotePath:          "//nas01/share",
+		ConsecutiveFailures: 5,
+		Error:               "logon failure",
+		Time:                time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var got map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected content type: %s", r.Header.Get("Content-Type"))
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer server.Close()
+
+	n, err := NewWebhookNotifier(server.URL + "/hook")
+	if err != nil {
+		t.Fatalf("NewWebhookNotifier failed: %v", err)
+	}
+	if err := n.Notify(context.Background(), testEvent()); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	if got["type"] != EventScanSuspended || got["connection_id"] != float64(7) || !strings.Contains(got["text"].(string), "logon failure") {
+		t.Errorf("unexpected payload: %v", got)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	n, _ = NewWebhookNotifier(failing.URL)
+	if err := n.Notify(context.Background(), testEvent()); err == nil {
+		t.Errorf("expected error for failing webhook")
+	}
+
+	if _, err := NewWebhookNotifier("ftp://example.com/hook"); err == nil {
+		t.Errorf("expected error for non-HTTP webhook URL")
+	}
+}
+
+// serveSMTP は1通だけ受け取る最小限のSMTPサーバーを動かし、受け取ったDATAを返すチャネルを返す。
+// configを渡すとSTARTTLSに対応する。
+func serveSMTP(t *testing.T, config *tls.Config) (string, <-chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { conn.Close() }()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+
+		reply("220 localhost ESMTP")
+		var data strings.Builder
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if inData {
+				if line == ".\r\n" {
+					inData = false
+					received <- data.String()
+					reply("250 OK")
+					continue
+				}
+				data.WriteString(line)
+				continue
+			}
+			switch cmd := strings.ToUpper(strings.Fields(line)[0]); cmd {
+			case "EHLO":
+				if config != nil {
+					reply("250-localhost")
+					reply("250 STARTTLS")
+				} else {
+					reply("250 localhost")
+				}
+			case "STARTTLS":
+				reply("220 Ready to start TLS")
+				tlsConn := tls.Server(conn, config)
+				if err := tlsConn.Handshake(); err != nil {
+					return
+				}
+				conn = tlsConn
+				r = bufio.NewReader(conn)
+			case "DATA":
+				inData = true
+				reply("354 End data with <CR><LF>.<CR><LF>")
+			case "QUIT":
+				reply("221 Bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+	return l.Addr().String(), received
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	addr, received := serveSMTP(t, nil)
+
+	n, err := NewSMTPNotifier(addr, "sokoni@example.com", "admin@example.com, ops@example.com")
+	if err != nil {
+		t.Fatalf("NewSMTPNotifier failed: %v", err)
+	}
+	if err := n.Notify(context.Background(), testEvent()); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+
+	select {
+	case msg := <-received:
+		if !strings.Contains(msg, "To: admin@example.com, ops@example.com") ||
+			!strings.Contains(msg, "Subject: =?utf-8?q?") ||
+			!strings.Contains(msg, "Last error: logon failure") {
+			t.Errorf("unexpected message:\n%s", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not received")
+	}
+}
+
+func TestSMTPNotifierTLS(t *testing.T) {
+	// httptestの自己署名証明書を使うSMTPサーバー
+	https := httptest.NewTLSServer(http.NotFoundHandler())
+	config := &tls.Config{Certificates: https.TLS.Certificates}
+	https.Close()
+
+	tests := []struct {
+		name     string
+		starttls bool
+		policy   SMTPTLSPolicy
+		wantErr  bool
+	}{
+		{name: "verifies certificate", starttls: true, policy: SMTPTLSOpportunistic, wantErr: true},
+		{name: "insecure", starttls: true, policy: SMTPTLSInsecure},
+		{name: "none", starttls: true, policy: SMTPTLSNone},
+		{name: "opportunistic without STARTTLS", policy: SMTPTLSOpportunistic},
+		{name: "required without STARTTLS", policy: SMTPTLSRequired, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var serverConfig *tls.Config
+			if tt.starttls {
+				serverConfig = config
+			}
+			addr, received := serveSMTP(t, serverConfig)
+			n, err := NewSMTPNotifier(addr, "sokoni@example.com", "admin@example.com")
+			if err != nil {
+				t.Fatalf("NewSMTPNotifier failed: %v", err)
+			}
+			n.TLS = tt.policy
+
+			err = n.Notify(context.Background(), testEvent())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Notify error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				select {
+				case <-received:
+				case <-time.After(5 * time.Second):
+					t.Fatal("message was not received")
+				}
+			}
+		})
+	}
+}
+
+func TestSMTPNotifierTimeout(t *testing.T) {
+	// 接続を受け付けても応答しないサーバー
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+	closed := make(chan struct{})
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer close(closed)
+		io.Copy(io.Discard, conn) // クライアントが接続を閉じるまで読み捨てる
+	}()
+
+	n, err := NewSMTPNotifier(l.Addr().String(), "sokoni@example.com", "admin@example.com")
+	if err != nil {
+		t.Fatalf("NewSMTPNotifier failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := n.Notify(ctx, testEvent()); err == nil {
+		t.Fatal("expected error from an unresponsive server")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected Notify to give up at the deadline, took %s", elapsed)
+	}
+	// 送信を諦めたら接続も閉じる
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the connection to be closed")
+	}
+}
+
+func TestParseSMTPTLSPolicy(t *testing.T) {
+	if p, err := ParseSMTPTLSPolicy(""); err != nil || p != SMTPTLSOpportunistic {
+		t.Errorf("expected starttls by default, got %q %v", p, err)
+	}
+	if p, err := ParseSMTPTLSPolicy("Required"); err != nil || p != SMTPTLSRequired {
+		t.Errorf("expected required, got %q %v", p, err)
+	}
+	if _, err := ParseSMTPTLSPolicy("tls"); err == nil {
+		t.Errorf("expected error for unknown policy")
+	}
+}
+
+func TestNewSMTPNotifierInvalid(t *testing.T) {
+	for _, tt := range []struct{ addr, from, to string }{
+		{"localhost", "sokoni@example.com", "admin@example.com"},
+		{"localhost:25", "not an address", "admin@example.com"},
+		{"localhost:25", "sokoni@example.com", ""},
+		{"localhost:25", "sokoni@example.com", "admin@example.com,,invalid"},
+	} {
+		if _, err := NewSMTPNotifier(tt.addr, tt.from, tt.to); err == nil {
+			t.Errorf("NewSMTPNotifier(%q, %q, %q): expected error", tt.addr, tt.from, tt.to)
+		}
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	n, err := FromEnv()
+	if err != nil || len(n.(Multi)) != 0 {
+		t.Errorf("expected no notifiers without configuration, got %v %v", n, err)
+	}
+
+	t.Setenv("SOKONI_NOTIFY_SMTP_ADDR", "localhost:25")
+	t.Setenv("SOKONI_NOTIFY_SMTP_FROM", "sokoni@example.com")
+	t.Setenv("SOKONI_NOTIFY_SMTP_TO", "admin@example.com")
+	t.Setenv("SOKONI_NOTIFY_WEBHOOK_URL", "https://hooks.example.com/sokoni")
+	n, err = FromEnv()
+	if err != nil || len(n.(Multi)) != 2 {
+		t.Errorf("expected SMTP and webhook notifiers, got %v %v", n, err)
+	}
+
+	t.Setenv("SOKONI_NOTIFY_SMTP_TLS", "plain")
+	if _, err := FromEnv(); err == nil {
+		t.Errorf("expected error for invalid SMTP TLS policy")
+	}
+	t.Setenv("SOKONI_NOTIFY_SMTP_TLS", "")
+
+	t.Setenv("SOKONI_NOTIFY_SMTP_TO", "")
+	if _, err := FromEnv(); err == nil {
+		t.Errorf("expected error for SMTP notifier without recipients")
+	}
+}
@@ -0,0 +1,150 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// smtpTimeout はctxに期限がないときに、1通を送り終えるまで待つ時間。
+const smtpTimeout = 30 * time.Second
+
+// SMTPTLSPolicy はSMTPサーバーとの通信を暗号化するかどうか。
+type SMTPTLSPolicy string
+
+const (
+	SMTPTLSOpportunistic SMTPTLSPolicy = "starttls" // サーバーが対応していればSTARTTLSを使う（証明書を検証する）
+	SMTPTLSRequired      SMTPTLSPolicy = "required" // STARTTLSに対応していないサーバーには送らない
+	SMTPTLSInsecure      SMTPTLSPolicy = "insecure" // 対応していればSTARTTLSを使うが、証明書を検証しない（自己署名証明書のリレー向け）
+	SMTPTLSNone          SMTPTLSPolicy = "none"     // STARTTLSを使わない
+)
+
+// ParseSMTPTLSPolicy はSOKONI_NOTIFY_SMTP_TLSの値を解析する。空の場合はSMTPTLSOpportunistic。
+func ParseSMTPTLSPolicy(s string) (SMTPTLSPolicy, error) {
+	switch p := SMTPTLSPolicy(strings.ToLower(strings.TrimSpace(s))); p {
+	case "":
+		return SMTPTLSOpportunistic, nil
+	case SMTPTLSOpportunistic, SMTPTLSRequired, SMTPTLSInsecure, SMTPTLSNone:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid SMTP TLS policy %q: expected starttls, required, insecure or none", s)
+	}
+}
+
+// SMTPNotifier はSMTPでメールを送る。社内のリレー（Postfix等）に認証なしで送ることを想定している。
+// STARTTLSを使うかどうかはTLSで決める（既定ではサーバーが対応していれば使う）。
+type SMTPNotifier struct {
+	Addr string // host:port
+	From string
+	To   []string
+	TLS  SMTPTLSPolicy
+}
+
+// NewSMTPNotifier はSMTPNotifierを作る。toはカンマ区切りの宛先。
+func NewSMTPNotifier(addr, from, to string) (*SMTPNotifier, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid SMTP address %q: %w", addr, err)
+	}
+	if _, err := mail.ParseAddress(from); err != nil {
+		return nil, fmt.Errorf("invalid SMTP sender %q: %w", from, err)
+	}
+	n := &SMTPNotifier{Addr: addr, From: from, TLS: SMTPTLSOpportunistic}
+	for _, rcpt := range strings.Split(to, ",") {
+		if rcpt = strings.TrimSpace(rcpt); rcpt == "" {
+			continue
+		}
+		if _, err := mail.ParseAddress(rcpt); err != nil {
+			return nil, fmt.Errorf("invalid SMTP recipient %q: %w", rcpt, err)
+		}
+		n.To = append(n.To, rcpt)
+	}
+	if len(n.To) == 0 {
+		return nil, fmt.Errorf("SMTP notifier requires at least one recipient")
+	}
+	return n, nil
+}
+
+func (n *SMTPNotifier) Notify(ctx context.Context, event Event) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.To, ", "))
+	// connection名に日本語が含まれる場合に備えてエンコードする
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", event.Subject()))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(event.Body(), "\n", "\r\n"))
+
+	if err := n.send(ctx, msg.Bytes()); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("failed to send mail via %s: %w", n.Addr, err)
+	}
+	return nil
+}
+
+// send はメールを1通送る。応答しないサーバーで待ち続けないよう、接続にctxの期限（なければsmtpTimeout）を設定し、
+// ctxがキャンセルされたら接続を閉じる。
+func (n *SMTPNotifier) send(ctx context.Context, msg []byte) error {
+	host, _, _ := net.SplitHostPort(n.Addr)
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(smtpTimeout)
+	}
+
+	dialer := &net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", n.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if n.TLS != SMTPTLSNone {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			config := &tls.Config{ServerName: host, InsecureSkipVerify: n.TLS == SMTPTLSInsecure}
+			if err := c.StartTLS(config); err != nil {
+				return err
+			}
+		} else if n.TLS == SMTPTLSRequired {
+			return fmt.Errorf("server does not support STARTTLS")
+		}
+	}
+
+	if err := c.Mail(n.From); err != nil {
+		return err
+	}
+	for _, rcpt := range n.To {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,55 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// WebhookNotifier はイベントをJSONでPOSTする（Slack互換のtextも含める）。
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewWebhookNotifier はWebhookNotifierを作る。
+func NewWebhookNotifier(rawURL string) (*WebhookNotifier, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL: %s", rawURL)
+	}
+	return &WebhookNotifier{URL: rawURL, Client: http.DefaultClient}, nil
+}
+
+// webhookPayload はイベントの各項目に、チャットツールでそのまま表示できるtextを加えたもの。
+type webhookPayload struct {
+	Event
+	Text string `json:"text"`
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, event Event) error {
+	body, err := json.Marshal(webhookPayload{Event: event, Text: event.Subject() + "\n" + event.Body()})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package schedule
+
+import (
+	"os"
+	"time"
+)
+
+// 失敗が続いたconnectionを再試行するまでの待ち時間の既定値。
+const (
+	defaultBackoffBase = 10 * time.Minute
+	defaultBackoffMax  = 24 * time.Hour
+)
+
+// Backoff は失敗が続いたconnectionを再試行するまでの待ち時間（指数バックオフ）。
+// 1回目の失敗の後はBase、以降は失敗のたびに倍にし、Maxで頭打ちにする。
+type Backoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+// BackoffFromEnv はSOKONI_SCAN_BACKOFF_BASE（既定10m）・SOKONI_SCAN_BACKOFF_MAX（既定24h）から待ち時間を決める。
+// 解析できない値は既定値にする。
+func BackoffFromEnv() Backoff {
+	return Backoff{
+		Base: envDuration("SOKONI_SCAN_BACKOFF_BASE", defaultBackoffBase),
+		Max:  envDuration("SOKONI_SCAN_BACKOFF_MAX", defaultBackoffMax),
+	}
+}
+
+// Delay はfailures回続けて失敗した後の待ち時間を返す。
+func (b Backoff) Delay(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	delay := b.Base
+	for i := 1; i < failures && delay < b.Max; i++ {
+		delay *= 2
+	}
+	return min(delay, b.Max)
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	if v := os.Getenv(name); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+	}
+	return def
+}
@@ -0,0 +1,111 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/koplec/sokoni/internal/tztime"
+	"github.com/robfig/cron/v3"
+)
+
+// Schedule はconnectionの定期スキャンの予定。
+// cron式（"0 2 * * *"、"@daily"、"@every 6h" など）か、前回のスキャンからの間隔で次のスキャンを決め、
+// 停止時間帯（blackout）に入る場合は停止時間帯の終わりまで遅らせる。
+// 時刻はすべてアプリケーションのタイムゾーン（tztime.Zone）で評価する。
+type Schedule struct {
+	cron      cron.Schedule // nilの場合はintervalを使う
+	interval  time.Duration
+	blackouts []Window
+}
+
+// Parse はcron式・間隔・停止時間帯からスケジュールを作る。
+// - expr: 標準の5フィールドのcron式または@daily等の記述子。空の場合はintervalを使う
+// - interval: 前回のスキャンからの間隔（connections.scan_interval）
+// - blackouts: 停止時間帯をカンマ区切りで指定する（ParseWindows参照）。空の場合はなし
+func Parse(expr string, interval time.Duration, blackouts string) (*Schedule, error) {
+	s := &Schedule{interval: interval}
+	if expr = strings.TrimSpace(expr); expr != "" {
+		c, err := cron.ParseStandard(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", expr, err)
+		}
+		s.cron = c
+	}
+
+	windows, err := ParseWindows(blackouts)
+	if err != nil {
+		return nil, err
+	}
+	s.blackouts = windows
+	// 停止時間帯が1週間すべてを覆っていると、いつまでもスキャンできない
+	if _, ok := skipWindows(windows, time.Date(2000, 1, 3, 0, 0, 0, 0, tztime.Zone())); !ok {
+		return nil, fmt.Errorf("blackout windows %q cover the whole week", blackouts)
+	}
+	return s, nil
+}
+
+// Next は次にスキャンする時刻を返す。
+// lastが前回のスキャン日時で、一度もスキャンしていない（nil）場合や予定を過ぎている場合はnowになる。
+func (s *Schedule) Next(last *time.Time, now time.Time) time.Time {
+	now = now.In(tztime.Zone())
+	next := now
+	if last != nil {
+		if s.cron != nil {
+			next = s.cron.Next(last.In(tztime.Zone()))
+		} else {
+			next = last.In(tztime.Zone()).Add(s.interval)
+		}
+		if next.Before(now) {
+			next = now
+		}
+	}
+	next, _ = skipWindows(s.blackouts, next)
+	return next
+}
+
+// Due はnowの時点でスキャンすべきかを返す。停止時間帯の間はfalseになる。
+func (s *Schedule) Due(last *time.Time, now time.Time) bool {
+	return !s.Next(last, now).After(now)
+}
+
+// InBlackout はtが停止時間帯に入っているかを返す。
+func (s *Schedule) InBlackout(t time.Time) bool {
+	for _, w := range s.blackouts {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextBlackout はt以降で最初に停止時間帯が始まる時刻を返す。停止時間帯がなければfalseを返す。
+// 定期スキャンは停止時間帯に入ったら中断するので、その期限に使う。
+func (s *Schedule) NextBlackout(t time.Time) (time.Time, bool) {
+	var next time.Time
+	for _, w := range s.blackouts {
+		if start := w.nextStart(t); next.IsZero() || start.Before(next) {
+			next = start
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// skipWindows はtがいずれかの停止時間帯に入っている間、その終わりまで進める。
+// 停止時間帯が重なったり連続したりしていても1週間分進めれば抜けられるはずなので、抜けられなければfalseを返す。
+func skipWindows(windows []Window, t time.Time) (time.Time, bool) {
+	limit := t.Add(8 * 24 * time.Hour)
+	for t.Before(limit) {
+		moved := false
+		for _, w := range windows {
+			if w.Contains(t) {
+				t = w.endOf(t)
+				moved = true
+			}
+		}
+		if !moved {
+			return t, true
+		}
+	}
+	return t, false
+}
@@ -0,0 +1,151 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/koplec/sokoni/internal/tztime"
+)
+
+// jst は2026-10-19（月）を基準にアプリケーションのタイムゾーンで時刻を作る。
+func jst(day, hour, minute int) time.Time {
+	return time.Date(2026, 10, 19+day, hour, minute, 0, 0, tztime.Zone())
+}
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		spec    string
+		at      time.Time
+		want    bool
+		wantErr bool
+	}{
+		{spec: "01:00-04:00", at: jst(0, 1, 0), want: true},
+		{spec: "01:00-04:00", at: jst(0, 3, 59), want: true},
+		{spec: "01:00-04:00", at: jst(0, 4, 0), want: false},
+		{spec: "01:00-04:00", at: jst(0, 0, 59), want: false},
+		// 日をまたぐ時間帯は開始日の曜日で判定する
+		{spec: "sat 22:00-02:00", at: jst(5, 23, 0), want: true},
+		{spec: "sat 22:00-02:00", at: jst(6, 1, 0), want: true},
+		{spec: "sat 22:00-02:00", at: jst(6, 23, 0), want: false},
+		{spec: "mon-fri 09:00-18:00", at: jst(4, 12, 0), want: true},
+		{spec: "mon-fri 09:00-18:00", at: jst(5, 12, 0), want: false},
+		{spec: "fri-mon 00:00-24:00", at: jst(0, 12, 0), want: true},
+		{spec: "fri-mon 00:00-24:00", at: jst(1, 12, 0), want: false},
+		// UTCで渡してもアプリケーションのタイムゾーンで評価する
+		{spec: "01:00-04:00", at: jst(0, 2, 0).UTC(), want: true},
+		{spec: "25:00-04:00", wantErr: true},
+		{spec: "01:00-01:00", wantErr: true},
+		{spec: "1:0-04:00", wantErr: true},
+		{spec: "holiday 01:00-04:00", wantErr: true},
+		{spec: "01:00", wantErr: true},
+	}
+	for _, tt := range tests {
+		w, err := ParseWindow(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseWindow(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if err == nil && w.Contains(tt.at) != tt.want {
+			t.Errorf("ParseWindow(%q).Contains(%s) = %v, want %v", tt.spec, tt.at, !tt.want, tt.want)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	ptr := func(t time.Time) *time.Time { return &t }
+	tests := []struct {
+		name      string
+		expr      string
+		interval  time.Duration
+		blackouts string
+		last      *time.Time
+		now       time.Time
+		want      time.Time
+	}{
+		{name: "never scanned", interval: time.Hour, now: jst(0, 12, 0), want: jst(0, 12, 0)},
+		{name: "interval", interval: time.Hour, last: ptr(jst(0, 12, 0)), now: jst(0, 12, 30), want: jst(0, 13, 0)},
+		{name: "overdue", interval: time.Hour, last: ptr(jst(0, 8, 0)), now: jst(0, 12, 30), want: jst(0, 12, 30)},
+		{name: "cron", expr: "0 2 * * *", last: ptr(jst(0, 2, 40)), now: jst(0, 12, 0), want: jst(1, 2, 0)},
+		{name: "cron every", expr: "@every 6h", last: ptr(jst(0, 2, 0)), now: jst(0, 3, 0), want: jst(0, 8, 0)},
+		{name: "cron weekdays", expr: "30 9 * * mon-fri", last: ptr(jst(4, 9, 45)), now: jst(4, 12, 0), want: jst(7, 9, 30)},
+		{name: "pushed out of blackout", interval: time.Hour, blackouts: "01:00-04:00", last: ptr(jst(0, 0, 30)), now: jst(0, 0, 45), want: jst(0, 4, 0)},
+		{name: "overdue during blackout", interval: time.Hour, blackouts: "01:00-04:00", last: ptr(jst(0, 0, 0)), now: jst(0, 2, 0), want: jst(0, 4, 0)},
+		{name: "adjacent blackouts", interval: time.Hour, blackouts: "22:00-02:00, 02:00-04:00", now: jst(0, 23, 0), want: jst(1, 4, 0)},
+		{name: "weekend blackout", expr: "0 2 * * *", blackouts: "sat-sun 00:00-24:00", last: ptr(jst(4, 2, 30)), now: jst(4, 12, 0), want: jst(7, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(tt.expr, tt.interval, tt.blackouts)
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			if got := s.Next(tt.last, tt.now); !got.Equal(tt.want) {
+				t.Errorf("Next = %s, want %s", got, tt.want)
+			}
+			if due := s.Due(tt.last, tt.now); due != tt.want.Equal(tt.now) {
+				t.Errorf("Due = %v, want %v", due, !due)
+			}
+		})
+	}
+}
+
+func TestNextBlackout(t *testing.T) {
+	tests := []struct {
+		blackouts string
+		at        time.Time
+		want      time.Time
+	}{
+		{blackouts: "01:00-04:00", at: jst(0, 0, 30), want: jst(0, 1, 0)},
+		{blackouts: "01:00-04:00", at: jst(0, 1, 0), want: jst(0, 1, 0)},
+		// 停止時間帯の中では、次に始まる時刻
+		{blackouts: "01:00-04:00", at: jst(0, 2, 0), want: jst(1, 1, 0)},
+		{blackouts: "01:00-04:00, sat 22:00-02:00", at: jst(5, 12, 0), want: jst(5, 22, 0)},
+		{blackouts: "mon-fri 09:00-18:00", at: jst(4, 19, 0), want: jst(7, 9, 0)},
+	}
+	for _, tt := range tests {
+		s, err := Parse("", time.Hour, tt.blackouts)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		if got, ok := s.NextBlackout(tt.at); !ok || !got.Equal(tt.want) {
+			t.Errorf("NextBlackout(%q, %s) = %s %v, want %s", tt.blackouts, tt.at, got, ok, tt.want)
+		}
+	}
+
+	s, _ := Parse("", time.Hour, "")
+	if _, ok := s.NextBlackout(jst(0, 0, 0)); ok {
+		t.Errorf("expected no blackout without windows")
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, tt := range []struct{ expr, blackouts string }{
+		{expr: "every day"},
+		{expr: "0 2 * *"},
+		{blackouts: "01:00-04:00,nightly"},
+		{blackouts: "00:00-12:00,12:00-24:00"},
+	} {
+		if _, err := Parse(tt.expr, time.Hour, tt.blackouts); err == nil {
+			t.Errorf("Parse(%q, %q): expected error", tt.expr, tt.blackouts)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Base: 10 * time.Minute, Max: 2 * time.Hour}
+	for failures, want := range []time.Duration{0, 10 * time.Minute, 20 * time.Minute, 40 * time.Minute, 80 * time.Minute, 2 * time.Hour, 2 * time.Hour} {
+		if got := b.Delay(failures); got != want {
+			t.Errorf("Delay(%d) = %s, want %s", failures, got, want)
+		}
+	}
+	// 大きな回数でもあふれない
+	if got := b.Delay(1000); got != 2*time.Hour {
+		t.Errorf("Delay(1000) = %s, want %s", got, 2*time.Hour)
+	}
+
+	t.Setenv("SOKONI_SCAN_BACKOFF_BASE", "1m")
+	t.Setenv("SOKONI_SCAN_BACKOFF_MAX", "invalid")
+	if got := BackoffFromEnv(); got.Base != time.Minute || got.Max != defaultBackoffMax {
+		t.Errorf("unexpected backoff from env: %+v", got)
+	}
+}
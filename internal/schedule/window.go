@@ -0,0 +1,149 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/koplec/sokoni/internal/tztime"
+)
+
+// Window は曜日と時刻で指定する時間帯（例: "01:00-04:00"、"mon-fri 09:00-18:00"、"sat 22:00-02:00"）。
+// 終了が開始以前の場合は翌日の終了時刻までを表し、曜日は開始時刻の曜日で判定する。
+type Window struct {
+	days  [7]bool // time.Weekday順
+	start int     // 0時からの分
+	end   int     // 0時からの分（24:00は1440）
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParseWindows はカンマ区切りの時間帯を解析する。空文字列の場合はnilを返す。
+func ParseWindows(s string) ([]Window, error) {
+	var windows []Window
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		w, err := ParseWindow(part)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// ParseWindow は "[曜日[-曜日] ]HH:MM-HH:MM" 形式の時間帯を解析する。曜日を省略した場合は毎日。
+func ParseWindow(s string) (Window, error) {
+	var w Window
+	fields := strings.Fields(strings.ToLower(s))
+	switch len(fields) {
+	case 1:
+		for i := range w.days {
+			w.days[i] = true
+		}
+	case 2:
+		if err := w.parseDays(fields[0]); err != nil {
+			return Window{}, fmt.Errorf("invalid time window %q: %w", s, err)
+		}
+		fields = fields[1:]
+	default:
+		return Window{}, fmt.Errorf("invalid time window %q: expected [days ]HH:MM-HH:MM", s)
+	}
+
+	start, end, ok := strings.Cut(fields[0], "-")
+	if !ok {
+		return Window{}, fmt.Errorf("invalid time window %q: expected HH:MM-HH:MM", s)
+	}
+	var err error
+	if w.start, err = parseClock(start); err != nil {
+		return Window{}, fmt.Errorf("invalid time window %q: %w", s, err)
+	}
+	if w.end, err = parseClock(end); err != nil {
+		return Window{}, fmt.Errorf("invalid time window %q: %w", s, err)
+	}
+	if w.start == w.end {
+		return Window{}, fmt.Errorf("invalid time window %q: start and end are the same", s)
+	}
+	return w, nil
+}
+
+func (w *Window) parseDays(s string) error {
+	from, to, isRange := strings.Cut(s, "-")
+	first, ok := weekdays[from]
+	if !ok {
+		return fmt.Errorf("unknown weekday %q", from)
+	}
+	last := first
+	if isRange {
+		if last, ok = weekdays[to]; !ok {
+			return fmt.Errorf("unknown weekday %q", to)
+		}
+	}
+	// "fri-mon" のように週をまたぐ範囲も許す
+	for d := first; ; d = (d + 1) % 7 {
+		w.days[d] = true
+		if d == last {
+			return nil
+		}
+	}
+}
+
+// parseClock は "HH:MM" を0時からの分にする。"24:00" も許す。
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	hour, err := strconv.Atoi(h)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	minute, err := strconv.Atoi(m)
+	if err != nil || len(m) != 2 || hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return hour*60 + minute, nil
+}
+
+// Contains はtが時間帯に入っているかを返す。tはアプリケーションのタイムゾーンで評価する。
+func (w Window) Contains(t time.Time) bool {
+	t = t.In(tztime.Zone())
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.start < w.end {
+		return w.days[day] && w.start <= minute && minute < w.end
+	}
+	// 日をまたぐ時間帯は、開始日の開始以降と翌日の終了前
+	return (w.days[day] && minute >= w.start) || (w.days[(day+6)%7] && minute < w.end)
+}
+
+// nextStart はt以降で最初に時間帯が始まる時刻を返す。
+func (w Window) nextStart(t time.Time) time.Time {
+	t = t.In(tztime.Zone())
+	for i := 0; ; i++ {
+		// 夏時間の切り替えがあっても時計の時刻で始まるよう、日付と時刻から作る
+		start := time.Date(t.Year(), t.Month(), t.Day()+i, w.start/60, w.start%60, 0, 0, t.Location())
+		if w.days[start.Weekday()] && !start.Before(t) {
+			return start
+		}
+	}
+}
+
+// endOf はtを含む時間帯の終わりの時刻を返す。tはContainsがtrueになる時刻であること。
+func (w Window) endOf(t time.Time) time.Time {
+	t = t.In(tztime.Zone())
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	minute := t.Hour()*60 + t.Minute()
+	if w.start > w.end && minute >= w.start {
+		// 日をまたぐ時間帯の開始日にいるので、終わりは翌日
+		midnight = midnight.AddDate(0, 0, 1)
+	}
+	return midnight.Add(time.Duration(w.end) * time.Minute)
+}
@@ -2,128 +2,265 @@ package scheduler
 
 import (
 	"context"
+	"errors"
 	"log"
+	"sync"
 	"time"
 
-	"github.com/jackc/pgx/v5"
 	"github.com/koplec/sokoni/internal/collector"
 	"github.com/koplec/sokoni/internal/db"
-	"github.com/koplec/sokoni/internal/model"
+	"github.com/koplec/sokoni/internal/service"
 )
 
+// watchRetryInterval は監視が異常終了したときに再開するまでの待ち時間。
+const watchRetryInterval = time.Minute
+
+// checkInterval はスキャンの時刻になったconnectionを確認する間隔。
+// cron式は分単位なので、1分ごとに確認すればスケジュールどおりに始められる。
+const checkInterval = time.Minute
+
 type Scanner struct {
-	conn *pgx.Conn
-	ctx  context.Context
-	done chan struct{}
+	repos  db.Repositories
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	watchers map[int]watcher       // 監視のgoroutineを起動したconnection ID
+	stopping map[int]chan struct{} // 止めた監視のgoroutineが終わると閉じる（次の監視はリースを手放すのを待ってから始める）
+	watching map[int]int           // connection IDごとの、現在監視できているgoroutineの数（ローカルの監視中はスケジュールされたスキャンを飛ばす）
+	watches  sync.WaitGroup        // 監視のgoroutine
 }
 
-func NewScanner(conn *pgx.Conn) *Scanner {
+// watcher はconnectionを監視するgoroutine。
+type watcher struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewScanner はスケジューラを作る。スケジューラはスキャンの時刻になったconnectionのスキャンジョブを積むだけで、
+// スキャンはsokoni workerが行う。監視はスケジューラの中で並行してreposを使う。
+// connectionの作成・変更・削除はAPIからの通知（db.EventRepository）ですぐに反映する。
+func NewScanner(repos db.Repositories) *Scanner {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Scanner{
-		conn: conn,
-		ctx:  context.Background(),
-		done: make(chan struct{}),
+		repos:    repos,
+		ctx:      ctx,
+		cancel:   cancel,
+		watchers: make(map[int]watcher),
+		stopping: make(map[int]chan struct{}),
+		watching: make(map[int]int),
 	}
 }
 
 func (s *Scanner) Start() {
-	ticker := time.NewTicker(6 * time.Hour) // 6時間ごとにチェック
+	ticker := time.NewTicker(checkInterval)
 	defer ticker.Stop()
 
-	log.Println("Scanner started (checking every 6 hours)")
+	// 通知を受け取れなくても、checkIntervalごとの確認で追いつく
+	events, err := s.repos.Events.ListenEvents(s.ctx)
+	if err != nil {
+		log.Printf("Warning: failed to listen for changes: %v", err)
+	}
+
+	log.Printf("Scanner started (checking every %s)", checkInterval)
 
 	// 起動時に1回チェック
+	s.startWatchers()
 	s.scanDueConnections()
 
 	for {
 		select {
 		case <-ticker.C:
+			s.startWatchers()
 			s.scanDueConnections()
-		case <-s.done:
+		case event, ok := <-events:
+			if !ok {
+				events = nil // 止めるときに閉じられる
+				continue
+			}
+			s.handleEvent(event)
+		case <-s.ctx.Done():
+			// 監視の差分スキャンが書き込み中のバッチを終えるまで待つ
+			s.watches.Wait()
 			log.Println("Scanner stopped")
 			return
 		}
 	}
 }
 
+// Stop はスケジューラと監視を止める。Startは監視が止まるのを待ってから戻る。
 func (s *Scanner) Stop() {
-	close(s.done)
+	s.cancel()
 }
 
+// handleEvent はAPIから知らされた変更を反映する。
+// 作成・変更されたconnectionは、スキャンの時刻になっていればすぐにジョブを積み、監視の設定を反映する。
+// 削除されたconnectionや監視をやめたconnectionは監視を止める。
+func (s *Scanner) handleEvent(event db.Event) {
+	switch event.Type {
+	case db.EventConnectionCreated, db.EventConnectionUpdated, db.EventConnectionDeleted:
+		log.Printf("Connection %d changed (%s)", event.ConnectionID, event.Type)
+		// 監視の間隔やパスが変わっている場合があるので、監視し直す
+		s.stopWatcher(event.ConnectionID)
+	case db.EventResync:
+	default:
+		return // スキャンの依頼などはワーカーが受け取る
+	}
+	s.startWatchers()
+	s.scanDueConnections()
+}
+
+// scanDueConnections はスケジュール（cron式またはscan_interval）上スキャンの時刻になり、
+// 停止時間帯に入っていないconnectionのスキャンジョブを積む。
+// 同じconnectionのジョブが待機中か実行中なら積まないので、複数のインスタンスで動かしても重ならない。
 func (s *Scanner) scanDueConnections() {
-	connections, err := s.getDueConnections()
+	connections, err := s.repos.Connections.GetDueConnections(s.ctx)
 	if err != nil {
 		log.Printf("Error getting due connections: %v", err)
 		return
 	}
 
-	if len(connections) == 0 {
-		log.Println("No connections due for scanning")
-		return
-	}
-
-	log.Printf("Found %d connections due for scanning", len(connections))
-
 	for _, conn := range connections {
-		log.Printf("Starting scan for connection: %s (ID: %d, Remote: %s)", conn.Name, conn.ID, conn.RemotePath)
-		
-		fileCount := 0
-		err := s.scanConnection(conn, &fileCount)
-		if err != nil {
-			log.Printf("Error scanning connection %s: %v", conn.Name, err)
+		if s.ctx.Err() != nil {
+			return
+		}
+		// ローカルの監視中のconnectionは変更が随時反映されているので、監視が止まっているときだけスキャンする
+		if s.isWatching(conn.ID) {
 			continue
 		}
-		
-		err = s.updateLastScan(conn.ID)
+		job, created, err := service.EnqueueScan(s.ctx, s.repos.Jobs, conn.ID, true)
 		if err != nil {
-			log.Printf("Error updating last_scan for connection %s: %v", conn.Name, err)
-		} else {
-			log.Printf("Completed scan for %s: processed %d files", conn.Name, fileCount)
+			log.Printf("Error enqueuing scan for connection %s: %v", conn.Name, err)
+			continue
+		}
+		if created {
+			log.Printf("Enqueued scan for connection: %s (ID: %d, job: %d)", conn.Name, conn.ID, job.ID)
 		}
 	}
 }
 
-
-func (s *Scanner) getDueConnections() ([]*db.Connection, error) {
-	query := `
-		SELECT id, name, base_path, remote_path, username, password, options,
-		       user_id, last_scan, scan_interval, auto_scan, created_at, updated_at
-		FROM connections 
-		WHERE auto_scan = true 
-		AND (last_scan IS NULL OR last_scan + (scan_interval || ' seconds')::interval < now())
-	`
-	
-	rows, err := s.conn.Query(s.ctx, query)
+// startWatchers はwatchが有効なconnectionのうち、まだ監視していないものの監視を始め、
+// 削除されたかwatchが無効になったconnectionの監視を止める。
+// 監視はconnectionごとのgoroutineで行い、異常終了した場合はwatchRetryInterval後に再開する。
+// 複数のインスタンスで動かしても、監視のリース（service.ClaimWatch）を取得できた1つのインスタンスだけが監視する。
+// ほかのインスタンスはwatchRetryIntervalごとにリースの取得を試み、監視していたインスタンスが止まったら引き継ぐ。
+// 監視が止まっている間もスケジュールされたスキャンは続くので、変更はそちらで反映される。
+// リモートのconnectionの監視（変更の確認）では見つけられない変更やフルスキャンがあるので、監視中もスケジュールされたスキャンを続ける。
+func (s *Scanner) startWatchers() {
+	connections, err := s.repos.Connections.GetWatchedConnections(s.ctx)
 	if err != nil {
-		return nil, err
+		log.Printf("Error getting watched connections: %v", err)
+		return
 	}
-	defer rows.Close()
-
-	var connections []*db.Connection
-	for rows.Next() {
-		var conn db.Connection
-		err := rows.Scan(
-			&conn.ID, &conn.Name, &conn.BasePath, &conn.RemotePath, &conn.Username, &conn.Password, &conn.Options,
-			&conn.UserID, &conn.LastScan, &conn.ScanInterval, &conn.AutoScan, &conn.CreatedAt, &conn.UpdatedAt,
-		)
-		if err != nil {
-			return nil, err
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	watched := make(map[int]bool, len(connections))
+	for _, conn := range connections {
+		watched[conn.ID] = true
+		if _, started := s.watchers[conn.ID]; !started {
+			ctx, cancel := context.WithCancel(s.ctx)
+			w := watcher{cancel: cancel, done: make(chan struct{})}
+			prev := s.stopping[conn.ID]
+			delete(s.stopping, conn.ID)
+			s.watchers[conn.ID] = w
+			s.watches.Add(1)
+			go func() {
+				defer s.watches.Done()
+				defer close(w.done)
+				if prev != nil {
+					select {
+					case <-prev:
+					case <-ctx.Done():
+						return
+					}
+				}
+				s.watch(ctx, conn.ID, conn.Name, collector.IsLocalPath(conn.RemotePath))
+			}()
+		}
+	}
+	for id := range s.watchers {
+		if !watched[id] {
+			log.Printf("Stopping watch for connection %d", id)
+			s.stopWatcherLocked(id)
 		}
-		connections = append(connections, &conn)
 	}
+}
 
-	return connections, rows.Err()
+// stopWatcher はconnectionの監視を止める。次のstartWatchersで、watchが有効なら監視し直す。
+func (s *Scanner) stopWatcher(connectionID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopWatcherLocked(connectionID)
 }
 
-func (s *Scanner) scanConnection(conn *db.Connection, fileCount *int) error {
-	return collector.ScanConnectionWith(conn, func(fileInfo model.FileInfo) error {
-		*fileCount++
-		return db.InsertFile(s.ctx, s.conn, conn.ID, fileInfo)
-	})
+func (s *Scanner) stopWatcherLocked(connectionID int) {
+	if w, ok := s.watchers[connectionID]; ok {
+		w.cancel()
+		s.stopping[connectionID] = w.done
+		delete(s.watchers, connectionID)
+	}
 }
 
-func (s *Scanner) updateLastScan(connectionID int) error {
-	_, err := s.conn.Exec(s.ctx, 
-		"UPDATE connections SET last_scan = now() WHERE id = $1", 
-		connectionID)
+func (s *Scanner) watch(ctx context.Context, connectionID int, name string, local bool) {
+	for {
+		err := s.watchOnce(ctx, connectionID, local)
+		if ctx.Err() != nil {
+			return
+		}
+		// ほかのインスタンスが監視している間は、ローカルの監視中として扱いスケジュールされたスキャンを飛ばす
+		elsewhere := errors.Is(err, service.ErrWatchInProgress)
+		if !elsewhere {
+			log.Printf("Watch for connection %s stopped: %v (retrying in %s)", name, err, watchRetryInterval)
+		} else if local {
+			s.setWatching(connectionID, 1)
+		}
+
+		select {
+		case <-time.After(watchRetryInterval):
+		case <-ctx.Done():
+		}
+		if elsewhere && local {
+			s.setWatching(connectionID, -1)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// watchOnce は監視のリースを取得して、止まるまでconnectionを監視する。
+// リースを失った場合はErrLeaseLostを返す。
+func (s *Scanner) watchOnce(ctx context.Context, connectionID int, local bool) error {
+	lease, err := service.ClaimWatch(ctx, s.repos.ScanRuns, connectionID)
+	if err != nil {
+		return err
+	}
+	defer lease.Release()
+
+	if local {
+		s.setWatching(connectionID, 1)
+		defer s.setWatching(connectionID, -1)
+	}
+	err = service.WatchConnection(lease.Context(), s.repos, connectionID)
+	if lease.Lost() {
+		return context.Cause(lease.Context())
+	}
 	return err
-}
\ No newline at end of file
+}
+
+// setWatching は監視できているgoroutineの数を増減する。
+func (s *Scanner) setWatching(connectionID int, delta int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watching[connectionID] += delta
+	if s.watching[connectionID] <= 0 {
+		delete(s.watching, connectionID)
+	}
+}
+
+func (s *Scanner) isWatching(connectionID int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.watching[connectionID] > 0
+}
@@ -0,0 +1,149 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/koplec/sokoni/internal/db"
+	"github.com/koplec/sokoni/internal/service"
+)
+
+func TestScanDueConnections(t *testing.T) {
+	ctx := context.Background()
+	repos := db.NewMemoryRepositories()
+
+	var ids []int
+	for _, name := range []string{"a", "b", "c"} {
+		dir := filepath.Join(t.TempDir(), name)
+		c, err := repos.Connections.CreateConnection(ctx, db.CreateConnectionRequest{Name: name, BasePath: dir, RemotePath: dir})
+		if err != nil {
+			t.Fatalf("failed to insert connection: %v", err)
+		}
+		ids = append(ids, c.ID)
+	}
+
+	// 同じDBを使う2つのスケジューラが同じ一覧から積んでも、connectionごとのジョブは1つだけ
+	for i := 0; i < 2; i++ {
+		s := NewScanner(repos)
+		defer s.Stop()
+		s.scanDueConnections()
+		s.scanDueConnections()
+	}
+
+	jobs, err := repos.Jobs.ListJobs(ctx, db.JobQueued, 100)
+	if err != nil {
+		t.Fatalf("ListJobs failed: %v", err)
+	}
+	if len(jobs) != len(ids) {
+		t.Fatalf("expected %d queued jobs, got %d", len(ids), len(jobs))
+	}
+	for _, job := range jobs {
+		if job.Type != db.JobTypeScan || job.Priority != db.JobPriorityScheduled || string(job.Payload) != `{"scheduled":true}` {
+			t.Errorf("unexpected job: %+v", job)
+		}
+	}
+
+	// スキャンはワーカーが行うので、スケジューラはconnectionを更新しない
+	c, _ := repos.Connections.GetConnectionByID(ctx, ids[0])
+	if c.LastScan != nil {
+		t.Errorf("expected last_scan not to be updated by the scheduler")
+	}
+}
+
+// waitFor はcondが成り立つまで、通知を送り直しながら待つ（LISTENを始める前に送った通知は届かない）。
+func waitFor(t *testing.T, repos db.Repositories, event db.Event, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("scheduler did not react to %+v", event)
+		}
+		repos.Events.PublishEvent(context.Background(), event)
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestScannerReactsToEvents(t *testing.T) {
+	ctx := context.Background()
+	repos := db.NewMemoryRepositories()
+	off, on := false, true
+
+	dir := t.TempDir()
+	scanned := db.CreateConnectionRequest{Name: "scanned", BasePath: dir, RemotePath: dir, AutoScan: &off}
+	c, err := repos.Connections.CreateConnection(ctx, scanned)
+	if err != nil {
+		t.Fatalf("failed to insert connection: %v", err)
+	}
+	watchDir := t.TempDir()
+	watched := db.CreateConnectionRequest{Name: "watched", BasePath: watchDir, RemotePath: watchDir, AutoScan: &off, Watch: &on}
+	w, err := repos.Connections.CreateConnection(ctx, watched)
+	if err != nil {
+		t.Fatalf("failed to insert connection: %v", err)
+	}
+
+	s := NewScanner(repos)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Start()
+	}()
+	defer func() {
+		s.Stop()
+		<-done
+	}()
+
+	// 自動スキャンを有効にしたconnectionは、次の確認（1分後）を待たずにジョブを積む
+	scanned.AutoScan = &on
+	if _, err := repos.Connections.UpdateConnection(ctx, c.ID, c.UserID, scanned); err != nil {
+		t.Fatalf("UpdateConnection failed: %v", err)
+	}
+	waitFor(t, repos, db.Event{Type: db.EventConnectionUpdated, ConnectionID: c.ID}, func() bool {
+		jobs, _ := repos.Jobs.ListJobs(ctx, db.JobQueued, 10)
+		return len(jobs) == 1 && *jobs[0].ConnectionID == c.ID
+	})
+
+	// 監視をやめたconnectionは監視を止める
+	waitFor(t, repos, db.Event{Type: db.EventResync}, func() bool { return s.isWatching(w.ID) })
+	watched.Watch = &off
+	if _, err := repos.Connections.UpdateConnection(ctx, w.ID, w.UserID, watched); err != nil {
+		t.Fatalf("UpdateConnection failed: %v", err)
+	}
+	waitFor(t, repos, db.Event{Type: db.EventConnectionUpdated, ConnectionID: w.ID}, func() bool { return !s.isWatching(w.ID) })
+}
+
+func TestWatchOneInstance(t *testing.T) {
+	ctx := context.Background()
+	repos := db.NewMemoryRepositories()
+	on := true
+	dir := t.TempDir()
+	w, err := repos.Connections.CreateConnection(ctx, db.CreateConnectionRequest{Name: "watched", BasePath: dir, RemotePath: dir, Watch: &on})
+	if err != nil {
+		t.Fatalf("failed to insert connection: %v", err)
+	}
+
+	first := NewScanner(repos)
+	first.startWatchers()
+	waitFor(t, repos, db.Event{Type: db.EventResync}, func() bool { return first.isWatching(w.ID) })
+
+	// 同じDBを使うほかのインスタンスは、監視のリースを取得できないので監視しない
+	second := NewScanner(repos)
+	defer second.Stop()
+	if err := second.watchOnce(second.ctx, w.ID, true); !errors.Is(err, service.ErrWatchInProgress) {
+		t.Fatalf("expected ErrWatchInProgress, got %v", err)
+	}
+
+	// 監視していたインスタンスが止まれば引き継ぐ
+	first.Stop()
+	first.watches.Wait()
+	watchCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- second.watchOnce(watchCtx, w.ID, true) }()
+	waitFor(t, repos, db.Event{Type: db.EventResync}, func() bool { return second.isWatching(w.ID) })
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("watchOnce failed: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultShutdownTimeout はSOKONI_SHUTDOWN_TIMEOUTが未設定のときに、処理中のHTTPリクエストを待つ時間。
+const defaultShutdownTimeout = 30 * time.Second
+
+// Service は一緒に動かすもの（APIサーバー・スケジューラ・ワーカー）。
+// Startは止められて後片付けを終えるまで戻らない。Stopは止め始めるだけで、Startが戻るのを待たなくてよい。
+// Stopは何度呼んでもよく、Startが自分で戻った後にも呼ばれる。
+type Service interface {
+	Start()
+	Stop()
+}
+
+// Run はservicesを並行して動かし、ctxがキャンセルされるか、どれかのStartが戻ったらすべてを止める。
+// すべてのStartが戻るまで（処理中のリクエストやスキャンのバッチを書き終えるまで）戻らない。
+func Run(ctx context.Context, services ...Service) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, s := range services {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer cancel() // 1つが止まったら、ほかも止める
+			s.Start()
+		}()
+	}
+
+	<-ctx.Done()
+	log.Println("Shutting down...")
+	for _, s := range services {
+		go s.Stop()
+	}
+	wg.Wait()
+	log.Println("Shutdown complete")
+}
+
+// HTTPServer はhttp.ServerをServiceとして動かす。止めるときは新しい接続を受け付けずに、処理中のリクエストを待つ。
+type HTTPServer struct {
+	server   *http.Server
+	listener net.Listener
+	timeout  time.Duration
+	cancel   context.CancelFunc // リクエストのコンテキストをキャンセルする
+	requests sync.WaitGroup     // 処理中のリクエスト
+	done     chan struct{}
+	once     sync.Once
+}
+
+// ListenHTTP はaddrで待ち受けを始め、handlerで応答するHTTPServerを返す。
+// ポートが使えない場合は、ほかのサービスを動かす前にエラーを返す。
+// 止めるときはSOKONI_SHUTDOWN_TIMEOUT（既定30s）まで処理中のリクエストを待ち、過ぎたらリクエストのコンテキストをキャンセルして接続を閉じる。
+func ListenHTTP(addr string, handler http.Handler) (*HTTPServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &HTTPServer{
+		listener: ln,
+		timeout:  shutdownTimeout(),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	s.server = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.requests.Add(1)
+			defer s.requests.Done()
+			handler.ServeHTTP(w, r)
+		}),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	return s, nil
+}
+
+// shutdownTimeout は処理中のリクエストを待つ時間を環境変数から返す。
+func shutdownTimeout() time.Duration {
+	if v := os.Getenv("SOKONI_SHUTDOWN_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("Ignoring invalid SOKONI_SHUTDOWN_TIMEOUT=%q (using %s)", v, defaultShutdownTimeout)
+	}
+	return defaultShutdownTimeout
+}
+
+// Addr は待ち受けているアドレスを返す。
+func (s *HTTPServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Start はStopが呼ばれて処理中のリクエストを終えるまでリクエストに応答する。
+func (s *HTTPServer) Start() {
+	err := s.server.Serve(s.listener)
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("API server failed: %v", err)
+		return
+	}
+	<-s.done // Serveはすぐに戻るので、処理中のリクエストを終えるまで待つ
+}
+
+// Stop は新しい接続の受け付けをやめ、処理中のリクエストを待ってから接続を閉じる。
+// 待ちきれなかったリクエストは、コンテキストをキャンセルしてハンドラーが戻るまで待つ。
+func (s *HTTPServer) Stop() {
+	s.once.Do(func() {
+		defer close(s.done)
+		defer s.cancel()
+		ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+		defer cancel()
+		if err := s.server.Shutdown(ctx); err != nil {
+			log.Printf("Warning: closing API server with requests in flight: %v", err)
+			// 処理中のリクエストのDBへの問い合わせやダウンロードを止める
+			s.cancel()
+			s.server.Close()
+		}
+		s.requests.Wait()
+	})
+}
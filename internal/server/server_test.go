@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeService はStopが呼ばれるまでStartから戻らない。
+type fakeService struct {
+	stop    chan struct{}
+	once    sync.Once
+	stopped atomic.Bool
+}
+
+func newFakeService() *fakeService {
+	return &fakeService{stop: make(chan struct{})}
+}
+
+func (s *fakeService) Start() {
+	<-s.stop
+	time.Sleep(20 * time.Millisecond) // 後片付け
+	s.stopped.Store(true)
+}
+
+func (s *fakeService) Stop() {
+	s.once.Do(func() { close(s.stop) })
+}
+
+func TestRunDrainsRequests(t *testing.T) {
+	started := make(chan struct{})
+	srv, err := ListenHTTP("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+	if err != nil {
+		t.Fatalf("ListenHTTP failed: %v", err)
+	}
+	other := newFakeService()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		Run(ctx, srv, other)
+	}()
+
+	type response struct {
+		body string
+		err  error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		resp, err := http.Get("http://" + srv.Addr().String())
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		responses <- response{string(body), err}
+	}()
+
+	// 処理中のリクエストは、止め始めた後も最後まで応答する
+	<-started
+	cancel()
+	if got := <-responses; got.err != nil || got.body != "done" {
+		t.Errorf("expected in-flight request to complete, got %q %v", got.body, got.err)
+	}
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the services stopped")
+	}
+	if !other.stopped.Load() {
+		t.Error("expected Run to wait for every service to stop")
+	}
+	if _, err := http.Get("http://" + srv.Addr().String()); err == nil {
+		t.Error("expected server to stop accepting connections")
+	}
+}
+
+func TestStopCancelsSlowRequests(t *testing.T) {
+	t.Setenv("SOKONI_SHUTDOWN_TIMEOUT", "50ms")
+	started := make(chan struct{})
+	var returned atomic.Bool
+	srv, err := ListenHTTP("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer returned.Store(true)
+		close(started)
+		<-r.Context().Done() // コンテキストがキャンセルされるまで処理し続けるリクエスト
+	}))
+	if err != nil {
+		t.Fatalf("ListenHTTP failed: %v", err)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		srv.Start()
+	}()
+	go http.Get("http://" + srv.Addr().String())
+
+	// 待ちきれなかったリクエストはキャンセルし、ハンドラーが戻るまで待つ
+	<-started
+	srv.Stop()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return after Stop")
+	}
+	if !returned.Load() {
+		t.Error("expected Stop to wait for the handler to return")
+	}
+}
+
+func TestRunStopsAllWhenOneStops(t *testing.T) {
+	first, second := newFakeService(), newFakeService()
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		Run(context.Background(), first, second)
+	}()
+
+	first.Stop()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Run to stop the other services")
+	}
+	if !second.stopped.Load() {
+		t.Error("expected second service to be stopped")
+	}
+}
+
+func TestListenHTTPPortInUse(t *testing.T) {
+	srv, err := ListenHTTP("127.0.0.1:0", http.NotFoundHandler())
+	if err != nil {
+		t.Fatalf("ListenHTTP failed: %v", err)
+	}
+	defer srv.listener.Close()
+	if _, err := ListenHTTP(srv.Addr().String(), http.NotFoundHandler()); err == nil {
+		t.Error("expected error for a port in use")
+	}
+}
@@ -0,0 +1,39 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/koplec/sokoni/internal/db"
+)
+
+// ScanJob はスキャンジョブ（db.JobTypeScan）のパラメータ。
+type ScanJob struct {
+	// Scheduled はスケジューラが積んだジョブか。取り出したときにスキャンの時刻でなくなっていれば
+	// （ほかのインスタンスがスキャンした、停止時間帯に入ったなど）スキャンせずに終え、
+	// 再試行しても失敗した場合はconnectionの連続失敗に数える。
+	Scheduled bool `json:"scheduled,omitempty"`
+}
+
+// EnqueueScan はconnectionのスキャンジョブを積む。スキャンはsokoni workerが行う。
+// 同じconnectionのスキャンジョブが待機中か実行中であれば積まずにそのジョブを返し、2つ目の戻り値をfalseにする。
+// 利用者が頼んだスキャン（scheduled=false）はスケジューラのものより先に取り出される。
+func EnqueueScan(ctx context.Context, jobs db.JobRepository, connectionID int, scheduled bool) (*db.Job, bool, error) {
+	payload, err := json.Marshal(ScanJob{Scheduled: scheduled})
+	if err != nil {
+		return nil, false, err
+	}
+	priority := db.JobPriorityManual
+	if scheduled {
+		priority = db.JobPriorityScheduled
+	}
+	key := fmt.Sprintf("%s:%d", db.JobTypeScan, connectionID)
+	return jobs.EnqueueJob(ctx, db.EnqueueJobRequest{
+		Type:         db.JobTypeScan,
+		ConnectionID: &connectionID,
+		Payload:      payload,
+		Priority:     priority,
+		DedupeKey:    &key,
+	})
+}
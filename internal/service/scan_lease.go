@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/koplec/sokoni/internal/db"
+)
+
+// ErrScanInProgress は同じconnectionをほかのスキャン（別のインスタンスのものを含む）が実行中のときに返す。
+var ErrScanInProgress = errors.New("connection is already being scanned")
+
+// ErrWatchInProgress は同じconnectionをほかのインスタンス（または同じプロセスのほかの監視）が監視中のときに返す。
+var ErrWatchInProgress = errors.New("connection is already being watched")
+
+// ErrLeaseLost はスキャン中（または監視中）にリースを延長できず、ほかのインスタンスに引き継がれた可能性があるときの中断理由。
+var ErrLeaseLost = errors.New("lease lost")
+
+// defaultLeaseTTL はSOKONI_SCAN_LEASE_TTLが未設定のときのリースの期限。
+const defaultLeaseTTL = 2 * time.Minute
+
+// leaseTTL はリースの期限を環境変数から返す。
+// インスタンスがクラッシュした場合、ほかのインスタンスはこの時間が過ぎてからスキャンを引き継ぐ。
+func leaseTTL() time.Duration {
+	return envDuration("SOKONI_SCAN_LEASE_TTL", defaultLeaseTTL)
+}
+
+// instanceID はこのプロセスを表す識別子。リースのownerはこれにスキャンごとの番号を付けたものになる。
+var instanceID = func() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d:%d", host, os.Getpid(), time.Now().UnixNano())
+}()
+
+var leaseSeq atomic.Int64
+
+// InstanceID はこのプロセスを表す識別子（ホスト名・PIDなど）を返す。リースやジョブを持っているのが誰かを記録するのに使う。
+func InstanceID() string {
+	return instanceID
+}
+
+// ScanLease はconnectionをスキャンする権利（ClaimWatchで取得したものは監視する権利）。
+// 持っている間はttlの1/3ごとに延長し（ハートビート）、延長できなくなったらContextをErrLeaseLostでキャンセルする。
+// 同じプロセス内のスキャンどうしもリースで排他するので、ownerはスキャンごとに異なる。
+type ScanLease struct {
+	store        leaseStore
+	connectionID int
+	owner        string
+	ttl          time.Duration
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	wg     sync.WaitGroup
+	once   sync.Once
+}
+
+// leaseStore はスキャンと監視のリースの取得・延長・解放の問い合わせ。
+type leaseStore struct {
+	kind    string // ログに出すリースの種類
+	acquire func(ctx context.Context, connectionID int, owner string, ttl time.Duration) (bool, error)
+	renew   func(ctx context.Context, connectionID int, owner string, ttl time.Duration) (bool, error)
+	release func(ctx context.Context, connectionID int, owner string) error
+}
+
+type scanLeaseKey struct{}
+
+// ClaimScan はconnectionのリースを取得してハートビートを始める。
+// ほかのスキャンがリースを持っていればErrScanInProgressを返す。
+// ハートビートはスキャンと並行して問い合わせるので、scanRunsは*pgxpool.Poolを使うものを渡すこと。
+// 使い終わったら必ずReleaseを呼ぶこと。
+func ClaimScan(ctx context.Context, scanRuns db.ScanRunRepository, connectionID int) (*ScanLease, error) {
+	l, err := claimLease(ctx, leaseStore{
+		kind:    "scan",
+		acquire: scanRuns.AcquireScanLease,
+		renew:   scanRuns.RenewScanLease,
+		release: scanRuns.ReleaseScanLease,
+	}, connectionID, ErrScanInProgress)
+	if err != nil {
+		return nil, err
+	}
+	l.ctx, l.cancel = context.WithCancelCause(context.WithValue(ctx, scanLeaseKey{}, l))
+	l.start()
+	return l, nil
+}
+
+// ClaimWatch はconnectionを監視するリースを取得してハートビートを始める。
+// 監視は1つのインスタンスだけが行うよう、ほかの監視がリースを持っていればErrWatchInProgressを返す。
+// 監視の中のスキャンはスキャンのリースを別に取得するので、このリースのContextはNewConnectionScannerにリースとして渡らない。
+// 使い終わったら必ずReleaseを呼ぶこと。
+func ClaimWatch(ctx context.Context, scanRuns db.ScanRunRepository, connectionID int) (*ScanLease, error) {
+	l, err := claimLease(ctx, leaseStore{
+		kind:    "watch",
+		acquire: scanRuns.AcquireWatchLease,
+		renew:   scanRuns.RenewWatchLease,
+		release: scanRuns.ReleaseWatchLease,
+	}, connectionID, ErrWatchInProgress)
+	if err != nil {
+		return nil, err
+	}
+	l.ctx, l.cancel = context.WithCancelCause(ctx)
+	l.start()
+	return l, nil
+}
+
+// claimLease はリースを取得する。ほかのownerが持っていればheldを返す。
+func claimLease(ctx context.Context, store leaseStore, connectionID int, held error) (*ScanLease, error) {
+	l := &ScanLease{
+		store:        store,
+		connectionID: connectionID,
+		owner:        fmt.Sprintf("%s/%d", instanceID, leaseSeq.Add(1)),
+		ttl:          leaseTTL(),
+	}
+	ok, err := store.acquire(ctx, connectionID, l.owner, l.ttl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire %s lease: %w", store.kind, err)
+	}
+	if !ok {
+		return nil, held
+	}
+	return l, nil
+}
+
+func (l *ScanLease) start() {
+	l.wg.Add(1)
+	go l.heartbeat()
+}
+
+// Context はリースを持っている間だけ有効なコンテキストを返す。
+// NewConnectionScannerにこのコンテキストを渡すと、スキャナーはリースを取り直さずにこのリースを使う。
+func (l *ScanLease) Context() context.Context {
+	return l.ctx
+}
+
+// Lost はリースを延長できずに失ったかを返す。
+func (l *ScanLease) Lost() bool {
+	return errors.Is(context.Cause(l.ctx), ErrLeaseLost)
+}
+
+// fence はスキャン実行の記録がリースを持っていないために拒まれた場合（db.ErrLeaseNotHeld）、
+// ハートビートが気づく前でもリースを失ったものとしてContextをErrLeaseLostでキャンセルし、ErrLeaseLostを返す。
+// それ以外のエラーはそのまま返す。
+func (l *ScanLease) fence(err error) error {
+	if !errors.Is(err, db.ErrLeaseNotHeld) {
+		return err
+	}
+	l.cancel(ErrLeaseLost)
+	return ErrLeaseLost
+}
+
+// Release はハートビートを止めてリースを手放す。何度呼んでもよい。
+// キャンセル後でも手放せるよう、ctxのキャンセルは引き継がない。
+func (l *ScanLease) Release() {
+	l.once.Do(func() {
+		l.cancel(context.Canceled)
+		l.wg.Wait()
+
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(l.ctx), 10*time.Second)
+		defer cancel()
+		if err := l.store.release(ctx, l.connectionID, l.owner); err != nil {
+			// 期限が切れればほかのインスタンスが取得できるので、警告だけにする
+			log.Printf("Warning: failed to release %s lease for connection %d: %v", l.store.kind, l.connectionID, err)
+		}
+	})
+}
+
+// heartbeat はリースを延長し続ける。DBのエラーで延長できない間も再試行するが、
+// 最後に延長してからttlが過ぎたらほかのインスタンスが取得できる状態なので、スキャン（監視）を中断させる。
+func (l *ScanLease) heartbeat() {
+	defer l.wg.Done()
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	renewed := time.Now()
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// 応答しない接続で待ち続けると期限が過ぎても中断できないので、次の延長までに諦める
+		ctx, cancel := context.WithTimeout(l.ctx, l.ttl/4)
+		ok, err := l.store.renew(ctx, l.connectionID, l.owner, l.ttl)
+		cancel()
+		if l.ctx.Err() != nil {
+			return // Releaseされたか、スキャン（監視）が止められた
+		}
+		switch {
+		case err == nil && ok:
+			renewed = time.Now()
+			continue
+		case err == nil:
+			log.Printf("The %s lease for connection %d was taken over by another instance", l.store.kind, l.connectionID)
+		case time.Since(renewed) < l.ttl:
+			log.Printf("Warning: failed to renew %s lease for connection %d: %v", l.store.kind, l.connectionID, err)
+			continue
+		default:
+			log.Printf("The %s lease for connection %d expired: %v", l.store.kind, l.connectionID, err)
+		}
+		l.cancel(ErrLeaseLost)
+		return
+	}
+}
+
+// leaseFromContext はctxに含まれるconnectionのリース（ScanLease.Context）を返す。
+func leaseFromContext(ctx context.Context, connectionID int) *ScanLease {
+	l, ok := ctx.Value(scanLeaseKey{}).(*ScanLease)
+	if !ok || l.connectionID != connectionID {
+		return nil
+	}
+	return l
+}
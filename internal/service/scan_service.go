@@ -2,7 +2,10 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/koplec/sokoni/internal/collector"
@@ -10,7 +13,12 @@ import (
 	"github.com/koplec/sokoni/internal/model"
 )
 
+// ErrCancelled は利用者がスキャン（ジョブ）の取り消しを頼んだときの中断理由。
+var ErrCancelled = errors.New("cancelled by request")
+
 // ConnectionScanner は指定されたconnectionをスキャンしてPDFファイルをデータベースに保存する関数型。
+// CLI（sokoni scan）・スケジューラー・API・監視の再同期はすべてNewConnectionScannerで作ったものを使うので、
+// 誰が起動してもバッチの書き込み・scan_runsの記録・削除の検出・last_scanの更新は同じになる。
 //
 // この関数型は以下の副作用を持つ：
 // - データベースへのファイル情報の書き込み
@@ -23,89 +31,347 @@ import (
 // - userID: 実行ユーザーのID（認可チェック用）
 //
 // 戻り値：
+// - *collector.ScanResult: 処理件数とスキップしたエントリ（エラー時も可能な範囲で返す）
 // - error: スキャン処理中にエラーが発生した場合
-type ConnectionScanner func(ctx context.Context, connectionID int, userID int) error
+type ConnectionScanner func(ctx context.Context, connectionID int, userID int) (*collector.ScanResult, error)
 
-// NewConnectionScanner は指定されたデータベース接続を使用して、
+// NewConnectionScanner は指定されたリポジトリを使用して、
 // connectionをスキャンするスキャナーを作成する。
 //
 // スキャナーは以下の処理を行う：
-// 1. connection情報をDBから取得
-// 2. SMB/CIFS または ローカルファイルシステムから PDFファイルをスキャン
-// 3. 見つかったファイルを100件ずつバッチでDBに保存
-// 4. 進捗状況をログ出力
+//  1. connection情報をDBから取得
+//  2. 前回のスキャンが途中で終わっていればそれを再開し、なければ新しいスキャン実行を記録
+//  3. SMB/CIFS または ローカルファイルシステムから PDFファイルをスキャン
+//  4. 見つかったファイルをdb.FileBatchSize件ずつCOPYでまとめてDBに保存し、配下を走査し終えたディレクトリを
+//     チェックポイントとして同じトランザクションで記録
+//  5. 最後に存在しなくなったファイルをDBから削除（リコンシリエーション）
+//  6. 成功した場合（partialを含む）はconnectionのlast_scanを更新
+//  7. 進捗状況をログ出力
+//
+// 前回のフルスキャンからSOKONI_FULL_SCAN_INTERVAL（既定168h）以内であれば差分スキャンにする。
+// 差分スキャンではmtimeが前回と同じディレクトリの一覧を取らず、サイズか更新日時が
+// 変わったファイルの行だけを書き込む。mtimeが変わらないファイルの上書きはフルスキャンで拾う。
+//
+// 読み取れないディレクトリ等はスキップして結果に記録し、
+// その件数がエラーバジェット（collector.DefaultScanOptions）を超えたときだけ失敗とする。
+// キャンセルやタイムアウトで中断した場合は、次回のスキャンが最後のチェックポイントから再開する。
+// ただし開始からSOKONI_SCAN_RESUME_MAX_AGE（既定24h）が過ぎたスキャン実行は、チェックポイントの後に変わった
+// ディレクトリを取りこぼさないよう再開せずに失敗として記録し、始め直す。
+// 終わったスキャン実行はSOKONI_SCAN_RUN_RETENTION（既定720h）が過ぎたら記録を消す（db.PruneScanRuns）。
+// ctxをErrCancelled（context.WithCancelCause）でキャンセルした場合は取り消しとしてcancelledを記録し、
+// 削除の検出は行わず（走査していないファイルを消さない）、次回も再開せずに始め直す。
 //
-// - conn: PostgreSQL データベース接続
+// スキャンの間はconnectionのリース（ClaimScan）を持つ。ほかのスキャンがリースを持っていればErrScanInProgressを返す。
+// ctxがClaimScanで取得したリースのコンテキスト（ScanLease.Context）であれば、そのリースを使う。
+// インスタンスがクラッシュしてリースの期限が切れると、次にリースを取得したスキャンがそのスキャン実行を再開する。
+// リースを失った場合はErrLeaseLostを返し、スキャン実行の記録は引き継いだ側に任せる。
+// ハートビートが気づく前でも、記録の書き込みはリースを持っていることをDBで確かめてから行う（db.ErrLeaseNotHeld）。
+//
+// - repos: connection・スキャン実行を記録するリポジトリ（リースを取得する場合は*pgxpool.Poolを使うもの）
 // 戻り値: ConnectionScanner (connectionID, userIDを受け取りスキャンを実行するスキャナー)
-func NewConnectionScanner(conn *pgx.Conn) ConnectionScanner {
-	return func(ctx context.Context, connectionID int, userID int) error {
-		connection, err := db.GetConnectionByID(ctx, conn, connectionID)
+func NewConnectionScanner(repos db.Repositories) ConnectionScanner {
+	return func(ctx context.Context, connectionID int, userID int) (*collector.ScanResult, error) {
+		connection, err := repos.Connections.GetConnectionByID(ctx, connectionID)
 		if err != nil {
-			return fmt.Errorf("failed to get connection: %w", err)
+			return nil, fmt.Errorf("failed to get connection: %w", err)
+		}
+
+		// 同じconnectionを複数のインスタンス（またはAPIと監視など）が同時にスキャンしないよう、リースを持ってからスキャンする
+		lease := leaseFromContext(ctx, connectionID)
+		if lease == nil {
+			lease, err = ClaimScan(ctx, repos.ScanRuns, connectionID)
+			if err != nil {
+				return nil, err
+			}
+			defer lease.Release()
+			ctx = lease.Context()
 		}
 
 		fmt.Printf("Scanning connection: %s (%s)\n", connection.Name, connection.BasePath)
 
-		const batchSize = 100
+		run, done, err := startScanRun(ctx, repos.ScanRuns, connectionID, lease.owner)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start scan run: %w", lease.fence(err))
+		}
+
+		// ファイルはCOPYでまとめて書き込み、チェックポイントは再開時に走査し直す量が増えすぎないよう細かく記録する
+		const dirBatchSize = 100
 		var batch []model.FileInfo
+		var dirs []collector.DirResult
 		var totalCount int
+		var written, deleted int64
 
-		err = collector.ScanConnectionWith(connection, func(file model.FileInfo) error {
+		flush := func() error {
+			if lease.Lost() {
+				// リースを引き継いだインスタンスと重ねて記録しない
+				return context.Cause(ctx)
+			}
+			w, d, err := commitBatch(ctx, repos.ScanRuns, connectionID, run.ID, lease.owner, batch, dirs)
+			if err != nil {
+				return lease.fence(err)
+			}
+			written += w
+			deleted += d
+			batch = batch[:0] // clear slice
+			dirs = dirs[:0]
+			return nil
+		}
+
+		opts := collector.DefaultScanOptions()
+		opts.SkipDir = func(path string) bool {
+			return done[path]
+		}
+		if !run.FullScan {
+			states, err := repos.ScanRuns.GetDirStates(ctx, connectionID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load directory states: %w", err)
+			}
+			opts.PreviousState = previousState(states)
+		}
+		opts.DirDone = func(dir collector.DirResult) error {
+			dirs = append(dirs, dir)
+			if len(dirs) >= dirBatchSize {
+				return flush()
+			}
+			return nil
+		}
+
+		result, err := collector.ScanConnectionWith(ctx, connection, opts, func(file model.FileInfo) error {
 			batch = append(batch, file)
 			totalCount++
 
-			if len(batch) >= batchSize {
-				if err := upsertFileBatch(ctx, conn, connectionID, batch); err != nil {
+			if len(batch) >= db.FileBatchSize {
+				if err := flush(); err != nil {
 					return err
 				}
-				batch = batch[:0] // clear slice
 				fmt.Printf("Processed %d files...\n", totalCount)
 			}
 			return nil
 		})
 
+		// Upsert remaining files and checkpoints in batch
+		if err == nil && (len(batch) > 0 || len(dirs) > 0) {
+			if err = flush(); err != nil {
+				result.Status = collector.StatusFailed
+			}
+		}
+		// 止められた場合も走査し終えた分は記録し、次のスキャンはその続きから再開する
+		if err != nil && ctx.Err() != nil && !lease.Lost() && (len(batch) > 0 || len(dirs) > 0) {
+			if flushErr := flush(); flushErr != nil {
+				fmt.Printf("Warning: failed to save progress of scan run %d: %v\n", run.ID, flushErr)
+			}
+		}
+
+		// 走査し終えた直後に取り消された場合も、削除の検出は行わない
+		cancelled := errors.Is(context.Cause(ctx), ErrCancelled)
+		if err == nil && cancelled {
+			err = context.Cause(ctx)
+		}
+		if err == nil {
+			var n int64
+			n, err = repos.ScanRuns.ReconcileScanRun(ctx, connectionID, run.ID, lease.owner)
+			if err != nil {
+				result.Status = collector.StatusFailed
+				err = fmt.Errorf("failed to reconcile deleted files: %w", lease.fence(err))
+			}
+			deleted += n
+		}
+
+		stats := db.ScanRunStats{
+			FilesSeen:      result.Files,
+			FilesWritten:   int(written),
+			FilesDeleted:   int(deleted),
+			ErrorCount:     len(result.Errors),
+			DirsUnchanged:  result.UnchangedDirs,
+			FilesUnchanged: result.UnchangedFiles,
+		}
+		if lease.Lost() {
+			// スキャン実行はリースを引き継いだインスタンスが再開しているので、ここでは記録しない
+			return result, fmt.Errorf("scan run %d abandoned: %w", run.ID, ErrLeaseLost)
+		}
+		if finishErr := finishScanRun(ctx, repos.ScanRuns, run.ID, lease.owner, result, stats, err); finishErr != nil {
+			if errors.Is(lease.fence(finishErr), ErrLeaseLost) {
+				return result, fmt.Errorf("scan run %d abandoned: %w", run.ID, ErrLeaseLost)
+			}
+			fmt.Printf("Warning: failed to record scan run %d: %v\n", run.ID, finishErr)
+		}
+		pruneScanRuns(ctx, repos.ScanRuns, connectionID)
+
+		if cancelled {
+			return result, fmt.Errorf("scan run %d: %w", run.ID, ErrCancelled)
+		}
 		if err != nil {
-			return fmt.Errorf("failed to scan files: %w", err)
+			return result, fmt.Errorf("failed to scan files: %w", err)
+		}
+
+		// 次の定期スキャンの時刻はlast_scanから決まる
+		if err := repos.Connections.UpdateLastScan(ctx, connectionID); err != nil {
+			fmt.Printf("Warning: failed to update last_scan for connection %s: %v\n", connection.Name, err)
+		}
+
+		if len(result.Errors) > 0 {
+			fmt.Printf("Skipped %d unreadable entries for connection %s\n", len(result.Errors), connection.Name)
 		}
+		if deleted > 0 {
+			fmt.Printf("Removed %d files that no longer exist\n", deleted)
+		}
+		if result.UnchangedDirs > 0 {
+			fmt.Printf("Skipped %d unchanged directories (%d files)\n", result.UnchangedDirs, result.UnchangedFiles)
+		}
+		fmt.Printf("Successfully scanned %d files for connection %s (%d written, %d unchanged)\n",
+			totalCount, connection.Name, written, int64(totalCount)-written)
+		return result, nil
+	}
+}
+
+// defaultFullScanInterval はSOKONI_FULL_SCAN_INTERVALが未設定のときのフルスキャンの間隔。
+const defaultFullScanInterval = 7 * 24 * time.Hour
+
+// fullScanInterval はフルスキャンの間隔を環境変数から返す。0以下の場合は毎回フルスキャンする。
+func fullScanInterval() time.Duration {
+	if v := os.Getenv("SOKONI_FULL_SCAN_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return defaultFullScanInterval
+}
+
+// defaultResumeMaxAge・defaultScanRunRetention はSOKONI_SCAN_RESUME_MAX_AGE・SOKONI_SCAN_RUN_RETENTIONが未設定のときの値。
+const (
+	defaultResumeMaxAge     = 24 * time.Hour
+	defaultScanRunRetention = 30 * 24 * time.Hour
+)
 
-		// Upsert remaining files in batch
-		if len(batch) > 0 {
-			if err := upsertFileBatch(ctx, conn, connectionID, batch); err != nil {
-				return err
+// envDuration は環境変数の正の期間を返す。未設定か不正な値の場合はdefを返す。
+func envDuration(name string, def time.Duration) time.Duration {
+	if v := os.Getenv(name); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+	}
+	return def
+}
+
+// startScanRun は途中で終わったスキャン実行があればそれを再開し、なければ新しく作成する。
+// 再開した場合は完了済みのディレクトリも返す。古すぎるスキャン実行は失敗として記録し、新しく作成する。
+func startScanRun(ctx context.Context, scanRuns db.ScanRunRepository, connectionID int, owner string) (*db.ScanRun, map[string]bool, error) {
+	run, err := scanRuns.GetResumableScanRun(ctx, connectionID)
+	if err == nil {
+		if maxAge := envDuration("SOKONI_SCAN_RESUME_MAX_AGE", defaultResumeMaxAge); time.Since(run.StartedAt) > maxAge {
+			msg := fmt.Sprintf("expired: not resumed after %s", maxAge)
+			if err := scanRuns.FinishScanRun(ctx, run.ID, owner, db.ScanRunFailed, db.ScanRunStats{}, &msg); err != nil {
+				return nil, nil, err
 			}
+			fmt.Printf("Scan run %d is too old to resume, starting over\n", run.ID)
+			err = pgx.ErrNoRows
+		}
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		full, err := needsFullScan(ctx, scanRuns, connectionID)
+		if err != nil {
+			return nil, nil, err
 		}
+		run, err = scanRuns.CreateScanRun(ctx, connectionID, full)
+		return run, map[string]bool{}, err
+	}
+	if err != nil {
+		return nil, nil, err
+	}
 
-		fmt.Printf("Successfully stored %d files for connection %s\n", totalCount, connection.Name)
-		return nil
+	done, err := scanRuns.GetScanCheckpoints(ctx, run.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := scanRuns.ResumeScanRun(ctx, run.ID); err != nil {
+		return nil, nil, err
 	}
+	fmt.Printf("Resuming scan run %d (%d directories already done)\n", run.ID, len(done))
+	return run, done, nil
 }
 
-// upsertFileBatch は複数のファイル情報をバッチでデータベースにUPSERT（INSERT or UPDATE）する。
-// 既存ファイルの場合はサイズと更新日時を更新し、新規ファイルの場合は挿入する。
-func upsertFileBatch(ctx context.Context, conn *pgx.Conn, connectionID int, files []model.FileInfo) error {
-	tx, err := conn.Begin(ctx)
+// needsFullScan は前回のフルスキャンから間隔が空いていればtrueを返す。
+func needsFullScan(ctx context.Context, scanRuns db.ScanRunRepository, connectionID int) (bool, error) {
+	interval := fullScanInterval()
+	if interval <= 0 {
+		return true, nil
+	}
+	last, err := scanRuns.GetLastFullScanAt(ctx, connectionID)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+		return false, err
 	}
-	defer tx.Rollback(ctx)
-
-	for _, f := range files {
-		_, err := tx.Exec(ctx, `
-			INSERT into files (connection_id, path, size, name, mod_time)
-			VALUES ($1, $2, $3, $4, $5)
-			ON CONFLICT (path) DO UPDATE
-			SET size = EXCLUDED.size, 
-				mod_time = EXCLUDED.mod_time,
-				updated_at = now()
-		`, connectionID, f.Path, f.Size, f.Name, f.ModTime)
-		if err != nil {
-			return fmt.Errorf("failed to insert file %s: %w", f.Path, err)
+	return last == nil || time.Since(*last) >= interval, nil
+}
+
+// finishScanRun はスキャン結果をscan_runsに記録する。
+// キャンセル後でも記録できるよう、ctxのキャンセルは引き継がない。
+func finishScanRun(ctx context.Context, scanRuns db.ScanRunRepository, scanRunID int, owner string, result *collector.ScanResult, stats db.ScanRunStats, scanErr error) error {
+	cancelled := errors.Is(context.Cause(ctx), ErrCancelled)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+
+	status := string(result.Status)
+	var message *string
+	if scanErr != nil {
+		// エラーバジェット超過と取り消し以外（停止・タイムアウト・接続やDBのエラー）は次回再開する
+		status = db.ScanRunInterrupted
+		if errors.Is(scanErr, collector.ErrTooManyErrors) {
+			status = db.ScanRunFailed
+		}
+		if cancelled {
+			status = db.ScanRunCancelled
+			scanErr = ErrCancelled
 		}
+		msg := scanErr.Error()
+		message = &msg
+	}
+
+	return scanRuns.FinishScanRun(ctx, scanRunID, owner, status, stats, message)
+}
+
+// previousState は前回記録したディレクトリの状態を差分スキャン（collector.ScanOptions.PreviousState）に渡す形にする。
+func previousState(states map[string]db.DirState) func(path string) (db.DirState, bool) {
+	return func(path string) (db.DirState, bool) {
+		s, ok := states[path]
+		return s, ok
 	}
+}
 
-	if err := tx.Commit(ctx); err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
+// pruneScanRuns は終わったスキャン実行の古い記録と、再開しないスキャン実行のチェックポイントを消す。
+// 消せなくても次のスキャンで消すので、警告だけにする。
+func pruneScanRuns(ctx context.Context, scanRuns db.ScanRunRepository, connectionID int) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+	n, err := scanRuns.PruneScanRuns(ctx, connectionID, envDuration("SOKONI_SCAN_RUN_RETENTION", defaultScanRunRetention))
+	if err != nil {
+		fmt.Printf("Warning: failed to prune scan runs: %v\n", err)
+		return
+	}
+	if n > 0 {
+		fmt.Printf("Pruned %d old scan runs\n", n)
 	}
+}
+
+// commitBatch はファイルと配下を走査し終えたディレクトリを1つのトランザクションで記録する（db.CommitScanBatch）。
+// dirsは対応するファイルがすべてfilesかそれ以前のバッチに含まれているものだけを渡すこと。
+// 戻り値は書き込んだファイル数と削除したファイル数。
+// スキャンを止めても書き込み中のバッチはコミットできるよう、ctxのキャンセルは引き継がない。
+func commitBatch(ctx context.Context, scanRuns db.ScanRunRepository, connectionID, scanRunID int, owner string, files []model.FileInfo, dirs []collector.DirResult) (int64, int64, error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
 
-	return nil
+	batch := db.ScanBatch{Files: files}
+	for _, dir := range dirs {
+		scanned := db.ScannedDir{
+			Path:   dir.Path,
+			Listed: !dir.Unchanged,
+			Files:  dir.Files,
+			State:  dir.State,
+		}
+		for _, e := range dir.Errors {
+			scanned.Errors = append(scanned.Errors, db.ScanErrorRecord{Path: e.Path, Reason: e.Err.Error()})
+		}
+		batch.Dirs = append(batch.Dirs, scanned)
+	}
+	return scanRuns.CommitScanBatch(ctx, connectionID, scanRunID, owner, batch)
 }
@@ -2,75 +2,45 @@ package service_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
-	"github.com/jackc/pgx/v5"
 	"github.com/joho/godotenv"
 
-	"github.com/koplec/sokoni/internal/cmd"
 	"github.com/koplec/sokoni/internal/db"
 	"github.com/koplec/sokoni/internal/service"
 )
 
-// helper to connect to database for tests. skips test when db is unavailable
-func testConn(t *testing.T) *pgx.Conn {
-	t.Helper()
-	err := godotenv.Load("../../test.env")
-	if err != nil {
-		t.Logf("Warning: Could not load test.env: %v", err)
-	}
-	ctx := context.Background()
-	conn, err := db.Connect(ctx)
-	if err != nil {
-		t.Skipf("Database connection failed: %v", err)
-	}
-	t.Cleanup(func() { conn.Close(ctx) })
-	return conn
-}
-
 func TestScanConnectionLocal(t *testing.T) {
-	conn := testConn(t)
+	repos := db.NewMemoryRepositories()
 	ctx := context.Background()
 
-	// clean tables in case previous tests left data
-	conn.Exec(ctx, "DELETE FROM files")
-	conn.Exec(ctx, "DELETE FROM connections")
-
 	// create temp directory with a single pdf file
 	dir := t.TempDir()
 	os.WriteFile(filepath.Join(dir, "sample.pdf"), []byte("dummy"), 0644)
 
-	connectionID := 101
-	_, err := conn.Exec(ctx, `
-        INSERT INTO connections (id, name, base_path, remote_path)
-        VALUES ($1, 'test', $2, $2)
-        ON CONFLICT (id) DO NOTHING
-    `, connectionID, dir)
-	if err != nil {
-		t.Fatalf("failed to insert connection: %v", err)
-	}
-
-	t.Cleanup(func() {
-		conn.Exec(ctx, "DELETE FROM files WHERE connection_id=$1", connectionID)
-		conn.Exec(ctx, "DELETE FROM connections WHERE id=$1", connectionID)
-	})
+	connectionID := insertLocalConnection(t, repos, dir)
 
-	scanner := service.NewConnectionScanner(conn)
-	err = cmd.ScanConnection(connectionID, scanner)
+	scanner := service.NewConnectionScanner(repos)
+	_, err := scanner(ctx, connectionID, -1)
 	if err != nil {
-		t.Fatalf("ScanConnection failed: %v", err)
+		t.Fatalf("scan failed: %v", err)
 	}
 
-	var count int
-	err = conn.QueryRow(ctx, "SELECT COUNT(*) FROM files WHERE connection_id=$1", connectionID).Scan(&count)
+	if count := countFiles(t, repos, connectionID); count != 1 {
+		t.Errorf("expected 1 file, got %d", count)
+	}
+	// スケジューラーから実行した場合と同じく、次の定期スキャンの基準になるlast_scanを更新する
+	connection, err := repos.Connections.GetConnectionByID(ctx, connectionID)
 	if err != nil {
-		t.Fatalf("failed to query files: %v", err)
+		t.Fatalf("failed to get connection: %v", err)
 	}
-	if count != 1 {
-		t.Errorf("expected 1 file, got %d", count)
+	if connection.LastScan == nil {
+		t.Errorf("expected last_scan to be updated")
 	}
 }
 
@@ -84,10 +54,8 @@ func stringPtr(s string) *string {
 
 // TestScanConnectionSMB verifies scanning using an SMB path if environment variables are provided.
 func TestScanConnectionSMB(t *testing.T) {
-	// Check DATABASE_URL is set (required for testConn)
-	dbURL := os.Getenv("DATABASE_URL")
-	if dbURL == "" {
-		t.Fatal("DATABASE_URL environment variable is required for SMB test")
+	if err := godotenv.Load("../../test.env"); err != nil {
+		t.Logf("Warning: Could not load test.env: %v", err)
 	}
 
 	// Check required environment variables
@@ -116,64 +84,29 @@ func TestScanConnectionSMB(t *testing.T) {
 		t.Fatalf("SOKONI_TEST_SMB_EXPECTED_PDF_COUNT must be non-negative, got: %d", expectedPdfCount)
 	}
 
-	conn := testConn(t)
+	repos := db.NewMemoryRepositories()
 	ctx := context.Background()
 
-	conn.Exec(ctx, "DELETE FROM files")
-	conn.Exec(ctx, "DELETE FROM connections")
-	conn.Exec(ctx, "DELETE FROM users")
-
-	// Create test user
-	var userID int
-	err := conn.QueryRow(ctx, `
-		INSERT INTO users (username, email, password_hash) 
-		VALUES ('test-user', 'test@example.com', 'dummy-hash') 
-		RETURNING id
-	`).Scan(&userID)
-	if err != nil {
-		t.Fatalf("failed to create test user: %v", err)
-	}
-
-	connectionID := 102
-	_, err = conn.Exec(ctx, `
-        INSERT INTO connections (id, name, base_path, remote_path, username, password, options, user_id)
-        VALUES ($1, 'smb-test', $2, $3, $4, $5, $6, $7)
-        ON CONFLICT (id) DO NOTHING
-    `, connectionID, smbPath, smbPath,
-		stringPtr(os.Getenv("SOKONI_TEST_SMB_USER")),
-		stringPtr(os.Getenv("SOKONI_TEST_SMB_PASS")),
-		stringPtr(os.Getenv("SOKONI_TEST_SMB_OPTIONS")),
-		userID)
+	connection, err := repos.Connections.CreateConnection(ctx, db.CreateConnectionRequest{
+		Name:       "smb-test",
+		BasePath:   smbPath,
+		RemotePath: smbPath,
+		Username:   stringPtr(os.Getenv("SOKONI_TEST_SMB_USER")),
+		Password:   stringPtr(os.Getenv("SOKONI_TEST_SMB_PASS")),
+		Options:    stringPtr(os.Getenv("SOKONI_TEST_SMB_OPTIONS")),
+	})
 	if err != nil {
 		t.Fatalf("failed to insert connection: %v", err)
 	}
+	connectionID := connection.ID
 
-	// Register cleanup immediately after data creation
-	t.Cleanup(func() {
-		conn.Exec(ctx, "DELETE FROM files WHERE connection_id=$1", connectionID)
-		conn.Exec(ctx, "DELETE FROM connections WHERE id=$1", connectionID)
-		conn.Exec(ctx, "DELETE FROM users WHERE id=$1", userID)
-	})
-
-	// Verify data insertion
-	var userCount, connectionCount int
-	conn.QueryRow(ctx, "SELECT COUNT(*) FROM users WHERE id=$1", userID).Scan(&userCount)
-	conn.QueryRow(ctx, "SELECT COUNT(*) FROM connections WHERE id=$1", connectionID).Scan(&connectionCount)
-	if userCount != 1 || connectionCount != 1 {
-		t.Fatalf("expected 1 user and 1 connection, got %d users and %d connections", userCount, connectionCount)
-	}
-
-	scanner := service.NewConnectionScanner(conn)
-	err = cmd.ScanConnection(connectionID, scanner)
+	scanner := service.NewConnectionScanner(repos)
+	_, err = scanner(ctx, connectionID, -1)
 	if err != nil {
-		t.Fatalf("ScanConnection failed: %v", err)
+		t.Fatalf("scan failed: %v", err)
 	}
 
-	var actualPdfCount int
-	err = conn.QueryRow(ctx, "SELECT COUNT(*) FROM files WHERE connection_id=$1", connectionID).Scan(&actualPdfCount)
-	if err != nil {
-		t.Fatalf("failed to query files: %v", err)
-	}
+	actualPdfCount := countFiles(t, repos, connectionID)
 
 	// Check expected PDF count if environment variable is set
 	if expectedPdfCountStr != "" {
@@ -195,3 +128,390 @@ func TestScanConnectionSMB(t *testing.T) {
 		}
 	}
 }
+
+// insertLocalConnection creates a connection for dir and returns its ID.
+func insertLocalConnection(t *testing.T, repos db.Repositories, dir string) int {
+	t.Helper()
+	connection, err := repos.Connections.CreateConnection(context.Background(), db.CreateConnectionRequest{
+		Name: "test", BasePath: dir, RemotePath: dir,
+	})
+	if err != nil {
+		t.Fatalf("failed to insert connection: %v", err)
+	}
+	return connection.ID
+}
+
+func countFiles(t *testing.T, repos db.Repositories, connectionID int) int {
+	t.Helper()
+	files, err := repos.Files.ListFiles(context.Background(), connectionID)
+	if err != nil {
+		t.Fatalf("failed to query files: %v", err)
+	}
+	return len(files)
+}
+
+func TestScanConnectionDetectsDeletedFiles(t *testing.T) {
+	repos := db.NewMemoryRepositories()
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	os.WriteFile(filepath.Join(dir, "keep.pdf"), []byte("dummy"), 0644)
+	os.WriteFile(filepath.Join(dir, "remove.pdf"), []byte("dummy"), 0644)
+	os.WriteFile(filepath.Join(dir, "sub", "nested.pdf"), []byte("dummy"), 0644)
+
+	connectionID := insertLocalConnection(t, repos, dir)
+
+	scanner := service.NewConnectionScanner(repos)
+	if _, err := scanner(ctx, connectionID, -1); err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if count := countFiles(t, repos, connectionID); count != 3 {
+		t.Fatalf("expected 3 files after first scan, got %d", count)
+	}
+
+	// 直下のファイルとサブディレクトリごとの削除を検出できること
+	os.Remove(filepath.Join(dir, "remove.pdf"))
+	os.RemoveAll(filepath.Join(dir, "sub"))
+
+	if _, err := scanner(ctx, connectionID, -1); err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if count := countFiles(t, repos, connectionID); count != 1 {
+		t.Errorf("expected 1 file after deletions, got %d", count)
+	}
+}
+
+func TestScanConnectionResumesFromCheckpoint(t *testing.T) {
+	repos := db.NewMemoryRepositories()
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "done"), 0755)
+	os.WriteFile(filepath.Join(dir, "top.pdf"), []byte("dummy"), 0644)
+	os.WriteFile(filepath.Join(dir, "done", "already.pdf"), []byte("dummy"), 0644)
+
+	connectionID := insertLocalConnection(t, repos, dir)
+
+	// 前回のスキャンが "done" ディレクトリまで反映した状態で中断したことにする
+	run := interruptedRun(t, repos, connectionID, filepath.Join(dir, "done"))
+
+	scanner := service.NewConnectionScanner(repos)
+	result, err := scanner(ctx, connectionID, -1)
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if result.Files != 1 || result.SkippedDirs != 1 {
+		t.Errorf("expected only top.pdf to be scanned, got Files=%d SkippedDirs=%d", result.Files, result.SkippedDirs)
+	}
+
+	resumed, err := repos.ScanRuns.GetScanRun(ctx, run.ID)
+	if err != nil {
+		t.Fatalf("failed to query scan run: %v", err)
+	}
+	if resumed.Status != db.ScanRunCompleted {
+		t.Errorf("expected resumed run to be %s, got %s", db.ScanRunCompleted, resumed.Status)
+	}
+	// 終わったスキャン実行のチェックポイントは残さない
+	if done, _ := repos.ScanRuns.GetScanCheckpoints(ctx, run.ID); len(done) != 0 {
+		t.Errorf("expected checkpoints of the finished run to be pruned, got %v", done)
+	}
+}
+
+// interruptedRun はdoneディレクトリまで反映した状態で中断したスキャン実行を作る。
+// スキャン実行の記録にはリースが要るので、前回のスキャンとしてリースを取得し、記録した後に手放す。
+func interruptedRun(t *testing.T, repos db.Repositories, connectionID int, done string) *db.ScanRun {
+	t.Helper()
+	ctx := context.Background()
+	const owner = "previous"
+	if ok, err := repos.ScanRuns.AcquireScanLease(ctx, connectionID, owner, time.Minute); err != nil || !ok {
+		t.Fatalf("failed to acquire scan lease: %v %v", ok, err)
+	}
+	defer repos.ScanRuns.ReleaseScanLease(ctx, connectionID, owner)
+
+	run, err := repos.ScanRuns.CreateScanRun(ctx, connectionID, true)
+	if err != nil {
+		t.Fatalf("failed to create scan run: %v", err)
+	}
+	_, _, err = repos.ScanRuns.CommitScanBatch(ctx, connectionID, run.ID, owner, db.ScanBatch{Dirs: []db.ScannedDir{{Path: done}}})
+	if err != nil {
+		t.Fatalf("failed to insert checkpoint: %v", err)
+	}
+	if err := repos.ScanRuns.FinishScanRun(ctx, run.ID, owner, db.ScanRunInterrupted, db.ScanRunStats{}, nil); err != nil {
+		t.Fatalf("failed to mark scan run interrupted: %v", err)
+	}
+	return run
+}
+
+func TestScanConnectionExpiresOldRun(t *testing.T) {
+	repos := db.NewMemoryRepositories()
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "done"), 0755)
+	os.WriteFile(filepath.Join(dir, "done", "already.pdf"), []byte("dummy"), 0644)
+	connectionID := insertLocalConnection(t, repos, dir)
+
+	run := interruptedRun(t, repos, connectionID, filepath.Join(dir, "done"))
+
+	// 再開の期限を過ぎたスキャン実行は再開せず、最初からスキャンし直す
+	t.Setenv("SOKONI_SCAN_RESUME_MAX_AGE", "1ns")
+	result, err := service.NewConnectionScanner(repos)(ctx, connectionID, -1)
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if result.Files != 1 || result.SkippedDirs != 0 {
+		t.Errorf("expected the whole tree to be scanned, got Files=%d SkippedDirs=%d", result.Files, result.SkippedDirs)
+	}
+	runs, _ := repos.ScanRuns.ListScanRuns(ctx, connectionID, 10)
+	if len(runs) != 2 || runs[1].ID != run.ID || runs[1].Status != db.ScanRunFailed || runs[1].ErrorMessage == nil {
+		t.Fatalf("expected the old run to be recorded as failed, got %+v", runs)
+	}
+
+	// 保存期間を過ぎた記録は、最新のものと最後に成功したフルスキャン以外消す
+	t.Setenv("SOKONI_SCAN_RUN_RETENTION", "1ns")
+	t.Setenv("SOKONI_FULL_SCAN_INTERVAL", "1h")
+	if _, err := service.NewConnectionScanner(repos)(ctx, connectionID, -1); err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	runs, _ = repos.ScanRuns.ListScanRuns(ctx, connectionID, 10)
+	if len(runs) != 2 || runs[0].FullScan || !runs[1].FullScan || runs[1].Status != db.ScanRunCompleted {
+		t.Errorf("expected the latest and the last full scan to be kept, got %+v", runs)
+	}
+}
+
+// cancelOnCommit は最初のバッチを書き込み始めたときにスキャンを止める。
+type cancelOnCommit struct {
+	db.ScanRunRepository
+	cancel context.CancelFunc
+}
+
+func (c cancelOnCommit) CommitScanBatch(ctx context.Context, connectionID, scanRunID int, owner string, batch db.ScanBatch) (int64, int64, error) {
+	c.cancel()
+	return c.ScanRunRepository.CommitScanBatch(ctx, connectionID, scanRunID, owner, batch)
+}
+
+func TestScanConnectionStoppedDuringCommit(t *testing.T) {
+	repos := db.NewMemoryRepositories()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 100ディレクトリごとに書き込むので、最初の書き込みはスキャンの途中になる
+	dir := t.TempDir()
+	for i := 0; i < 150; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("d%03d", i))
+		os.MkdirAll(sub, 0755)
+		os.WriteFile(filepath.Join(sub, "a.pdf"), []byte("dummy"), 0644)
+	}
+	connectionID := insertLocalConnection(t, repos, dir)
+
+	stopping := repos
+	stopping.ScanRuns = cancelOnCommit{repos.ScanRuns, cancel}
+	_, err := service.NewConnectionScanner(stopping)(ctx, connectionID, -1)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected scan to be cancelled, got %v", err)
+	}
+
+	// 止めたときに書き込み中だったバッチも、走査し終えていた分も記録されている
+	if n := countFiles(t, repos, connectionID); n < 100 {
+		t.Errorf("expected at least the first batch to be committed, got %d files", n)
+	}
+	runs, _ := repos.ScanRuns.ListScanRuns(context.Background(), connectionID, 1)
+	checkpoints, _ := repos.ScanRuns.GetScanCheckpoints(context.Background(), runs[0].ID)
+	if runs[0].Status != db.ScanRunInterrupted || len(checkpoints) < 100 {
+		t.Errorf("expected interrupted run with saved checkpoints, got %s with %d", runs[0].Status, len(checkpoints))
+	}
+}
+
+// cancelCauseOnCommit は最初のバッチを書き込み始めたときに、取り消しとしてスキャンを止める。
+type cancelCauseOnCommit struct {
+	db.ScanRunRepository
+	cancel context.CancelCauseFunc
+}
+
+func (c cancelCauseOnCommit) CommitScanBatch(ctx context.Context, connectionID, scanRunID int, owner string, batch db.ScanBatch) (int64, int64, error) {
+	c.cancel(service.ErrCancelled)
+	return c.ScanRunRepository.CommitScanBatch(ctx, connectionID, scanRunID, owner, batch)
+}
+
+func TestScanConnectionCancelled(t *testing.T) {
+	repos := db.NewMemoryRepositories()
+
+	dir := t.TempDir()
+	for i := 0; i < 150; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("d%03d", i))
+		os.MkdirAll(sub, 0755)
+		os.WriteFile(filepath.Join(sub, "a.pdf"), []byte("dummy"), 0644)
+	}
+	connectionID := insertLocalConnection(t, repos, dir)
+	if _, err := service.NewConnectionScanner(repos)(context.Background(), connectionID, -1); err != nil {
+		t.Fatalf("first scan failed: %v", err)
+	}
+	os.RemoveAll(filepath.Join(dir, "d149"))
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	cancelling := repos
+	cancelling.ScanRuns = cancelCauseOnCommit{repos.ScanRuns, cancel}
+	_, err := service.NewConnectionScanner(cancelling)(ctx, connectionID, -1)
+	if !errors.Is(err, service.ErrCancelled) {
+		t.Fatalf("expected scan to be cancelled, got %v", err)
+	}
+
+	// 走査し終えていないので、見つからなかったファイルを削除しない
+	if n := countFiles(t, repos, connectionID); n != 150 {
+		t.Errorf("expected no files to be deleted by a cancelled scan, got %d files", n)
+	}
+	runs, _ := repos.ScanRuns.ListScanRuns(context.Background(), connectionID, 1)
+	if runs[0].Status != db.ScanRunCancelled || runs[0].ErrorMessage == nil || runs[0].FilesDeleted != 0 {
+		t.Errorf("expected cancelled run with error, got %+v", runs[0])
+	}
+}
+
+func TestScanConnectionIncremental(t *testing.T) {
+	repos := db.NewMemoryRepositories()
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	os.WriteFile(filepath.Join(dir, "top.pdf"), []byte("dummy"), 0644)
+	os.WriteFile(filepath.Join(dir, "sub", "nested.pdf"), []byte("dummy"), 0644)
+	// 一覧を取った直後の変更とみなされないよう、ディレクトリのmtimeを過去にする
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, "sub"), past, past)
+
+	connectionID := insertLocalConnection(t, repos, dir)
+	t.Setenv("SOKONI_FULL_SCAN_INTERVAL", "1h")
+
+	scanner := service.NewConnectionScanner(repos)
+	if _, err := scanner(ctx, connectionID, -1); err != nil {
+		t.Fatalf("first scan failed: %v", err)
+	}
+
+	result, err := scanner(ctx, connectionID, -1)
+	if err != nil {
+		t.Fatalf("second scan failed: %v", err)
+	}
+	if result.UnchangedDirs != 1 || result.UnchangedFiles != 1 {
+		t.Errorf("expected sub to be skipped, got UnchangedDirs=%d UnchangedFiles=%d", result.UnchangedDirs, result.UnchangedFiles)
+	}
+
+	runs, err := repos.ScanRuns.ListScanRuns(ctx, connectionID, 1)
+	if err != nil || len(runs) != 1 {
+		t.Fatalf("failed to query scan run: %v", err)
+	}
+	if runs[0].FullScan || runs[0].FilesWritten != 0 {
+		t.Errorf("expected incremental run without writes, got full_scan=%v files_written=%d", runs[0].FullScan, runs[0].FilesWritten)
+	}
+	if count := countFiles(t, repos, connectionID); count != 2 {
+		t.Errorf("expected 2 files after incremental scan, got %d", count)
+	}
+}
+
+func TestScanLease(t *testing.T) {
+	repos := db.NewMemoryRepositories()
+	ctx := context.Background()
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "sample.pdf"), []byte("dummy"), 0644)
+	connectionID := insertLocalConnection(t, repos, dir)
+
+	lease, err := service.ClaimScan(ctx, repos.ScanRuns, connectionID)
+	if err != nil {
+		t.Fatalf("ClaimScan failed: %v", err)
+	}
+	// リースを持っていないスキャンは始まらない
+	scanner := service.NewConnectionScanner(repos)
+	if _, err := scanner(ctx, connectionID, -1); !errors.Is(err, service.ErrScanInProgress) {
+		t.Errorf("expected ErrScanInProgress, got %v", err)
+	}
+	// リースのコンテキストを渡せばそのリースでスキャンする
+	if _, err := scanner(lease.Context(), connectionID, -1); err != nil {
+		t.Errorf("scan with lease failed: %v", err)
+	}
+	lease.Release()
+	if _, err := scanner(ctx, connectionID, -1); err != nil {
+		t.Errorf("scan after release failed: %v", err)
+	}
+}
+
+// stolenLeases はリースの延長に常に失敗する（ほかのインスタンスに引き継がれた状態）。
+type stolenLeases struct {
+	db.ScanRunRepository
+}
+
+func (stolenLeases) RenewScanLease(ctx context.Context, connectionID int, owner string, ttl time.Duration) (bool, error) {
+	return false, nil
+}
+
+// hangingLeases はリースの延長がctxのキャンセルまで返らない（応答しない接続の状態）。
+type hangingLeases struct {
+	db.ScanRunRepository
+}
+
+func (hangingLeases) RenewScanLease(ctx context.Context, connectionID int, owner string, ttl time.Duration) (bool, error) {
+	<-ctx.Done()
+	return false, ctx.Err()
+}
+
+func TestScanLeaseLost(t *testing.T) {
+	t.Setenv("SOKONI_SCAN_LEASE_TTL", "30ms")
+	repos := db.NewMemoryRepositories()
+	connectionID := insertLocalConnection(t, repos, t.TempDir())
+
+	for name, scanRuns := range map[string]db.ScanRunRepository{
+		"stolen":  stolenLeases{repos.ScanRuns},
+		"hanging": hangingLeases{repos.ScanRuns},
+	} {
+		t.Run(name, func(t *testing.T) {
+			lease, err := service.ClaimScan(context.Background(), scanRuns, connectionID)
+			if err != nil {
+				t.Fatalf("ClaimScan failed: %v", err)
+			}
+			defer lease.Release()
+
+			select {
+			case <-lease.Context().Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected lease context to be cancelled")
+			}
+			if !lease.Lost() || !errors.Is(context.Cause(lease.Context()), service.ErrLeaseLost) {
+				t.Errorf("expected lease to be lost, got %v", context.Cause(lease.Context()))
+			}
+		})
+	}
+}
+
+// takeOverOnCommit はバッチを書き込む直前に、ほかのインスタンスがリースを引き継いだ状態にする
+// （期限が切れてからハートビートが気づくまでの間に書き込もうとした場合）。
+type takeOverOnCommit struct {
+	db.ScanRunRepository
+}
+
+func (c takeOverOnCommit) CommitScanBatch(ctx context.Context, connectionID, scanRunID int, owner string, batch db.ScanBatch) (int64, int64, error) {
+	c.ReleaseScanLease(ctx, connectionID, owner)
+	c.AcquireScanLease(ctx, connectionID, "other", time.Minute)
+	return c.ScanRunRepository.CommitScanBatch(ctx, connectionID, scanRunID, owner, batch)
+}
+
+func TestScanLeaseFenced(t *testing.T) {
+	repos := db.NewMemoryRepositories()
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "sample.pdf"), []byte("dummy"), 0644)
+	connectionID := insertLocalConnection(t, repos, dir)
+
+	takenOver := repos
+	takenOver.ScanRuns = takeOverOnCommit{repos.ScanRuns}
+	_, err := service.NewConnectionScanner(takenOver)(context.Background(), connectionID, -1)
+	if !errors.Is(err, service.ErrLeaseLost) {
+		t.Fatalf("expected ErrLeaseLost, got %v", err)
+	}
+
+	// リースを失ったスキャンは何も記録せず、スキャン実行は引き継いだ側に任せる
+	if n := countFiles(t, repos, connectionID); n != 0 {
+		t.Errorf("expected no files to be written after the lease was taken over, got %d", n)
+	}
+	runs, _ := repos.ScanRuns.ListScanRuns(context.Background(), connectionID, 1)
+	if len(runs) != 1 || runs[0].Status != db.ScanRunRunning || runs[0].FinishedAt != nil {
+		t.Errorf("expected the run to be left for the new owner, got %+v", runs)
+	}
+}
@@ -0,0 +1,155 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/koplec/sokoni/internal/collector"
+	"github.com/koplec/sokoni/internal/db"
+	"github.com/koplec/sokoni/internal/model"
+)
+
+// WatchConnection はconnectionを監視し、PDFファイルの変更をfilesに反映し続ける。
+// ctxがキャンセルされるまで戻らない。
+//
+// ローカルのconnectionはbase_pathをinotifyで監視する。監視開始時とイベントを取りこぼしたときは、
+// NewConnectionScannerによる差分スキャンで追いつく（mtimeが変わったディレクトリだけが走査し直される）。
+// SMB・SFTPのconnectionはwatchRemoteを参照。
+func WatchConnection(ctx context.Context, repos db.Repositories, connectionID int) error {
+	connection, err := repos.Connections.GetConnectionByID(ctx, connectionID)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	if !collector.IsLocalPath(connection.RemotePath) {
+		return watchRemote(ctx, repos, connection)
+	}
+
+	scanner := NewConnectionScanner(repos)
+	log.Printf("Watching connection: %s (%s)", connection.Name, connection.BasePath)
+
+	return collector.WatchLocal(ctx, connection.BasePath, collector.WatchHandler{
+		Upsert: func(file model.FileInfo) error {
+			if err := repos.Files.InsertFile(ctx, connectionID, file); err != nil {
+				return fmt.Errorf("failed to store %s: %w", file.Path, err)
+			}
+			return nil
+		},
+		Remove: func(path string) error {
+			n, err := repos.Files.DeleteFilesUnder(ctx, connectionID, path)
+			if err != nil {
+				return fmt.Errorf("failed to delete %s: %w", path, err)
+			}
+			if n > 0 {
+				log.Printf("Removed %d files under %s", n, path)
+			}
+			return nil
+		},
+		Resync: func() error {
+			_, err := scanner(ctx, connectionID, -1)
+			if errors.Is(err, ErrScanInProgress) {
+				// ほかのスキャンの差分で追いつくので、重ねてスキャンしない
+				log.Printf("Skipping resync of %s: %v", connection.Name, err)
+				return nil
+			}
+			return err
+		},
+	})
+}
+
+// watchRemote はリモートのconnectionをポーリングで監視する。watch_intervalごとに変更がないかを確かめ（remoteChanged）、
+// 変更があったときだけ差分スキャンで反映する。
+//
+// SMB2のCHANGE_NOTIFYを使えればイベント単位で反映できるが、利用しているSMBクライアント（go-smb2）が
+// CHANGE_NOTIFYを実装していないため、変更通知の代わりにディレクトリのmtimeを確認している
+// （SFTPには変更通知の仕組みがない）。
+// 確認はDBに書き込まないので、変更のない間はscan_runs・チェックポイントの行は増えない。
+// 確認で見つけられない変更（直下のエントリ数の変わらない名前変更等）は定期スキャンで反映する。
+// 確認かスキャンが失敗した場合（セッションが切れた等）はエラーを返すので、呼び出し側で定期スキャンに戻すこと。
+// ほかのスキャンがリースを持っている間は、その回の確認を飛ばす。
+func watchRemote(ctx context.Context, repos db.Repositories, connection *db.Connection) error {
+	interval, err := collector.WatchInterval(connection)
+	if err != nil {
+		return err
+	}
+
+	scanner := NewConnectionScanner(repos)
+	log.Printf("Watching remote connection: %s (%s, checking every %s)", connection.Name, connection.RemotePath, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		changed, err := remoteChanged(ctx, repos, connection)
+		if err == nil && changed {
+			_, err = scanner(ctx, connection.ID, -1)
+		}
+		switch {
+		case err == nil:
+		case ctx.Err() != nil:
+			return nil
+		case errors.Is(err, ErrScanInProgress):
+			// ほかのインスタンスやAPIからのスキャンが反映するので、次の確認を待つ
+		default:
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// errChanged はremoteChangedで変更を見つけた時点で走査をやめるためのエラー。
+var errChanged = errors.New("changes found")
+
+// remoteChanged は前回のスキャンからconnectionが変わったかを、DBに書き込まずに差分スキャンと同じ走査で確かめる。
+// mtimeの変わったディレクトリがあれば変更とする。一覧を取り直したディレクトリ（ルートとmtimeを持たないもの）は、
+// 直下のエントリ数・PDFファイル数・サブディレクトリが前回と同じで、前回の一覧より後に更新されたファイルがなければ変わっていないとみなす。
+// 変更を見つけた時点で走査をやめる。
+func remoteChanged(ctx context.Context, repos db.Repositories, connection *db.Connection) (bool, error) {
+	states, err := repos.ScanRuns.GetDirStates(ctx, connection.ID)
+	if err != nil {
+		return false, fmt.Errorf("failed to load directory states: %w", err)
+	}
+
+	opts := collector.DefaultScanOptions()
+	opts.PreviousState = previousState(states)
+	listedAt := make(map[string]time.Time) // 一覧を取り直したディレクトリの、前回一覧を取った日時
+	opts.DirDone = func(dir collector.DirResult) error {
+		if dir.Unchanged {
+			return nil
+		}
+		prev, ok := states[dir.Path]
+		if !ok || !dir.State.ModTime.IsZero() || prev.EntryCount != dir.State.EntryCount || prev.FileCount != dir.State.FileCount ||
+			!slices.Equal(slices.Sorted(slices.Values(prev.Subdirs)), slices.Sorted(slices.Values(dir.State.Subdirs))) {
+			return errChanged
+		}
+		return nil
+	}
+	_, err = collector.ScanConnectionWith(ctx, connection, opts, func(file model.FileInfo) error {
+		dir := filepath.Dir(file.Path)
+		last, ok := listedAt[dir]
+		if !ok {
+			prev, found := states[dir]
+			if !found {
+				return errChanged
+			}
+			last = prev.ListedAt
+			listedAt[dir] = last
+		}
+		if !file.ModTime.Before(last.Add(-collector.RacyWindow)) {
+			return errChanged
+		}
+		return nil
+	})
+	if errors.Is(err, errChanged) {
+		return true, nil
+	}
+	return false, err
+}
@@ -0,0 +1,78 @@
+package service_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/koplec/sokoni/internal/db"
+	"github.com/koplec/sokoni/internal/service"
+	"golang.org/x/net/webdav"
+)
+
+// waitFor はcondが成り立つまで待つ。
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchRemote(t *testing.T) {
+	repos := db.NewMemoryRepositories()
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "sub"), 0755)
+	os.WriteFile(filepath.Join(root, "top.pdf"), []byte("dummy"), 0644)
+	os.WriteFile(filepath.Join(root, "sub", "nested.pdf"), []byte("dummy"), 0644)
+	// 一覧を取った直後の変更とみなされないよう、mtimeを過去にする
+	past := time.Now().Add(-time.Hour)
+	for _, name := range []string{"top.pdf", "sub/nested.pdf", "sub"} {
+		os.Chtimes(filepath.Join(root, name), past, past)
+	}
+
+	server := httptest.NewServer(&webdav.Handler{Prefix: "/dav", FileSystem: webdav.Dir(root), LockSystem: webdav.NewMemLS()})
+	defer server.Close()
+	options := "watch_interval=20ms"
+	connection, err := repos.Connections.CreateConnection(context.Background(), db.CreateConnectionRequest{
+		Name: "dav", BasePath: "/dav", RemotePath: server.URL + "/dav/", Options: &options,
+	})
+	if err != nil {
+		t.Fatalf("failed to insert connection: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- service.WatchConnection(ctx, repos, connection.ID) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("WatchConnection failed: %v", err)
+		}
+	}()
+
+	runs := func() int {
+		list, _ := repos.ScanRuns.ListScanRuns(context.Background(), connection.ID, 100)
+		return len(list)
+	}
+	// 初回は記録がないのでスキャンする
+	waitFor(t, "the first scan", func() bool { return countFiles(t, repos, connection.ID) == 2 })
+
+	// 変更がなければ確認だけで、スキャン実行を記録しない
+	time.Sleep(200 * time.Millisecond)
+	if n := runs(); n != 1 {
+		t.Errorf("expected polls without changes not to record scan runs, got %d runs", n)
+	}
+
+	os.WriteFile(filepath.Join(root, "sub", "added.pdf"), []byte("dummy"), 0644)
+	waitFor(t, "the added file", func() bool { return countFiles(t, repos, connection.ID) == 3 })
+	if n := runs(); n != 2 {
+		t.Errorf("expected one more scan run for the change, got %d runs", n)
+	}
+}
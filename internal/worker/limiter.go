@@ -0,0 +1,43 @@
+package worker
+
+import (
+	"sync"
+)
+
+// limiter はスキャンの同時実行数をホスト（NAS）ごとに制限する。
+// 全体の同時実行数はワーカーのループの数で決まるので、ここでは数えない。
+type limiter struct {
+	perHost int
+
+	mu    sync.Mutex
+	hosts map[string]int // ホストごとの実行中のスキャンの数
+}
+
+func newLimiter(perHost int) *limiter {
+	return &limiter{
+		perHost: perHost,
+		hosts:   make(map[string]int),
+	}
+}
+
+// tryAcquire はhostに空きがあれば枠を取り、枠を返す関数とtrueを返す。空きがなければ待たずにfalseを返す。
+// 待つとワーカーのループをふさぎ、ほかのホストのジョブを始められなくなるので、空くのを待つのは呼び出し側に任せる。
+func (l *limiter) tryAcquire(host string) (func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.hosts[host] >= l.perHost {
+		return nil, false
+	}
+	l.hosts[host]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.hosts[host]--; l.hosts[host] == 0 {
+				delete(l.hosts, host)
+			}
+		})
+	}, true
+}
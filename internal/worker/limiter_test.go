@@ -0,0 +1,41 @@
+package worker
+
+import (
+	"testing"
+)
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(1)
+
+	releaseA, ok := l.tryAcquire("nas-a")
+	if !ok {
+		t.Fatal("expected to acquire nas-a")
+	}
+
+	// 同じホストは1つまでで、空くのを待たない
+	if _, ok := l.tryAcquire("nas-a"); ok {
+		t.Errorf("expected second scan of the same host to be refused")
+	}
+
+	// 別のホストは同じホストの混み具合に関係なく始められる
+	releaseB, ok := l.tryAcquire("nas-b")
+	if !ok {
+		t.Fatal("expected to acquire nas-b while nas-a is busy")
+	}
+
+	// 枠を返せば始められる。何度返しても枠は増えない
+	releaseA()
+	releaseA()
+	release, ok := l.tryAcquire("nas-a")
+	if !ok {
+		t.Fatal("expected to acquire nas-a after release")
+	}
+	if _, ok := l.tryAcquire("nas-a"); ok {
+		t.Errorf("expected releasing twice not to free an extra slot")
+	}
+	release()
+	releaseB()
+	if len(l.hosts) != 0 {
+		t.Errorf("expected no hosts to be tracked after all releases, got %v", l.hosts)
+	}
+}
@@ -0,0 +1,164 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/koplec/sokoni/internal/collector"
+	"github.com/koplec/sokoni/internal/db"
+	"github.com/koplec/sokoni/internal/notify"
+	"github.com/koplec/sokoni/internal/schedule"
+	"github.com/koplec/sokoni/internal/service"
+)
+
+// notifyTimeout は通知1件を送り終えるまで待つ時間。
+const notifyTimeout = 30 * time.Second
+
+// hostBusyDelay は接続先のホストに空きがなくて始められなかったスキャンのジョブを、取り出し直すまでの待ち時間。
+const hostBusyDelay = 10 * time.Second
+
+// errBlackout は定期スキャンを停止時間帯に入ったために中断したときの理由。
+var errBlackout = errors.New("blackout window started")
+
+// scan はスキャンジョブを処理する。ホストに空きがあればconnectionのリースを取得し、
+// プールから取り出したこのスキャン専用のDB接続でconnectionをスキャンする。
+// ホストに空きがなければ、ループをふさがないよう待たずにジョブをhostBusyDelayの後に回す（Defer）。
+// ほかのスキャン（監視の再同期など）がリースを持っていれば、そちらに任せてジョブは成功にする。
+// 定期スキャンは停止時間帯に入ったら中断し、停止時間帯が明けた後の定期スキャンがチェックポイントから再開する。
+func (w *Worker) scan(ctx context.Context, job *db.Job) error {
+	var params service.ScanJob
+	if err := json.Unmarshal(job.Payload, &params); err != nil {
+		return Permanent(fmt.Errorf("invalid scan job payload: %w", err))
+	}
+	if job.ConnectionID == nil {
+		return Permanent(errors.New("scan job has no connection"))
+	}
+	conn, err := w.repos.Connections.GetConnectionByID(ctx, *job.ConnectionID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Permanent(fmt.Errorf("connection %d not found", *job.ConnectionID))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+
+	// 積んでからほかのインスタンスがスキャンを終えた、停止時間帯に入ったなどの場合は重ねてスキャンしない
+	if params.Scheduled {
+		now := time.Now()
+		if next := conn.NextScanAt(now); next == nil || next.After(now) {
+			log.Printf("Skipping scheduled scan for %s: no longer due", conn.Name)
+			return nil
+		}
+	}
+
+	host := collector.Host(conn)
+	release, ok := w.limiter.tryAcquire(host)
+	if !ok {
+		log.Printf("Deferring scan of connection %s: host %s is busy", conn.Name, host)
+		return Defer(hostBusyDelay)
+	}
+	defer release()
+
+	// リースのハートビートはスキャンと並行して問い合わせるので、スキャン専用の接続ではなくプールで行う
+	lease, err := service.ClaimScan(ctx, w.repos.ScanRuns, conn.ID)
+	if errors.Is(err, service.ErrScanInProgress) {
+		log.Printf("Skipping connection %s: %v", conn.Name, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer lease.Release()
+
+	scanCtx := lease.Context()
+	if params.Scheduled {
+		// ジョブを取り出した後に停止時間帯に入った場合は始めない
+		sched, err := conn.ScanSchedule()
+		if err != nil {
+			return Permanent(fmt.Errorf("invalid schedule: %w", err))
+		}
+		if sched.InBlackout(time.Now()) {
+			log.Printf("Skipping scheduled scan for %s: in a blackout window", conn.Name)
+			return nil
+		}
+		var cancel context.CancelFunc
+		scanCtx, cancel = blackoutContext(scanCtx, sched, time.Now())
+		defer cancel()
+	}
+
+	repos, releaseConn, err := w.repos.Acquire(lease.Context())
+	if err != nil {
+		return fmt.Errorf("failed to acquire database connection: %w", err)
+	}
+	defer releaseConn()
+
+	log.Printf("Starting scan for connection: %s (ID: %d, Remote: %s, Host: %s)", conn.Name, conn.ID, conn.RemotePath, host)
+
+	// CLIと同じスキャナーを使うので、scan_runsの記録やlast_scanの更新もそちらで行われる
+	result, err := service.NewConnectionScanner(repos)(scanCtx, conn.ID, -1)
+	if err != nil && errors.Is(context.Cause(scanCtx), errBlackout) {
+		// スキャン実行は中断（interrupted）として記録されているので、失敗とは数えない
+		log.Printf("Paused scan of connection %s: %v (resuming after the blackout window)", conn.Name, errBlackout)
+		return nil
+	}
+	if err != nil {
+		log.Printf("Error scanning connection %s: %v", conn.Name, err)
+		// 再試行しても失敗した定期スキャンだけを数える。ワーカーを止めたためや、リースを引き継がれたための中断は数えない
+		if params.Scheduled && job.Attempts >= job.MaxAttempts && ctx.Err() == nil && !lease.Lost() {
+			w.recordFailure(repos, conn, err)
+		}
+		return err
+	}
+	for _, e := range result.Errors {
+		log.Printf("Skipped %s on connection %s: %v", e.Path, conn.Name, e.Err)
+	}
+	log.Printf("Completed scan for %s (%s): processed %d files, skipped %d entries", conn.Name, result.Status, result.Files, len(result.Errors))
+	return nil
+}
+
+// blackoutContext はnowの後で次に停止時間帯が始まる時刻に、errBlackoutでキャンセルされるコンテキストを返す。
+// 停止時間帯がなければctxのキャンセルだけを引き継ぐ。
+func blackoutContext(ctx context.Context, sched *schedule.Schedule, now time.Time) (context.Context, context.CancelFunc) {
+	start, ok := sched.NextBlackout(now)
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadlineCause(ctx, start, errBlackout)
+}
+
+// recordFailure は定期スキャンの失敗を記録する。続けて失敗した回数がsuspendAfterに達したら
+// 定期スキャンは停止されるので、notifierで管理者に知らせる。
+func (w *Worker) recordFailure(repos db.Repositories, conn *db.Connection, scanErr error) {
+	failures, err := repos.Connections.RecordScanFailure(w.ctx, conn.ID, scanErr.Error(), w.suspendAfter)
+	if err != nil {
+		log.Printf("Error recording scan failure for connection %s: %v", conn.Name, err)
+		return
+	}
+	if w.suspendAfter <= 0 || failures < w.suspendAfter {
+		log.Printf("Scan of connection %s failed %d times in a row (retrying in %s)", conn.Name, failures, schedule.BackoffFromEnv().Delay(failures))
+		return
+	}
+	if failures > w.suspendAfter {
+		return // すでに停止を知らせている
+	}
+
+	log.Printf("Suspended scheduled scans for connection %s after %d consecutive failures", conn.Name, failures)
+	ctx, cancel := context.WithTimeout(w.ctx, notifyTimeout)
+	defer cancel()
+	err = w.notifier.Notify(ctx, notify.Event{
+		Type:                notify.EventScanSuspended,
+		ConnectionID:        conn.ID,
+		ConnectionName:      conn.Name,
+		RemotePath:          conn.RemotePath,
+		ConsecutiveFailures: failures,
+		Error:               scanErr.Error(),
+		Time:                time.Now(),
+	})
+	if err != nil {
+		log.Printf("Error sending notification for connection %s: %v", conn.Name, err)
+	}
+}
@@ -0,0 +1,358 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/koplec/sokoni/internal/db"
+	"github.com/koplec/sokoni/internal/notify"
+	"github.com/koplec/sokoni/internal/schedule"
+	"github.com/koplec/sokoni/internal/service"
+)
+
+// pollInterval は取り出せるジョブがなかったときに、次に確認するまでの待ち時間。
+const pollInterval = 2 * time.Second
+
+// defaultScanWorkers・defaultScanHostLimit・defaultSuspendAfter は
+// SOKONI_SCAN_WORKERS・SOKONI_SCAN_HOST_LIMIT・SOKONI_SCAN_SUSPEND_AFTERが未設定のときの値。
+const (
+	defaultScanWorkers   = 4
+	defaultScanHostLimit = 1
+	defaultSuspendAfter  = 5
+)
+
+// defaultVisibilityTimeout はSOKONI_JOB_VISIBILITY_TIMEOUTが未設定のときの可視性タイムアウト。
+const defaultVisibilityTimeout = 5 * time.Minute
+
+// retryBackoff は失敗したジョブを再試行するまでの待ち時間（失敗するたびに倍になる）。
+var retryBackoff = schedule.Backoff{Base: 30 * time.Second, Max: 30 * time.Minute}
+
+// errJobLost はジョブの可視性タイムアウトを延長できず、ほかのワーカーに取り出し直された可能性があるときの中断理由。
+var errJobLost = errors.New("job lost to another worker")
+
+// Handler は種類ごとのジョブの処理。エラーを返すと再試行の上限まで待ち時間をおいて再試行する。
+// ctxはワーカーを止めたとき、ジョブをほかのワーカーに取り出し直されたとき、
+// ジョブの取り消しを頼まれたとき（context.Causeがservice.ErrCancelled）にキャンセルされる。
+type Handler func(ctx context.Context, job *db.Job) error
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent は再試行しても成功しないエラーにする。Handlerがこれを返すとジョブはすぐにdeadになる。
+func Permanent(err error) error {
+	return permanentError{err: err}
+}
+
+type deferredError struct {
+	after time.Duration
+}
+
+func (e deferredError) Error() string { return fmt.Sprintf("job deferred for %s", e.after) }
+
+// Defer は今は始められないジョブを後に回すエラーを返す。Handlerがこれを返すとジョブは回数に数えずにキューへ戻り、
+// afterの後に取り出し直される（その間、ワーカーはほかのジョブを処理する）。
+func Defer(after time.Duration) error {
+	return deferredError{after: after}
+}
+
+// Worker はジョブのキュー（jobsテーブル）からジョブを取り出して処理する。
+// 複数のプロセスで動かしても、1つのジョブを処理するのは1つのワーカーだけになる。
+type Worker struct {
+	repos        db.Repositories
+	notifier     notify.Notifier
+	id           string
+	concurrency  int
+	visibility   time.Duration
+	limiter      *limiter
+	suspendAfter int // 定期スキャンがこの回数続けて失敗したら停止する（0なら停止しない）
+	handlers     map[string]Handler
+	wake         chan struct{} // ジョブが積まれたときに、待っているループを1つ起こす（待っているループがなければ送らない）
+	ctx          context.Context
+	cancel       context.CancelFunc
+	loops        sync.WaitGroup
+
+	mu      sync.Mutex
+	running map[int]context.CancelCauseFunc // 処理中のジョブと、その処理を止める関数
+}
+
+// New はワーカーを作り、スキャン（db.JobTypeScan）の処理を登録する。
+// ジョブは最大SOKONI_SCAN_WORKERS（既定4）件を並行して処理し、同じホストへのスキャンは
+// SOKONI_SCAN_HOST_LIMIT（既定1）件までに制限する（空きのないホストのジョブは後に回し、ほかのホストのジョブを先に処理する）。
+// 処理中のジョブはSOKONI_JOB_VISIBILITY_TIMEOUT（既定5m）の1/3ごとに延長し、ワーカーが落ちて延長されなくなったら
+// ほかのワーカーが取り出し直す。
+// ジョブが積まれた通知（db.EventScanRequested）を受け取ると、pollIntervalを待たずに取り出す。
+// 処理中のジョブの取り消し（db.JobRepository.CancelJob）は、通知（db.EventJobCancelled）かハートビートで知って処理を止める。
+// 定期スキャンがSOKONI_SCAN_SUSPEND_AFTER（既定5、0で無制限）回続けて失敗したら停止し、notifierで知らせる。
+func New(repos db.Repositories, notifier notify.Notifier) *Worker {
+	ctx, cancel := context.WithCancel(context.Background())
+	concurrency := Concurrency()
+	w := &Worker{
+		repos:        repos,
+		notifier:     notifier,
+		id:           service.InstanceID(),
+		concurrency:  concurrency,
+		visibility:   visibilityTimeout(),
+		limiter:      newLimiter(envInt("SOKONI_SCAN_HOST_LIMIT", defaultScanHostLimit, 1)),
+		suspendAfter: envInt("SOKONI_SCAN_SUSPEND_AFTER", defaultSuspendAfter, 0),
+		handlers:     make(map[string]Handler),
+		wake:         make(chan struct{}),
+		running:      make(map[int]context.CancelCauseFunc),
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+	w.Handle(db.JobTypeScan, w.scan)
+	return w
+}
+
+// Handle はjobTypeのジョブの処理を登録する。Startの前に呼ぶこと。
+func (w *Worker) Handle(jobType string, h Handler) {
+	w.handlers[jobType] = h
+}
+
+// Concurrency はワーカーが並行して処理するジョブの数（SOKONI_SCAN_WORKERS）を返す。
+// スキャン中のジョブはそれぞれDBの接続を1つ占有するので、コネクションプールの大きさを決めるのにも使う。
+func Concurrency() int {
+	return envInt("SOKONI_SCAN_WORKERS", defaultScanWorkers, 1)
+}
+
+// envInt は環境変数のmin以上の整数を返す。未設定か不正な値の場合はdefを返す。
+func envInt(name string, def, min int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < min {
+		log.Printf("Ignoring invalid %s=%q (using %d)", name, v, def)
+		return def
+	}
+	return n
+}
+
+// visibilityTimeout は可視性タイムアウトを環境変数から返す。
+func visibilityTimeout() time.Duration {
+	if v := os.Getenv("SOKONI_JOB_VISIBILITY_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("Ignoring invalid SOKONI_JOB_VISIBILITY_TIMEOUT=%q (using %s)", v, defaultVisibilityTimeout)
+	}
+	return defaultVisibilityTimeout
+}
+
+// Start はStopが呼ばれるまでジョブを処理する。Stopの後は処理中のジョブを片付けてから戻る。
+func (w *Worker) Start() {
+	log.Printf("Worker started (%d concurrent jobs, types: %s)", w.concurrency, strings.Join(w.types(), ", "))
+	for i := 0; i < w.concurrency; i++ {
+		w.loops.Add(1)
+		go w.loop()
+	}
+	// 通知を受け取れなくても、pollIntervalごとに確認する
+	if events, err := w.repos.Events.ListenEvents(w.ctx); err != nil {
+		log.Printf("Warning: failed to listen for new jobs: %v", err)
+	} else {
+		go w.listen(events)
+	}
+	w.loops.Wait()
+	log.Println("Worker stopped")
+}
+
+// Stop はワーカーを止める。処理中のジョブはキャンセルし、回数に数えずにキューへ戻す。
+func (w *Worker) Stop() {
+	w.cancel()
+}
+
+func (w *Worker) types() []string {
+	types := make([]string, 0, len(w.handlers))
+	for t := range w.handlers {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func (w *Worker) loop() {
+	defer w.loops.Done()
+	for w.ctx.Err() == nil {
+		if w.processNext() {
+			continue
+		}
+		select {
+		case <-time.After(pollInterval):
+		case <-w.wake:
+		case <-w.ctx.Done():
+		}
+	}
+}
+
+// listen はジョブが積まれた通知を受け取るたびに、待っているループを起こす。
+// すべてのループが処理中なら、空いたループが続けて取り出すので起こさない。
+// 取り消しの通知を受け取ったら、そのジョブを処理していれば止める。
+func (w *Worker) listen(events <-chan db.Event) {
+	for event := range events {
+		switch event.Type {
+		case db.EventJobCancelled:
+			w.cancelJob(event.JobID)
+			continue
+		case db.EventScanRequested, db.EventResync:
+		default:
+			continue
+		}
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// cancelJob は処理中のジョブを、取り消し（service.ErrCancelled）として止める。
+func (w *Worker) cancelJob(jobID int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if cancel, ok := w.running[jobID]; ok {
+		log.Printf("Cancelling job %d", jobID)
+		cancel(service.ErrCancelled)
+	}
+}
+
+// processNext はジョブを1件取り出して処理する。取り出せるジョブがなかった場合はfalseを返す。
+func (w *Worker) processNext() bool {
+	job, err := w.repos.Jobs.DequeueJob(w.ctx, w.id, w.types(), w.visibility)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false
+	}
+	if err != nil {
+		if w.ctx.Err() == nil {
+			log.Printf("Error dequeuing job: %v", err)
+		}
+		return false
+	}
+	w.process(job)
+	return true
+}
+
+// process はジョブを処理し、結果をキューに記録する。
+func (w *Worker) process(job *db.Job) {
+	ctx, cancel := context.WithCancelCause(w.ctx)
+	w.mu.Lock()
+	w.running[job.ID] = cancel
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		delete(w.running, job.ID)
+		w.mu.Unlock()
+	}()
+
+	var heartbeat sync.WaitGroup
+	heartbeat.Add(1)
+	go func() {
+		defer heartbeat.Done()
+		w.heartbeat(ctx, cancel, job.ID)
+	}()
+
+	log.Printf("Running job %d (%s, attempt %d/%d)", job.ID, job.Type, job.Attempts, job.MaxAttempts)
+	err := w.handlers[job.Type](ctx, job)
+	lost := errors.Is(context.Cause(ctx), errJobLost)
+	cancelled := errors.Is(context.Cause(ctx), service.ErrCancelled)
+	cancel(nil)
+	heartbeat.Wait()
+
+	// ワーカーを止めた後でも記録できるよう、キャンセルは引き継がない
+	finishCtx, finishCancel := context.WithTimeout(context.WithoutCancel(w.ctx), 10*time.Second)
+	defer finishCancel()
+
+	var deferred deferredError
+	switch {
+	case lost:
+		log.Printf("Job %d was taken over by another worker", job.ID)
+		return
+	case err == nil:
+		err = w.repos.Jobs.CompleteJob(finishCtx, job.ID, w.id)
+		if err == nil {
+			log.Printf("Job %d succeeded", job.ID)
+		}
+	case cancelled:
+		// 取り消しを頼まれているので、キューには戻らずcancelledになる
+		err = w.repos.Jobs.ReleaseJob(finishCtx, job.ID, w.id, 0)
+		if err == nil {
+			log.Printf("Job %d was cancelled", job.ID)
+		}
+	case w.ctx.Err() != nil:
+		err = w.repos.Jobs.ReleaseJob(finishCtx, job.ID, w.id, 0)
+		if err == nil {
+			log.Printf("Returned job %d to the queue", job.ID)
+		}
+	case errors.As(err, &deferred):
+		err = w.repos.Jobs.ReleaseJob(finishCtx, job.ID, w.id, deferred.after)
+		if err == nil {
+			log.Printf("Deferred job %d (retrying in %s)", job.ID, deferred.after)
+		}
+	default:
+		var status string
+		var p permanentError
+		status, err = w.repos.Jobs.FailJob(finishCtx, job.ID, w.id, err.Error(), retryBackoff.Delay(job.Attempts), errors.As(err, &p))
+		if status == db.JobDead {
+			log.Printf("Job %d failed and was moved to the dead letter queue", job.ID)
+		} else if err == nil {
+			log.Printf("Job %d failed (retrying in %s)", job.ID, retryBackoff.Delay(job.Attempts))
+		}
+	}
+	if err != nil {
+		log.Printf("Error recording result of job %d: %v", job.ID, err)
+	}
+}
+
+// heartbeat はジョブの可視性タイムアウトを延長し続ける。DBのエラーで延長できない間も再試行するが、
+// 最後に延長してから可視性タイムアウトが過ぎたらほかのワーカーが取り出せる状態なので、処理を中断させる。
+// 取り消しを頼まれていたら（通知が届かなかった場合）、処理を止める。
+func (w *Worker) heartbeat(ctx context.Context, cancel context.CancelCauseFunc, jobID int) {
+	ticker := time.NewTicker(w.visibility / 3)
+	defer ticker.Stop()
+
+	extended := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// 応答しない接続で待ち続けると可視性タイムアウトが過ぎても中断できないので、次の延長までに諦める
+		extendCtx, cancelExtend := context.WithTimeout(ctx, w.visibility/4)
+		job, err := w.repos.Jobs.ExtendJob(extendCtx, jobID, w.id, w.visibility)
+		cancelExtend()
+		if ctx.Err() != nil {
+			return // 処理が終わったか、ワーカーが止められた
+		}
+		switch {
+		case err == nil && job.CancelRequestedAt != nil:
+			log.Printf("Cancelling job %d", jobID)
+			cancel(service.ErrCancelled)
+			return
+		case err == nil:
+			extended = time.Now()
+			continue
+		case errors.Is(err, pgx.ErrNoRows):
+		case time.Since(extended) < w.visibility:
+			log.Printf("Warning: failed to extend job %d: %v", jobID, err)
+			continue
+		default:
+			log.Printf("Job %d expired: %v", jobID, err)
+		}
+		cancel(errJobLost)
+		return
+	}
+}
@@ -0,0 +1,428 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/koplec/sokoni/internal/db"
+	"github.com/koplec/sokoni/internal/notify"
+	"github.com/koplec/sokoni/internal/schedule"
+	"github.com/koplec/sokoni/internal/service"
+	"github.com/koplec/sokoni/internal/tztime"
+)
+
+// drain は取り出せるジョブがなくなるまで処理する。
+func drain(w *Worker) {
+	for w.processNext() {
+	}
+}
+
+func createConnection(t *testing.T, repos db.Repositories, name, dir string) int {
+	t.Helper()
+	c, err := repos.Connections.CreateConnection(context.Background(), db.CreateConnectionRequest{Name: name, BasePath: dir, RemotePath: dir})
+	if err != nil {
+		t.Fatalf("failed to insert connection: %v", err)
+	}
+	return c.ID
+}
+
+func TestWorkerScansConnections(t *testing.T) {
+	ctx := context.Background()
+	repos := db.NewMemoryRepositories()
+
+	var ids []int
+	for _, name := range []string{"a", "b", "c"} {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, name+".pdf"), []byte("dummy"), 0644)
+		id := createConnection(t, repos, name, dir)
+		if _, _, err := service.EnqueueScan(ctx, repos.Jobs, id, true); err != nil {
+			t.Fatalf("EnqueueScan failed: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	w := New(repos, notify.Multi{})
+	defer w.Stop()
+	drain(w)
+
+	for _, id := range ids {
+		files, _ := repos.Files.ListFiles(ctx, id)
+		c, _ := repos.Connections.GetConnectionByID(ctx, id)
+		if len(files) != 1 || c.LastScan == nil {
+			t.Errorf("connection %d: expected 1 file and last_scan, got %d files, last_scan %v", id, len(files), c.LastScan)
+		}
+	}
+	if done, _ := repos.Jobs.ListJobs(ctx, db.JobSucceeded, 100); len(done) != len(ids) {
+		t.Errorf("expected %d succeeded jobs, got %d", len(ids), len(done))
+	}
+	// スキャンしたばかりなので、次の確認では対象にならない
+	if due, _ := repos.Connections.GetDueConnections(ctx); len(due) != 0 {
+		t.Errorf("expected no due connections after scanning, got %d", len(due))
+	}
+
+	// 積んだ後にスキャンされた定期スキャンのジョブは、スキャンせずに終える
+	service.EnqueueScan(ctx, repos.Jobs, ids[0], true)
+	drain(w)
+	if runs, _ := repos.ScanRuns.ListScanRuns(ctx, ids[0], 10); len(runs) != 1 {
+		t.Errorf("expected scheduled job for a scanned connection to be skipped, got %d scan runs", len(runs))
+	}
+	// 利用者が頼んだスキャンは時刻に関係なく行う
+	service.EnqueueScan(ctx, repos.Jobs, ids[0], false)
+	drain(w)
+	if runs, _ := repos.ScanRuns.ListScanRuns(ctx, ids[0], 10); len(runs) != 2 {
+		t.Errorf("expected manual scan to run, got %d scan runs", len(runs))
+	}
+}
+
+// recordingNotifier は受け取ったイベントを記録する。
+type recordingNotifier struct {
+	mu     sync.Mutex
+	events []notify.Event
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, event notify.Event) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.events = append(n.events, event)
+	return nil
+}
+
+func TestScanFailureSuspendsConnection(t *testing.T) {
+	ctx := context.Background()
+	repos := db.NewMemoryRepositories()
+	id := createConnection(t, repos, "broken", filepath.Join(t.TempDir(), "missing"))
+
+	t.Setenv("SOKONI_SCAN_SUSPEND_AFTER", "2")
+	// バックオフを待たずに次の定期スキャンを試せるようにする
+	t.Setenv("SOKONI_SCAN_BACKOFF_BASE", "1ms")
+	t.Setenv("SOKONI_SCAN_BACKOFF_MAX", "1ms")
+	notifier := &recordingNotifier{}
+	w := New(repos, notifier)
+	defer w.Stop()
+
+	enqueue := func(maxAttempts int) *db.Job {
+		job, _, err := repos.Jobs.EnqueueJob(ctx, db.EnqueueJobRequest{
+			Type: db.JobTypeScan, ConnectionID: &id, Payload: []byte(`{"scheduled":true}`), MaxAttempts: maxAttempts,
+		})
+		if err != nil {
+			t.Fatalf("EnqueueJob failed: %v", err)
+		}
+		return job
+	}
+
+	// 再試行が残っている失敗は数えない
+	retried := enqueue(2)
+	drain(w)
+	got, _ := repos.Connections.GetConnectionByID(ctx, id)
+	if job, _ := repos.Jobs.GetJob(ctx, retried.ID); job.Status != db.JobQueued || job.LastError == nil || got.ConsecutiveFailures != 0 {
+		t.Errorf("expected job to wait for retry without counting the failure, got %+v, %d failures", job, got.ConsecutiveFailures)
+	}
+
+	for i := 0; i < 2; i++ {
+		job := enqueue(1)
+		time.Sleep(5 * time.Millisecond)
+		drain(w)
+		if got, _ := repos.Jobs.GetJob(ctx, job.ID); got.Status != db.JobDead {
+			t.Errorf("expected failed job to be dead, got %s", got.Status)
+		}
+	}
+
+	got, _ = repos.Connections.GetConnectionByID(ctx, id)
+	if got.ConsecutiveFailures != 2 || got.SuspendedAt == nil || got.LastError == nil {
+		t.Errorf("expected connection to be suspended after 2 failures, got %+v", got.ScanFailures)
+	}
+	if len(notifier.events) != 1 || notifier.events[0].Type != notify.EventScanSuspended || notifier.events[0].ConnectionID != id {
+		t.Errorf("expected one suspension notification, got %+v", notifier.events)
+	}
+	// 停止中は定期スキャンの対象にならない
+	if due, _ := repos.Connections.GetDueConnections(ctx); len(due) != 0 {
+		t.Errorf("expected suspended connection not to be due, got %d", len(due))
+	}
+}
+
+func TestScanDefersBusyHost(t *testing.T) {
+	ctx := context.Background()
+	repos := db.NewMemoryRepositories()
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.pdf"), []byte("dummy"), 0644)
+	id := createConnection(t, repos, "a", dir)
+
+	w := New(repos, notify.Multi{})
+	defer w.Stop()
+	ran := false
+	w.Handle("test", func(ctx context.Context, job *db.Job) error {
+		ran = true
+		return nil
+	})
+
+	// ローカルのパスのホスト（localhost）をほかのスキャンがふさいでいる
+	release, ok := w.limiter.tryAcquire("localhost")
+	if !ok {
+		t.Fatal("failed to acquire localhost")
+	}
+	scan, _, _ := service.EnqueueScan(ctx, repos.Jobs, id, false)
+	other, _, _ := repos.Jobs.EnqueueJob(ctx, db.EnqueueJobRequest{Type: "test"})
+	drain(w)
+
+	// 空きのないホストのジョブは待たずに後に回し、ほかのジョブを先に処理する
+	job, _ := repos.Jobs.GetJob(ctx, scan.ID)
+	if job.Status != db.JobQueued || job.Attempts != 0 || !job.RunAfter.After(time.Now()) {
+		t.Errorf("expected the scan of a busy host to be deferred without counting an attempt, got %+v", job)
+	}
+	if done, _ := repos.Jobs.GetJob(ctx, other.ID); !ran || done.Status != db.JobSucceeded {
+		t.Errorf("expected the other job to run while the host is busy, got %s", done.Status)
+	}
+	if runs, _ := repos.ScanRuns.ListScanRuns(ctx, id, 10); len(runs) != 0 {
+		t.Errorf("expected no scan while the host is busy, got %d scan runs", len(runs))
+	}
+	release()
+}
+
+func TestScanTakesOverExpiredLease(t *testing.T) {
+	t.Setenv("SOKONI_SCAN_LEASE_TTL", "50ms")
+	ctx := context.Background()
+	repos := db.NewMemoryRepositories()
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.pdf"), []byte("dummy"), 0644)
+	id := createConnection(t, repos, "a", dir)
+
+	// クラッシュしたインスタンスが残したリースとスキャン実行
+	if ok, _ := repos.ScanRuns.AcquireScanLease(ctx, id, "crashed", 50*time.Millisecond); !ok {
+		t.Fatal("failed to acquire lease")
+	}
+	crashed, _ := repos.ScanRuns.CreateScanRun(ctx, id, true)
+
+	w := New(repos, notify.Multi{})
+	defer w.Stop()
+
+	// 期限内はリースを持つスキャンに任せる
+	service.EnqueueScan(ctx, repos.Jobs, id, false)
+	drain(w)
+	if run, _ := repos.ScanRuns.GetScanRun(ctx, crashed.ID); run.Status != db.ScanRunRunning {
+		t.Fatalf("expected scan run to be left to the lease owner, got %s", run.Status)
+	}
+
+	// 期限が切れたら引き継いで、中断したスキャン実行を再開する
+	time.Sleep(100 * time.Millisecond)
+	service.EnqueueScan(ctx, repos.Jobs, id, false)
+	drain(w)
+	run, _ := repos.ScanRuns.GetScanRun(ctx, crashed.ID)
+	if run.Status != db.ScanRunCompleted || run.ResumedAt == nil {
+		t.Errorf("expected crashed scan run to be resumed and completed, got %+v", run)
+	}
+}
+
+func TestWorkerJobResults(t *testing.T) {
+	ctx := context.Background()
+	repos := db.NewMemoryRepositories()
+	w := New(repos, notify.Multi{})
+
+	started := make(chan struct{})
+	w.Handle("test", func(ctx context.Context, job *db.Job) error {
+		switch string(job.Payload) {
+		case `"fail"`:
+			return errors.New("temporary failure")
+		case `"permanent"`:
+			return Permanent(errors.New("bad payload"))
+		case `"block"`:
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+	enqueue := func(payload string) int {
+		job, _, err := repos.Jobs.EnqueueJob(ctx, db.EnqueueJobRequest{Type: "test", Payload: []byte(payload)})
+		if err != nil {
+			t.Fatalf("EnqueueJob failed: %v", err)
+		}
+		return job.ID
+	}
+
+	for _, tt := range []struct {
+		payload  string
+		status   string
+		attempts int
+	}{
+		{`"ok"`, db.JobSucceeded, 1},
+		{`"fail"`, db.JobQueued, 1}, // 待ち時間の後に再試行する
+		{`"permanent"`, db.JobDead, 1},
+	} {
+		id := enqueue(tt.payload)
+		drain(w)
+		job, _ := repos.Jobs.GetJob(ctx, id)
+		if job.Status != tt.status || job.Attempts != tt.attempts {
+			t.Errorf("%s: expected %s after %d attempts, got %s after %d", tt.payload, tt.status, tt.attempts, job.Status, job.Attempts)
+		}
+	}
+
+	// 止めたときに処理中だったジョブは、回数に数えずにキューへ戻す
+	id := enqueue(`"block"`)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.processNext()
+	}()
+	<-started
+	w.Stop()
+	<-done
+	if job, _ := repos.Jobs.GetJob(ctx, id); job.Status != db.JobQueued || job.Attempts != 0 {
+		t.Errorf("expected interrupted job to be returned to the queue, got %s after %d attempts", job.Status, job.Attempts)
+	}
+}
+
+func TestWorkerExtendsVisibility(t *testing.T) {
+	t.Setenv("SOKONI_JOB_VISIBILITY_TIMEOUT", "60ms")
+	ctx := context.Background()
+	repos := db.NewMemoryRepositories()
+	w := New(repos, notify.Multi{})
+	defer w.Stop()
+
+	// 可視性タイムアウトより長くかかるジョブも、延長している間はほかのワーカーに取り出されない
+	var stolen error
+	w.Handle("slow", func(ctx context.Context, job *db.Job) error {
+		time.Sleep(200 * time.Millisecond)
+		_, stolen = repos.Jobs.DequeueJob(ctx, "other", []string{"slow"}, time.Minute)
+		return nil
+	})
+	job, _, _ := repos.Jobs.EnqueueJob(ctx, db.EnqueueJobRequest{Type: "slow"})
+	drain(w)
+
+	if !errors.Is(stolen, pgx.ErrNoRows) {
+		t.Errorf("expected running job not to be dequeued by another worker, got %v", stolen)
+	}
+	if got, _ := repos.Jobs.GetJob(ctx, job.ID); got.Status != db.JobSucceeded || got.Attempts != 1 {
+		t.Errorf("expected job to succeed on the first attempt, got %+v", got)
+	}
+}
+
+func TestWorkerWakesOnEvent(t *testing.T) {
+	ctx := context.Background()
+	repos := db.NewMemoryRepositories()
+	w := New(repos, notify.Multi{})
+	w.Handle("test", func(ctx context.Context, job *db.Job) error { return nil })
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.Start()
+	}()
+	defer func() {
+		w.Stop()
+		<-done
+	}()
+	time.Sleep(50 * time.Millisecond) // ループが空のキューを確認して待つまで
+
+	// 通知を受け取ったら、pollIntervalを待たずに取り出す
+	job, _, _ := repos.Jobs.EnqueueJob(ctx, db.EnqueueJobRequest{Type: "test"})
+	deadline := time.Now().Add(pollInterval / 2)
+	for {
+		if got, _ := repos.Jobs.GetJob(ctx, job.ID); got.Status == db.JobSucceeded {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected worker to pick up the job as soon as it was notified")
+		}
+		repos.Events.PublishEvent(ctx, db.Event{Type: db.EventScanRequested, JobID: job.ID})
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWorkerCancelsJob(t *testing.T) {
+	t.Setenv("SOKONI_JOB_VISIBILITY_TIMEOUT", "60ms")
+	ctx := context.Background()
+	repos := db.NewMemoryRepositories()
+	w := New(repos, notify.Multi{})
+	started := make(chan struct{}, 1)
+	w.Handle("block", func(ctx context.Context, job *db.Job) error {
+		started <- struct{}{}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.Start()
+	}()
+	defer func() {
+		w.Stop()
+		<-done
+	}()
+
+	waitCancelled := func(name string, id int) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for {
+			job, _ := repos.Jobs.GetJob(ctx, id)
+			if job.Status == db.JobCancelled {
+				// 取り消したジョブは再試行しない
+				if job.FinishedAt == nil || job.LockedBy != nil {
+					t.Errorf("%s: expected job to be finished, got %+v", name, job)
+				}
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: expected job to be cancelled, got %s", name, job.Status)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// 通知を受け取ったらすぐに止める
+	job, _, _ := repos.Jobs.EnqueueJob(ctx, db.EnqueueJobRequest{Type: "block"})
+	repos.Events.PublishEvent(ctx, db.Event{Type: db.EventScanRequested, JobID: job.ID})
+	<-started
+	repos.Jobs.CancelJob(ctx, job.ID)
+	repos.Events.PublishEvent(ctx, db.Event{Type: db.EventJobCancelled, JobID: job.ID})
+	waitCancelled("event", job.ID)
+
+	// 通知が届かなくても、ハートビートで取り消しに気づく
+	job, _, _ = repos.Jobs.EnqueueJob(ctx, db.EnqueueJobRequest{Type: "block"})
+	repos.Events.PublishEvent(ctx, db.Event{Type: db.EventScanRequested, JobID: job.ID})
+	<-started
+	repos.Jobs.CancelJob(ctx, job.ID)
+	waitCancelled("heartbeat", job.ID)
+}
+
+func TestEnvInt(t *testing.T) {
+	t.Setenv("SOKONI_SCAN_WORKERS", "8")
+	if got := envInt("SOKONI_SCAN_WORKERS", 4, 1); got != 8 {
+		t.Errorf("expected 8, got %d", got)
+	}
+	t.Setenv("SOKONI_SCAN_WORKERS", "0")
+	if got := envInt("SOKONI_SCAN_WORKERS", 4, 1); got != 4 {
+		t.Errorf("expected default for invalid value, got %d", got)
+	}
+}
+
+func TestBlackoutContext(t *testing.T) {
+	start := tztime.Now().Truncate(time.Minute)
+	sched, err := schedule.Parse("", time.Hour, start.Format("15:04")+"-"+start.Add(time.Hour).Format("15:04"))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	// 停止時間帯が始まったら、スキャンをerrBlackoutで中断する
+	ctx, cancel := blackoutContext(context.Background(), sched, start.Add(-time.Second))
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); !ok || !deadline.Equal(start) {
+		t.Errorf("expected deadline at the window start %s, got %s %v", start, deadline, ok)
+	}
+	<-ctx.Done()
+	if !errors.Is(context.Cause(ctx), errBlackout) {
+		t.Errorf("expected errBlackout, got %v", context.Cause(ctx))
+	}
+
+	// 停止時間帯がなければ期限を付けない
+	none, _ := schedule.Parse("", time.Hour, "")
+	ctx, cancel = blackoutContext(context.Background(), none, start)
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Errorf("expected no deadline without blackout windows")
+	}
+}